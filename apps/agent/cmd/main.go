@@ -3,10 +3,12 @@ package main
 import (
 	"context"
 	"errors"
+	"io"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/coder/websocket"
 	"github.com/sonomandeep/containers/agent/internal/agent"
@@ -23,6 +25,7 @@ func main() {
 		log.Fatal(err)
 	}
 	defer client.Close(websocket.StatusNormalClosure, "shutdown")
+	log.Printf("ws: session %s", client.Session())
 
 	agent, err := agent.New()
 	if err != nil {
@@ -31,9 +34,33 @@ func main() {
 		return
 	}
 	defer agent.Close()
+	agent.ReportOutbound(client)
+
+	// Without a backup directory, volumes still back up to streams.
+	backupDir, err := agentcommands.OpenBackupDir()
+	if err != nil {
+		log.Printf("volume backups to files disabled: %v", err)
+	} else {
+		defer backupDir.Close()
+	}
 
 	go agent.Run(ctx)
-	dispatcher := agentcommands.NewDispatcher(agent)
+	dispatcher := agentcommands.NewDispatcher(
+		agent,
+		agentcommands.WithSnapshotResyncer(agent),
+		agentcommands.WithSnapshotRequester(agent),
+		agentcommands.WithSnapshotScheduler(agent),
+		agentcommands.WithEventReplayer(client),
+		agentcommands.WithNetworkManager(agent),
+		agentcommands.WithVolumeManager(agent),
+		agentcommands.WithPruner(agent),
+		agentcommands.WithImagePuller(agent),
+		agentcommands.WithImageRemover(agent),
+		agentcommands.WithStreamOpener(streamOpener{client}),
+		agentcommands.WithBackupDir(backupDir),
+		agentcommands.WithBackgroundRunner(agent),
+		agentcommands.WithResultReporter(resultReporter{client}),
+	)
 
 	for {
 		select {
@@ -69,6 +96,11 @@ func main() {
 				log.Printf("recv: command %q (%s) failed: %v", command.Name, command.ID, err)
 			}
 
+		case endpoint := <-client.Attached():
+			log.Printf("ws: now attached to endpoint %d (%s), resyncing", endpoint.Index, endpoint.URL)
+			agent.Resync()
+			agent.RefreshHost()
+
 		case e, ok := <-client.Errs:
 			if !ok {
 				return
@@ -80,8 +112,8 @@ func main() {
 			if !ok {
 				return
 			}
-			log.Println(e)
-			cancel()
+			// The agent recovers from Docker outages on its own.
+			log.Printf("agent: %v", e)
 
 		case e, ok := <-agent.Events():
 			if !ok {
@@ -92,3 +124,31 @@ func main() {
 		}
 	}
 }
+
+// streamOpener hands client streams to the commands package, which only
+// needs their bytes.
+type streamOpener struct {
+	client *client.Client
+}
+
+func (o streamOpener) OpenStream(ctx context.Context, kind string, meta any) (io.ReadWriteCloser, error) {
+	stream, err := o.client.OpenStream(ctx, kind, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// resultReporter sends command results as events.
+type resultReporter struct {
+	client *client.Client
+}
+
+func (r resultReporter) ReportResult(result agentcommands.Result) {
+	r.client.Write(agent.Event{
+		Type: agentcommands.ResultEventType,
+		TS:   time.Now(),
+		Data: result,
+	})
+}
@@ -3,46 +3,160 @@ package agent
 
 import (
 	"context"
+	"crypto/rand"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/docker/docker/api/types/events"
-	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
+	"github.com/sonomandeep/containers/agent/internal/env"
 )
 
 type Agent struct {
-	cli    *client.Client
-	events chan Event
-	errors chan error
+	cli            client.APIClient
+	snapshotOpts   snapshotOptions
+	eventOpts      eventOptions
+	events         chan Event
+	errors         chan error
+	resync         chan struct{}
+	requests       chan snapshotRequest
+	intervals      chan snapshotIntervalChange
+	snapshots      snapshotTracker
+	cache          dockerCache
+	eventCounters  eventCounters
+	limiter        *eventLimiter
+	coalescer      *coalescer
+	cursor         eventCursor
+	dockerDown     atomic.Bool
+	outbound       OutboundReporter
+	telemetryEvery time.Duration
+	volumeUsage    volumeUsage
+	// transfers tracks volume backups, restores, image pulls and commands
+	// run in the background so Run outlives them.
+	transfers         sync.WaitGroup
+	volumeHelperImage string
+	volumeHelperOwner string
+	hostRoot          string
+	hostEvery         time.Duration
+	hostRefresh       chan struct{}
+	hostMetricsEvery  time.Duration
+	dockerDiskEvery   time.Duration
+	diskAlerts        diskAlertOptions
+	registryAuthFile  string
 }
 
 func New() (*Agent, error) {
+	snapshotOpts, err := snapshotOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	eventOpts, err := eventOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	telemetryInterval, err := env.Duration(agentTelemetryIntervalEnv, defaultTelemetryInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	hostInterval, err := env.Duration(agentHostIntervalEnv, defaultHostInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	hostMetricsInterval, err := env.Duration(agentHostMetricsIntervalEnv, defaultHostMetricsInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	dockerDiskInterval, err := env.Duration(agentDockerDiskIntervalEnv, defaultDockerDiskInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	diskAlerts, err := diskAlertOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return nil, err
 	}
 
+	a := newAgent(cli, snapshotOpts, eventOpts)
+	a.telemetryEvery = telemetryInterval
+	a.volumeHelperImage = env.String(agentVolumeHelperImageEnv, defaultVolumeHelperImage)
+	a.hostRoot = env.String(agentHostRootEnv, defaultHostRoot)
+	a.hostEvery = hostInterval
+	a.hostMetricsEvery = hostMetricsInterval
+	a.dockerDiskEvery = dockerDiskInterval
+	a.diskAlerts = diskAlerts
+	a.registryAuthFile = env.String(agentRegistryAuthFileEnv, defaultRegistryAuthFile())
+
+	return a, nil
+}
+
+func newAgent(cli client.APIClient, snapshotOpts snapshotOptions, eventOpts eventOptions) *Agent {
 	return &Agent{
-		cli: cli, events: make(chan Event), errors: make(chan error),
-	}, nil
+		cli:          cli,
+		snapshotOpts: snapshotOpts,
+		eventOpts:    eventOpts,
+		events:       make(chan Event),
+		errors:       make(chan error),
+		resync:       make(chan struct{}, 1),
+		limiter:      newEventLimiter(eventOpts.RateLimits),
+		coalescer:    newCoalescer(eventOpts.CoalesceWindow),
+		requests:     make(chan snapshotRequest, snapshotRequestQueueSize),
+		intervals:    make(chan snapshotIntervalChange, 1),
+
+		volumeHelperImage: defaultVolumeHelperImage,
+		volumeHelperOwner: rand.Text(),
+		hostRoot:          defaultHostRoot,
+		hostRefresh:       make(chan struct{}, 1),
+	}
 }
 
 func (a *Agent) Run(ctx context.Context) {
 	defer close(a.events)
 	defer close(a.errors)
 
-	msgs, errs := a.getEvents(ctx)
-
-	const snapshotInterval = 30 * time.Second
 	var wg sync.WaitGroup
 	wg.Go(func() {
-		a.runSnapshots(ctx, snapshotInterval)
+		a.removeStaleVolumeHelpers(ctx)
+	})
+	wg.Go(func() {
+		a.runSnapshots(ctx, a.snapshotOpts.Interval)
 	})
+	if a.telemetryEvery > 0 {
+		wg.Go(func() {
+			a.runTelemetry(ctx, a.telemetryEvery)
+		})
+	}
+	if a.hostEvery > 0 {
+		wg.Go(func() {
+			a.runHost(ctx, a.hostEvery)
+		})
+	}
+	if a.hostMetricsEvery > 0 {
+		wg.Go(func() {
+			a.runHostMetrics(ctx, a.hostMetricsEvery)
+		})
+	}
+	if a.dockerDiskEvery > 0 {
+		wg.Go(func() {
+			a.runDockerDisk(ctx, a.dockerDiskEvery)
+		})
+	}
 
-	a.runEventLoop(ctx, msgs, errs)
+	a.runEvents(ctx)
 
 	wg.Wait()
+	a.transfers.Wait()
 }
 
 func (a *Agent) Events() <-chan Event {
@@ -53,83 +167,241 @@ func (a *Agent) Errors() <-chan error {
 	return a.errors
 }
 
-func (a *Agent) Close() error {
-	return a.cli.Close()
+// Resync asks the agent to send a full snapshot without waiting for the next
+// tick, e.g. after the connection moved to another API instance or the
+// server reported a sequence gap. Ticks in between only send deltas.
+func (a *Agent) Resync() {
+	select {
+	case a.resync <- struct{}{}:
+	default:
+	}
 }
 
-func (a *Agent) getEvents(ctx context.Context) (<-chan events.Message, <-chan error) {
-	f := filters.NewArgs()
-	f.Add("type", "container")
-	f.Add("type", "image")
+// RunInBackground runs a long command, e.g. a prune, next to the transfers,
+// so Run outlives it too.
+func (a *Agent) RunInBackground(run func()) {
+	a.transfers.Go(run)
+}
+
+// CacheStats reports hit and miss counts of the inspect cache.
+func (a *Agent) CacheStats() CacheStats {
+	return a.cache.stats()
+}
 
-	msgs, errs := a.cli.Events(ctx, events.ListOptions{Filters: f})
+// EventStats reports how Docker events were filtered, limited and merged.
+func (a *Agent) EventStats() EventStats {
+	return a.eventCounters.stats()
+}
 
-	return msgs, errs
+func (a *Agent) Close() error {
+	return a.cli.Close()
 }
 
+// runEventLoop forwards events from one subscription. It returns nil when
+// ctx ends and the stream error otherwise.
 func (a *Agent) runEventLoop(
 	ctx context.Context,
 	msgs <-chan events.Message,
 	errs <-chan error,
-) {
+) error {
+	limiter, coalesce := a.limiter, a.coalescer
+
+	timer := time.NewTimer(0)
+	<-timer.C
+	defer timer.Stop()
+	var flush <-chan time.Time
+	schedule := func() {
+		timer.Stop()
+		flush = nil
+		if deadline, ok := coalesce.next(); ok {
+			timer.Reset(time.Until(deadline))
+			flush = timer.C
+		}
+	}
+	// Bursts held before a resubscription still go out.
+	schedule()
+
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return nil
 
 		case m, ok := <-msgs:
 			if !ok {
-				return
+				return errEventStreamClosed
 			}
-			event, err := a.parseDockerEvent(ctx, m)
-			if err != nil {
-				a.emitError(ctx, err)
+			if !a.cursor.accept(m) {
+				// Replayed after resubscribing; already handled.
 				continue
 			}
-			if event != nil {
-				a.emitEvent(ctx, *event)
+			a.eventCounters.received.Add(1)
+			// The cache sees every event, including those not forwarded.
+			a.cache.observe(m)
+
+			now := time.Now()
+			if a.eventOpts.IgnoreActions[baseAction(m.Action)] {
+				a.eventCounters.ignored.Add(1)
+				continue
+			}
+			if !limiter.allow(m, now) {
+				a.eventCounters.rateLimited.Add(1)
+				continue
 			}
 
-		case e, ok := <-errs:
-			if !ok {
-				return
+			emit, replaced := coalesce.add(m, now)
+			if replaced {
+				a.eventCounters.coalesced.Add(1)
+			}
+			if emit {
+				a.forwardDockerEvent(ctx, m)
 			}
-			a.emitError(ctx, e)
+			schedule()
+
+		case <-flush:
+			for _, m := range coalesce.due(time.Now()) {
+				a.forwardDockerEvent(ctx, m)
+			}
+			schedule()
+
+		case err, ok := <-errs:
+			if !ok || err == nil {
+				return errEventStreamClosed
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("docker event stream: %w", err)
 		}
 	}
 }
 
-func (a *Agent) runSnapshots(ctx context.Context, interval time.Duration) {
-	if interval <= 0 {
+func (a *Agent) forwardDockerEvent(ctx context.Context, m events.Message) {
+	event, err := a.parseDockerEvent(ctx, m)
+	if err != nil {
+		a.emitError(ctx, err)
+		return
+	}
+	if event != nil {
+		a.eventCounters.emitted.Add(1)
+		a.emitEvent(ctx, *event)
+	}
+}
+
+func (a *Agent) runSnapshots(ctx context.Context, defaultInterval time.Duration) {
+	if defaultInterval <= 0 {
 		return
 	}
 
-	if err := a.emitSnapshot(ctx); err != nil {
+	if err := a.emitSnapshot(ctx, true); err != nil {
 		a.emitError(ctx, err)
 	}
 
+	interval := defaultInterval
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
+	// revert fires when a temporary interval change expires.
+	revertTimer := time.NewTimer(0)
+	<-revertTimer.C
+	defer revertTimer.Stop()
+	var revert <-chan time.Time
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			if err := a.emitSnapshot(ctx); err != nil {
+			if a.dockerDown.Load() {
+				// A full snapshot follows once Docker is back.
+				continue
+			}
+			if err := a.emitSnapshot(ctx, false); err != nil {
+				a.emitError(ctx, err)
+			}
+		case <-a.resync:
+			if err := a.emitSnapshot(ctx, true); err != nil {
+				a.emitError(ctx, err)
+			}
+			ticker.Reset(interval)
+		case request := <-a.requests:
+			if err := a.emitRequestedSnapshot(ctx, request); err != nil {
 				a.emitError(ctx, err)
 			}
+			if request.scope.full() {
+				ticker.Reset(interval)
+			}
+		case change := <-a.intervals:
+			interval = defaultInterval
+			if change.interval > 0 {
+				interval = change.interval
+			}
+			ticker.Reset(interval)
+
+			revertTimer.Stop()
+			revert = nil
+			if change.ttl > 0 && interval != defaultInterval {
+				revertTimer.Reset(change.ttl)
+				revert = revertTimer.C
+			}
+		case <-revert:
+			revert = nil
+			interval = defaultInterval
+			ticker.Reset(interval)
 		}
 	}
 }
 
-func (a *Agent) emitSnapshot(ctx context.Context) error {
-	event, err := a.buildSnapshotEvent(ctx)
+func (a *Agent) emitSnapshot(ctx context.Context, full bool) error {
+	payload, err := a.buildSnapshot(ctx)
 	if err != nil {
 		return err
 	}
 
-	a.emitEvent(ctx, *event)
+	event := a.snapshots.next(*payload, full, time.Now())
+	if event != nil && event.Type == snapshotEventType {
+		// A newer full snapshot makes one still queued redundant, and
+		// carries the metrics itself.
+		event.Key = snapshotEventType
+		return a.emitSnapshotEvent(ctx, *event)
+	}
+	if event != nil {
+		if err := a.emitSnapshotEvent(ctx, *event); err != nil {
+			return err
+		}
+	}
+	a.emitContainerMetrics(ctx, payload.Containers)
+
+	return nil
+}
+
+// emitRequestedSnapshot answers a snapshot.request. A full request is sent
+// as a regular snapshot so it also becomes the new delta baseline.
+func (a *Agent) emitRequestedSnapshot(ctx context.Context, request snapshotRequest) error {
+	payload, err := a.buildScopedSnapshot(ctx, request.scope)
+	if err != nil {
+		return fmt.Errorf("snapshot request %s: %w", request.commandID, err)
+	}
+
+	if request.scope.full() {
+		payload.CommandID = request.commandID
+		if event := a.snapshots.next(*payload, true, time.Now()); event != nil {
+			event.Key = snapshotEventType
+			return a.emitSnapshotEvent(ctx, *event)
+		}
+		return nil
+	}
+
+	a.emitEvent(ctx, Event{
+		Type: snapshotPartialEventType,
+		TS:   time.Now(),
+		Data: PartialSnapshotPayload{
+			CommandID:  request.commandID,
+			Containers: scoped(request.scope.Containers, payload.Containers),
+			Images:     scoped(request.scope.Images, payload.Images),
+			Networks:   scoped(request.scope.Networks, payload.Networks),
+			Volumes:    scoped(request.scope.Volumes, payload.Volumes),
+		},
+	})
 	return nil
 }
 
@@ -0,0 +1,325 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/sonomandeep/containers/agent/internal/env"
+)
+
+const (
+	dockerDiskEventType = "docker.diskusage"
+	diskAlertEventType  = "alert.disk"
+
+	agentDockerDiskIntervalEnv   = "AGENT_DOCKER_DISK_INTERVAL"
+	agentDiskAlertPercentEnv     = "AGENT_DISK_ALERT_PERCENT"
+	agentDiskAlertReclaimableEnv = "AGENT_DISK_ALERT_RECLAIMABLE"
+
+	// defaultDockerDiskInterval keeps system df, which walks every volume on
+	// disk, well behind the snapshot cadence. Volume sizes in snapshots come
+	// from the same run.
+	defaultDockerDiskInterval   = 5 * time.Minute
+	defaultDiskAlertPercent     = 85
+	defaultDiskAlertReclaimable = 10 << 30
+
+	// diskAlertResolveMargin is how far below its limit, as a fraction of
+	// the limit, a value has to drop before a firing alert resolves, so
+	// usage hovering at the limit does not flap.
+	diskAlertResolveMargin = 0.05
+
+	diskAlertDataRoot    = "dataRoot"
+	diskAlertReclaimable = "reclaimable"
+	diskAlertFiring      = "firing"
+	diskAlertResolved    = "resolved"
+)
+
+// DockerDiskCategory is one row of docker system df. Reclaimable is what a
+// prune of that kind would free: unused images, stopped containers' writable
+// layers, unreferenced volumes and build cache not in use.
+type DockerDiskCategory struct {
+	Count            int   `json:"count"`
+	Active           int   `json:"active"`
+	SizeBytes        int64 `json:"sizeBytes"`
+	ReclaimableBytes int64 `json:"reclaimableBytes"`
+}
+
+// DockerDiskUsage is the payload of docker.diskusage events. DataRoot is
+// the filesystem holding the Docker root dir; it is omitted when the agent
+// cannot see it.
+type DockerDiskUsage struct {
+	Images           DockerDiskCategory `json:"images"`
+	Containers       DockerDiskCategory `json:"containers"`
+	Volumes          DockerDiskCategory `json:"volumes"`
+	BuildCache       DockerDiskCategory `json:"buildCache"`
+	TotalBytes       int64              `json:"totalBytes"`
+	ReclaimableBytes int64              `json:"reclaimableBytes"`
+	DataRoot         *HostDiskUsage     `json:"dataRoot,omitempty"`
+}
+
+// DiskAlert is the payload of alert.disk events, sent when a limit is
+// crossed and again when usage drops back below it by the resolve margin.
+type DiskAlert struct {
+	Kind     string  `json:"kind"`
+	State    string  `json:"state"`
+	Value    float64 `json:"value"`
+	Limit    float64 `json:"limit"`
+	DataRoot string  `json:"dataRoot,omitempty"`
+}
+
+// diskAlertOptions are the limits for alert.disk: the used percentage of the
+// data root filesystem and the bytes prunes could reclaim.
+type diskAlertOptions struct {
+	Percent     float64
+	Reclaimable int64
+}
+
+func diskAlertOptionsFromEnv() (diskAlertOptions, error) {
+	percent, err := env.Int(agentDiskAlertPercentEnv, defaultDiskAlertPercent)
+	if err != nil {
+		return diskAlertOptions{}, err
+	}
+	if percent > 100 {
+		return diskAlertOptions{}, fmt.Errorf("invalid %s: must be at most 100", agentDiskAlertPercentEnv)
+	}
+
+	reclaimable, err := env.Size(agentDiskAlertReclaimableEnv, defaultDiskAlertReclaimable)
+	if err != nil {
+		return diskAlertOptions{}, err
+	}
+
+	return diskAlertOptions{Percent: float64(percent), Reclaimable: reclaimable}, nil
+}
+
+// firing says whether an alert fires given whether it did before. It starts
+// at the limit and resolves only once the value is clear of the margin.
+func (a DiskAlert) firing(before bool) bool {
+	if before {
+		return a.Value >= a.Limit*(1-diskAlertResolveMargin)
+	}
+
+	return a.Value >= a.Limit
+}
+
+// check returns an alert per configured limit with the value compared
+// against it. The data root limit is skipped while the data root is unknown.
+func (o diskAlertOptions) check(usage DockerDiskUsage) map[string]DiskAlert {
+	alerts := map[string]DiskAlert{}
+
+	if usage.DataRoot != nil && o.Percent > 0 {
+		alerts[diskAlertDataRoot] = DiskAlert{
+			Kind:     diskAlertDataRoot,
+			Value:    usage.DataRoot.UsedPercent,
+			Limit:    o.Percent,
+			DataRoot: usage.DataRoot.Mountpoint,
+		}
+	}
+	if o.Reclaimable > 0 {
+		alerts[diskAlertReclaimable] = DiskAlert{
+			Kind:  diskAlertReclaimable,
+			Value: float64(usage.ReclaimableBytes),
+			Limit: float64(o.Reclaimable),
+		}
+	}
+
+	return alerts
+}
+
+// runDockerDisk sends docker.diskusage every interval and alert.disk when an
+// alert starts or stops firing. An alert already firing when the agent
+// starts is sent with the first sample.
+func (a *Agent) runDockerDisk(ctx context.Context, interval time.Duration) {
+	firing := map[string]bool{}
+	measure := func() {
+		if a.dockerDown.Load() {
+			return
+		}
+
+		usage, err := a.dockerDiskUsage(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				a.emitError(ctx, err)
+			}
+			return
+		}
+
+		a.emitEvent(ctx, Event{
+			Type: dockerDiskEventType,
+			TS:   time.Now(),
+			Data: usage,
+			Key:  dockerDiskEventType,
+		})
+
+		for kind, alert := range a.diskAlerts.check(usage) {
+			over := alert.firing(firing[kind])
+			if over == firing[kind] {
+				continue
+			}
+			firing[kind] = over
+
+			alert.State = diskAlertResolved
+			if over {
+				alert.State = diskAlertFiring
+			}
+			a.emitEvent(ctx, Event{
+				Type: diskAlertEventType,
+				TS:   time.Now(),
+				Data: alert,
+			})
+		}
+	}
+	measure()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			measure()
+		}
+	}
+}
+
+// dockerDiskUsage runs a full system df and stores the volume sizes it
+// found for snapshots. Sizes are summed the way docker system df does, so
+// the numbers match what users see on the host. DataRoot is left out when
+// docker info fails.
+func (a *Agent) dockerDiskUsage(ctx context.Context) (DockerDiskUsage, error) {
+	du, err := a.cli.DiskUsage(ctx, types.DiskUsageOptions{})
+	if err != nil {
+		return DockerDiskUsage{}, fmt.Errorf("docker disk usage: %w", err)
+	}
+	a.volumeUsage.set(volumeSizes(du))
+
+	usage := DockerDiskUsage{
+		Images:     imagesDiskUsage(du),
+		Containers: containersDiskUsage(du.Containers),
+		Volumes:    volumesDiskUsage(du),
+		BuildCache: buildCacheDiskUsage(du),
+	}
+	for _, category := range []DockerDiskCategory{usage.Images, usage.Containers, usage.Volumes, usage.BuildCache} {
+		usage.TotalBytes += category.SizeBytes
+		usage.ReclaimableBytes += category.ReclaimableBytes
+	}
+
+	if root, err := a.dockerRootDir(ctx); err == nil {
+		if dataRoot, err := statFilesystem(filepath.Join(a.hostRoot, root)); err == nil {
+			dataRoot.Mountpoint = root
+			usage.DataRoot = &dataRoot
+		}
+	}
+
+	return usage, nil
+}
+
+func (a *Agent) dockerRootDir(ctx context.Context) (string, error) {
+	ctx, cancel := withCallTimeout(ctx, a.snapshotOpts.CallTimeout)
+	defer cancel()
+
+	info, err := a.cli.Info(ctx)
+	if err != nil {
+		return "", fmt.Errorf("docker info: %w", err)
+	}
+
+	return info.DockerRootDir, nil
+}
+
+// imagesDiskUsage counts layers once. What images used by containers hold
+// exclusively cannot be reclaimed.
+func imagesDiskUsage(du types.DiskUsage) DockerDiskCategory {
+	category := DockerDiskCategory{SizeBytes: du.LayersSize}
+
+	var used int64
+	for _, item := range du.Images {
+		if item == nil {
+			continue
+		}
+		category.Count++
+		if item.Containers <= 0 {
+			continue
+		}
+		category.Active++
+		if item.Size >= 0 && item.SharedSize >= 0 {
+			used += item.Size - item.SharedSize
+		}
+	}
+	category.ReclaimableBytes = max(category.SizeBytes-used, 0)
+
+	return category
+}
+
+func containersDiskUsage(containers []*container.Summary) DockerDiskCategory {
+	category := DockerDiskCategory{}
+
+	for _, item := range containers {
+		if item == nil {
+			continue
+		}
+		category.Count++
+		category.SizeBytes += item.SizeRw
+		if item.State == container.StateRunning {
+			category.Active++
+			continue
+		}
+		category.ReclaimableBytes += item.SizeRw
+	}
+
+	return category
+}
+
+// volumesDiskUsage leaves out volumes whose driver cannot report a size.
+func volumesDiskUsage(du types.DiskUsage) DockerDiskCategory {
+	category := DockerDiskCategory{}
+
+	for _, item := range du.Volumes {
+		if item == nil {
+			continue
+		}
+		category.Count++
+		if item.UsageData == nil {
+			continue
+		}
+		if item.UsageData.RefCount > 0 {
+			category.Active++
+		}
+		if item.UsageData.Size < 0 {
+			continue
+		}
+		category.SizeBytes += item.UsageData.Size
+		if item.UsageData.RefCount == 0 {
+			category.ReclaimableBytes += item.UsageData.Size
+		}
+	}
+
+	return category
+}
+
+// buildCacheDiskUsage counts shared records once, under whoever owns them.
+func buildCacheDiskUsage(du types.DiskUsage) DockerDiskCategory {
+	category := DockerDiskCategory{}
+
+	for _, item := range du.BuildCache {
+		if item == nil {
+			continue
+		}
+		category.Count++
+		if item.InUse {
+			category.Active++
+		}
+		if item.Shared {
+			continue
+		}
+		category.SizeBytes += item.Size
+		if !item.InUse {
+			category.ReclaimableBytes += item.Size
+		}
+	}
+
+	return category
+}
@@ -0,0 +1,217 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/build"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+)
+
+func testDiskUsage() types.DiskUsage {
+	return types.DiskUsage{
+		LayersSize: 3 << 30,
+		Images: []*image.Summary{
+			{ID: "sha256:used", Containers: 1, Size: 1 << 30, SharedSize: 256 << 20},
+			{ID: "sha256:unused", Containers: 0, Size: 2 << 30, SharedSize: 256 << 20},
+		},
+		Containers: []*container.Summary{
+			{ID: "web", State: container.StateRunning, SizeRw: 10 << 20},
+			{ID: "job", State: container.StateExited, SizeRw: 20 << 20},
+		},
+		BuildCache: []*build.CacheRecord{
+			{ID: "step-1", InUse: true, Size: 100 << 20},
+			{ID: "step-2", Size: 200 << 20},
+			{ID: "base", Shared: true, Size: 50 << 20},
+		},
+	}
+}
+
+func TestDockerDiskUsage(t *testing.T) {
+	docker := newFakeDocker(1, 0)
+	docker.diskUsage = testDiskUsage()
+	a := newAgent(docker, snapshotOptions{Workers: 1, CallTimeout: time.Second, Timeout: time.Second}, eventOptions{})
+	a.hostRoot = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(a.hostRoot, "var/lib/docker"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := a.dockerDiskUsage(context.Background())
+	if err != nil {
+		t.Fatalf("dockerDiskUsage() unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		category DockerDiskCategory
+		want     DockerDiskCategory
+	}{
+		{"images", usage.Images, DockerDiskCategory{Count: 2, Active: 1, SizeBytes: 3 << 30, ReclaimableBytes: 3<<30 - 768<<20}},
+		{"containers", usage.Containers, DockerDiskCategory{Count: 2, Active: 1, SizeBytes: 30 << 20, ReclaimableBytes: 20 << 20}},
+		{"volumes", usage.Volumes, DockerDiskCategory{Count: 2, SizeBytes: 4 << 20, ReclaimableBytes: 4 << 20}},
+		{"build cache", usage.BuildCache, DockerDiskCategory{Count: 3, Active: 1, SizeBytes: 300 << 20, ReclaimableBytes: 200 << 20}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.category != tc.want {
+				t.Fatalf("%s = %+v, want %+v", tc.name, tc.category, tc.want)
+			}
+		})
+	}
+
+	if usage.TotalBytes != 3<<30+334<<20 || usage.ReclaimableBytes != 3<<30-768<<20+224<<20 {
+		t.Fatalf("total = %d, reclaimable = %d", usage.TotalBytes, usage.ReclaimableBytes)
+	}
+	if usage.DataRoot == nil || usage.DataRoot.Mountpoint != "/var/lib/docker" || usage.DataRoot.TotalBytes == 0 {
+		t.Fatalf("data root = %+v", usage.DataRoot)
+	}
+	if size := a.volumeUsage.get("data"); size == nil || *size != 4<<20 {
+		t.Fatalf("data volume size = %v", size)
+	}
+	if calls := docker.callCount("DiskUsage"); calls != 1 {
+		t.Fatalf("DiskUsage() calls = %d, want 1", calls)
+	}
+
+	t.Run("data root the agent cannot see is left out", func(t *testing.T) {
+		a.hostRoot = t.TempDir()
+
+		usage, err := a.dockerDiskUsage(context.Background())
+		if err != nil {
+			t.Fatalf("dockerDiskUsage() unexpected error: %v", err)
+		}
+		if usage.DataRoot != nil {
+			t.Fatalf("data root = %+v", usage.DataRoot)
+		}
+	})
+
+	t.Run("usage is kept when docker info fails", func(t *testing.T) {
+		docker.mu.Lock()
+		docker.infoErr = errors.New("info unavailable")
+		docker.mu.Unlock()
+		t.Cleanup(func() {
+			docker.mu.Lock()
+			docker.infoErr = nil
+			docker.mu.Unlock()
+		})
+
+		usage, err := a.dockerDiskUsage(context.Background())
+		if err != nil {
+			t.Fatalf("dockerDiskUsage() unexpected error: %v", err)
+		}
+		if usage.DataRoot != nil || usage.TotalBytes != 3<<30+334<<20 {
+			t.Fatalf("usage = %+v", usage)
+		}
+	})
+}
+
+func TestDiskAlertFiring(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  float64
+		before bool
+		want   bool
+	}{
+		{"below the limit", 84, false, false},
+		{"at the limit", 85, false, true},
+		{"back below the limit within the margin", 82, true, true},
+		{"clear of the margin", 80, true, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			alert := DiskAlert{Value: tc.value, Limit: 85}
+			if got := alert.firing(tc.before); got != tc.want {
+				t.Fatalf("firing(%t) = %t, want %t", tc.before, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDiskAlertCheck(t *testing.T) {
+	options := diskAlertOptions{Percent: 85, Reclaimable: 10 << 30}
+
+	alerts := options.check(DockerDiskUsage{
+		ReclaimableBytes: 12 << 30,
+		DataRoot:         &HostDiskUsage{Mountpoint: "/var/lib/docker", UsedPercent: 91.5},
+	})
+	if alert := alerts[diskAlertDataRoot]; alert.Value != 91.5 || alert.Limit != 85 || alert.DataRoot != "/var/lib/docker" {
+		t.Fatalf("data root alert = %+v", alert)
+	}
+	if alert := alerts[diskAlertReclaimable]; alert.Value != 12<<30 || alert.Limit != 10<<30 {
+		t.Fatalf("reclaimable alert = %+v", alert)
+	}
+
+	t.Run("unknown data root has no alert", func(t *testing.T) {
+		if _, ok := options.check(DockerDiskUsage{})[diskAlertDataRoot]; ok {
+			t.Fatal("data root alert without a data root")
+		}
+	})
+}
+
+func TestRunDockerDisk(t *testing.T) {
+	docker := newFakeDocker(1, 0)
+	docker.diskUsage = testDiskUsage()
+	a := newAgent(docker, snapshotOptions{Workers: 1, CallTimeout: time.Second, Timeout: time.Second}, eventOptions{})
+	a.hostRoot = t.TempDir()
+	a.diskAlerts = diskAlertOptions{Reclaimable: 1 << 30}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		a.runDockerDisk(ctx, 10*time.Millisecond)
+	}()
+
+	event := nextEvent(t, a, time.Second)
+	if event.Type != dockerDiskEventType || event.Key != dockerDiskEventType {
+		t.Fatalf("event = %q key %q", event.Type, event.Key)
+	}
+
+	event = nextEvent(t, a, time.Second)
+	alert, ok := event.Data.(DiskAlert)
+	if event.Type != diskAlertEventType || !ok || alert.Kind != diskAlertReclaimable || alert.State != diskAlertFiring {
+		t.Fatalf("event = %q %+v", event.Type, event.Data)
+	}
+
+	t.Run("still over the limit, no new alert", func(t *testing.T) {
+		for range 3 {
+			if event := nextEvent(t, a, time.Second); event.Type != dockerDiskEventType {
+				t.Fatalf("event = %q %+v", event.Type, event.Data)
+			}
+		}
+	})
+
+	t.Run("resolves after a prune", func(t *testing.T) {
+		docker.mu.Lock()
+		docker.diskUsage.LayersSize = 1 << 30
+		docker.diskUsage.Images = docker.diskUsage.Images[:1]
+		docker.mu.Unlock()
+
+		deadline := time.After(time.Second)
+		for {
+			select {
+			case event := <-a.Events():
+				if event.Type != diskAlertEventType {
+					continue
+				}
+				if alert := event.Data.(DiskAlert); alert.State != diskAlertResolved {
+					t.Fatalf("alert = %+v", alert)
+				}
+				return
+			case <-deadline:
+				t.Fatal("alert not resolved")
+			}
+		}
+	})
+}
@@ -13,6 +13,8 @@ import (
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
 	"github.com/docker/go-connections/nat"
 )
 
@@ -54,6 +56,10 @@ type Container struct {
 	Envs    []EnvironmentVariable `json:"envs"`
 	Host    *string               `json:"host,omitempty"`
 	Created int64                 `json:"created"`
+
+	// fallback marks containers built from the list summary because
+	// inspect failed; they lack envs and format status and ports apart.
+	fallback bool
 }
 
 type ImageContainer struct {
@@ -63,20 +69,28 @@ type ImageContainer struct {
 }
 
 type Image struct {
-	ID           string           `json:"id"`
-	Name         string           `json:"name"`
-	Tags         []string         `json:"tags"`
-	Size         int64            `json:"size"`
-	Layers       *int             `json:"layers,omitempty"`
-	OS           string           `json:"os"`
-	Architecture string           `json:"architecture"`
-	Registry     string           `json:"registry"`
-	Containers   []ImageContainer `json:"containers"`
+	ID           string            `json:"id"`
+	Name         string            `json:"name"`
+	Tags         []string          `json:"tags"`
+	Size         int64             `json:"size"`
+	Layers       *int              `json:"layers,omitempty"`
+	OS           string            `json:"os"`
+	Architecture string            `json:"architecture"`
+	Registry     string            `json:"registry"`
+	References   []ImageReference  `json:"references"`
+	RepoDigests  []string          `json:"repoDigests"`
+	Created      int64             `json:"created"`
+	Labels       map[string]string `json:"labels"`
+	Containers   []ImageContainer  `json:"containers"`
 }
 
 type SnapshotPayload struct {
+	Seq        uint64      `json:"seq"`
+	CommandID  string      `json:"commandId,omitempty"`
 	Containers []Container `json:"containers"`
 	Images     []Image     `json:"images"`
+	Networks   []Network   `json:"networks"`
+	Volumes    []Volume    `json:"volumes"`
 }
 
 func (a *Agent) parseDockerEvent(ctx context.Context, msg events.Message) (*Event, error) {
@@ -99,45 +113,171 @@ func (a *Agent) parseDockerEvent(ctx context.Context, msg events.Message) (*Even
 			return nil, err
 		}
 		return &Event{Type: eventType, TS: time.Unix(0, msg.TimeNano), Data: image}, nil
+	case dockerNetworkType:
+		network, err := a.networkPayload(ctx, msg)
+		if err != nil {
+			return nil, err
+		}
+		return &Event{Type: eventType, TS: time.Unix(0, msg.TimeNano), Data: network}, nil
+	case dockerVolumeType:
+		volume, err := a.volumePayload(ctx, msg)
+		if err != nil {
+			return nil, err
+		}
+		return &Event{Type: eventType, TS: time.Unix(0, msg.TimeNano), Data: volume}, nil
 	default:
 		return nil, nil
 	}
 }
 
-func (a *Agent) buildSnapshotEvent(ctx context.Context) (*Event, error) {
-	containerSummaries, err := a.cli.ContainerList(ctx, container.ListOptions{All: true})
+// buildSnapshot lists containers, images, networks and volumes, then fans the
+// per-object inspect and stats calls out over a bounded worker pool. Objects
+// whose calls fail or do not finish before the snapshot deadline use their
+// list summary. Volumes need no extra calls; their sizes come from the last
+// system df run.
+func (a *Agent) buildSnapshot(ctx context.Context) (*SnapshotPayload, error) {
+	return a.buildScopedSnapshot(ctx, fullSnapshotScope)
+}
+
+// buildScopedSnapshot is buildSnapshot restricted to scope. Collections left
+// out of scope are nil.
+func (a *Agent) buildScopedSnapshot(ctx context.Context, scope snapshotScope) (*SnapshotPayload, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.snapshotOpts.Timeout)
+	defer cancel()
+
+	// Image entries list their containers, so containers are listed either way.
+	allContainers, err := a.cache.containerList.refresh(ctx, containerListKey, a.fetchContainerList)
 	if err != nil {
 		return nil, err
 	}
 
-	containers := make([]Container, 0, len(containerSummaries))
-	for _, summary := range containerSummaries {
-		containers = append(containers, a.snapshotContainer(ctx, summary))
+	var allImages []image.Summary
+	if scope.Images {
+		allImages, err = a.cli.ImageList(ctx, image.ListOptions{All: true})
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	imageSummaries, err := a.cli.ImageList(ctx, image.ListOptions{All: true})
-	if err != nil {
-		return nil, err
+	var allNetworks []network.Summary
+	if scope.Networks {
+		allNetworks, err = a.cli.NetworkList(ctx, network.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	images := make([]Image, 0, len(imageSummaries))
-	for _, summary := range imageSummaries {
-		images = append(images, a.snapshotImage(ctx, summary, containerSummaries))
+	var allVolumes []volume.Volume
+	if scope.Volumes {
+		allVolumes, err = a.listVolumes(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if scope.full() {
+		a.cache.retain(allContainers, allImages, allNetworks)
+	}
+
+	var containerSummaries []container.Summary
+	if scope.Containers {
+		containerSummaries = filterSummaries(allContainers, scope, func(c container.Summary) string { return c.ID })
+	}
+	imageSummaries := filterSummaries(allImages, scope, func(i image.Summary) string { return i.ID })
+	networkSummaries := filterSummaries(allNetworks, scope, func(n network.Summary) string { return n.ID })
+
+	// All objects share one pool so the worker bound holds for the whole
+	// snapshot; index n and above are images, m and above networks.
+	type item struct {
+		container Container
+		image     Image
+		network   Network
 	}
+	n := len(containerSummaries)
+	m := n + len(imageSummaries)
+	results, done := collect(ctx, a.snapshotOpts.Workers, m+len(networkSummaries),
+		func(ctx context.Context, i int) item {
+			switch {
+			case i < n:
+				return item{container: a.snapshotContainer(ctx, containerSummaries[i])}
+			case i < m:
+				return item{image: a.snapshotImage(ctx, imageSummaries[i-n], allContainers)}
+			default:
+				return item{network: a.snapshotNetwork(ctx, networkSummaries[i-m])}
+			}
+		},
+	)
 
-	payload := SnapshotPayload{Containers: containers, Images: images}
-	return &Event{Type: "snapshot", TS: time.Now(), Data: payload}, nil
+	var containers []Container
+	if scope.Containers {
+		containers = make([]Container, 0, n)
+	}
+	for i, summary := range containerSummaries {
+		if done[i] {
+			containers = append(containers, results[i].container)
+			continue
+		}
+		containers = append(containers, buildContainerFallbackFromSummary(summary))
+	}
+
+	var images []Image
+	if scope.Images {
+		images = make([]Image, 0, len(imageSummaries))
+	}
+	for i, summary := range imageSummaries {
+		if done[n+i] {
+			images = append(images, results[n+i].image)
+			continue
+		}
+		images = append(images, buildImageFallbackFromSummary(summary, allContainers))
+	}
+
+	var networks []Network
+	if scope.Networks {
+		networks = make([]Network, 0, len(networkSummaries))
+	}
+	for i, summary := range networkSummaries {
+		if done[m+i] {
+			networks = append(networks, results[m+i].network)
+			continue
+		}
+		networks = append(networks, networkFromInspect(summary))
+	}
+
+	var volumes []Volume
+	if scope.Volumes {
+		volumes = make([]Volume, 0, len(allVolumes))
+	}
+	for _, info := range filterSummaries(allVolumes, scope, func(v volume.Volume) string { return v.Name }) {
+		volumes = append(volumes, a.volumeFromInspect(info, allContainers))
+	}
+
+	return &SnapshotPayload{
+		Containers: containers,
+		Images:     images,
+		Networks:   networks,
+		Volumes:    volumes,
+	}, nil
 }
 
 func (a *Agent) snapshotContainer(ctx context.Context, summary container.Summary) Container {
-	info, err := a.cli.ContainerInspect(ctx, summary.ID)
+	// A state that disagrees with the list means an event was missed.
+	fresh := func(info container.InspectResponse) bool {
+		return info.State != nil && info.State.Status == summary.State
+	}
+
+	inspectCtx, cancel := withCallTimeout(ctx, a.snapshotOpts.CallTimeout)
+	info, err := a.cache.containers.loadMatching(inspectCtx, summary.ID, fresh, a.cli.ContainerInspect)
+	cancel()
 	if err != nil {
 		return buildContainerFallbackFromSummary(summary)
 	}
 
 	var metrics *ContainerMetrics
 	if info.State != nil && info.State.Running {
-		data, err := a.getContainerMetrics(ctx, info)
+		statsCtx, cancel := withCallTimeout(ctx, a.snapshotOpts.CallTimeout)
+		data, err := a.getContainerMetrics(statsCtx, info)
+		cancel()
 		if err == nil {
 			metrics = data
 		}
@@ -151,7 +291,10 @@ func (a *Agent) snapshotImage(
 	summary image.Summary,
 	containers []container.Summary,
 ) Image {
-	info, _, err := a.cli.ImageInspectWithRaw(ctx, summary.ID)
+	ctx, cancel := withCallTimeout(ctx, a.snapshotOpts.CallTimeout)
+	defer cancel()
+
+	info, err := a.inspectImage(ctx, summary.ID)
 	if err != nil {
 		return buildImageFallbackFromSummary(summary, containers)
 	}
@@ -164,7 +307,7 @@ func (a *Agent) containerPayload(ctx context.Context, msg events.Message) (*Cont
 		return nil, fmt.Errorf("container event missing id")
 	}
 
-	info, err := a.cli.ContainerInspect(ctx, msg.Actor.ID)
+	info, err := a.inspectContainer(ctx, msg.Actor.ID)
 	if err != nil {
 		fallback := buildContainerFallback(msg)
 		return &fallback, nil
@@ -267,6 +410,8 @@ func buildContainerFallbackFromSummary(summary container.Summary) Container {
 		Envs:    []EnvironmentVariable{},
 		Host:    hostName(),
 		Created: summary.Created,
+
+		fallback: true,
 	}
 }
 
@@ -275,13 +420,13 @@ func (a *Agent) imagePayload(ctx context.Context, msg events.Message) (*Image, e
 		return nil, fmt.Errorf("image event missing id")
 	}
 
-	info, _, err := a.cli.ImageInspectWithRaw(ctx, msg.Actor.ID)
+	info, err := a.inspectImage(ctx, msg.Actor.ID)
 	if err != nil {
 		fallback := buildImageFallback(msg)
 		return &fallback, nil
 	}
 
-	containers, err := a.cli.ContainerList(ctx, container.ListOptions{All: true})
+	containers, err := a.listContainers(ctx)
 	if err != nil {
 		containers = nil
 	}
@@ -312,19 +457,24 @@ func imageFromInspect(info image.InspectResponse, containers []container.Summary
 		}
 	}
 
-	firstTag := firstName(info.RepoTags)
+	labels := map[string]string{}
+	if info.Config != nil && info.Config.Labels != nil {
+		labels = info.Config.Labels
+	}
 
-	return Image{
+	payload := Image{
 		ID:           shortID(info.ID),
-		Name:         getImageName(firstTag),
-		Tags:         getImageTags(info.RepoTags),
 		Size:         info.Size,
 		Layers:       layers,
 		OS:           info.Os,
 		Architecture: info.Architecture,
-		Registry:     "docker.io",
+		Created:      parseCreated(info.Created),
+		Labels:       labels,
 		Containers:   containersWithImage,
 	}
+	setImageReferences(&payload, info.RepoTags, info.RepoDigests)
+
+	return payload
 }
 
 func buildImageFallback(msg events.Message) Image {
@@ -334,36 +484,35 @@ func buildImageFallback(msg events.Message) Image {
 		name = attrs["repo"]
 	}
 
-	return Image{
-		ID:           shortID(msg.Actor.ID),
-		Name:         getImageName(name),
-		Tags:         getImageTags([]string{name}),
-		Size:         0,
-		Layers:       nil,
-		OS:           "",
-		Architecture: "",
-		Registry:     "docker.io",
-		Containers:   []ImageContainer{},
+	payload := Image{
+		ID:         shortID(msg.Actor.ID),
+		Labels:     map[string]string{},
+		Containers: []ImageContainer{},
 	}
+	setImageReferences(&payload, []string{name}, nil)
+
+	return payload
 }
 
 func buildImageFallbackFromSummary(
 	summary image.Summary,
 	containers []container.Summary,
 ) Image {
-	firstTag := firstName(summary.RepoTags)
+	labels := summary.Labels
+	if labels == nil {
+		labels = map[string]string{}
+	}
 
-	return Image{
-		ID:           shortID(summary.ID),
-		Name:         getImageName(firstTag),
-		Tags:         getImageTags(summary.RepoTags),
-		Size:         summary.Size,
-		Layers:       nil,
-		OS:           "",
-		Architecture: "",
-		Registry:     "docker.io",
-		Containers:   containersForImage(summary.ID, containers),
+	payload := Image{
+		ID:         shortID(summary.ID),
+		Size:       summary.Size,
+		Created:    summary.Created,
+		Labels:     labels,
+		Containers: containersForImage(summary.ID, containers),
 	}
+	setImageReferences(&payload, summary.RepoTags, summary.RepoDigests)
+
+	return payload
 }
 
 func containersForImage(
@@ -640,32 +789,6 @@ func shortID(value string) string {
 	return trimmed[:12]
 }
 
-func getImageName(value string) string {
-	if value == "" {
-		return ""
-	}
-
-	parts := strings.Split(value, "/")
-	last := parts[len(parts)-1]
-
-	nameParts := strings.SplitN(last, ":", 2)
-	return nameParts[0]
-}
-
-func getImageTags(tags []string) []string {
-	result := make([]string, 0, len(tags))
-	for _, tag := range tags {
-		parts := strings.Split(tag, "/")
-		last := parts[len(parts)-1]
-		if last == "" {
-			continue
-		}
-		result = append(result, last)
-	}
-
-	return result
-}
-
 func firstName(values []string) string {
 	if len(values) == 0 {
 		return ""
@@ -0,0 +1,170 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+)
+
+const (
+	dockerUnavailableEventType = "agent.docker.unavailable"
+	dockerAvailableEventType   = "agent.docker.available"
+
+	defaultDockerRetryMin = 500 * time.Millisecond
+	defaultDockerRetryMax = 30 * time.Second
+)
+
+var errEventStreamClosed = errors.New("docker event stream closed")
+
+type DockerUnavailablePayload struct {
+	Error string    `json:"error"`
+	Since time.Time `json:"since"`
+}
+
+type DockerAvailablePayload struct {
+	UnavailableSince time.Time `json:"unavailableSince"`
+	DowntimeMs       int64     `json:"downtimeMs"`
+}
+
+// eventCursor remembers how far the event stream got so a resubscription
+// can ask Docker to replay from there, and drops what was already seen.
+// Docker replays events at the Since timestamp itself, so events sharing the
+// last timestamp are remembered by identity.
+type eventCursor struct {
+	subscribedAt time.Time
+	lastNano     int64
+	seen         map[string]bool
+}
+
+// since returns the Since option for the next subscription.
+func (c *eventCursor) since(now time.Time) string {
+	if c.lastNano == 0 {
+		if c.subscribedAt.IsZero() {
+			c.subscribedAt = now
+			return ""
+		}
+		return formatEventTime(c.subscribedAt.UnixNano())
+	}
+
+	return formatEventTime(c.lastNano)
+}
+
+// accept reports whether msg is new. Events without a timestamp carry no
+// ordering and are always accepted.
+func (c *eventCursor) accept(msg events.Message) bool {
+	if msg.TimeNano == 0 {
+		return true
+	}
+
+	key := fmt.Sprintf("%s/%s/%s", msg.Type, msg.Action, msg.Actor.ID)
+	switch {
+	case msg.TimeNano < c.lastNano:
+		return false
+	case msg.TimeNano == c.lastNano:
+		if c.seen[key] {
+			return false
+		}
+	default:
+		c.lastNano = msg.TimeNano
+		c.seen = make(map[string]bool)
+	}
+
+	c.seen[key] = true
+	return true
+}
+
+func formatEventTime(nano int64) string {
+	return fmt.Sprintf("%d.%09d", nano/int64(time.Second), nano%int64(time.Second))
+}
+
+// runEvents consumes Docker events until ctx ends. When the stream fails it
+// reports Docker as unavailable, waits for the daemon to answer again,
+// resubscribes from the last event seen and asks for a full snapshot.
+func (a *Agent) runEvents(ctx context.Context) {
+	for {
+		streamCtx, cancel := context.WithCancel(ctx)
+		msgs, errs := a.getEvents(streamCtx)
+		err := a.runEventLoop(streamCtx, msgs, errs)
+		cancel()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		down := time.Now()
+		a.dockerDown.Store(true)
+		a.emitEvent(ctx, Event{
+			Type: dockerUnavailableEventType,
+			TS:   down,
+			Data: DockerUnavailablePayload{Error: err.Error(), Since: down},
+		})
+
+		if !a.waitForDocker(ctx) {
+			return
+		}
+
+		// Whatever happened while the stream was down may not be replayed
+		// (e.g. a daemon restart), so nothing cached can be trusted.
+		a.cache.invalidateAll()
+		a.dockerDown.Store(false)
+
+		now := time.Now()
+		a.emitEvent(ctx, Event{
+			Type: dockerAvailableEventType,
+			TS:   now,
+			Data: DockerAvailablePayload{UnavailableSince: down, DowntimeMs: now.Sub(down).Milliseconds()},
+		})
+		a.Resync()
+		// The daemon may have come back upgraded or reconfigured.
+		a.RefreshHost()
+	}
+}
+
+// waitForDocker pings the daemon with exponential backoff until it answers.
+func (a *Agent) waitForDocker(ctx context.Context) bool {
+	delay := a.eventOpts.RetryMin
+	if delay <= 0 {
+		delay = defaultDockerRetryMin
+	}
+	maxDelay := a.eventOpts.RetryMax
+	if maxDelay <= 0 {
+		maxDelay = defaultDockerRetryMax
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+		}
+
+		if _, err := a.cli.Ping(ctx); err == nil {
+			return true
+		}
+
+		delay = min(delay*2, maxDelay)
+		timer.Reset(delay)
+	}
+}
+
+func (a *Agent) getEvents(ctx context.Context) (<-chan events.Message, <-chan error) {
+	f := filters.NewArgs()
+	f.Add("type", "container")
+	f.Add("type", "image")
+	f.Add("type", "network")
+	f.Add("type", "volume")
+
+	msgs, errs := a.cli.Events(ctx, events.ListOptions{
+		Since:   a.cursor.since(time.Now()),
+		Filters: f,
+	})
+
+	return msgs, errs
+}
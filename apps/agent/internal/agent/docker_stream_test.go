@@ -0,0 +1,149 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+)
+
+func TestEventCursor(t *testing.T) {
+	at := func(nano int64, action events.Action, id string) events.Message {
+		return events.Message{
+			Type:     events.ContainerEventType,
+			Action:   action,
+			Actor:    events.Actor{ID: id},
+			TimeNano: nano,
+		}
+	}
+
+	var cursor eventCursor
+	steps := []struct {
+		msg  events.Message
+		want bool
+	}{
+		{at(100, events.ActionStart, "a"), true},
+		{at(100, events.ActionStart, "b"), true},
+		{at(100, events.ActionStart, "a"), false},
+		{at(99, events.ActionDie, "a"), false},
+		{at(101, events.ActionStart, "a"), true},
+		{at(0, events.ActionStart, "a"), true},
+		{at(0, events.ActionStart, "a"), true},
+	}
+
+	for i, step := range steps {
+		if got := cursor.accept(step.msg); got != step.want {
+			t.Fatalf("step %d accept() = %t, want %t", i, got, step.want)
+		}
+	}
+
+	if since := cursor.since(time.Now()); since != "0.000000101" {
+		t.Fatalf("since() = %q", since)
+	}
+}
+
+func TestEventCursorSince(t *testing.T) {
+	var cursor eventCursor
+	start := time.Unix(1767225600, 5)
+
+	if since := cursor.since(start); since != "" {
+		t.Fatalf("first since() = %q, want empty", since)
+	}
+
+	// No event arrived before the stream failed: replay from the first
+	// subscription.
+	if since := cursor.since(start.Add(time.Minute)); since != "1767225600.000000005" {
+		t.Fatalf("since() = %q", since)
+	}
+}
+
+func TestRunEventsRecovery(t *testing.T) {
+	docker := newFakeDocker(1, 0)
+	docker.setPingErr(errors.New("connection refused"))
+	a := newAgent(docker, snapshotOptions{Workers: 2, CallTimeout: time.Second, Timeout: time.Second}, eventOptions{
+		RetryMin: 5 * time.Millisecond,
+		RetryMax: 10 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		a.runEvents(ctx)
+	}()
+
+	id := docker.containers[0].ID
+	first := containerEvent(id, events.ActionStart)
+	first.TimeNano = time.Unix(1767225600, 0).UnixNano()
+	publish(t, a, docker, first)
+
+	// Warm the cache so recovery has something to invalidate.
+	if _, err := a.inspectContainer(ctx, id); err != nil {
+		t.Fatalf("inspectContainer() unexpected error: %v", err)
+	}
+
+	docker.streamErrs <- errors.New("unexpected EOF")
+	unavailable := nextEvent(t, a, time.Second)
+	if unavailable.Type != dockerUnavailableEventType {
+		t.Fatalf("event = %q", unavailable.Type)
+	}
+	if payload := unavailable.Data.(DockerUnavailablePayload); payload.Error != "docker event stream: unexpected EOF" {
+		t.Fatalf("unavailable error = %q", payload.Error)
+	}
+
+	waitUntil(t, func() bool { return docker.callCount("Ping") >= 3 })
+	docker.setPingErr(nil)
+
+	if event := nextEvent(t, a, time.Second); event.Type != dockerAvailableEventType {
+		t.Fatalf("event = %q", event.Type)
+	}
+
+	select {
+	case <-a.resync:
+	default:
+		t.Fatal("recovery did not request a full snapshot")
+	}
+
+	a.cache.containers.mu.Lock()
+	cached := a.cache.containers.entries[id]
+	stale := cached == nil || !cached.valid
+	a.cache.containers.mu.Unlock()
+	if !stale {
+		t.Fatal("cache survived the outage")
+	}
+
+	waitUntil(t, func() bool { return len(docker.subscriptions()) == 2 })
+	if since := docker.subscriptions()[1]; since != "1767225600.000000000" {
+		t.Fatalf("resubscribed since = %q", since)
+	}
+
+	// The replayed event is dropped and the next one goes through.
+	send(t, docker, first)
+	next := containerEvent(id, events.ActionDie)
+	next.TimeNano = first.TimeNano + 1
+	if event := publish(t, a, docker, next); event.Type != "container.die" {
+		t.Fatalf("event = %q", event.Type)
+	}
+
+	if stats := a.EventStats(); stats.Received != 2 {
+		t.Fatalf("EventStats() received = %d, want 2", stats.Received)
+	}
+}
+
+func waitUntil(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
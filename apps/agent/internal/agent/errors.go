@@ -0,0 +1,21 @@
+package agent
+
+// kindError is a sentinel error that names its kind, so a failed command
+// result tells the server why without it parsing messages.
+type kindError struct {
+	kind    string
+	message string
+}
+
+func newKindError(kind string, message string) error {
+	return &kindError{kind: kind, message: message}
+}
+
+func (e *kindError) Error() string {
+	return e.message
+}
+
+// ErrorKind is what the commands package reports as the error kind.
+func (e *kindError) ErrorKind() string {
+	return e.kind
+}
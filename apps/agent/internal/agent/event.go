@@ -2,8 +2,21 @@ package agent
 
 import "time"
 
+// Event is one message to the server. Session and Seq are stamped by the
+// client when the event is written, and events dropped before that still
+// use up a number, so the server sees a gap; Replay marks a resend of an
+// event already sent once. Key is not sent: a newer event with the same Key
+// replaces a queued one instead of waiting behind it. Parts, when set, go
+// on the wire in place of the event itself: they are queued, replaced and
+// written as one unit. Only a replacement after the first part went out
+// leaves the server with part of the group, which it must discard.
 type Event struct {
-	Type string    `json:"type"`
-	TS   time.Time `json:"ts"`
-	Data any       `json:"data"`
+	Type    string    `json:"type"`
+	TS      time.Time `json:"ts"`
+	Data    any       `json:"data"`
+	Session string    `json:"session,omitempty"`
+	Seq     uint64    `json:"seq,omitempty"`
+	Replay  bool      `json:"replay,omitempty"`
+	Key     string    `json:"-"`
+	Parts   []Event   `json:"-"`
 }
@@ -0,0 +1,302 @@
+package agent
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/sonomandeep/containers/agent/internal/env"
+	"golang.org/x/time/rate"
+)
+
+const (
+	agentEventIgnoreActionsEnv  = "AGENT_EVENT_IGNORE_ACTIONS"
+	agentEventCoalesceWindowEnv = "AGENT_EVENT_COALESCE_WINDOW"
+	agentEventRateLimitsEnv     = "AGENT_EVENT_RATE_LIMITS"
+
+	// exec_* fire on every health check probe and top on every `docker top`;
+	// none of them change what the UI shows.
+	defaultEventIgnoreActions  = "exec_create,exec_start,exec_die,exec_detach,top"
+	defaultEventCoalesceWindow = 500 * time.Millisecond
+	defaultEventRateLimits     = "*=30/1m"
+
+	// anyAction keys the rate limit used for actions without their own.
+	anyAction = "*"
+
+	// limiterPruneThreshold is how many idle limiters may pile up before
+	// they are swept.
+	limiterPruneThreshold = 1024
+)
+
+// eventOptions shapes the Docker event stream before it goes upstream.
+// Ignored actions are dropped, events for one object within Window of each
+// other are merged into one carrying the latest state, and RateLimits caps
+// each action per object. RetryMin and RetryMax bound the backoff between
+// attempts to reach Docker after the stream fails.
+type eventOptions struct {
+	IgnoreActions  map[string]bool
+	CoalesceWindow time.Duration
+	RateLimits     map[string]rateLimit
+	RetryMin       time.Duration
+	RetryMax       time.Duration
+}
+
+// rateLimit allows Events per Per, all of which may arrive in one burst.
+type rateLimit struct {
+	Events int
+	Per    time.Duration
+}
+
+func (r rateLimit) limiter() *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(float64(r.Events)/r.Per.Seconds()), r.Events)
+}
+
+// EventStats counts what happened to Docker events received by the agent.
+type EventStats struct {
+	Received    uint64 `json:"received"`
+	Ignored     uint64 `json:"ignored"`
+	RateLimited uint64 `json:"rateLimited"`
+	Coalesced   uint64 `json:"coalesced"`
+	Emitted     uint64 `json:"emitted"`
+}
+
+type eventCounters struct {
+	received    atomic.Uint64
+	ignored     atomic.Uint64
+	rateLimited atomic.Uint64
+	coalesced   atomic.Uint64
+	emitted     atomic.Uint64
+}
+
+func (c *eventCounters) stats() EventStats {
+	return EventStats{
+		Received:    c.received.Load(),
+		Ignored:     c.ignored.Load(),
+		RateLimited: c.rateLimited.Load(),
+		Coalesced:   c.coalesced.Load(),
+		Emitted:     c.emitted.Load(),
+	}
+}
+
+func eventOptionsFromEnv() (eventOptions, error) {
+	ignore, err := parseIgnoreActions(env.String(agentEventIgnoreActionsEnv, defaultEventIgnoreActions))
+	if err != nil {
+		return eventOptions{}, fmt.Errorf("invalid %s: %w", agentEventIgnoreActionsEnv, err)
+	}
+
+	// Zero disables coalescing, which env.Duration does not accept.
+	window := defaultEventCoalesceWindow
+	if value := env.String(agentEventCoalesceWindowEnv, ""); value != "" {
+		window, err = time.ParseDuration(value)
+		if err != nil {
+			return eventOptions{}, fmt.Errorf("invalid %s: %w", agentEventCoalesceWindowEnv, err)
+		}
+		if window < 0 {
+			return eventOptions{}, fmt.Errorf("invalid %s: must not be negative", agentEventCoalesceWindowEnv)
+		}
+	}
+
+	limits, err := parseRateLimits(env.String(agentEventRateLimitsEnv, defaultEventRateLimits))
+	if err != nil {
+		return eventOptions{}, fmt.Errorf("invalid %s: %w", agentEventRateLimitsEnv, err)
+	}
+
+	return eventOptions{
+		IgnoreActions:  ignore,
+		CoalesceWindow: window,
+		RateLimits:     limits,
+		RetryMin:       defaultDockerRetryMin,
+		RetryMax:       defaultDockerRetryMax,
+	}, nil
+}
+
+// parseIgnoreActions reads a comma-separated action list. "none" forwards
+// every action.
+func parseIgnoreActions(value string) (map[string]bool, error) {
+	actions := make(map[string]bool)
+	if value == "none" {
+		return actions, nil
+	}
+
+	for item := range strings.SplitSeq(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if strings.Contains(item, ":") {
+			return nil, fmt.Errorf("action %q must not carry details", item)
+		}
+		actions[item] = true
+	}
+
+	return actions, nil
+}
+
+// parseRateLimits reads "action=count/duration" pairs, e.g.
+// "die=5/1m,*=30/1m". "none" disables rate limiting.
+func parseRateLimits(value string) (map[string]rateLimit, error) {
+	limits := make(map[string]rateLimit)
+	if value == "none" {
+		return limits, nil
+	}
+
+	for item := range strings.SplitSeq(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		action, spec, ok := strings.Cut(item, "=")
+		count, per, ok2 := strings.Cut(spec, "/")
+		if !ok || !ok2 || strings.TrimSpace(action) == "" {
+			return nil, fmt.Errorf("rate limit %q must look like action=count/duration", item)
+		}
+
+		events, err := strconv.Atoi(strings.TrimSpace(count))
+		if err != nil || events <= 0 {
+			return nil, fmt.Errorf("rate limit %q: count must be a positive integer", item)
+		}
+
+		duration, err := time.ParseDuration(strings.TrimSpace(per))
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("rate limit %q: duration must be positive", item)
+		}
+
+		limits[strings.TrimSpace(action)] = rateLimit{Events: events, Per: duration}
+	}
+
+	return limits, nil
+}
+
+// baseAction strips details such as the command of exec_start or the status
+// of health_status.
+func baseAction(action events.Action) string {
+	base, _, _ := strings.Cut(string(action), ":")
+	return base
+}
+
+func eventKey(msg events.Message) string {
+	return string(msg.Type) + "/" + msg.Actor.ID
+}
+
+// eventLimiter applies per-object, per-action rate limits.
+type eventLimiter struct {
+	limits   map[string]rateLimit
+	limiters map[string]*rate.Limiter
+}
+
+func newEventLimiter(limits map[string]rateLimit) *eventLimiter {
+	return &eventLimiter{limits: limits, limiters: make(map[string]*rate.Limiter)}
+}
+
+func (l *eventLimiter) allow(msg events.Message, now time.Time) bool {
+	action := baseAction(msg.Action)
+	limit, ok := l.limits[action]
+	if !ok {
+		limit, ok = l.limits[anyAction]
+	}
+	if !ok {
+		return true
+	}
+
+	key := eventKey(msg) + "/" + action
+	limiter, ok := l.limiters[key]
+	if !ok {
+		if len(l.limiters) >= limiterPruneThreshold {
+			l.prune(now)
+		}
+		limiter = limit.limiter()
+		l.limiters[key] = limiter
+	}
+
+	return limiter.AllowN(now, 1)
+}
+
+// prune drops limiters that have refilled; recreating them is equivalent.
+func (l *eventLimiter) prune(now time.Time) {
+	for key, limiter := range l.limiters {
+		if limiter.TokensAt(now) >= float64(limiter.Burst()) {
+			delete(l.limiters, key)
+		}
+	}
+}
+
+// coalescer merges events for the same object. The first event of a burst
+// goes out at once; later ones inside the window are held, the latest
+// replacing earlier ones, and go out when the window closes, which opens the
+// next window. It is used from the event loop goroutine only.
+type coalescer struct {
+	window  time.Duration
+	windows map[string]*coalesceWindow
+}
+
+type coalesceWindow struct {
+	deadline time.Time
+	pending  *events.Message
+}
+
+func newCoalescer(window time.Duration) *coalescer {
+	return &coalescer{window: window, windows: make(map[string]*coalesceWindow)}
+}
+
+// add reports whether msg should be emitted now. When it returns false the
+// event is held, and replaced reports whether it displaced a held one.
+func (c *coalescer) add(msg events.Message, now time.Time) (emit bool, replaced bool) {
+	if c.window <= 0 {
+		return true, false
+	}
+
+	key := eventKey(msg)
+	w, ok := c.windows[key]
+	if !ok {
+		c.windows[key] = &coalesceWindow{deadline: now.Add(c.window)}
+		return true, false
+	}
+
+	replaced = w.pending != nil
+	w.pending = &msg
+	return false, replaced
+}
+
+// due returns held events whose window closed, in event time order. Windows
+// that held something stay open for another period.
+func (c *coalescer) due(now time.Time) []events.Message {
+	var ready []events.Message
+	for key, w := range c.windows {
+		if w.deadline.After(now) {
+			continue
+		}
+
+		if w.pending == nil {
+			delete(c.windows, key)
+			continue
+		}
+
+		ready = append(ready, *w.pending)
+		w.pending = nil
+		w.deadline = now.Add(c.window)
+	}
+
+	slices.SortFunc(ready, func(a, b events.Message) int {
+		return cmp.Compare(a.TimeNano, b.TimeNano)
+	})
+
+	return ready
+}
+
+// next returns the earliest open window deadline.
+func (c *coalescer) next() (time.Time, bool) {
+	var earliest time.Time
+	for _, w := range c.windows {
+		if earliest.IsZero() || w.deadline.Before(earliest) {
+			earliest = w.deadline
+		}
+	}
+
+	return earliest, !earliest.IsZero()
+}
@@ -0,0 +1,204 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]rateLimit
+		wantErr bool
+	}{
+		{
+			name:  "action and fallback",
+			value: "die=5/1m, *=30/1m",
+			want: map[string]rateLimit{
+				"die": {Events: 5, Per: time.Minute},
+				"*":   {Events: 30, Per: time.Minute},
+			},
+		},
+		{name: "none disables limits", value: "none", want: map[string]rateLimit{}},
+		{name: "missing duration", value: "die=5", wantErr: true},
+		{name: "zero count", value: "die=0/1m", wantErr: true},
+		{name: "bad duration", value: "die=5/minute", wantErr: true},
+		{name: "missing action", value: "=5/1m", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRateLimits(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("parseRateLimits() expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRateLimits() unexpected error: %v", err)
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseRateLimits() = %v, want %v", got, tt.want)
+			}
+			for action, limit := range tt.want {
+				if got[action] != limit {
+					t.Fatalf("parseRateLimits()[%q] = %v, want %v", action, got[action], limit)
+				}
+			}
+		})
+	}
+}
+
+func TestEventOptionsFromEnv(t *testing.T) {
+	t.Run("defaults ignore exec and top", func(t *testing.T) {
+		opts, err := eventOptionsFromEnv()
+		if err != nil {
+			t.Fatalf("eventOptionsFromEnv() unexpected error: %v", err)
+		}
+
+		for _, action := range []string{"exec_create", "exec_start", "exec_die", "top"} {
+			if !opts.IgnoreActions[action] {
+				t.Fatalf("IgnoreActions missing %q", action)
+			}
+		}
+
+		if opts.CoalesceWindow != defaultEventCoalesceWindow {
+			t.Fatalf("CoalesceWindow = %s", opts.CoalesceWindow)
+		}
+	})
+
+	t.Run("zero window and none disable shaping", func(t *testing.T) {
+		t.Setenv(agentEventIgnoreActionsEnv, "none")
+		t.Setenv(agentEventCoalesceWindowEnv, "0")
+		t.Setenv(agentEventRateLimitsEnv, "none")
+
+		opts, err := eventOptionsFromEnv()
+		if err != nil {
+			t.Fatalf("eventOptionsFromEnv() unexpected error: %v", err)
+		}
+
+		if len(opts.IgnoreActions) != 0 || opts.CoalesceWindow != 0 || len(opts.RateLimits) != 0 {
+			t.Fatalf("eventOptionsFromEnv() = %+v", opts)
+		}
+	})
+
+	t.Run("rejects detailed actions", func(t *testing.T) {
+		t.Setenv(agentEventIgnoreActionsEnv, "health_status: healthy")
+
+		if _, err := eventOptionsFromEnv(); err == nil {
+			t.Fatal("eventOptionsFromEnv() expected error")
+		}
+	})
+}
+
+func expectNoEvent(t *testing.T, a *Agent, wait time.Duration) {
+	t.Helper()
+
+	select {
+	case event := <-a.Events():
+		t.Fatalf("unexpected event %q", event.Type)
+	case <-time.After(wait):
+	}
+}
+
+func TestEventShaping(t *testing.T) {
+	t.Run("ignored actions still invalidate the cache", func(t *testing.T) {
+		docker := newFakeDocker(1, 0)
+		a := startEventLoop(t, docker, eventOptions{IgnoreActions: map[string]bool{"exec_start": true}})
+		id := docker.containers[0].ID
+
+		send(t, docker, containerEvent(id, "exec_start: sh -c healthcheck"))
+		expectNoEvent(t, a, 50*time.Millisecond)
+
+		if calls := docker.callCount("ContainerInspect"); calls != 0 {
+			t.Fatalf("ContainerInspect calls = %d, want 0", calls)
+		}
+
+		stats := a.EventStats()
+		if stats.Received != 1 || stats.Ignored != 1 || stats.Emitted != 0 {
+			t.Fatalf("EventStats() = %+v", stats)
+		}
+	})
+
+	t.Run("bursts merge into the latest state", func(t *testing.T) {
+		docker := newFakeDocker(2, 0)
+		a := startEventLoop(t, docker, eventOptions{CoalesceWindow: 100 * time.Millisecond})
+		id := docker.containers[0].ID
+
+		if event := publish(t, a, docker, containerEvent(id, events.ActionStart)); event.Type != "container.start" {
+			t.Fatalf("leading event = %q", event.Type)
+		}
+
+		docker.mu.Lock()
+		docker.containers[0].State = "exited"
+		docker.mu.Unlock()
+		send(t, docker, containerEvent(id, events.ActionKill))
+		send(t, docker, containerEvent(id, events.ActionStop))
+		send(t, docker, containerEvent(id, events.ActionDie))
+
+		// Another container is not held back by the burst.
+		other := publish(t, a, docker, containerEvent(docker.containers[1].ID, events.ActionStart))
+		if other.Data.(*Container).ID != docker.containers[1].ID {
+			t.Fatalf("unexpected event for %s", other.Data.(*Container).ID)
+		}
+
+		trailing := nextEvent(t, a, time.Second)
+		if trailing.Type != "container.die" || trailing.Data.(*Container).State != "exited" {
+			t.Fatalf("trailing event = %q %+v", trailing.Type, trailing.Data)
+		}
+		expectNoEvent(t, a, 250*time.Millisecond)
+
+		stats := a.EventStats()
+		if stats.Coalesced != 2 || stats.Emitted != 3 {
+			t.Fatalf("EventStats() = %+v", stats)
+		}
+	})
+
+	t.Run("rate limits apply per container and action", func(t *testing.T) {
+		docker := newFakeDocker(2, 0)
+		a := startEventLoop(t, docker, eventOptions{
+			RateLimits: map[string]rateLimit{
+				"die": {Events: 2, Per: time.Hour},
+				"*":   {Events: 100, Per: time.Hour},
+			},
+		})
+		looping := docker.containers[0].ID
+
+		publish(t, a, docker, containerEvent(looping, events.ActionDie))
+		publish(t, a, docker, containerEvent(looping, events.ActionDie))
+		for range 3 {
+			send(t, docker, containerEvent(looping, events.ActionDie))
+		}
+		expectNoEvent(t, a, 50*time.Millisecond)
+
+		publish(t, a, docker, containerEvent(looping, events.ActionStart))
+		publish(t, a, docker, containerEvent(docker.containers[1].ID, events.ActionDie))
+
+		stats := a.EventStats()
+		if stats.RateLimited != 3 || stats.Emitted != 4 {
+			t.Fatalf("EventStats() = %+v", stats)
+		}
+	})
+}
+
+func TestEventLimiterPrune(t *testing.T) {
+	limiter := newEventLimiter(map[string]rateLimit{"*": {Events: 1, Per: time.Second}})
+	now := time.Now()
+
+	if !limiter.allow(containerEvent("a", events.ActionDie), now) {
+		t.Fatal("allow() first event denied")
+	}
+	if limiter.allow(containerEvent("a", events.ActionDie), now) {
+		t.Fatal("allow() second event allowed")
+	}
+
+	limiter.prune(now.Add(2 * time.Second))
+	if len(limiter.limiters) != 0 {
+		t.Fatalf("limiters after prune = %d", len(limiter.limiters))
+	}
+}
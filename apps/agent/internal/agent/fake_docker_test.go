@@ -0,0 +1,886 @@
+package agent
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/build"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/system"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fakeDocker serves a fixed set of containers and images and simulates the
+// latency of the Docker API. Methods not overridden panic via the nil
+// embedded client.
+type fakeDocker struct {
+	client.APIClient
+
+	containers  []container.Summary
+	images      []image.Summary
+	networks    []network.Inspect
+	volumes     []volume.Volume
+	volumeSizes map[string]int64
+	// diskUsage is what DiskUsage reports besides volumes.
+	diskUsage types.DiskUsage
+	// prunes records the filters of every prune call by kind.
+	prunes map[string]filters.Args
+	// volumeFiles holds volume contents as seen by helper containers, which
+	// map IDs to the volume they mount.
+	volumeFiles map[string]map[string]string
+	helpers     map[string]string
+	// missingImages fail ContainerCreate with not found until pulled.
+	missingImages map[string]bool
+	// pullStreams are the progress streams ImagePull returns by reference;
+	// pullAuths records the registry auth of every pull.
+	pullStreams  map[string]string
+	pullAuths    []string
+	info         system.Info
+	version      types.Version
+	latency      time.Duration
+	statsLatency time.Duration
+	// hang lists container IDs whose stats never return before ctx ends.
+	hang map[string]bool
+	// stream and streamErrs feed Events; tests push Docker events and
+	// stream failures into them.
+	stream     chan events.Message
+	streamErrs chan error
+	// pingErr fails Ping while set, infoErr Info and networkRemoveErr
+	// NetworkRemove.
+	pingErr          error
+	infoErr          error
+	networkRemoveErr error
+	// since records the Since option of every Events subscription.
+	since []string
+
+	inflight    atomic.Int64
+	maxInflight atomic.Int64
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func newFakeDocker(containers int, images int) *fakeDocker {
+	f := &fakeDocker{
+		hang:       map[string]bool{},
+		helpers:    map[string]string{},
+		stream:     make(chan events.Message),
+		streamErrs: make(chan error),
+		calls:      map[string]int{},
+	}
+
+	for i := range images {
+		f.images = append(f.images, image.Summary{
+			ID:       fmt.Sprintf("sha256:%064x", i),
+			RepoTags: []string{fmt.Sprintf("app-%d:latest", i)},
+			Size:     int64(i+1) << 20,
+		})
+	}
+
+	for i := range containers {
+		imageID := ""
+		if images > 0 {
+			imageID = f.images[i%images].ID
+		}
+		f.containers = append(f.containers, container.Summary{
+			ID:      fmt.Sprintf("%064x", i),
+			Names:   []string{fmt.Sprintf("/container-%d", i)},
+			Image:   "app:latest",
+			ImageID: imageID,
+			State:   "running",
+			Status:  "Up 5 minutes",
+			Created: 1767225600,
+		})
+	}
+
+	f.volumes = []volume.Volume{
+		{Name: "data", Driver: "local", Scope: "local", Mountpoint: "/var/lib/docker/volumes/data/_data", CreatedAt: "2026-01-01T00:00:00Z"},
+		{Name: "cache", Driver: "local", Scope: "local", Mountpoint: "/var/lib/docker/volumes/cache/_data", Labels: map[string]string{"tier": "tmp"}},
+	}
+	f.volumeSizes = map[string]int64{"data": 4 << 20, "cache": -1}
+	f.volumeFiles = map[string]map[string]string{
+		"data": {"config.json": `{"debug":true}`, "logs/app.log": "started\n"},
+	}
+	f.missingImages = map[string]bool{}
+	f.prunes = map[string]filters.Args{}
+
+	f.info = system.Info{
+		ID:              "engine-1",
+		Name:            "docker-host",
+		Driver:          "overlay2",
+		DockerRootDir:   "/var/lib/docker",
+		CgroupDriver:    "systemd",
+		CgroupVersion:   "2",
+		SecurityOptions: []string{"name=apparmor", "name=seccomp,profile=builtin", "name=cgroupns"},
+		Runtimes:        map[string]system.RuntimeWithStatus{"runc": {}, "io.containerd.runc.v2": {}},
+		DefaultRuntime:  "runc",
+		RegistryConfig:  &registry.ServiceConfig{Mirrors: []string{"https://mirror.example.com/"}},
+	}
+	f.version = types.Version{Version: "28.5.2", APIVersion: "1.51", MinAPIVersion: "1.24", Os: "linux", Arch: "amd64"}
+	if containers > 0 {
+		f.containers[0].Mounts = []container.MountPoint{
+			{Type: mount.TypeVolume, Name: "data", Destination: "/data", RW: true},
+		}
+	}
+
+	f.networks = []network.Inspect{{
+		ID:     fmt.Sprintf("%064x", 0xbeef),
+		Name:   "bridge",
+		Driver: "bridge",
+		Scope:  "local",
+		IPAM: network.IPAM{Config: []network.IPAMConfig{
+			{Subnet: "172.17.0.0/16", Gateway: "172.17.0.1"},
+		}},
+		Containers: map[string]network.EndpointResource{},
+	}}
+	for i, item := range f.containers {
+		f.networks[0].Containers[item.ID] = network.EndpointResource{
+			Name:        strings.TrimPrefix(item.Names[0], "/"),
+			IPv4Address: fmt.Sprintf("172.17.%d.%d/16", (i+2)/256, (i+2)%256),
+		}
+	}
+
+	return f
+}
+
+func (f *fakeDocker) call(ctx context.Context, name string, latency time.Duration) error {
+	f.mu.Lock()
+	f.calls[name]++
+	f.mu.Unlock()
+
+	current := f.inflight.Add(1)
+	defer f.inflight.Add(-1)
+	for {
+		peak := f.maxInflight.Load()
+		if current <= peak || f.maxInflight.CompareAndSwap(peak, current) {
+			break
+		}
+	}
+
+	if latency <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(latency)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (f *fakeDocker) callCount(name string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.calls[name]
+}
+
+// ContainerList honours label filters by key only.
+func (f *fakeDocker) ContainerList(ctx context.Context, options container.ListOptions) ([]container.Summary, error) {
+	if err := f.call(ctx, "ContainerList", 0); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	labels := options.Filters.Get("label")
+	return slices.DeleteFunc(slices.Clone(f.containers), func(item container.Summary) bool {
+		return slices.ContainsFunc(labels, func(key string) bool {
+			_, ok := item.Labels[key]
+			return !ok
+		})
+	}), nil
+}
+
+func (f *fakeDocker) ImageList(ctx context.Context, _ image.ListOptions) ([]image.Summary, error) {
+	if err := f.call(ctx, "ImageList", 0); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]image.Summary(nil), f.images...), nil
+}
+
+func (f *fakeDocker) ContainerInspect(ctx context.Context, id string) (container.InspectResponse, error) {
+	if err := f.call(ctx, "ContainerInspect", f.latency); err != nil {
+		return container.InspectResponse{}, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, summary := range f.containers {
+		if summary.ID != id {
+			continue
+		}
+
+		return container.InspectResponse{
+			ContainerJSONBase: &container.ContainerJSONBase{
+				ID:         summary.ID,
+				Name:       summary.Names[0],
+				Created:    "2026-01-01T00:00:00Z",
+				Image:      summary.ImageID,
+				State:      &container.State{Status: summary.State, Running: summary.State == "running"},
+				HostConfig: &container.HostConfig{},
+			},
+			Config: &container.Config{Image: summary.Image, Env: []string{"APP_ENV=production"}},
+		}, nil
+	}
+
+	return container.InspectResponse{}, errdefs.NotFound(fmt.Errorf("no such container: %s", id))
+}
+
+func (f *fakeDocker) ContainerStats(ctx context.Context, id string, _ bool) (container.StatsResponseReader, error) {
+	latency := f.statsLatency
+	if f.hang[id] {
+		latency = time.Hour
+	}
+
+	if err := f.call(ctx, "ContainerStats", latency); err != nil {
+		return container.StatsResponseReader{}, err
+	}
+
+	var stats container.StatsResponse
+	stats.CPUStats.CPUUsage.TotalUsage = 2_000_000
+	stats.PreCPUStats.CPUUsage.TotalUsage = 1_000_000
+	stats.CPUStats.SystemUsage = 20_000_000
+	stats.PreCPUStats.SystemUsage = 10_000_000
+	stats.CPUStats.OnlineCPUs = 2
+	stats.MemoryStats.Usage = 64 << 20
+	stats.MemoryStats.Limit = 1 << 30
+
+	body, err := json.Marshal(stats)
+	if err != nil {
+		return container.StatsResponseReader{}, err
+	}
+
+	return container.StatsResponseReader{Body: io.NopCloser(bytes.NewReader(body))}, nil
+}
+
+func (f *fakeDocker) ImageInspectWithRaw(ctx context.Context, id string) (image.InspectResponse, []byte, error) {
+	if err := f.call(ctx, "ImageInspect", f.latency); err != nil {
+		return image.InspectResponse{}, nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, summary := range f.images {
+		if summary.ID != id && !slices.Contains(summary.RepoTags, id) {
+			continue
+		}
+
+		return image.InspectResponse{
+			ID:           summary.ID,
+			RepoTags:     summary.RepoTags,
+			RepoDigests:  summary.RepoDigests,
+			Size:         summary.Size,
+			Os:           "linux",
+			Architecture: "amd64",
+		}, nil, nil
+	}
+
+	return image.InspectResponse{}, nil, errdefs.NotFound(fmt.Errorf("no such image: %s", id))
+}
+
+func (f *fakeDocker) Events(_ context.Context, options events.ListOptions) (<-chan events.Message, <-chan error) {
+	f.mu.Lock()
+	f.since = append(f.since, options.Since)
+	f.mu.Unlock()
+
+	return f.stream, f.streamErrs
+}
+
+func (f *fakeDocker) Ping(ctx context.Context) (types.Ping, error) {
+	f.mu.Lock()
+	err := f.pingErr
+	f.mu.Unlock()
+
+	if err := f.call(ctx, "Ping", 0); err != nil {
+		return types.Ping{}, err
+	}
+
+	return types.Ping{}, err
+}
+
+func (f *fakeDocker) setPingErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.pingErr = err
+}
+
+func (f *fakeDocker) subscriptions() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.since...)
+}
+
+func (f *fakeDocker) Close() error {
+	return nil
+}
+
+func (f *fakeDocker) NetworkList(ctx context.Context, _ network.ListOptions) ([]network.Summary, error) {
+	if err := f.call(ctx, "NetworkList", 0); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Like the API, the list does not include endpoints.
+	result := make([]network.Summary, 0, len(f.networks))
+	for _, item := range f.networks {
+		item.Containers = nil
+		result = append(result, item)
+	}
+
+	return result, nil
+}
+
+func (f *fakeDocker) NetworkInspect(ctx context.Context, id string, _ network.InspectOptions) (network.Inspect, error) {
+	if err := f.call(ctx, "NetworkInspect", f.latency); err != nil {
+		return network.Inspect{}, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, item := range f.networks {
+		if item.ID == id || item.Name == id {
+			item.Containers = maps.Clone(item.Containers)
+			return item, nil
+		}
+	}
+
+	return network.Inspect{}, errdefs.NotFound(fmt.Errorf("network %s not found", id))
+}
+
+func (f *fakeDocker) NetworkCreate(ctx context.Context, name string, options network.CreateOptions) (network.CreateResponse, error) {
+	if err := f.call(ctx, "NetworkCreate", 0); err != nil {
+		return network.CreateResponse{}, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	created := network.Inspect{
+		ID:         fmt.Sprintf("%064x", 0xbeef+len(f.networks)),
+		Name:       name,
+		Driver:     options.Driver,
+		Scope:      "local",
+		Internal:   options.Internal,
+		Labels:     options.Labels,
+		Containers: map[string]network.EndpointResource{},
+	}
+	if options.IPAM != nil {
+		created.IPAM = *options.IPAM
+	}
+	f.networks = append(f.networks, created)
+
+	return network.CreateResponse{ID: created.ID}, nil
+}
+
+func (f *fakeDocker) NetworkRemove(ctx context.Context, id string) error {
+	if err := f.call(ctx, "NetworkRemove", 0); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.networkRemoveErr != nil {
+		return f.networkRemoveErr
+	}
+
+	f.networks = slices.DeleteFunc(f.networks, func(item network.Inspect) bool { return item.ID == id })
+	return nil
+}
+
+func (f *fakeDocker) NetworkConnect(ctx context.Context, id string, containerID string, settings *network.EndpointSettings) error {
+	if err := f.call(ctx, "NetworkConnect", 0); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, item := range f.networks {
+		if item.ID == id {
+			endpoint := network.EndpointResource{Name: containerID}
+			if settings.IPAMConfig != nil {
+				endpoint.IPv4Address = settings.IPAMConfig.IPv4Address
+			}
+			item.Containers[containerID] = endpoint
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeDocker) NetworkDisconnect(ctx context.Context, id string, containerID string, _ bool) error {
+	if err := f.call(ctx, "NetworkDisconnect", 0); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, item := range f.networks {
+		if item.ID == id {
+			delete(item.Containers, containerID)
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeDocker) VolumeList(ctx context.Context, _ volume.ListOptions) (volume.ListResponse, error) {
+	if err := f.call(ctx, "VolumeList", 0); err != nil {
+		return volume.ListResponse{}, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	response := volume.ListResponse{Volumes: []*volume.Volume{}}
+	for _, item := range f.volumes {
+		response.Volumes = append(response.Volumes, &item)
+	}
+
+	return response, nil
+}
+
+func (f *fakeDocker) VolumeInspect(ctx context.Context, name string) (volume.Volume, error) {
+	if err := f.call(ctx, "VolumeInspect", f.latency); err != nil {
+		return volume.Volume{}, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, item := range f.volumes {
+		if item.Name == name {
+			return item, nil
+		}
+	}
+
+	return volume.Volume{}, errdefs.NotFound(fmt.Errorf("get %s: no such volume", name))
+}
+
+func (f *fakeDocker) DiskUsage(ctx context.Context, _ types.DiskUsageOptions) (types.DiskUsage, error) {
+	if err := f.call(ctx, "DiskUsage", 0); err != nil {
+		return types.DiskUsage{}, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	usage := f.diskUsage
+	usage.Volumes = nil
+	for _, item := range f.volumes {
+		item.UsageData = &volume.UsageData{Size: f.volumeSizes[item.Name], RefCount: 0}
+		usage.Volumes = append(usage.Volumes, &item)
+	}
+
+	return usage, nil
+}
+
+func (f *fakeDocker) VolumeCreate(ctx context.Context, options volume.CreateOptions) (volume.Volume, error) {
+	if err := f.call(ctx, "VolumeCreate", 0); err != nil {
+		return volume.Volume{}, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	created := volume.Volume{
+		Name:      options.Name,
+		Driver:    options.Driver,
+		Scope:     "local",
+		Labels:    options.Labels,
+		Options:   options.DriverOpts,
+		CreatedAt: "2026-01-02T00:00:00Z",
+	}
+	f.volumes = append(f.volumes, created)
+
+	return created, nil
+}
+
+func (f *fakeDocker) VolumeRemove(ctx context.Context, name string, _ bool) error {
+	if err := f.call(ctx, "VolumeRemove", 0); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.volumes = slices.DeleteFunc(f.volumes, func(item volume.Volume) bool { return item.Name == name })
+	return nil
+}
+
+// VolumesPrune removes volumes no container mounts. Without all=true only
+// volumes labelled anonymous go, as with Docker.
+func (f *fakeDocker) VolumesPrune(ctx context.Context, args filters.Args) (volume.PruneReport, error) {
+	if err := f.call(ctx, "VolumesPrune", 0); err != nil {
+		return volume.PruneReport{}, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	all := slices.Contains(args.Get("all"), "true")
+	var report volume.PruneReport
+	f.volumes = slices.DeleteFunc(f.volumes, func(item volume.Volume) bool {
+		if !all && item.Labels["com.docker.volume.anonymous"] == "" {
+			return false
+		}
+		for _, summary := range f.containers {
+			for _, point := range summary.Mounts {
+				if point.Name == item.Name {
+					return false
+				}
+			}
+		}
+
+		report.VolumesDeleted = append(report.VolumesDeleted, item.Name)
+		if size := f.volumeSizes[item.Name]; size > 0 {
+			report.SpaceReclaimed += uint64(size)
+		}
+		return true
+	})
+
+	return report, nil
+}
+
+func (f *fakeDocker) ImagePull(ctx context.Context, ref string, options image.PullOptions) (io.ReadCloser, error) {
+	if err := f.call(ctx, "ImagePull", 0); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.missingImages, ref)
+	f.pullAuths = append(f.pullAuths, options.RegistryAuth)
+	if stream, ok := f.pullStreams[ref]; ok {
+		return io.NopCloser(strings.NewReader(stream)), nil
+	}
+	return io.NopCloser(strings.NewReader(`{"status":"Downloaded newer image"}`)), nil
+}
+
+func (f *fakeDocker) ContainerCreate(
+	ctx context.Context,
+	config *container.Config,
+	hostConfig *container.HostConfig,
+	_ *network.NetworkingConfig,
+	_ *ocispec.Platform,
+	_ string,
+) (container.CreateResponse, error) {
+	if err := f.call(ctx, "ContainerCreate", 0); err != nil {
+		return container.CreateResponse{}, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.missingImages[config.Image] {
+		return container.CreateResponse{}, errdefs.NotFound(fmt.Errorf("no such image: %s", config.Image))
+	}
+
+	id := fmt.Sprintf("%064x", 0xfeed+len(f.helpers))
+	for _, point := range hostConfig.Mounts {
+		if point.Type == mount.TypeVolume {
+			f.helpers[id] = point.Source
+		}
+	}
+
+	return container.CreateResponse{ID: id}, nil
+}
+
+func (f *fakeDocker) ContainerRemove(ctx context.Context, id string, _ container.RemoveOptions) error {
+	if err := f.call(ctx, "ContainerRemove", 0); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.helpers, id)
+	// Fake IDs share long prefixes, so only the first match goes.
+	if i := slices.IndexFunc(f.containers, func(item container.Summary) bool {
+		return strings.HasPrefix(item.ID, id)
+	}); i >= 0 {
+		f.containers = slices.Delete(f.containers, i, i+1)
+	}
+	return nil
+}
+
+// CopyFromContainer archives the helper's volume the way Docker does for a
+// path ending in /.: entries are relative to the volume root.
+func (f *fakeDocker) CopyFromContainer(ctx context.Context, id string, _ string) (io.ReadCloser, container.PathStat, error) {
+	if err := f.call(ctx, "CopyFromContainer", 0); err != nil {
+		return nil, container.PathStat{}, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name, ok := f.helpers[id]
+	if !ok {
+		return nil, container.PathStat{}, errdefs.NotFound(fmt.Errorf("no such container: %s", id))
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, path := range slices.Sorted(maps.Keys(f.volumeFiles[name])) {
+		content := f.volumeFiles[name][path]
+		tw.WriteHeader(&tar.Header{Name: "./" + path, Mode: 0o644, Size: int64(len(content))})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+
+	return io.NopCloser(&buf), container.PathStat{Name: ".", Mode: 0o755}, nil
+}
+
+func (f *fakeDocker) CopyToContainer(
+	ctx context.Context,
+	id string,
+	_ string,
+	content io.Reader,
+	_ container.CopyToContainerOptions,
+) error {
+	if err := f.call(ctx, "CopyToContainer", 0); err != nil {
+		return err
+	}
+
+	files := map[string]string{}
+	tr := tar.NewReader(content)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeReg {
+			files[strings.TrimPrefix(header.Name, "./")] = string(data)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name, ok := f.helpers[id]
+	if !ok {
+		return errdefs.NotFound(fmt.Errorf("no such container: %s", id))
+	}
+	if f.volumeFiles[name] == nil {
+		f.volumeFiles[name] = map[string]string{}
+	}
+	maps.Copy(f.volumeFiles[name], files)
+
+	return nil
+}
+
+func (f *fakeDocker) Info(ctx context.Context) (system.Info, error) {
+	if err := f.call(ctx, "Info", 0); err != nil {
+		return system.Info{}, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.infoErr != nil {
+		return system.Info{}, f.infoErr
+	}
+
+	return f.info, nil
+}
+
+func (f *fakeDocker) ServerVersion(ctx context.Context) (types.Version, error) {
+	if err := f.call(ctx, "ServerVersion", 0); err != nil {
+		return types.Version{}, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.version, nil
+}
+
+func (f *fakeDocker) ContainersPrune(ctx context.Context, args filters.Args) (container.PruneReport, error) {
+	if err := f.call(ctx, "ContainersPrune", 0); err != nil {
+		return container.PruneReport{}, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.prunes["containers"] = args
+	var report container.PruneReport
+	f.containers = slices.DeleteFunc(f.containers, func(item container.Summary) bool {
+		if item.State == container.StateRunning {
+			return false
+		}
+		report.ContainersDeleted = append(report.ContainersDeleted, item.ID)
+		report.SpaceReclaimed += uint64(item.SizeRw)
+		return true
+	})
+
+	return report, nil
+}
+
+// ImagesPrune removes images no container uses; with dangling=true only
+// those without tags.
+func (f *fakeDocker) ImagesPrune(ctx context.Context, args filters.Args) (image.PruneReport, error) {
+	if err := f.call(ctx, "ImagesPrune", 0); err != nil {
+		return image.PruneReport{}, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.prunes["images"] = args
+	danglingOnly := slices.Contains(args.Get("dangling"), "true")
+	var report image.PruneReport
+	f.images = slices.DeleteFunc(f.images, func(item image.Summary) bool {
+		if danglingOnly && len(item.RepoTags) > 0 {
+			return false
+		}
+		for _, summary := range f.containers {
+			if summary.ImageID == item.ID {
+				return false
+			}
+		}
+
+		for _, tag := range item.RepoTags {
+			report.ImagesDeleted = append(report.ImagesDeleted, image.DeleteResponse{Untagged: tag})
+		}
+		report.ImagesDeleted = append(report.ImagesDeleted, image.DeleteResponse{Deleted: item.ID})
+		report.SpaceReclaimed += uint64(item.Size)
+		return true
+	})
+
+	return report, nil
+}
+
+func (f *fakeDocker) NetworksPrune(ctx context.Context, args filters.Args) (network.PruneReport, error) {
+	if err := f.call(ctx, "NetworksPrune", 0); err != nil {
+		return network.PruneReport{}, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.prunes["networks"] = args
+	var report network.PruneReport
+	f.networks = slices.DeleteFunc(f.networks, func(item network.Inspect) bool {
+		if item.Name == "bridge" || len(item.Containers) > 0 {
+			return false
+		}
+		report.NetworksDeleted = append(report.NetworksDeleted, item.Name)
+		return true
+	})
+
+	return report, nil
+}
+
+func (f *fakeDocker) BuildCachePrune(ctx context.Context, options build.CachePruneOptions) (*build.CachePruneReport, error) {
+	if err := f.call(ctx, "BuildCachePrune", 0); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.prunes["builder"] = options.Filters
+	var report build.CachePruneReport
+	f.diskUsage.BuildCache = slices.DeleteFunc(f.diskUsage.BuildCache, func(item *build.CacheRecord) bool {
+		if item.InUse || (item.Shared && !options.All) {
+			return false
+		}
+		report.CachesDeleted = append(report.CachesDeleted, item.ID)
+		report.SpaceReclaimed += uint64(item.Size)
+		return true
+	})
+
+	return &report, nil
+}
+
+// ImageRemove untags a reference to an image with other tags; otherwise it
+// deletes the image unless containers use it and force is not set.
+func (f *fakeDocker) ImageRemove(ctx context.Context, ref string, options image.RemoveOptions) ([]image.DeleteResponse, error) {
+	if err := f.call(ctx, "ImageRemove", 0); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	index := slices.IndexFunc(f.images, func(item image.Summary) bool {
+		return item.ID == ref || slices.Contains(item.RepoTags, ref)
+	})
+	if index < 0 {
+		return nil, errdefs.NotFound(fmt.Errorf("no such image: %s", ref))
+	}
+
+	item := &f.images[index]
+	if item.ID != ref && len(item.RepoTags) > 1 {
+		item.RepoTags = slices.DeleteFunc(item.RepoTags, func(tag string) bool { return tag == ref })
+		return []image.DeleteResponse{{Untagged: ref}}, nil
+	}
+
+	if !options.Force && slices.ContainsFunc(f.containers, func(summary container.Summary) bool {
+		return summary.ImageID == item.ID
+	}) {
+		return nil, errdefs.Conflict(fmt.Errorf("image %s is being used by a container", ref))
+	}
+
+	var response []image.DeleteResponse
+	for _, tag := range item.RepoTags {
+		response = append(response, image.DeleteResponse{Untagged: tag})
+	}
+	response = append(response, image.DeleteResponse{Deleted: item.ID})
+	if options.PruneChildren {
+		// Every fake image has one untagged parent.
+		response = append(response, image.DeleteResponse{Deleted: item.ID + "-parent"})
+	}
+	f.images = slices.Delete(f.images, index, index+1)
+
+	return response, nil
+}
@@ -0,0 +1,373 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	hostEventType = "agent.host"
+
+	agentHostIntervalEnv = "AGENT_HOST_INTERVAL"
+	agentHostRootEnv     = "AGENT_HOST_ROOT"
+
+	// defaultHostInterval is how often host and engine facts are checked for
+	// changes; they are only sent when something did change.
+	defaultHostInterval = 5 * time.Minute
+	defaultHostRoot     = "/"
+
+	// bootTimeJitter is how far boot times derived from uptime drift
+	// between reads of the same boot.
+	bootTimeJitter = 2
+)
+
+// HostFacts describes the machine Docker runs on. They are read from proc
+// and etc under the host root, which is the host's / mounted into the agent
+// container when the agent runs in one.
+type HostFacts struct {
+	Hostname      string `json:"hostname"`
+	Kernel        string `json:"kernel"`
+	OS            string `json:"os"`
+	OSID          string `json:"osId"`
+	OSVersion     string `json:"osVersion"`
+	CPUs          int    `json:"cpus"`
+	CPUModel      string `json:"cpuModel"`
+	MemoryBytes   uint64 `json:"memoryBytes"`
+	UptimeSeconds int64  `json:"uptimeSeconds"`
+	BootTime      int64  `json:"bootTime"`
+}
+
+// EngineInfo describes the Docker engine.
+type EngineInfo struct {
+	ID              string   `json:"id"`
+	Name            string   `json:"name"`
+	Version         string   `json:"version"`
+	APIVersion      string   `json:"apiVersion"`
+	MinAPIVersion   string   `json:"minApiVersion"`
+	GitCommit       string   `json:"gitCommit"`
+	GoVersion       string   `json:"goVersion"`
+	OS              string   `json:"os"`
+	Arch            string   `json:"arch"`
+	StorageDriver   string   `json:"storageDriver"`
+	DockerRootDir   string   `json:"dockerRootDir"`
+	CgroupDriver    string   `json:"cgroupDriver"`
+	CgroupVersion   string   `json:"cgroupVersion"`
+	SecurityOptions []string `json:"securityOptions"`
+	Runtimes        []string `json:"runtimes"`
+	DefaultRuntime  string   `json:"defaultRuntime"`
+	RegistryMirrors []string `json:"registryMirrors"`
+}
+
+// HostPayload is the payload of agent.host events. Engine is omitted while
+// Docker does not answer.
+type HostPayload struct {
+	Host   HostFacts   `json:"host"`
+	Engine *EngineInfo `json:"engine,omitempty"`
+}
+
+// RefreshHost asks the agent to send agent.host even if nothing changed,
+// e.g. after the connection moved to another API instance.
+func (a *Agent) RefreshHost() {
+	select {
+	case a.hostRefresh <- struct{}{}:
+	default:
+	}
+}
+
+// runHost sends agent.host at start, on refresh and whenever a check every
+// interval finds the facts changed. Uptime alone does not count as a change.
+func (a *Agent) runHost(ctx context.Context, interval time.Duration) {
+	var last *HostPayload
+	check := func(force bool) {
+		payload := a.collectHost(ctx)
+		if !force && last != nil && !hostChanged(*last, payload) {
+			return
+		}
+
+		last = &payload
+		a.emitEvent(ctx, Event{
+			Type: hostEventType,
+			TS:   time.Now(),
+			Data: payload,
+			Key:  hostEventType,
+		})
+	}
+	check(true)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			check(false)
+		case <-a.hostRefresh:
+			check(true)
+		}
+	}
+}
+
+func hostChanged(prev HostPayload, next HostPayload) bool {
+	prev.Host.UptimeSeconds = 0
+	next.Host.UptimeSeconds = 0
+	if drift := next.Host.BootTime - prev.Host.BootTime; drift >= -bootTimeJitter && drift <= bootTimeJitter {
+		next.Host.BootTime = prev.Host.BootTime
+	}
+
+	return !reflect.DeepEqual(prev, next)
+}
+
+func (a *Agent) collectHost(ctx context.Context) HostPayload {
+	facts, err := readHostFacts(a.hostRoot, time.Now())
+	if err != nil {
+		a.emitError(ctx, err)
+	}
+
+	payload := HostPayload{Host: facts}
+	if a.dockerDown.Load() {
+		return payload
+	}
+
+	engine, err := a.engineInfo(ctx)
+	if err != nil {
+		a.emitError(ctx, err)
+		return payload
+	}
+	payload.Engine = &engine
+
+	return payload
+}
+
+func (a *Agent) engineInfo(ctx context.Context) (EngineInfo, error) {
+	ctx, cancel := withCallTimeout(ctx, a.snapshotOpts.CallTimeout)
+	defer cancel()
+
+	info, err := a.cli.Info(ctx)
+	if err != nil {
+		return EngineInfo{}, fmt.Errorf("docker info: %w", err)
+	}
+
+	version, err := a.cli.ServerVersion(ctx)
+	if err != nil {
+		return EngineInfo{}, fmt.Errorf("docker version: %w", err)
+	}
+
+	mirrors := []string{}
+	if info.RegistryConfig != nil {
+		mirrors = append(mirrors, info.RegistryConfig.Mirrors...)
+	}
+
+	securityOptions := []string{}
+	securityOptions = append(securityOptions, info.SecurityOptions...)
+
+	return EngineInfo{
+		ID:              info.ID,
+		Name:            info.Name,
+		Version:         version.Version,
+		APIVersion:      version.APIVersion,
+		MinAPIVersion:   version.MinAPIVersion,
+		GitCommit:       version.GitCommit,
+		GoVersion:       version.GoVersion,
+		OS:              version.Os,
+		Arch:            version.Arch,
+		StorageDriver:   info.Driver,
+		DockerRootDir:   info.DockerRootDir,
+		CgroupDriver:    info.CgroupDriver,
+		CgroupVersion:   info.CgroupVersion,
+		SecurityOptions: securityOptions,
+		Runtimes:        slices.Sorted(maps.Keys(info.Runtimes)),
+		DefaultRuntime:  info.DefaultRuntime,
+		RegistryMirrors: mirrors,
+	}, nil
+}
+
+// readHostFacts reads what it can under root. Missing proc files are
+// reported together; a missing os-release or hostname is not an error.
+func readHostFacts(root string, now time.Time) (HostFacts, error) {
+	facts := HostFacts{Hostname: readHostname(root)}
+
+	var errs []error
+
+	kernel, err := os.ReadFile(filepath.Join(root, "proc/sys/kernel/osrelease"))
+	if err != nil {
+		errs = append(errs, err)
+	}
+	facts.Kernel = strings.TrimSpace(string(kernel))
+
+	release := readOSRelease(root)
+	facts.OS = release["PRETTY_NAME"]
+	facts.OSID = release["ID"]
+	facts.OSVersion = release["VERSION_ID"]
+
+	if facts.CPUs, facts.CPUModel, err = readCPUInfo(filepath.Join(root, "proc/cpuinfo")); err != nil {
+		errs = append(errs, err)
+	}
+
+	if memory, err := readMeminfo(filepath.Join(root, "proc/meminfo")); err != nil {
+		errs = append(errs, err)
+	} else {
+		facts.MemoryBytes = memory["MemTotal"]
+	}
+
+	if uptime, err := readUptime(filepath.Join(root, "proc/uptime")); err != nil {
+		errs = append(errs, err)
+	} else {
+		facts.UptimeSeconds = int64(uptime.Seconds())
+		facts.BootTime = now.Add(-uptime).Unix()
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return facts, fmt.Errorf("read host facts: %w", err)
+	}
+
+	return facts, nil
+}
+
+// readHostname reads the host's name under root rather than the agent's,
+// which differs when the agent runs in a container.
+func readHostname(root string) string {
+	for _, name := range []string{"proc/sys/kernel/hostname", "etc/hostname"} {
+		data, err := os.ReadFile(filepath.Join(root, name))
+		if hostname := strings.TrimSpace(string(data)); err == nil && hostname != "" {
+			return hostname
+		}
+	}
+
+	return ""
+}
+
+// readOSRelease parses os-release(5), preferring /etc over /usr/lib.
+func readOSRelease(root string) map[string]string {
+	values := map[string]string{}
+
+	for _, name := range []string{"etc/os-release", "usr/lib/os-release"} {
+		data, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			continue
+		}
+
+		for line := range strings.Lines(string(data)) {
+			key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+			if !ok || strings.HasPrefix(key, "#") {
+				continue
+			}
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				value = unquoted
+			} else {
+				value = strings.Trim(value, `'"`)
+			}
+			values[key] = value
+		}
+		break
+	}
+
+	return values
+}
+
+// readCPUInfo counts logical CPUs and picks the model name. ARM kernels
+// report no model name per processor, only a machine-wide Hardware or
+// Model line.
+func readCPUInfo(path string) (int, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	count := 0
+	models := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		if key == "processor" {
+			count++
+			continue
+		}
+		if _, seen := models[key]; !seen && value != "" {
+			models[key] = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, "", fmt.Errorf("read %s: %w", path, err)
+	}
+
+	for _, key := range []string{"model name", "Model", "Hardware", "cpu model"} {
+		if model, ok := models[key]; ok {
+			return count, model, nil
+		}
+	}
+
+	return count, "", nil
+}
+
+// readMeminfo returns /proc/meminfo in bytes.
+func readMeminfo(path string) (map[string]uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	values := map[string]uint64{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, rest, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 1 && fields[1] == "kB" {
+			value *= 1024
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	return values, nil
+}
+
+func readUptime(path string) (time.Duration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("parse %s: empty", path)
+	}
+
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
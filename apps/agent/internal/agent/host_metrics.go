@@ -0,0 +1,654 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	hostMetricsEventType = "host.metrics"
+
+	agentHostMetricsIntervalEnv = "AGENT_HOST_METRICS_INTERVAL"
+
+	defaultHostMetricsInterval = 15 * time.Second
+
+	// diskSectorSize is the unit of /proc/diskstats, whatever the device's
+	// real sector size.
+	diskSectorSize = 512
+)
+
+// pseudoFilesystems never hold data worth a disk usage entry.
+var pseudoFilesystems = map[string]bool{
+	"autofs": true, "binfmt_misc": true, "bpf": true, "cgroup": true, "cgroup2": true,
+	"configfs": true, "debugfs": true, "devpts": true, "devtmpfs": true, "efivarfs": true,
+	"fuse.lxcfs": true, "fusectl": true, "hugetlbfs": true, "mqueue": true, "nsfs": true,
+	"overlay": true, "proc": true, "pstore": true, "ramfs": true, "rpc_pipefs": true,
+	"securityfs": true, "selinuxfs": true, "squashfs": true, "sysfs": true, "tmpfs": true,
+	"tracefs": true,
+}
+
+// HostCPU is utilization over the last interval in percent. Cores follow
+// the kernel's CPU numbering.
+type HostCPU struct {
+	Percent       float64   `json:"percent"`
+	IOWaitPercent float64   `json:"iowaitPercent"`
+	StealPercent  float64   `json:"stealPercent"`
+	Cores         []float64 `json:"cores"`
+}
+
+type HostLoad struct {
+	Load1  float64 `json:"load1"`
+	Load5  float64 `json:"load5"`
+	Load15 float64 `json:"load15"`
+}
+
+// HostMemory is in bytes. Used excludes reclaimable caches.
+type HostMemory struct {
+	TotalBytes     uint64 `json:"totalBytes"`
+	UsedBytes      uint64 `json:"usedBytes"`
+	AvailableBytes uint64 `json:"availableBytes"`
+	FreeBytes      uint64 `json:"freeBytes"`
+	BuffersBytes   uint64 `json:"buffersBytes"`
+	CachedBytes    uint64 `json:"cachedBytes"`
+	SwapTotalBytes uint64 `json:"swapTotalBytes"`
+	SwapUsedBytes  uint64 `json:"swapUsedBytes"`
+}
+
+type HostDiskUsage struct {
+	Mountpoint     string  `json:"mountpoint"`
+	Device         string  `json:"device"`
+	FSType         string  `json:"fsType"`
+	TotalBytes     uint64  `json:"totalBytes"`
+	UsedBytes      uint64  `json:"usedBytes"`
+	AvailableBytes uint64  `json:"availableBytes"`
+	UsedPercent    float64 `json:"usedPercent"`
+	InodesTotal    uint64  `json:"inodesTotal"`
+	InodesUsed     uint64  `json:"inodesUsed"`
+}
+
+// HostDiskIO is the throughput of a whole block device over the last
+// interval. Util is the share of the interval the device was busy.
+type HostDiskIO struct {
+	Device           string  `json:"device"`
+	ReadBytesPerSec  float64 `json:"readBytesPerSec"`
+	WriteBytesPerSec float64 `json:"writeBytesPerSec"`
+	ReadOpsPerSec    float64 `json:"readOpsPerSec"`
+	WriteOpsPerSec   float64 `json:"writeOpsPerSec"`
+	UtilPercent      float64 `json:"utilPercent"`
+}
+
+// HostNetwork is the throughput of an interface over the last interval.
+// Errors and drops count those seen during the interval.
+type HostNetwork struct {
+	Interface       string  `json:"interface"`
+	RxBytesPerSec   float64 `json:"rxBytesPerSec"`
+	TxBytesPerSec   float64 `json:"txBytesPerSec"`
+	RxPacketsPerSec float64 `json:"rxPacketsPerSec"`
+	TxPacketsPerSec float64 `json:"txPacketsPerSec"`
+	RxErrors        uint64  `json:"rxErrors"`
+	TxErrors        uint64  `json:"txErrors"`
+	RxDropped       uint64  `json:"rxDropped"`
+	TxDropped       uint64  `json:"txDropped"`
+}
+
+// HostMetricsPayload is the payload of host.metrics events.
+type HostMetricsPayload struct {
+	IntervalMs int64           `json:"intervalMs"`
+	CPU        HostCPU         `json:"cpu"`
+	Load       HostLoad        `json:"load"`
+	Memory     HostMemory      `json:"memory"`
+	Disks      []HostDiskUsage `json:"disks"`
+	DiskIO     []HostDiskIO    `json:"diskIo"`
+	Network    []HostNetwork   `json:"network"`
+}
+
+// cpuTimes are the jiffies of one /proc/stat cpu line.
+type cpuTimes struct {
+	total  uint64
+	idle   uint64
+	iowait uint64
+	steal  uint64
+}
+
+type diskCounters struct {
+	reads        uint64
+	sectorsRead  uint64
+	writes       uint64
+	sectorsWrite uint64
+	ioMillis     uint64
+}
+
+type netCounters struct {
+	rxBytes   uint64
+	rxPackets uint64
+	rxErrors  uint64
+	rxDropped uint64
+	txBytes   uint64
+	txPackets uint64
+	txErrors  uint64
+	txDropped uint64
+}
+
+// hostCounters are the cumulative counters rates are computed from.
+type hostCounters struct {
+	at    time.Time
+	cpu   cpuTimes
+	cores []cpuTimes
+	disks map[string]diskCounters
+	nets  map[string]netCounters
+}
+
+// hostSampler turns consecutive counter readings into rates. It is only
+// used from the metrics goroutine.
+type hostSampler struct {
+	root string
+	prev *hostCounters
+}
+
+// sample reads the host once. The first call only records counters and
+// returns nil.
+func (s *hostSampler) sample(now time.Time) (*HostMetricsPayload, error) {
+	counters, err := readHostCounters(s.root, now)
+	if err != nil {
+		return nil, err
+	}
+
+	prev := s.prev
+	s.prev = &counters
+	if prev == nil {
+		return nil, nil
+	}
+
+	payload := hostRates(*prev, counters)
+
+	var errs []error
+	if payload.Load, err = readLoadavg(filepath.Join(s.root, "proc/loadavg")); err != nil {
+		errs = append(errs, err)
+	}
+	if payload.Memory, err = readHostMemory(filepath.Join(s.root, "proc/meminfo")); err != nil {
+		errs = append(errs, err)
+	}
+	if payload.Disks, err = readDiskUsage(s.root); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return &payload, fmt.Errorf("read host metrics: %w", err)
+	}
+
+	return &payload, nil
+}
+
+// runHostMetrics sends host.metrics every interval, starting one interval
+// after Run since rates need two readings.
+func (a *Agent) runHostMetrics(ctx context.Context, interval time.Duration) {
+	sampler := &hostSampler{root: a.hostRoot}
+	sample := func() {
+		payload, err := sampler.sample(time.Now())
+		if err != nil {
+			a.emitError(ctx, err)
+		}
+		if payload == nil {
+			return
+		}
+
+		a.emitEvent(ctx, Event{
+			Type: hostMetricsEventType,
+			TS:   time.Now(),
+			Data: *payload,
+			Key:  hostMetricsEventType,
+		})
+	}
+	sample()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sample()
+		}
+	}
+}
+
+func readHostCounters(root string, now time.Time) (hostCounters, error) {
+	counters := hostCounters{at: now}
+
+	var err error
+	if counters.cpu, counters.cores, err = readProcStat(filepath.Join(root, "proc/stat")); err != nil {
+		return counters, fmt.Errorf("read host metrics: %w", err)
+	}
+
+	// Network devices and mounts are per namespace; pid 1's are the host's
+	// even when the agent runs in a container.
+	if counters.disks, err = readDiskstats(root); err != nil {
+		return counters, fmt.Errorf("read host metrics: %w", err)
+	}
+	if counters.nets, err = readNetDev(hostProcPath(root, "net/dev")); err != nil {
+		return counters, fmt.Errorf("read host metrics: %w", err)
+	}
+
+	return counters, nil
+}
+
+// hostProcPath prefers the view of pid 1 and falls back to the agent's own
+// when pid 1 is not visible.
+func hostProcPath(root string, name string) string {
+	path := filepath.Join(root, "proc/1", name)
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+
+	return filepath.Join(root, "proc", name)
+}
+
+func hostRates(prev hostCounters, cur hostCounters) HostMetricsPayload {
+	elapsed := cur.at.Sub(prev.at)
+	seconds := elapsed.Seconds()
+	if seconds <= 0 {
+		seconds = 1
+	}
+
+	payload := HostMetricsPayload{
+		IntervalMs: elapsed.Milliseconds(),
+		Disks:      []HostDiskUsage{},
+		DiskIO:     []HostDiskIO{},
+		Network:    []HostNetwork{},
+	}
+
+	payload.CPU = cpuUsage(prev.cpu, cur.cpu)
+	payload.CPU.Cores = make([]float64, 0, len(cur.cores))
+	for i, core := range cur.cores {
+		var before cpuTimes
+		if i < len(prev.cores) {
+			before = prev.cores[i]
+		}
+		payload.CPU.Cores = append(payload.CPU.Cores, cpuUsage(before, core).Percent)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(cur.disks)) {
+		before, ok := prev.disks[name]
+		if !ok {
+			continue
+		}
+		after := cur.disks[name]
+		payload.DiskIO = append(payload.DiskIO, HostDiskIO{
+			Device:           name,
+			ReadBytesPerSec:  round2(float64(delta(before.sectorsRead, after.sectorsRead)*diskSectorSize) / seconds),
+			WriteBytesPerSec: round2(float64(delta(before.sectorsWrite, after.sectorsWrite)*diskSectorSize) / seconds),
+			ReadOpsPerSec:    round2(float64(delta(before.reads, after.reads)) / seconds),
+			WriteOpsPerSec:   round2(float64(delta(before.writes, after.writes)) / seconds),
+			UtilPercent:      round2(min(100, float64(delta(before.ioMillis, after.ioMillis))/(seconds*10))),
+		})
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(cur.nets)) {
+		before, ok := prev.nets[name]
+		if !ok {
+			continue
+		}
+		after := cur.nets[name]
+		payload.Network = append(payload.Network, HostNetwork{
+			Interface:       name,
+			RxBytesPerSec:   round2(float64(delta(before.rxBytes, after.rxBytes)) / seconds),
+			TxBytesPerSec:   round2(float64(delta(before.txBytes, after.txBytes)) / seconds),
+			RxPacketsPerSec: round2(float64(delta(before.rxPackets, after.rxPackets)) / seconds),
+			TxPacketsPerSec: round2(float64(delta(before.txPackets, after.txPackets)) / seconds),
+			RxErrors:        delta(before.rxErrors, after.rxErrors),
+			TxErrors:        delta(before.txErrors, after.txErrors),
+			RxDropped:       delta(before.rxDropped, after.rxDropped),
+			TxDropped:       delta(before.txDropped, after.txDropped),
+		})
+	}
+
+	return payload
+}
+
+func cpuUsage(prev cpuTimes, cur cpuTimes) HostCPU {
+	total := delta(prev.total, cur.total)
+	if total == 0 {
+		return HostCPU{}
+	}
+
+	percent := func(value uint64) float64 {
+		return round2(float64(value) / float64(total) * 100)
+	}
+
+	return HostCPU{
+		Percent:       percent(total - min(total, delta(prev.idle, cur.idle))),
+		IOWaitPercent: percent(delta(prev.iowait, cur.iowait)),
+		StealPercent:  percent(delta(prev.steal, cur.steal)),
+	}
+}
+
+// delta treats a counter that went backwards, e.g. a recreated interface,
+// as unchanged.
+func delta(prev uint64, cur uint64) uint64 {
+	if cur < prev {
+		return 0
+	}
+
+	return cur - prev
+}
+
+func round2(value float64) float64 {
+	return math.Round(value*100) / 100
+}
+
+// readProcStat returns the aggregate and per-core CPU times. Idle includes
+// iowait; guest time is already part of user time and not added again.
+func readProcStat(path string) (cpuTimes, []cpuTimes, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return cpuTimes{}, nil, err
+	}
+	defer file.Close()
+
+	var aggregate cpuTimes
+	var cores []cpuTimes
+	found := false
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+
+		var values [8]uint64
+		for i := 1; i < len(fields) && i <= len(values); i++ {
+			value, err := strconv.ParseUint(fields[i], 10, 64)
+			if err != nil {
+				return cpuTimes{}, nil, fmt.Errorf("parse %s: %w", path, err)
+			}
+			values[i-1] = value
+		}
+
+		times := cpuTimes{
+			idle:   values[3] + values[4],
+			iowait: values[4],
+			steal:  values[7],
+		}
+		for _, value := range values {
+			times.total += value
+		}
+
+		if fields[0] == "cpu" {
+			aggregate = times
+			found = true
+		} else {
+			cores = append(cores, times)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return cpuTimes{}, nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	if !found {
+		return cpuTimes{}, nil, fmt.Errorf("parse %s: no cpu line", path)
+	}
+
+	return aggregate, cores, nil
+}
+
+func readLoadavg(path string) (HostLoad, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return HostLoad{}, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return HostLoad{}, fmt.Errorf("parse %s: %q", path, data)
+	}
+
+	var loads [3]float64
+	for i := range loads {
+		if loads[i], err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return HostLoad{}, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+
+	return HostLoad{Load1: loads[0], Load5: loads[1], Load15: loads[2]}, nil
+}
+
+func readHostMemory(path string) (HostMemory, error) {
+	values, err := readMeminfo(path)
+	if err != nil {
+		return HostMemory{}, err
+	}
+
+	total := values["MemTotal"]
+	available, ok := values["MemAvailable"]
+	if !ok {
+		// Kernels before 3.14 lack MemAvailable.
+		available = values["MemFree"] + values["Buffers"] + values["Cached"]
+	}
+
+	return HostMemory{
+		TotalBytes:     total,
+		UsedBytes:      total - min(total, available),
+		AvailableBytes: available,
+		FreeBytes:      values["MemFree"],
+		BuffersBytes:   values["Buffers"],
+		CachedBytes:    values["Cached"],
+		SwapTotalBytes: values["SwapTotal"],
+		SwapUsedBytes:  values["SwapTotal"] - min(values["SwapTotal"], values["SwapFree"]),
+	}, nil
+}
+
+// readDiskstats returns counters of whole block devices, those listed in
+// /sys/block, leaving out partitions, loop and ram devices.
+func readDiskstats(root string) (map[string]diskCounters, error) {
+	path := filepath.Join(root, "proc/diskstats")
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	devices := map[string]bool{}
+	if entries, err := os.ReadDir(filepath.Join(root, "sys/block")); err == nil {
+		for _, entry := range entries {
+			devices[entry.Name()] = true
+		}
+	}
+
+	disks := map[string]diskCounters{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 14 {
+			continue
+		}
+
+		name := fields[2]
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") {
+			continue
+		}
+		if len(devices) > 0 && !devices[name] {
+			continue
+		}
+
+		var values [11]uint64
+		for i := range values {
+			if values[i], err = strconv.ParseUint(fields[3+i], 10, 64); err != nil {
+				return nil, fmt.Errorf("parse %s: %w", path, err)
+			}
+		}
+
+		disks[name] = diskCounters{
+			reads:        values[0],
+			sectorsRead:  values[2],
+			writes:       values[4],
+			sectorsWrite: values[6],
+			ioMillis:     values[9],
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	return disks, nil
+}
+
+// readNetDev returns interface counters, leaving out loopback and the veth
+// halves Docker creates per container.
+func readNetDev(path string) (map[string]netCounters, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	nets := map[string]netCounters{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		name, rest, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+
+		name = strings.TrimSpace(name)
+		if name == "lo" || strings.HasPrefix(name, "veth") {
+			continue
+		}
+
+		fields := strings.Fields(rest)
+		if len(fields) < 16 {
+			continue
+		}
+
+		var values [16]uint64
+		for i := range values {
+			if values[i], err = strconv.ParseUint(fields[i], 10, 64); err != nil {
+				return nil, fmt.Errorf("parse %s: %w", path, err)
+			}
+		}
+
+		nets[name] = netCounters{
+			rxBytes:   values[0],
+			rxPackets: values[1],
+			rxErrors:  values[2],
+			rxDropped: values[3],
+			txBytes:   values[8],
+			txPackets: values[9],
+			txErrors:  values[10],
+			txDropped: values[11],
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	return nets, nil
+}
+
+type hostMount struct {
+	device     string
+	mountpoint string
+	fsType     string
+}
+
+// readMounts returns real filesystems, one mount per device. A device
+// mounted several times, as with bind mounts, is reported at its shortest
+// mountpoint.
+func readMounts(path string) ([]hostMount, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	byDevice := map[string]hostMount{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || pseudoFilesystems[fields[2]] {
+			continue
+		}
+
+		mount := hostMount{
+			device:     unescapeMountField(fields[0]),
+			mountpoint: unescapeMountField(fields[1]),
+			fsType:     fields[2],
+		}
+		if existing, ok := byDevice[mount.device]; ok && len(existing.mountpoint) <= len(mount.mountpoint) {
+			continue
+		}
+		byDevice[mount.device] = mount
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	mounts := make([]hostMount, 0, len(byDevice))
+	for _, mount := range byDevice {
+		mounts = append(mounts, mount)
+	}
+	slices.SortFunc(mounts, func(a, b hostMount) int {
+		return strings.Compare(a.mountpoint, b.mountpoint)
+	})
+
+	return mounts, nil
+}
+
+// unescapeMountField decodes the octal escapes (\040 for a space) the
+// kernel uses in mount tables.
+func unescapeMountField(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+3 < len(value) {
+			if code, err := strconv.ParseUint(value[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(code))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(value[i])
+	}
+
+	return b.String()
+}
+
+// readDiskUsage reports usage of every real mount. Mounts the agent cannot
+// see under root, e.g. when only part of the host is mounted in, are left
+// out.
+func readDiskUsage(root string) ([]HostDiskUsage, error) {
+	mounts, err := readMounts(hostProcPath(root, "mounts"))
+	if err != nil {
+		return []HostDiskUsage{}, err
+	}
+
+	disks := make([]HostDiskUsage, 0, len(mounts))
+	for _, mount := range mounts {
+		usage, err := statFilesystem(filepath.Join(root, mount.mountpoint))
+		if err != nil {
+			continue
+		}
+
+		usage.Mountpoint = mount.mountpoint
+		usage.Device = mount.device
+		usage.FSType = mount.fsType
+		disks = append(disks, usage)
+	}
+
+	return disks, nil
+}
@@ -0,0 +1,191 @@
+package agent
+
+import (
+	"context"
+	"maps"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestReadHostMetricFiles(t *testing.T) {
+	t.Run("proc stat", func(t *testing.T) {
+		aggregate, cores, err := readProcStat("testdata/host/proc/stat")
+		if err != nil {
+			t.Fatalf("readProcStat() unexpected error: %v", err)
+		}
+		if aggregate != (cpuTimes{total: 95000, idle: 81000, iowait: 1000, steal: 300}) {
+			t.Fatalf("aggregate = %+v", aggregate)
+		}
+		if len(cores) != 2 || cores[0].total != 47500 {
+			t.Fatalf("cores = %+v", cores)
+		}
+	})
+
+	t.Run("loadavg", func(t *testing.T) {
+		load, err := readLoadavg("testdata/host/proc/loadavg")
+		if err != nil {
+			t.Fatalf("readLoadavg() unexpected error: %v", err)
+		}
+		if load != (HostLoad{Load1: 0.52, Load5: 0.61, Load15: 0.70}) {
+			t.Fatalf("load = %+v", load)
+		}
+	})
+
+	t.Run("meminfo", func(t *testing.T) {
+		memory, err := readHostMemory("testdata/host/proc/meminfo")
+		if err != nil {
+			t.Fatalf("readHostMemory() unexpected error: %v", err)
+		}
+		if memory.TotalBytes != 8039556<<10 || memory.AvailableBytes != 5123456<<10 {
+			t.Fatalf("memory = %+v", memory)
+		}
+		if memory.UsedBytes != (8039556-5123456)<<10 || memory.SwapUsedBytes != 1048574<<10 {
+			t.Fatalf("memory used = %d, swap used = %d", memory.UsedBytes, memory.SwapUsedBytes)
+		}
+	})
+
+	t.Run("diskstats keeps whole devices", func(t *testing.T) {
+		disks, err := readDiskstats("testdata/host")
+		if err != nil {
+			t.Fatalf("readDiskstats() unexpected error: %v", err)
+		}
+		if names := slices.Sorted(maps.Keys(disks)); !slices.Equal(names, []string{"nvme0n1", "sda"}) {
+			t.Fatalf("devices = %v", names)
+		}
+		if disks["nvme0n1"] != (diskCounters{reads: 20000, sectorsRead: 4000000, writes: 10000, sectorsWrite: 2000000, ioMillis: 15000}) {
+			t.Fatalf("nvme0n1 = %+v", disks["nvme0n1"])
+		}
+	})
+
+	t.Run("net dev skips loopback and veth", func(t *testing.T) {
+		nets, err := readNetDev(hostProcPath("testdata/host", "net/dev"))
+		if err != nil {
+			t.Fatalf("readNetDev() unexpected error: %v", err)
+		}
+		if names := slices.Sorted(maps.Keys(nets)); !slices.Equal(names, []string{"docker0", "eth0"}) {
+			t.Fatalf("interfaces = %v", names)
+		}
+		if eth0 := nets["eth0"]; eth0.rxBytes != 9000000000 || eth0.txPackets != 4000000 || eth0.rxDropped != 2 {
+			t.Fatalf("eth0 = %+v", eth0)
+		}
+	})
+
+	t.Run("mounts keep real filesystems once", func(t *testing.T) {
+		mounts, err := readMounts(hostProcPath("testdata/host", "mounts"))
+		if err != nil {
+			t.Fatalf("readMounts() unexpected error: %v", err)
+		}
+
+		want := []hostMount{
+			{device: "/dev/nvme0n1p1", mountpoint: "/", fsType: "ext4"},
+			{device: "/dev/sda", mountpoint: "/mnt/backup disk", fsType: "xfs"},
+		}
+		if !slices.Equal(mounts, want) {
+			t.Fatalf("mounts = %+v", mounts)
+		}
+	})
+
+	t.Run("disk usage leaves out mounts not visible under root", func(t *testing.T) {
+		disks, err := readDiskUsage("testdata/host")
+		if err != nil {
+			t.Fatalf("readDiskUsage() unexpected error: %v", err)
+		}
+		if len(disks) != 1 || disks[0].Mountpoint != "/" || disks[0].Device != "/dev/nvme0n1p1" {
+			t.Fatalf("disks = %+v", disks)
+		}
+		if disks[0].TotalBytes == 0 || disks[0].UsedPercent < 0 || disks[0].UsedPercent > 100 {
+			t.Fatalf("root usage = %+v", disks[0])
+		}
+	})
+}
+
+func TestHostSampler(t *testing.T) {
+	root := t.TempDir()
+	if err := os.CopyFS(root, os.DirFS("testdata/host")); err != nil {
+		t.Fatal(err)
+	}
+	sampler := &hostSampler{root: root}
+	start := time.Unix(1767225600, 0)
+
+	payload, err := sampler.sample(start)
+	if err != nil || payload != nil {
+		t.Fatalf("first sample() = %+v, %v, want only counters", payload, err)
+	}
+
+	writeTestFiles(t, root, map[string]string{
+		"proc/stat": "cpu  10900 500 3300 80600 1100 0 200 400 0 0\n" +
+			"cpu0 5600 250 1600 40300 550 0 100 200 0 0\n" +
+			"cpu1 5300 250 1700 40300 550 0 100 200 0 0\n",
+		"proc/diskstats": " 259 0 nvme0n1 21000 100 4020480 9000 10500 500 2040960 12000 0 20000 21000 0 0 0 0 0 0\n" +
+			"   8 0 sda 500 0 80000 300 200 0 40000 400 0 600 700 0 0 0 0 0 0\n",
+		// docker0 was recreated, so its counters restarted.
+		"proc/1/net/dev": "Inter-| Receive | Transmit\n face |bytes packets|bytes packets\n" +
+			"  eth0: 9010000000 6008000 2 2 0 0 0 0 3005000000 4004000 0 0 0 0 0 0\n" +
+			"docker0: 500 5 0 0 0 0 0 0 600 6 0 0 0 0 0 0\n",
+	})
+
+	payload, err = sampler.sample(start.Add(10 * time.Second))
+	if err != nil {
+		t.Fatalf("sample() unexpected error: %v", err)
+	}
+
+	if payload.IntervalMs != 10000 {
+		t.Fatalf("interval = %d", payload.IntervalMs)
+	}
+	if cpu := payload.CPU; cpu.Percent != 65 || cpu.IOWaitPercent != 5 || cpu.StealPercent != 5 {
+		t.Fatalf("cpu = %+v", cpu)
+	}
+	if !slices.Equal(payload.CPU.Cores, []float64{68.18, 61.11}) {
+		t.Fatalf("cores = %v", payload.CPU.Cores)
+	}
+
+	want := []HostDiskIO{
+		{Device: "nvme0n1", ReadBytesPerSec: 1 << 20, WriteBytesPerSec: 2 << 20, ReadOpsPerSec: 100, WriteOpsPerSec: 50, UtilPercent: 50},
+		{Device: "sda"},
+	}
+	if !slices.Equal(payload.DiskIO, want) {
+		t.Fatalf("disk io = %+v", payload.DiskIO)
+	}
+
+	if len(payload.Network) != 2 {
+		t.Fatalf("network = %+v", payload.Network)
+	}
+	docker0, eth0 := payload.Network[0], payload.Network[1]
+	if eth0.RxBytesPerSec != 1e6 || eth0.TxBytesPerSec != 5e5 || eth0.RxPacketsPerSec != 800 || eth0.RxErrors != 1 {
+		t.Fatalf("eth0 = %+v", eth0)
+	}
+	if docker0 != (HostNetwork{Interface: "docker0"}) {
+		t.Fatalf("docker0 after a counter reset = %+v", docker0)
+	}
+
+	if payload.Load.Load1 != 0.52 || payload.Memory.TotalBytes == 0 || len(payload.Disks) != 1 {
+		t.Fatalf("load = %+v, memory = %+v, disks = %+v", payload.Load, payload.Memory, payload.Disks)
+	}
+}
+
+func TestRunHostMetrics(t *testing.T) {
+	a := newAgent(newFakeDocker(1, 0), snapshotOptions{Workers: 1, CallTimeout: time.Second, Timeout: time.Second}, eventOptions{})
+	a.hostRoot = "testdata/host"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		a.runHostMetrics(ctx, 10*time.Millisecond)
+	}()
+
+	// The first tick only records counters, so an event means a second sample.
+	event := nextEvent(t, a, time.Second)
+	if event.Type != hostMetricsEventType || event.Key != hostMetricsEventType {
+		t.Fatalf("event = %q key %q", event.Type, event.Key)
+	}
+	if payload := event.Data.(HostMetricsPayload); payload.IntervalMs <= 0 || payload.Memory.TotalBytes == 0 {
+		t.Fatalf("payload = %+v", payload)
+	}
+}
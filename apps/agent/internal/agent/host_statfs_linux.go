@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// statFilesystem reports usage the way df does: used is what is neither
+// free nor reserved for root, and the percentage is of what users can fill.
+func statFilesystem(path string) (HostDiskUsage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return HostDiskUsage{}, fmt.Errorf("statfs %s: %w", path, err)
+	}
+
+	size := uint64(stat.Frsize)
+	if size == 0 {
+		size = uint64(stat.Bsize)
+	}
+
+	total := stat.Blocks * size
+	free := stat.Bfree * size
+	available := stat.Bavail * size
+	used := total - free
+
+	var percent float64
+	if used+available > 0 {
+		percent = round2(float64(used) / float64(used+available) * 100)
+	}
+
+	return HostDiskUsage{
+		TotalBytes:     total,
+		UsedBytes:      used,
+		AvailableBytes: available,
+		UsedPercent:    percent,
+		InodesTotal:    stat.Files,
+		InodesUsed:     stat.Files - stat.Ffree,
+	}, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+)
+
+// statFilesystem is only implemented on Linux, the only platform the agent
+// reads host metrics on.
+func statFilesystem(path string) (HostDiskUsage, error) {
+	return HostDiskUsage{}, fmt.Errorf("statfs %s: %w", path, errors.ErrUnsupported)
+}
@@ -0,0 +1,171 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestHostChanged(t *testing.T) {
+	prev := HostPayload{Host: HostFacts{Kernel: "6.8.0", UptimeSeconds: 100, BootTime: 1767225600}}
+
+	tests := []struct {
+		name string
+		edit func(*HostPayload)
+		want bool
+	}{
+		{"uptime ticks", func(p *HostPayload) { p.Host.UptimeSeconds += 300 }, false},
+		{"boot time jitters", func(p *HostPayload) { p.Host.BootTime-- }, false},
+		{"rebooted", func(p *HostPayload) { p.Host.BootTime += 3600 }, true},
+		{"kernel upgraded", func(p *HostPayload) { p.Host.Kernel = "6.8.1" }, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			next := prev
+			tc.edit(&next)
+			if got := hostChanged(prev, next); got != tc.want {
+				t.Fatalf("hostChanged() = %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReadHostFacts(t *testing.T) {
+	now := time.Unix(1767225600, 0)
+
+	facts, err := readHostFacts("testdata/host", now)
+	if err != nil {
+		t.Fatalf("readHostFacts() unexpected error: %v", err)
+	}
+
+	if facts.Hostname != "ip-172-31-8-21" {
+		t.Fatalf("hostname = %q", facts.Hostname)
+	}
+	if facts.Kernel != "6.8.0-1021-aws" {
+		t.Fatalf("kernel = %q", facts.Kernel)
+	}
+	if facts.OS != "Ubuntu 24.04.1 LTS" || facts.OSID != "ubuntu" || facts.OSVersion != "24.04" {
+		t.Fatalf("os = %q (%s %s)", facts.OS, facts.OSID, facts.OSVersion)
+	}
+	if facts.CPUs != 2 || facts.CPUModel != "Intel(R) Xeon(R) Platinum 8259CL CPU @ 2.50GHz" {
+		t.Fatalf("cpus = %d %q", facts.CPUs, facts.CPUModel)
+	}
+	if facts.MemoryBytes != 8039556*1024 {
+		t.Fatalf("memory = %d", facts.MemoryBytes)
+	}
+	if facts.UptimeSeconds != 93784 || facts.BootTime != now.Unix()-93785 {
+		t.Fatalf("uptime = %d, boot time = %d", facts.UptimeSeconds, facts.BootTime)
+	}
+
+	t.Run("arm cpuinfo has a machine-wide model", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "cpuinfo")
+		cpuinfo := "processor\t: 0\nBogoMIPS\t: 108.00\n\nprocessor\t: 1\nBogoMIPS\t: 108.00\n\n" +
+			"Hardware\t: BCM2835\nModel\t\t: Raspberry Pi 4 Model B Rev 1.4\n"
+		if err := os.WriteFile(path, []byte(cpuinfo), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		count, model, err := readCPUInfo(path)
+		if err != nil {
+			t.Fatalf("readCPUInfo() unexpected error: %v", err)
+		}
+		if count != 2 || model != "Raspberry Pi 4 Model B Rev 1.4" {
+			t.Fatalf("readCPUInfo() = %d, %q", count, model)
+		}
+	})
+
+	t.Run("reports missing proc files", func(t *testing.T) {
+		root := t.TempDir()
+		writeTestFiles(t, root, map[string]string{"etc/hostname": "web-1\n"})
+
+		facts, err := readHostFacts(root, now)
+		if err == nil {
+			t.Fatal("readHostFacts() expected error for an empty proc")
+		}
+		if facts.Hostname != "web-1" {
+			t.Fatalf("hostname = %q, want the /etc/hostname fallback", facts.Hostname)
+		}
+	})
+}
+
+func TestRunHost(t *testing.T) {
+	docker := newFakeDocker(1, 0)
+	a := newAgent(docker, snapshotOptions{Workers: 1, CallTimeout: time.Second, Timeout: time.Second}, eventOptions{})
+	a.hostRoot = "testdata/host"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		a.runHost(ctx, 10*time.Millisecond)
+	}()
+
+	event := nextEvent(t, a, time.Second)
+	if event.Type != hostEventType || event.Key != hostEventType {
+		t.Fatalf("event = %q key %q", event.Type, event.Key)
+	}
+
+	payload := event.Data.(HostPayload)
+	engine := payload.Engine
+	if engine == nil || engine.Version != "28.5.2" || engine.APIVersion != "1.51" || engine.StorageDriver != "overlay2" {
+		t.Fatalf("engine = %+v", engine)
+	}
+	if engine.CgroupDriver != "systemd" || engine.CgroupVersion != "2" || len(engine.SecurityOptions) != 3 {
+		t.Fatalf("engine cgroup and security = %+v", engine)
+	}
+	if !slices.Equal(engine.Runtimes, []string{"io.containerd.runc.v2", "runc"}) || engine.DefaultRuntime != "runc" {
+		t.Fatalf("engine runtimes = %v (default %q)", engine.Runtimes, engine.DefaultRuntime)
+	}
+	if !slices.Equal(engine.RegistryMirrors, []string{"https://mirror.example.com/"}) {
+		t.Fatalf("engine mirrors = %v", engine.RegistryMirrors)
+	}
+	if payload.Host.CPUs != 2 {
+		t.Fatalf("host = %+v", payload.Host)
+	}
+
+	t.Run("nothing changed, nothing sent", func(t *testing.T) {
+		select {
+		case event := <-a.Events():
+			t.Fatalf("unexpected %s event without changes", event.Type)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+
+	t.Run("an engine upgrade is sent", func(t *testing.T) {
+		docker.mu.Lock()
+		docker.version.Version = "28.5.3"
+		docker.mu.Unlock()
+
+		event := nextEvent(t, a, time.Second)
+		if version := event.Data.(HostPayload).Engine.Version; version != "28.5.3" {
+			t.Fatalf("engine version = %q", version)
+		}
+	})
+
+	t.Run("refresh sends unchanged facts", func(t *testing.T) {
+		a.RefreshHost()
+
+		event := nextEvent(t, a, time.Second)
+		if event.Type != hostEventType {
+			t.Fatalf("event = %q", event.Type)
+		}
+	})
+
+	t.Run("engine is omitted while docker is down", func(t *testing.T) {
+		a.dockerDown.Store(true)
+		t.Cleanup(func() { a.dockerDown.Store(false) })
+
+		event := nextEvent(t, a, time.Second)
+		if engine := event.Data.(HostPayload).Engine; engine != nil {
+			t.Fatalf("engine = %+v while docker is down", engine)
+		}
+	})
+}
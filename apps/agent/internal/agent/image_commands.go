@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+)
+
+var (
+	ErrImageNotFound = newKindError("image_not_found", "image not found")
+	ErrImageInUse    = newKindError("image_in_use", "image in use")
+)
+
+// RemoveImage removes an image by ID or reference and returns the
+// references untagged and the image and layer IDs deleted. A reference to
+// an image with other tags only untags it. Otherwise containers using the
+// image block the removal unless force is set, in which case they are
+// removed first, as the API does. Parent layers no other image uses are
+// kept with noPrune.
+func (a *Agent) RemoveImage(ctx context.Context, ref string, force bool, noPrune bool) ([]string, []string, error) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return nil, nil, errors.New("image reference is required")
+	}
+
+	info, _, err := a.cli.ImageInspectWithRaw(ctx, ref)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return nil, nil, fmt.Errorf("%w: %q", ErrImageNotFound, ref)
+		}
+
+		return nil, nil, fmt.Errorf("docker inspect image: %w", err)
+	}
+
+	if !untagsOnly(ref, info.RepoTags) {
+		// Bypass the cache so a container created moments ago counts.
+		containers, err := a.fetchContainerList(ctx, "")
+		if err != nil {
+			return nil, nil, fmt.Errorf("docker list containers: %w", err)
+		}
+
+		if err := a.releaseImage(ctx, ref, containersForImage(info.ID, containers), force); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	response, err := a.cli.ImageRemove(ctx, ref, image.RemoveOptions{Force: force, PruneChildren: !noPrune})
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return nil, nil, fmt.Errorf("%w: %q", ErrImageNotFound, ref)
+		}
+		if errdefs.IsConflict(err) {
+			return nil, nil, fmt.Errorf("%w: %q: %w", ErrImageInUse, ref, err)
+		}
+
+		return nil, nil, fmt.Errorf("docker remove image: %w", err)
+	}
+
+	untagged, deleted := []string{}, []string{}
+	for _, item := range response {
+		if item.Untagged != "" {
+			untagged = append(untagged, item.Untagged)
+		}
+		if item.Deleted != "" {
+			deleted = append(deleted, item.Deleted)
+		}
+	}
+
+	return untagged, deleted, nil
+}
+
+// releaseImage fails when containers use the image, or removes them with
+// force.
+func (a *Agent) releaseImage(ctx context.Context, ref string, users []ImageContainer, force bool) error {
+	if len(users) == 0 {
+		return nil
+	}
+
+	if !force {
+		names := make([]string, 0, len(users))
+		for _, user := range users {
+			names = append(names, user.Name)
+		}
+
+		return fmt.Errorf(
+			"%w: %q is used by %d containers: %s",
+			ErrImageInUse,
+			ref,
+			len(names),
+			strings.Join(names, ", "),
+		)
+	}
+
+	for _, user := range users {
+		if err := a.cli.ContainerRemove(ctx, user.ID, container.RemoveOptions{Force: true}); err != nil {
+			return fmt.Errorf("docker remove container %s using %q: %w", user.ID, ref, err)
+		}
+	}
+
+	return nil
+}
+
+// untagsOnly reports whether removing ref drops one of several tags and
+// leaves the image itself in place.
+func untagsOnly(ref string, repoTags []string) bool {
+	if len(repoTags) < 2 {
+		return false
+	}
+
+	return slices.ContainsFunc(repoTags, func(tag string) bool {
+		return tag == ref || tag == ref+":latest"
+	})
+}
@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/image"
+)
+
+func TestRemoveImage(t *testing.T) {
+	ctx := context.Background()
+	docker := newFakeDocker(2, 2)
+	docker.images = append(docker.images, image.Summary{ID: "sha256:multi", RepoTags: []string{"app:2", "app:two"}})
+	a := newAgent(docker, snapshotOptions{Workers: 1}, eventOptions{})
+	used, other := docker.images[0], docker.images[1]
+
+	t.Run("in use without force", func(t *testing.T) {
+		_, _, err := a.RemoveImage(ctx, used.ID, false, false)
+		if !errors.Is(err, ErrImageInUse) || !strings.Contains(err.Error(), "container-0") {
+			t.Fatalf("RemoveImage() error = %v, want ErrImageInUse naming container-0", err)
+		}
+		if docker.callCount("ImageRemove") != 0 {
+			t.Fatalf("ImageRemove() calls = %d, want 0", docker.callCount("ImageRemove"))
+		}
+	})
+
+	t.Run("untagging one of several tags ignores containers", func(t *testing.T) {
+		untagged, deleted, err := a.RemoveImage(ctx, "app:two", false, false)
+		if err != nil {
+			t.Fatalf("RemoveImage() unexpected error: %v", err)
+		}
+		if !slices.Equal(untagged, []string{"app:two"}) || len(deleted) != 0 {
+			t.Fatalf("RemoveImage() = %v, %v", untagged, deleted)
+		}
+	})
+
+	t.Run("force removes the containers first", func(t *testing.T) {
+		untagged, deleted, err := a.RemoveImage(ctx, used.ID, true, false)
+		if err != nil {
+			t.Fatalf("RemoveImage() unexpected error: %v", err)
+		}
+		if !slices.Equal(untagged, used.RepoTags) || !slices.Equal(deleted, []string{used.ID, used.ID + "-parent"}) {
+			t.Fatalf("RemoveImage() = %v, %v", untagged, deleted)
+		}
+		if docker.callCount("ContainerRemove") != 1 || len(docker.containers) != 1 {
+			t.Fatalf("ContainerRemove() calls = %d, containers left = %d", docker.callCount("ContainerRemove"), len(docker.containers))
+		}
+	})
+
+	t.Run("noPrune keeps parents", func(t *testing.T) {
+		_, deleted, err := a.RemoveImage(ctx, other.RepoTags[0], true, true)
+		if err != nil {
+			t.Fatalf("RemoveImage() unexpected error: %v", err)
+		}
+		if !slices.Equal(deleted, []string{other.ID}) {
+			t.Fatalf("deleted = %v", deleted)
+		}
+	})
+
+	t.Run("missing image", func(t *testing.T) {
+		_, _, err := a.RemoveImage(ctx, "missing:latest", false, false)
+		if !errors.Is(err, ErrImageNotFound) {
+			t.Fatalf("RemoveImage() error = %v, want ErrImageNotFound", err)
+		}
+	})
+}
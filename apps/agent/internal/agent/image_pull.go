@@ -0,0 +1,187 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+const imagePullEventPrefix = "image.pull"
+
+// imagePullProgressInterval spaces progress events of one layer. A layer
+// changing status, e.g. from downloading to extracting, is sent right away.
+var imagePullProgressInterval = 500 * time.Millisecond
+
+// ImagePullProgress is the state of one layer of a pull. Current and Total
+// are bytes of the current step and zero when Docker reports none.
+type ImagePullProgress struct {
+	CommandID string `json:"commandId"`
+	Reference string `json:"reference"`
+	Layer     string `json:"layer"`
+	Status    string `json:"status"`
+	Current   int64  `json:"current"`
+	Total     int64  `json:"total"`
+}
+
+// ImagePullResult ends a pull. Digest is the manifest digest the reference
+// resolved to.
+type ImagePullResult struct {
+	CommandID  string `json:"commandId"`
+	Reference  string `json:"reference"`
+	Digest     string `json:"digest,omitempty"`
+	ImageID    string `json:"imageId,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+	Error      string `json:"error,omitempty"`
+}
+
+// PullImage pulls reference, which starts with the registry host. Without
+// username and password, credentials come from the agent's Docker config.
+// It returns once the credentials are resolved; the pull runs in the
+// background and reports image.pull.progress per layer, then
+// image.pull.complete with the digest or image.pull.failed.
+func (a *Agent) PullImage(ctx context.Context, commandID string, reference string, username string, password string) error {
+	reference = strings.TrimSpace(reference)
+	if reference == "" {
+		return errors.New("image reference is required")
+	}
+
+	host, _, _ := strings.Cut(reference, "/")
+	auth, err := a.registryAuth(ctx, host, username, password)
+	if err != nil {
+		return err
+	}
+
+	a.transfers.Go(func() {
+		started := time.Now()
+		digest, imageID, err := a.pullImage(ctx, commandID, reference, auth)
+
+		result := ImagePullResult{
+			CommandID:  commandID,
+			Reference:  reference,
+			Digest:     digest,
+			ImageID:    imageID,
+			DurationMs: time.Since(started).Milliseconds(),
+		}
+		eventType := imagePullEventPrefix + ".complete"
+		if err != nil {
+			eventType = imagePullEventPrefix + ".failed"
+			result.Error = err.Error()
+		}
+
+		a.emitEvent(ctx, Event{Type: eventType, TS: time.Now(), Data: result})
+	})
+
+	return nil
+}
+
+func (a *Agent) pullImage(ctx context.Context, commandID string, reference string, auth string) (string, string, error) {
+	body, err := a.cli.ImagePull(ctx, reference, image.PullOptions{RegistryAuth: auth})
+	if err != nil {
+		return "", "", fmt.Errorf("docker pull %s: %w", reference, err)
+	}
+	defer body.Close()
+
+	digest, err := a.followImagePull(ctx, commandID, reference, body)
+	if err != nil {
+		return "", "", fmt.Errorf("docker pull %s: %w", reference, err)
+	}
+
+	info, _, err := a.cli.ImageInspectWithRaw(ctx, reference)
+	if err != nil {
+		return digest, "", fmt.Errorf("docker inspect image %s: %w", reference, err)
+	}
+	if digest == "" {
+		digest = repoDigest(reference, info.RepoDigests)
+	}
+
+	return digest, info.ID, nil
+}
+
+// followImagePull turns the JSON progress stream of a pull into progress
+// events and returns the digest Docker reports at the end. Registry errors
+// such as an unknown manifest arrive in the stream, not as an API error.
+func (a *Agent) followImagePull(ctx context.Context, commandID string, reference string, body io.Reader) (string, error) {
+	type layerState struct {
+		status   string
+		reported time.Time
+	}
+	layers := map[string]*layerState{}
+
+	var digest string
+	decoder := json.NewDecoder(body)
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := decoder.Decode(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				return digest, nil
+			}
+			return "", err
+		}
+
+		if msg.Error != nil {
+			return "", errors.New(msg.Error.Message)
+		}
+		if value, ok := strings.CutPrefix(msg.Status, "Digest: "); ok {
+			digest = strings.TrimSpace(value)
+			continue
+		}
+		// Messages without an ID are about the whole pull; "Pulling from"
+		// carries the tag as its ID.
+		if msg.ID == "" || strings.HasPrefix(msg.Status, "Pulling from ") {
+			continue
+		}
+
+		now := time.Now()
+		state, seen := layers[msg.ID]
+		if !seen {
+			state = &layerState{}
+			layers[msg.ID] = state
+		}
+		if seen && state.status == msg.Status && now.Sub(state.reported) < imagePullProgressInterval {
+			continue
+		}
+		state.status, state.reported = msg.Status, now
+
+		progress := ImagePullProgress{
+			CommandID: commandID,
+			Reference: reference,
+			Layer:     msg.ID,
+			Status:    msg.Status,
+		}
+		if msg.Progress != nil {
+			progress.Current, progress.Total = msg.Progress.Current, msg.Progress.Total
+		}
+		a.emitEvent(ctx, Event{
+			Type: imagePullEventPrefix + ".progress",
+			TS:   now,
+			Data: progress,
+			// Only the latest state of a layer is worth sending.
+			Key: imagePullEventPrefix + ".progress:" + commandID + ":" + msg.ID,
+		})
+	}
+}
+
+// repoDigest picks the digest of reference's repository from an image's
+// repo digests, which list one per repository the image was pulled from.
+func repoDigest(reference string, repoDigests []string) string {
+	repository := reference
+	if i := strings.LastIndex(reference, ":"); i > strings.LastIndex(reference, "/") {
+		repository = reference[:i]
+	}
+
+	for _, item := range repoDigests {
+		name, digest, ok := strings.Cut(item, "@")
+		if ok && (name == repository || strings.HasSuffix(repository, "/"+name)) {
+			return digest
+		}
+	}
+
+	return ""
+}
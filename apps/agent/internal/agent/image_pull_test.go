@@ -0,0 +1,152 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/registry"
+)
+
+const testPullStream = `{"status":"Pulling from library/nginx","id":"1.27"}
+{"status":"Pulling fs layer","progressDetail":{},"id":"a1b2c3"}
+{"status":"Already exists","progressDetail":{},"id":"d4e5f6"}
+{"status":"Downloading","progressDetail":{"current":1024,"total":4096},"id":"a1b2c3"}
+{"status":"Downloading","progressDetail":{"current":2048,"total":4096},"id":"a1b2c3"}
+{"status":"Downloading","progressDetail":{"current":4096,"total":4096},"id":"a1b2c3"}
+{"status":"Download complete","progressDetail":{},"id":"a1b2c3"}
+{"status":"Pull complete","progressDetail":{},"id":"a1b2c3"}
+{"status":"Digest: sha256:5e1f"}
+{"status":"Status: Downloaded newer image for nginx:1.27"}
+`
+
+// waitPull collects events until a pull ends and returns the progress
+// events and the result.
+func waitPull(t *testing.T, a *Agent) ([]Event, Event) {
+	t.Helper()
+
+	var progress []Event
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-a.events:
+			if event.Type == imagePullEventPrefix+".progress" {
+				progress = append(progress, event)
+				continue
+			}
+			a.transfers.Wait()
+			return progress, event
+		case err := <-a.errors:
+			t.Fatalf("unexpected agent error: %v", err)
+		case <-timeout:
+			t.Fatal("pull did not finish")
+		}
+	}
+}
+
+func newPullTestAgent(t *testing.T) (*Agent, *fakeDocker) {
+	t.Helper()
+
+	docker := newFakeDocker(0, 0)
+	docker.images = append(docker.images, image.Summary{
+		ID:          "sha256:nginx",
+		RepoTags:    []string{"docker.io/nginx:1.27"},
+		RepoDigests: []string{"nginx@sha256:5e1f"},
+	})
+	docker.pullStreams = map[string]string{"docker.io/nginx:1.27": testPullStream}
+
+	a := newAgent(docker, snapshotOptions{Workers: 1}, eventOptions{})
+	a.registryAuthFile = ""
+
+	return a, docker
+}
+
+func TestPullImage(t *testing.T) {
+	ctx := context.Background()
+	a, docker := newPullTestAgent(t)
+
+	if err := a.PullImage(ctx, "cmd-1", "docker.io/nginx:1.27", "", ""); err != nil {
+		t.Fatalf("PullImage() unexpected error: %v", err)
+	}
+
+	progress, event := waitPull(t, a)
+	result := event.Data.(ImagePullResult)
+	if event.Type != "image.pull.complete" || result.Digest != "sha256:5e1f" || result.ImageID != "sha256:nginx" {
+		t.Fatalf("event = %s %+v", event.Type, result)
+	}
+	if docker.pullAuths[0] != "" {
+		t.Fatalf("anonymous pull sent auth %q", docker.pullAuths[0])
+	}
+
+	// Downloading is sent once; the rest fall within the progress interval.
+	var statuses []string
+	for _, event := range progress {
+		data := event.Data.(ImagePullProgress)
+		statuses = append(statuses, data.Layer+" "+data.Status)
+		if data.CommandID != "cmd-1" || event.Key != "image.pull.progress:cmd-1:"+data.Layer {
+			t.Fatalf("progress = %+v key %q", data, event.Key)
+		}
+	}
+	want := "a1b2c3 Pulling fs layer,d4e5f6 Already exists,a1b2c3 Downloading,a1b2c3 Download complete,a1b2c3 Pull complete"
+	if strings.Join(statuses, ",") != want {
+		t.Fatalf("progress = %v", statuses)
+	}
+	if data := progress[2].Data.(ImagePullProgress); data.Current != 1024 || data.Total != 4096 {
+		t.Fatalf("downloading progress = %+v", data)
+	}
+
+	t.Run("errors in the stream fail the pull", func(t *testing.T) {
+		docker.pullStreams["docker.io/nginx:9.99"] = `{"status":"Pulling from library/nginx","id":"9.99"}
+{"errorDetail":{"message":"manifest for nginx:9.99 not found"},"error":"manifest for nginx:9.99 not found"}
+`
+		if err := a.PullImage(ctx, "cmd-2", "docker.io/nginx:9.99", "", ""); err != nil {
+			t.Fatalf("PullImage() unexpected error: %v", err)
+		}
+
+		_, event := waitPull(t, a)
+		result := event.Data.(ImagePullResult)
+		if event.Type != "image.pull.failed" || !strings.Contains(result.Error, "manifest for nginx:9.99 not found") {
+			t.Fatalf("event = %s %+v", event.Type, result)
+		}
+	})
+
+	t.Run("payload credentials", func(t *testing.T) {
+		if err := a.PullImage(ctx, "cmd-3", "docker.io/nginx:1.27", "deploy", "s3cret"); err != nil {
+			t.Fatalf("PullImage() unexpected error: %v", err)
+		}
+		waitPull(t, a)
+
+		auth, err := registry.DecodeAuthConfig(docker.pullAuths[len(docker.pullAuths)-1])
+		if err != nil {
+			t.Fatalf("DecodeAuthConfig() unexpected error: %v", err)
+		}
+		if auth.Username != "deploy" || auth.Password != "s3cret" || auth.ServerAddress != "docker.io" {
+			t.Fatalf("auth = %+v", auth)
+		}
+	})
+}
+
+func TestRepoDigest(t *testing.T) {
+	digests := []string{"ghcr.io/acme/api@sha256:aaa", "nginx@sha256:bbb"}
+
+	tests := []struct {
+		reference string
+		want      string
+	}{
+		{"ghcr.io/acme/api:v2", "sha256:aaa"},
+		{"docker.io/nginx:1.27", "sha256:bbb"},
+		{"docker.io/library/nginx:1.27", "sha256:bbb"},
+		{"registry.local:5000/nginx", "sha256:bbb"},
+		{"ghcr.io/acme/web:v2", ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.reference, func(t *testing.T) {
+			if got := repoDigest(tc.reference, digests); got != tc.want {
+				t.Fatalf("repoDigest(%q) = %q, want %q", tc.reference, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"path"
+	"strings"
+
+	"github.com/distribution/reference"
+)
+
+const dockerHubRegistry = "docker.io"
+
+// ImageReference is one of an image's references split into its parts.
+// Repository is the path the Docker CLI shows, without the library/
+// prefix of official Docker Hub images.
+type ImageReference struct {
+	Registry   string `json:"registry"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+}
+
+// parseImageReference splits value, normalizing names the way Docker
+// does: nginx is docker.io/library/nginx. It fails for image IDs and for
+// the <none>:<none> placeholder of dangling images.
+func parseImageReference(value string) (ImageReference, bool) {
+	value = strings.TrimSpace(value)
+	if isImageID(value) {
+		// Parses as repository sha256 with the hex as its tag.
+		return ImageReference{}, false
+	}
+
+	named, err := reference.ParseNormalizedNamed(value)
+	if err != nil {
+		return ImageReference{}, false
+	}
+
+	ref := ImageReference{
+		Registry:   reference.Domain(named),
+		Repository: reference.Path(named),
+	}
+	if ref.Registry == dockerHubRegistry {
+		ref.Repository = strings.TrimPrefix(ref.Repository, "library/")
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		ref.Tag = tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		ref.Digest = digested.Digest().String()
+	}
+
+	return ref, true
+}
+
+// setImageReferences fills in the image's name, tags and registry from
+// its repo tags, falling back to its repo digests for untagged images.
+// Name and Tags keep the short form clients show, the last path segment:
+// grafana/grafana:11.0.0 is named grafana and tagged grafana:11.0.0. Name
+// and Registry come from the first reference; the full repository and
+// registry of each tag are in References.
+func setImageReferences(payload *Image, repoTags []string, repoDigests []string) {
+	payload.Tags = []string{}
+	payload.References = []ImageReference{}
+	payload.RepoDigests = []string{}
+
+	for _, value := range repoTags {
+		ref, ok := parseImageReference(value)
+		if !ok {
+			continue
+		}
+		payload.References = append(payload.References, ref)
+		if ref.Tag != "" {
+			payload.Tags = append(payload.Tags, path.Base(ref.Repository)+":"+ref.Tag)
+		}
+	}
+
+	first, ok := ImageReference{}, false
+	if len(payload.References) > 0 {
+		first, ok = payload.References[0], true
+	}
+
+	for _, value := range repoDigests {
+		ref, parsed := parseImageReference(value)
+		if !parsed {
+			continue
+		}
+		payload.RepoDigests = append(payload.RepoDigests, value)
+		if !ok {
+			first, ok = ref, true
+		}
+	}
+
+	if ok {
+		payload.Name = path.Base(first.Repository)
+	}
+	payload.Registry = first.Registry
+}
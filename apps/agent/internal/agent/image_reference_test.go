@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types/image"
+	dockerspec "github.com/moby/docker-image-spec/specs-go/v1"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const testImageDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestParseImageReference(t *testing.T) {
+	const digest = testImageDigest
+
+	tests := []struct {
+		value string
+		want  ImageReference
+		ok    bool
+	}{
+		{"nginx", ImageReference{Registry: "docker.io", Repository: "nginx"}, true},
+		{"nginx:1.27", ImageReference{Registry: "docker.io", Repository: "nginx", Tag: "1.27"}, true},
+		{"docker.io/library/nginx:1.27", ImageReference{Registry: "docker.io", Repository: "nginx", Tag: "1.27"}, true},
+		{"grafana/grafana:11.0.0", ImageReference{Registry: "docker.io", Repository: "grafana/grafana", Tag: "11.0.0"}, true},
+		{"ghcr.io/org/app:1.2", ImageReference{Registry: "ghcr.io", Repository: "org/app", Tag: "1.2"}, true},
+		{"ghcr.io/library/app:1", ImageReference{Registry: "ghcr.io", Repository: "library/app", Tag: "1"}, true},
+		{"localhost:5000/app", ImageReference{Registry: "localhost:5000", Repository: "app"}, true},
+		{"localhost:5000/team/app:v2", ImageReference{Registry: "localhost:5000", Repository: "team/app", Tag: "v2"}, true},
+		{"localhost/app:dev", ImageReference{Registry: "localhost", Repository: "app", Tag: "dev"}, true},
+		{"nginx@" + digest, ImageReference{Registry: "docker.io", Repository: "nginx", Digest: digest}, true},
+		{"ghcr.io/org/app:1.2@" + digest, ImageReference{Registry: "ghcr.io", Repository: "org/app", Tag: "1.2", Digest: digest}, true},
+		{"<none>:<none>", ImageReference{}, false},
+		{"<none>@<none>", ImageReference{}, false},
+		{digest, ImageReference{}, false},
+		{"", ImageReference{}, false},
+		{"Upper/Case", ImageReference{}, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.value, func(t *testing.T) {
+			got, ok := parseImageReference(tc.value)
+			if ok != tc.ok || got != tc.want {
+				t.Fatalf("parseImageReference(%q) = %+v, %t, want %+v, %t", tc.value, got, ok, tc.want, tc.ok)
+			}
+		})
+	}
+}
+
+func TestSetImageReferences(t *testing.T) {
+	tests := []struct {
+		name        string
+		repoTags    []string
+		repoDigests []string
+		want        Image
+	}{
+		{
+			name:        "tags across registries",
+			repoTags:    []string{"ghcr.io/org/app:1.2", "localhost:5000/app:latest", "org/app:1.2"},
+			repoDigests: []string{"ghcr.io/org/app@" + testImageDigest},
+			want: Image{
+				Name:     "app",
+				Registry: "ghcr.io",
+				Tags:     []string{"app:1.2", "app:latest", "app:1.2"},
+				References: []ImageReference{
+					{Registry: "ghcr.io", Repository: "org/app", Tag: "1.2"},
+					{Registry: "localhost:5000", Repository: "app", Tag: "latest"},
+					{Registry: "docker.io", Repository: "org/app", Tag: "1.2"},
+				},
+				RepoDigests: []string{"ghcr.io/org/app@" + testImageDigest},
+			},
+		},
+		{
+			name:        "untagged image named by its digest",
+			repoTags:    []string{"<none>:<none>"},
+			repoDigests: []string{"<none>@<none>", "nginx@" + testImageDigest},
+			want: Image{
+				Name:        "nginx",
+				Registry:    "docker.io",
+				Tags:        []string{},
+				References:  []ImageReference{},
+				RepoDigests: []string{"nginx@" + testImageDigest},
+			},
+		},
+		{
+			name:     "official and namespaced images",
+			repoTags: []string{"grafana/grafana:11.0.0", "docker.io/library/nginx:1.27"},
+			want: Image{
+				Name:     "grafana",
+				Registry: "docker.io",
+				Tags:     []string{"grafana:11.0.0", "nginx:1.27"},
+				References: []ImageReference{
+					{Registry: "docker.io", Repository: "grafana/grafana", Tag: "11.0.0"},
+					{Registry: "docker.io", Repository: "nginx", Tag: "1.27"},
+				},
+				RepoDigests: []string{},
+			},
+		},
+		{
+			name: "dangling image",
+			want: Image{
+				Tags:        []string{},
+				References:  []ImageReference{},
+				RepoDigests: []string{},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got Image
+			setImageReferences(&got, tc.repoTags, tc.repoDigests)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("setImageReferences() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestImageFromInspect(t *testing.T) {
+	info := image.InspectResponse{
+		ID:          "sha256:4f8b2a1c9d3e4f8b2a1c9d3e",
+		RepoTags:    []string{"ghcr.io/org/app:1.2"},
+		RepoDigests: []string{"ghcr.io/org/app@" + testImageDigest},
+		Created:     "2026-01-01T00:00:00.123456789Z",
+		Config: &dockerspec.DockerOCIImageConfig{
+			ImageConfig: ocispec.ImageConfig{Labels: map[string]string{"org.opencontainers.image.version": "1.2"}},
+		},
+	}
+
+	got := imageFromInspect(info, nil)
+	if got.Name != "app" || got.Registry != "ghcr.io" || got.Created != 1767225600 {
+		t.Fatalf("imageFromInspect() = %+v", got)
+	}
+	if got.Labels["org.opencontainers.image.version"] != "1.2" || len(got.RepoDigests) != 1 {
+		t.Fatalf("imageFromInspect() labels = %v, digests = %v", got.Labels, got.RepoDigests)
+	}
+
+	info.Config = nil
+	if got := imageFromInspect(info, nil); got.Labels == nil {
+		t.Fatal("imageFromInspect() labels = nil, want empty map")
+	}
+}
@@ -0,0 +1,326 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+)
+
+// containerListKey is the single key of the container list cache.
+const containerListKey = "all"
+
+// CacheStats counts lookups served from the inspect cache (hits) and those
+// that went to the Docker API (misses).
+type CacheStats struct {
+	ContainerHits       uint64 `json:"containerHits"`
+	ContainerMisses     uint64 `json:"containerMisses"`
+	ImageHits           uint64 `json:"imageHits"`
+	ImageMisses         uint64 `json:"imageMisses"`
+	ContainerListHits   uint64 `json:"containerListHits"`
+	ContainerListMisses uint64 `json:"containerListMisses"`
+	NetworkHits         uint64 `json:"networkHits"`
+	NetworkMisses       uint64 `json:"networkMisses"`
+}
+
+// dockerCache keeps inspect results until a Docker event says they changed.
+// Stats are never cached; they change on every read.
+type dockerCache struct {
+	containers    inspectCache[container.InspectResponse]
+	images        inspectCache[image.InspectResponse]
+	containerList inspectCache[[]container.Summary]
+	networks      inspectCache[network.Inspect]
+}
+
+// observe invalidates whatever msg can have changed. It must run before the
+// event's own payload is built so that payload reads fresh data.
+func (c *dockerCache) observe(msg events.Message) {
+	action := baseAction(msg.Action)
+
+	switch msg.Type {
+	case dockerContainerType:
+		c.observeContainer(events.Action(action), msg.Actor.ID)
+	case dockerImageType:
+		c.observeImage(events.Action(action), msg.Actor.ID)
+	case dockerNetworkType:
+		c.observeNetwork(events.Action(action), msg.Actor.ID)
+	}
+}
+
+func (c *dockerCache) observeContainer(action events.Action, id string) {
+	switch action {
+	case events.ActionAttach, events.ActionDetach, events.ActionResize,
+		events.ActionTop, events.ActionCopy, events.ActionArchivePath,
+		events.ActionExtractToDir, events.ActionExport, events.ActionCommit,
+		events.ActionExecCreate, events.ActionExecStart, events.ActionExecDie,
+		events.ActionExecDetach:
+		// Read-only or filesystem-only; inspect output is unchanged.
+		return
+	case events.ActionDestroy, events.ActionRemove:
+		c.containers.remove(id)
+	default:
+		c.containers.invalidate(id)
+	}
+
+	switch action {
+	case events.ActionCreate, events.ActionDestroy, events.ActionRemove,
+		events.ActionRename, events.ActionStart, events.ActionRestart,
+		events.ActionStop, events.ActionKill, events.ActionDie,
+		events.ActionPause, events.ActionUnPause, events.ActionOOM:
+		// Names and states in the list feed Image.Containers.
+		c.containerList.invalidate(containerListKey)
+	}
+}
+
+func (c *dockerCache) observeImage(action events.Action, id string) {
+	switch action {
+	case events.ActionPush, events.ActionSave:
+		return
+	case events.ActionDelete:
+		c.images.remove(id)
+	case events.ActionPull, events.ActionLoad, events.ActionImport, events.ActionPrune:
+		// These are reported by reference or not at all per image, and can
+		// move tags away from images we hold.
+		c.images.invalidateAll()
+	default:
+		c.images.invalidate(id)
+	}
+}
+
+func (c *dockerCache) observeNetwork(action events.Action, id string) {
+	switch action {
+	case events.ActionDestroy, events.ActionRemove:
+		c.networks.remove(id)
+	default:
+		// connect and disconnect change the endpoint list.
+		c.networks.invalidate(id)
+	}
+}
+
+// invalidateAll drops trust in every cached value, e.g. after events may
+// have been lost.
+func (c *dockerCache) invalidateAll() {
+	c.containers.invalidateAll()
+	c.images.invalidateAll()
+	c.containerList.invalidateAll()
+	c.networks.invalidateAll()
+}
+
+// retain drops entries for objects missing from the latest lists, covering
+// removals whose events were missed.
+func (c *dockerCache) retain(
+	containers []container.Summary,
+	images []image.Summary,
+	networks []network.Summary,
+) {
+	containerIDs := make(map[string]bool, len(containers))
+	for _, item := range containers {
+		containerIDs[item.ID] = true
+	}
+	c.containers.retain(containerIDs)
+
+	imageIDs := make(map[string]bool, len(images))
+	for _, item := range images {
+		imageIDs[item.ID] = true
+	}
+	c.images.retain(imageIDs)
+
+	networkIDs := make(map[string]bool, len(networks))
+	for _, item := range networks {
+		networkIDs[item.ID] = true
+	}
+	c.networks.retain(networkIDs)
+}
+
+func (c *dockerCache) stats() CacheStats {
+	return CacheStats{
+		ContainerHits:       c.containers.hits.Load(),
+		ContainerMisses:     c.containers.misses.Load(),
+		ImageHits:           c.images.hits.Load(),
+		ImageMisses:         c.images.misses.Load(),
+		ContainerListHits:   c.containerList.hits.Load(),
+		ContainerListMisses: c.containerList.misses.Load(),
+		NetworkHits:         c.networks.hits.Load(),
+		NetworkMisses:       c.networks.misses.Load(),
+	}
+}
+
+// inspectCache holds values keyed by object ID. Each entry carries a
+// generation so a fetch that raced an invalidation does not store what it
+// read. Cached values are shared; callers must not modify them.
+type inspectCache[T any] struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry[T]
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+}
+
+type cacheEntry[T any] struct {
+	value T
+	valid bool
+	gen   uint64
+}
+
+// load returns the cached value for id, or fetches and caches it.
+func (c *inspectCache[T]) load(
+	ctx context.Context,
+	id string,
+	fetch func(context.Context, string) (T, error),
+) (T, error) {
+	return c.loadMatching(ctx, id, nil, fetch)
+}
+
+// loadMatching is load, but a cached value for which fresh returns false is
+// treated as stale and fetched again.
+func (c *inspectCache[T]) loadMatching(
+	ctx context.Context,
+	id string,
+	fresh func(T) bool,
+	fetch func(context.Context, string) (T, error),
+) (T, error) {
+	c.mu.Lock()
+	entry := c.entry(id)
+	if entry.valid && (fresh == nil || fresh(entry.value)) {
+		value := entry.value
+		c.mu.Unlock()
+		c.hits.Add(1)
+		return value, nil
+	}
+	entry.valid = false
+	gen := entry.gen
+	c.mu.Unlock()
+
+	c.misses.Add(1)
+	return c.fetch(ctx, id, entry, gen, fetch)
+}
+
+// refresh always fetches and caches the result, without counting a lookup.
+func (c *inspectCache[T]) refresh(
+	ctx context.Context,
+	id string,
+	fetch func(context.Context, string) (T, error),
+) (T, error) {
+	c.mu.Lock()
+	entry := c.entry(id)
+	gen := entry.gen
+	c.mu.Unlock()
+
+	return c.fetch(ctx, id, entry, gen, fetch)
+}
+
+func (c *inspectCache[T]) fetch(
+	ctx context.Context,
+	id string,
+	entry *cacheEntry[T],
+	gen uint64,
+	fetch func(context.Context, string) (T, error),
+) (T, error) {
+	value, err := fetch(ctx, id)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case c.entries[id] != entry:
+	case err != nil:
+		// Do not keep placeholders for objects that are gone.
+		if !entry.valid {
+			delete(c.entries, id)
+		}
+	case entry.gen == gen:
+		entry.value = value
+		entry.valid = true
+	}
+
+	return value, err
+}
+
+// entry returns the entry for id, creating it. c.mu must be held.
+func (c *inspectCache[T]) entry(id string) *cacheEntry[T] {
+	if c.entries == nil {
+		c.entries = make(map[string]*cacheEntry[T])
+	}
+
+	entry, ok := c.entries[id]
+	if !ok {
+		entry = &cacheEntry[T]{}
+		c.entries[id] = entry
+	}
+
+	return entry
+}
+
+func (c *inspectCache[T]) invalidate(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.entries[id]; ok {
+		entry.valid = false
+		entry.gen++
+	}
+}
+
+func (c *inspectCache[T]) invalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, entry := range c.entries {
+		entry.valid = false
+		entry.gen++
+	}
+}
+
+func (c *inspectCache[T]) remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, id)
+}
+
+func (c *inspectCache[T]) retain(ids map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id := range c.entries {
+		if !ids[id] {
+			delete(c.entries, id)
+		}
+	}
+}
+
+// isImageID reports whether value is a full image ID rather than a
+// reference such as "nginx:latest", which can move between images.
+func isImageID(value string) bool {
+	hex, ok := strings.CutPrefix(value, "sha256:")
+	return ok && len(hex) == 64
+}
+
+func (a *Agent) inspectContainer(ctx context.Context, id string) (container.InspectResponse, error) {
+	return a.cache.containers.load(ctx, id, a.cli.ContainerInspect)
+}
+
+func (a *Agent) inspectImage(ctx context.Context, id string) (image.InspectResponse, error) {
+	fetch := func(ctx context.Context, id string) (image.InspectResponse, error) {
+		info, _, err := a.cli.ImageInspectWithRaw(ctx, id)
+		return info, err
+	}
+
+	if !isImageID(id) {
+		return fetch(ctx, id)
+	}
+
+	return a.cache.images.load(ctx, id, fetch)
+}
+
+func (a *Agent) listContainers(ctx context.Context) ([]container.Summary, error) {
+	return a.cache.containerList.load(ctx, containerListKey, a.fetchContainerList)
+}
+
+func (a *Agent) fetchContainerList(ctx context.Context, _ string) ([]container.Summary, error) {
+	return a.cli.ContainerList(ctx, container.ListOptions{All: true})
+}
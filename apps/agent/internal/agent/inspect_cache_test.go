@@ -0,0 +1,299 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+)
+
+// startEventLoop runs the agent's event loop over the fake's event stream.
+func startEventLoop(t *testing.T, docker *fakeDocker, opts eventOptions) *Agent {
+	t.Helper()
+
+	a := newAgent(docker, snapshotOptions{Workers: 4, CallTimeout: time.Second, Timeout: time.Second}, opts)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	msgs, errs := a.getEvents(ctx)
+	go func() {
+		defer close(done)
+		a.runEventLoop(ctx, msgs, errs)
+	}()
+
+	return a
+}
+
+// send pushes msg through the fake stream.
+func send(t *testing.T, docker *fakeDocker, msg events.Message) {
+	t.Helper()
+
+	select {
+	case docker.stream <- msg:
+	case <-time.After(time.Second):
+		t.Fatalf("event loop did not accept %s.%s", msg.Type, msg.Action)
+	}
+}
+
+// publish pushes msg through the fake stream and waits for the agent's event.
+func publish(t *testing.T, a *Agent, docker *fakeDocker, msg events.Message) Event {
+	t.Helper()
+
+	send(t, docker, msg)
+
+	select {
+	case event := <-a.Events():
+		return event
+	case <-time.After(time.Second):
+		t.Fatalf("no event for %s.%s", msg.Type, msg.Action)
+		return Event{}
+	}
+}
+
+func containerEvent(id string, action events.Action) events.Message {
+	return events.Message{Type: events.ContainerEventType, Action: action, Actor: events.Actor{ID: id}}
+}
+
+func imageEvent(id string, action events.Action) events.Message {
+	return events.Message{Type: events.ImageEventType, Action: action, Actor: events.Actor{ID: id}}
+}
+
+func TestInspectCacheEvents(t *testing.T) {
+	t.Run("serves unchanged containers from cache", func(t *testing.T) {
+		docker := newFakeDocker(1, 1)
+		a := startEventLoop(t, docker, eventOptions{})
+		id := docker.containers[0].ID
+
+		publish(t, a, docker, containerEvent(id, "exec_create: sh -c true"))
+		publish(t, a, docker, containerEvent(id, "exec_start: sh -c true"))
+		publish(t, a, docker, containerEvent(id, events.ActionExecDie))
+
+		if calls := docker.callCount("ContainerInspect"); calls != 1 {
+			t.Fatalf("ContainerInspect calls = %d, want 1", calls)
+		}
+
+		stats := a.CacheStats()
+		if stats.ContainerHits != 2 || stats.ContainerMisses != 1 {
+			t.Fatalf("CacheStats() = %+v", stats)
+		}
+	})
+
+	t.Run("state changes invalidate the container", func(t *testing.T) {
+		docker := newFakeDocker(1, 1)
+		a := startEventLoop(t, docker, eventOptions{})
+		id := docker.containers[0].ID
+
+		publish(t, a, docker, containerEvent(id, events.ActionExecStart))
+		docker.containers[0].State = "exited"
+		event := publish(t, a, docker, containerEvent(id, events.ActionDie))
+		publish(t, a, docker, containerEvent(id, events.ActionAttach))
+
+		if calls := docker.callCount("ContainerInspect"); calls != 2 {
+			t.Fatalf("ContainerInspect calls = %d, want 2", calls)
+		}
+
+		if payload := event.Data.(*Container); payload.State != "exited" {
+			t.Fatalf("die payload state = %q", payload.State)
+		}
+
+		stats := a.CacheStats()
+		if stats.ContainerHits != 1 || stats.ContainerMisses != 2 {
+			t.Fatalf("CacheStats() = %+v", stats)
+		}
+	})
+
+	t.Run("health status invalidates the container", func(t *testing.T) {
+		docker := newFakeDocker(1, 1)
+		a := startEventLoop(t, docker, eventOptions{})
+		id := docker.containers[0].ID
+
+		publish(t, a, docker, containerEvent(id, events.ActionExecStart))
+		publish(t, a, docker, containerEvent(id, events.ActionHealthStatusHealthy))
+
+		if calls := docker.callCount("ContainerInspect"); calls != 2 {
+			t.Fatalf("ContainerInspect calls = %d, want 2", calls)
+		}
+	})
+
+	t.Run("image events reuse the container list until containers change", func(t *testing.T) {
+		docker := newFakeDocker(1, 1)
+		a := startEventLoop(t, docker, eventOptions{})
+		imageID := docker.images[0].ID
+
+		publish(t, a, docker, imageEvent(imageID, events.ActionPush))
+		publish(t, a, docker, imageEvent(imageID, events.ActionSave))
+		if calls := docker.callCount("ContainerList"); calls != 1 {
+			t.Fatalf("ContainerList calls = %d, want 1", calls)
+		}
+		if calls := docker.callCount("ImageInspect"); calls != 1 {
+			t.Fatalf("ImageInspect calls = %d, want 1", calls)
+		}
+
+		docker.containers[0].State = "paused"
+		publish(t, a, docker, containerEvent(docker.containers[0].ID, events.ActionPause))
+		event := publish(t, a, docker, imageEvent(imageID, events.ActionPush))
+
+		if calls := docker.callCount("ContainerList"); calls != 2 {
+			t.Fatalf("ContainerList calls = %d, want 2", calls)
+		}
+
+		payload := event.Data.(*Image)
+		if len(payload.Containers) != 1 || payload.Containers[0].State != "paused" {
+			t.Fatalf("image containers = %+v", payload.Containers)
+		}
+	})
+
+	t.Run("tags invalidate the image", func(t *testing.T) {
+		docker := newFakeDocker(0, 1)
+		a := startEventLoop(t, docker, eventOptions{})
+		imageID := docker.images[0].ID
+
+		publish(t, a, docker, imageEvent(imageID, events.ActionPush))
+		docker.images[0].RepoTags = append(docker.images[0].RepoTags, "app-0:v2")
+		event := publish(t, a, docker, imageEvent(imageID, events.ActionTag))
+
+		if tags := event.Data.(*Image).Tags; len(tags) != 2 {
+			t.Fatalf("tag payload tags = %v", tags)
+		}
+
+		stats := a.CacheStats()
+		if stats.ImageHits != 0 || stats.ImageMisses != 2 {
+			t.Fatalf("CacheStats() = %+v", stats)
+		}
+	})
+
+	t.Run("pull invalidates every image", func(t *testing.T) {
+		docker := newFakeDocker(0, 2)
+		a := startEventLoop(t, docker, eventOptions{})
+
+		publish(t, a, docker, imageEvent(docker.images[0].ID, events.ActionPush))
+		publish(t, a, docker, imageEvent(docker.images[1].ID, events.ActionPush))
+		publish(t, a, docker, imageEvent("app-1:latest", events.ActionPull))
+		publish(t, a, docker, imageEvent(docker.images[0].ID, events.ActionPush))
+
+		// Both pushes after warm-up miss: the pull invalidated everything and
+		// references are never cached.
+		stats := a.CacheStats()
+		if stats.ImageHits != 0 || stats.ImageMisses != 3 {
+			t.Fatalf("CacheStats() = %+v", stats)
+		}
+	})
+
+	t.Run("destroy drops the container", func(t *testing.T) {
+		docker := newFakeDocker(1, 0)
+		a := startEventLoop(t, docker, eventOptions{})
+		id := docker.containers[0].ID
+
+		publish(t, a, docker, containerEvent(id, events.ActionExecStart))
+		docker.containers = nil
+		event := publish(t, a, docker, containerEvent(id, events.ActionDestroy))
+
+		if payload := event.Data.(*Container); payload.State != "exited" || len(payload.Envs) != 0 {
+			t.Fatalf("destroy payload = %+v", payload)
+		}
+
+		a.cache.containers.mu.Lock()
+		defer a.cache.containers.mu.Unlock()
+		if _, ok := a.cache.containers.entries[id]; ok {
+			t.Fatal("destroyed container still cached")
+		}
+	})
+}
+
+func TestInspectCacheSnapshots(t *testing.T) {
+	t.Run("second snapshot reuses inspect results", func(t *testing.T) {
+		docker := newFakeDocker(5, 2)
+		a := newAgent(docker, snapshotOptions{Workers: 4, CallTimeout: time.Second, Timeout: time.Second}, eventOptions{})
+
+		for range 2 {
+			if _, err := a.buildSnapshot(context.Background()); err != nil {
+				t.Fatalf("buildSnapshot() unexpected error: %v", err)
+			}
+		}
+
+		if calls := docker.callCount("ContainerInspect"); calls != 5 {
+			t.Fatalf("ContainerInspect calls = %d, want 5", calls)
+		}
+		if calls := docker.callCount("ImageInspect"); calls != 2 {
+			t.Fatalf("ImageInspect calls = %d, want 2", calls)
+		}
+		if calls := docker.callCount("ContainerStats"); calls != 10 {
+			t.Fatalf("ContainerStats calls = %d, want 10", calls)
+		}
+	})
+
+	t.Run("state drift from a missed event refetches", func(t *testing.T) {
+		docker := newFakeDocker(2, 0)
+		a := newAgent(docker, snapshotOptions{Workers: 4, CallTimeout: time.Second, Timeout: time.Second}, eventOptions{})
+
+		if _, err := a.buildSnapshot(context.Background()); err != nil {
+			t.Fatalf("buildSnapshot() unexpected error: %v", err)
+		}
+
+		docker.containers[1].State = "exited"
+		payload, err := a.buildSnapshot(context.Background())
+		if err != nil {
+			t.Fatalf("buildSnapshot() unexpected error: %v", err)
+		}
+
+		if state := payload.Containers[1].State; state != "exited" {
+			t.Fatalf("container state = %q", state)
+		}
+		if calls := docker.callCount("ContainerInspect"); calls != 3 {
+			t.Fatalf("ContainerInspect calls = %d, want 3", calls)
+		}
+	})
+
+	t.Run("removed objects leave the cache", func(t *testing.T) {
+		docker := newFakeDocker(2, 1)
+		a := newAgent(docker, snapshotOptions{Workers: 4, CallTimeout: time.Second, Timeout: time.Second}, eventOptions{})
+
+		if _, err := a.buildSnapshot(context.Background()); err != nil {
+			t.Fatalf("buildSnapshot() unexpected error: %v", err)
+		}
+
+		removed := docker.containers[0].ID
+		docker.containers = docker.containers[1:]
+		if _, err := a.buildSnapshot(context.Background()); err != nil {
+			t.Fatalf("buildSnapshot() unexpected error: %v", err)
+		}
+
+		a.cache.containers.mu.Lock()
+		defer a.cache.containers.mu.Unlock()
+		if _, ok := a.cache.containers.entries[removed]; ok {
+			t.Fatal("removed container still cached")
+		}
+	})
+}
+
+func TestInspectCacheRace(t *testing.T) {
+	var cache inspectCache[int]
+	fetches := 0
+	fetch := func(context.Context, string) (int, error) {
+		fetches++
+		if fetches == 1 {
+			// An event lands while the first read is in flight.
+			cache.invalidate("a")
+		}
+		return fetches, nil
+	}
+
+	first, err := cache.load(context.Background(), "a", fetch)
+	if err != nil {
+		t.Fatalf("load() unexpected error: %v", err)
+	}
+
+	second, err := cache.load(context.Background(), "a", fetch)
+	if err != nil {
+		t.Fatalf("load() unexpected error: %v", err)
+	}
+
+	if first != 1 || second != 2 {
+		t.Fatalf("load() = %d then %d, want 1 then 2", first, second)
+	}
+}
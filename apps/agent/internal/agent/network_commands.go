@@ -0,0 +1,339 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+)
+
+const defaultNetworkDriver = "bridge"
+
+var (
+	ErrNetworkNotFound       = newKindError("network_not_found", "network not found")
+	ErrNetworkExists         = newKindError("network_exists", "network already exists")
+	ErrNetworkInUse          = newKindError("network_in_use", "network in use")
+	ErrSubnetOverlap         = newKindError("subnet_overlap", "subnet overlaps an existing network")
+	ErrContainerConnected    = newKindError("container_connected", "container already connected")
+	ErrContainerNotConnected = newKindError("container_not_connected", "container not connected")
+	ErrAddressInUse          = newKindError("address_in_use", "address in use")
+	ErrAddressOutOfRange     = newKindError("address_out_of_range", "address outside network subnets")
+	ErrContainerNotFound     = newKindError("container_not_found", "container not found")
+)
+
+// CreateNetwork creates a network and returns its ID. The driver defaults to
+// bridge. Subnet and gateway are optional; a gateway needs a subnet that
+// contains it, and the subnet must not overlap another network's.
+func (a *Agent) CreateNetwork(
+	ctx context.Context,
+	name string,
+	driver string,
+	subnet string,
+	gateway string,
+	internal bool,
+	labels map[string]string,
+) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("network name is required")
+	}
+
+	driver = strings.TrimSpace(driver)
+	if driver == "" {
+		driver = defaultNetworkDriver
+	}
+
+	ipam, prefix, err := networkIPAM(subnet, gateway)
+	if err != nil {
+		return "", err
+	}
+
+	existing, err := a.cli.NetworkList(ctx, network.ListOptions{})
+	if err != nil {
+		return "", fmt.Errorf("docker list networks: %w", err)
+	}
+
+	for _, item := range existing {
+		if item.Name == name {
+			return "", fmt.Errorf("%w: %q (%s)", ErrNetworkExists, name, shortID(item.ID))
+		}
+
+		if !prefix.IsValid() {
+			continue
+		}
+		for _, config := range item.IPAM.Config {
+			other, err := netip.ParsePrefix(config.Subnet)
+			if err == nil && other.Overlaps(prefix) {
+				return "", fmt.Errorf(
+					"%w: %s overlaps %s of network %q",
+					ErrSubnetOverlap,
+					prefix,
+					other,
+					item.Name,
+				)
+			}
+		}
+	}
+
+	created, err := a.cli.NetworkCreate(ctx, name, network.CreateOptions{
+		Driver:   driver,
+		IPAM:     ipam,
+		Internal: internal,
+		Labels:   labels,
+	})
+	if err != nil {
+		if errdefs.IsConflict(err) {
+			return "", fmt.Errorf("%w: %q: %w", ErrNetworkExists, name, err)
+		}
+
+		return "", fmt.Errorf("docker create network: %w", err)
+	}
+
+	return created.ID, nil
+}
+
+// networkIPAM validates subnet and gateway. It returns nil IPAM, leaving
+// address allocation to Docker, when no subnet is given.
+func networkIPAM(subnet string, gateway string) (*network.IPAM, netip.Prefix, error) {
+	subnet = strings.TrimSpace(subnet)
+	gateway = strings.TrimSpace(gateway)
+
+	if subnet == "" {
+		if gateway != "" {
+			return nil, netip.Prefix{}, errors.New("network gateway requires a subnet")
+		}
+		return nil, netip.Prefix{}, nil
+	}
+
+	prefix, err := netip.ParsePrefix(subnet)
+	if err != nil {
+		return nil, netip.Prefix{}, fmt.Errorf("invalid subnet %q: %w", subnet, err)
+	}
+	if prefix.Masked() != prefix {
+		return nil, netip.Prefix{}, fmt.Errorf("invalid subnet %q: host bits set, use %s", subnet, prefix.Masked())
+	}
+
+	config := network.IPAMConfig{Subnet: prefix.String()}
+	if gateway != "" {
+		addr, err := netip.ParseAddr(gateway)
+		if err != nil {
+			return nil, netip.Prefix{}, fmt.Errorf("invalid gateway %q: %w", gateway, err)
+		}
+		if !prefix.Contains(addr) {
+			return nil, netip.Prefix{}, fmt.Errorf("%w: gateway %s not in %s", ErrAddressOutOfRange, addr, prefix)
+		}
+		config.Gateway = addr.String()
+	}
+
+	return &network.IPAM{Config: []network.IPAMConfig{config}}, prefix, nil
+}
+
+// RemoveNetwork removes a network by ID or name. It refuses while containers
+// are connected and names them.
+func (a *Agent) RemoveNetwork(ctx context.Context, networkID string) error {
+	info, err := a.lookupNetwork(ctx, networkID)
+	if err != nil {
+		return err
+	}
+
+	if len(info.Containers) > 0 {
+		names := make([]string, 0, len(info.Containers))
+		for _, endpoint := range info.Containers {
+			names = append(names, endpoint.Name)
+		}
+		slices.Sort(names)
+
+		return fmt.Errorf(
+			"%w: %q has %d connected containers: %s",
+			ErrNetworkInUse,
+			info.Name,
+			len(names),
+			strings.Join(names, ", "),
+		)
+	}
+
+	if err := a.cli.NetworkRemove(ctx, info.ID); err != nil {
+		if errdefs.IsNotFound(err) {
+			return fmt.Errorf("%w: %q", ErrNetworkNotFound, networkID)
+		}
+		if errdefs.IsConflict(err) {
+			// A container connected since the check above.
+			return fmt.Errorf("%w: %q: %w", ErrNetworkInUse, info.Name, err)
+		}
+
+		return fmt.Errorf("docker remove network: %w", err)
+	}
+
+	return nil
+}
+
+// ConnectNetwork attaches a container to a network with optional aliases and
+// a static IPv4 or IPv6 address. A static address must lie in one of the
+// network's configured subnets and be free.
+func (a *Agent) ConnectNetwork(
+	ctx context.Context,
+	networkID string,
+	containerID string,
+	aliases []string,
+	ip string,
+) error {
+	info, err := a.lookupNetwork(ctx, networkID)
+	if err != nil {
+		return err
+	}
+
+	target, err := a.lookupContainer(ctx, containerID)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := info.Containers[target.ID]; ok {
+		return fmt.Errorf("%w: %q is already on %q", ErrContainerConnected, target.Name, info.Name)
+	}
+
+	settings := &network.EndpointSettings{}
+	for _, alias := range aliases {
+		if alias = strings.TrimSpace(alias); alias != "" {
+			settings.Aliases = append(settings.Aliases, alias)
+		}
+	}
+
+	if ip = strings.TrimSpace(ip); ip != "" {
+		addr, err := networkAddress(info, ip)
+		if err != nil {
+			return err
+		}
+
+		settings.IPAMConfig = &network.EndpointIPAMConfig{}
+		if addr.Is4() {
+			settings.IPAMConfig.IPv4Address = addr.String()
+		} else {
+			settings.IPAMConfig.IPv6Address = addr.String()
+		}
+	}
+
+	if err := a.cli.NetworkConnect(ctx, info.ID, target.ID, settings); err != nil {
+		return fmt.Errorf("docker connect %q to network %q: %w", target.Name, info.Name, err)
+	}
+
+	return nil
+}
+
+// networkAddress checks that ip can be assigned statically on info.
+func networkAddress(info network.Inspect, ip string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid ip %q: %w", ip, err)
+	}
+
+	if len(info.IPAM.Config) == 0 {
+		return netip.Addr{}, fmt.Errorf(
+			"%w: network %q has no configured subnet, static addresses need one",
+			ErrAddressOutOfRange,
+			info.Name,
+		)
+	}
+
+	inRange := false
+	subnets := make([]string, 0, len(info.IPAM.Config))
+	for _, config := range info.IPAM.Config {
+		subnets = append(subnets, config.Subnet)
+		prefix, err := netip.ParsePrefix(config.Subnet)
+		if err == nil && prefix.Contains(addr) {
+			inRange = true
+		}
+
+		if config.Gateway == addr.String() {
+			return netip.Addr{}, fmt.Errorf("%w: %s is the gateway of %q", ErrAddressInUse, addr, info.Name)
+		}
+	}
+	if !inRange {
+		return netip.Addr{}, fmt.Errorf(
+			"%w: %s not in %s of %q",
+			ErrAddressOutOfRange,
+			addr,
+			strings.Join(subnets, ", "),
+			info.Name,
+		)
+	}
+
+	for _, endpoint := range info.Containers {
+		if stripPrefixLen(endpoint.IPv4Address) == addr.String() || stripPrefixLen(endpoint.IPv6Address) == addr.String() {
+			return netip.Addr{}, fmt.Errorf("%w: %s is taken by %q", ErrAddressInUse, addr, endpoint.Name)
+		}
+	}
+
+	return addr, nil
+}
+
+// DisconnectNetwork detaches a container from a network. Force disconnects
+// even when the container is not running.
+func (a *Agent) DisconnectNetwork(ctx context.Context, networkID string, containerID string, force bool) error {
+	info, err := a.lookupNetwork(ctx, networkID)
+	if err != nil {
+		return err
+	}
+
+	target, err := a.lookupContainer(ctx, containerID)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := info.Containers[target.ID]; !ok {
+		return fmt.Errorf("%w: %q is not on %q", ErrContainerNotConnected, target.Name, info.Name)
+	}
+
+	if err := a.cli.NetworkDisconnect(ctx, info.ID, target.ID, force); err != nil {
+		return fmt.Errorf("docker disconnect %q from network %q: %w", target.Name, info.Name, err)
+	}
+
+	return nil
+}
+
+// lookupNetwork inspects a network by ID or name, bypassing the cache so
+// checks see the current endpoints.
+func (a *Agent) lookupNetwork(ctx context.Context, networkID string) (network.Inspect, error) {
+	id := strings.TrimSpace(networkID)
+	if id == "" {
+		return network.Inspect{}, errors.New("network id is required")
+	}
+
+	info, err := a.cli.NetworkInspect(ctx, id, network.InspectOptions{})
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return network.Inspect{}, fmt.Errorf("%w: %q", ErrNetworkNotFound, id)
+		}
+
+		return network.Inspect{}, fmt.Errorf("docker inspect network: %w", err)
+	}
+
+	return info, nil
+}
+
+type containerRef struct {
+	ID   string
+	Name string
+}
+
+func (a *Agent) lookupContainer(ctx context.Context, containerID string) (containerRef, error) {
+	id := strings.TrimSpace(containerID)
+	if id == "" {
+		return containerRef{}, errors.New("container id is required")
+	}
+
+	info, err := a.cli.ContainerInspect(ctx, id)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return containerRef{}, fmt.Errorf("%w: %q", ErrContainerNotFound, id)
+		}
+
+		return containerRef{}, fmt.Errorf("docker inspect container: %w", err)
+	}
+
+	return containerRef{ID: info.ID, Name: strings.TrimPrefix(info.Name, "/")}, nil
+}
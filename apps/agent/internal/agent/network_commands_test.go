@@ -0,0 +1,197 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+)
+
+func newNetworkTestAgent(t *testing.T) (*Agent, *fakeDocker) {
+	t.Helper()
+
+	docker := newFakeDocker(2, 0)
+	docker.mu.Lock()
+	docker.networks = append(docker.networks, network.Inspect{
+		ID:     "backend-id",
+		Name:   "backend",
+		Driver: "bridge",
+		IPAM: network.IPAM{Config: []network.IPAMConfig{
+			{Subnet: "10.10.0.0/24", Gateway: "10.10.0.1"},
+		}},
+		Containers: map[string]network.EndpointResource{
+			docker.containers[0].ID: {Name: "container-0", IPv4Address: "10.10.0.2/24"},
+		},
+	})
+	docker.mu.Unlock()
+
+	a := newAgent(docker, snapshotOptions{Workers: 1, CallTimeout: time.Second, Timeout: time.Second}, eventOptions{})
+	return a, docker
+}
+
+func TestCreateNetwork(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("creates with subnet and gateway", func(t *testing.T) {
+		a, docker := newNetworkTestAgent(t)
+
+		id, err := a.CreateNetwork(ctx, "frontend", "", "10.20.0.0/24", "10.20.0.1", true, map[string]string{"app": "web"})
+		if err != nil {
+			t.Fatalf("CreateNetwork() unexpected error: %v", err)
+		}
+
+		info, err := docker.NetworkInspect(ctx, id, network.InspectOptions{})
+		if err != nil {
+			t.Fatalf("NetworkInspect() unexpected error: %v", err)
+		}
+		if info.Driver != "bridge" || !info.Internal || info.Labels["app"] != "web" {
+			t.Fatalf("created network = %+v", info)
+		}
+		if len(info.IPAM.Config) != 1 || info.IPAM.Config[0].Gateway != "10.20.0.1" {
+			t.Fatalf("created IPAM = %+v", info.IPAM)
+		}
+	})
+
+	tests := []struct {
+		name    string
+		network string
+		subnet  string
+		gateway string
+		want    error
+		message string
+	}{
+		{"duplicate name", "backend", "", "", ErrNetworkExists, `"backend"`},
+		{"overlapping subnet", "other", "10.10.0.128/25", "", ErrSubnetOverlap, `10.10.0.128/25 overlaps 10.10.0.0/24 of network "backend"`},
+		{"overlapping default bridge", "other", "172.16.0.0/12", "", ErrSubnetOverlap, `"bridge"`},
+		{"gateway outside subnet", "other", "10.30.0.0/24", "10.31.0.1", ErrAddressOutOfRange, "10.31.0.1 not in 10.30.0.0/24"},
+		{"gateway without subnet", "other", "", "10.30.0.1", nil, "requires a subnet"},
+		{"host bits in subnet", "other", "10.30.0.5/24", "", nil, "use 10.30.0.0/24"},
+		{"invalid subnet", "other", "10.30.0.0", "", nil, "invalid subnet"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a, docker := newNetworkTestAgent(t)
+
+			_, err := a.CreateNetwork(ctx, tc.network, "bridge", tc.subnet, tc.gateway, false, nil)
+			if err == nil {
+				t.Fatal("CreateNetwork() expected error")
+			}
+			if tc.want != nil && !errors.Is(err, tc.want) {
+				t.Fatalf("CreateNetwork() error = %v, want %v", err, tc.want)
+			}
+			var kinded interface{ ErrorKind() string }
+			if tc.want != nil && (!errors.As(err, &kinded) || kinded.ErrorKind() != tc.want.(*kindError).kind) {
+				t.Fatalf("CreateNetwork() error kind = %v, want %q", kinded, tc.want.(*kindError).kind)
+			}
+			if !strings.Contains(err.Error(), tc.message) {
+				t.Fatalf("CreateNetwork() error = %q, want it to mention %q", err, tc.message)
+			}
+			if calls := docker.callCount("NetworkCreate"); calls != 0 {
+				t.Fatalf("NetworkCreate() calls = %d", calls)
+			}
+		})
+	}
+}
+
+func TestRemoveNetwork(t *testing.T) {
+	ctx := context.Background()
+	a, docker := newNetworkTestAgent(t)
+
+	err := a.RemoveNetwork(ctx, "backend")
+	if !errors.Is(err, ErrNetworkInUse) || !strings.Contains(err.Error(), "1 connected containers: container-0") {
+		t.Fatalf("RemoveNetwork() error = %v, want ErrNetworkInUse", err)
+	}
+
+	if err := a.RemoveNetwork(ctx, "missing"); !errors.Is(err, ErrNetworkNotFound) {
+		t.Fatalf("RemoveNetwork() error = %v, want ErrNetworkNotFound", err)
+	}
+
+	if err := a.DisconnectNetwork(ctx, "backend", docker.containers[0].ID, false); err != nil {
+		t.Fatalf("DisconnectNetwork() unexpected error: %v", err)
+	}
+	if err := a.RemoveNetwork(ctx, "backend"); err != nil {
+		t.Fatalf("RemoveNetwork() unexpected error: %v", err)
+	}
+	if calls := docker.callCount("NetworkRemove"); calls != 1 {
+		t.Fatalf("NetworkRemove() calls = %d", calls)
+	}
+
+	t.Run("a container connecting before the remove", func(t *testing.T) {
+		a, docker := newNetworkTestAgent(t)
+		if err := a.DisconnectNetwork(ctx, "backend", docker.containers[0].ID, false); err != nil {
+			t.Fatalf("DisconnectNetwork() unexpected error: %v", err)
+		}
+		docker.mu.Lock()
+		docker.networkRemoveErr = errdefs.Conflict(errors.New("network backend has active endpoints"))
+		docker.mu.Unlock()
+
+		if err := a.RemoveNetwork(ctx, "backend"); !errors.Is(err, ErrNetworkInUse) {
+			t.Fatalf("RemoveNetwork() error = %v, want ErrNetworkInUse", err)
+		}
+	})
+}
+
+func TestConnectNetwork(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("connects with a static address", func(t *testing.T) {
+		a, docker := newNetworkTestAgent(t)
+		id := docker.containers[1].ID
+
+		if err := a.ConnectNetwork(ctx, "backend", id, []string{"db", " "}, "10.10.0.9"); err != nil {
+			t.Fatalf("ConnectNetwork() unexpected error: %v", err)
+		}
+
+		info, _ := docker.NetworkInspect(ctx, "backend", network.InspectOptions{})
+		if endpoint := info.Containers[id]; endpoint.IPv4Address != "10.10.0.9" {
+			t.Fatalf("endpoint = %+v", endpoint)
+		}
+	})
+
+	tests := []struct {
+		name      string
+		network   string
+		container int
+		ip        string
+		want      error
+	}{
+		{"already connected", "backend", 0, "", ErrContainerConnected},
+		{"address taken", "backend", 1, "10.10.0.2", ErrAddressInUse},
+		{"gateway address", "backend", 1, "10.10.0.1", ErrAddressInUse},
+		{"address outside subnet", "backend", 1, "10.11.0.2", ErrAddressOutOfRange},
+		{"unknown network", "missing", 1, "", ErrNetworkNotFound},
+		{"unknown container", "backend", -1, "", ErrContainerNotFound},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a, docker := newNetworkTestAgent(t)
+
+			id := "missing"
+			if tc.container >= 0 {
+				id = docker.containers[tc.container].ID
+			}
+			err := a.ConnectNetwork(ctx, tc.network, id, nil, tc.ip)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("ConnectNetwork() error = %v, want %v", err, tc.want)
+			}
+			if calls := docker.callCount("NetworkConnect"); calls != 0 {
+				t.Fatalf("NetworkConnect() calls = %d", calls)
+			}
+		})
+	}
+}
+
+func TestDisconnectNetwork(t *testing.T) {
+	a, docker := newNetworkTestAgent(t)
+
+	err := a.DisconnectNetwork(context.Background(), "backend", docker.containers[1].ID, false)
+	if !errors.Is(err, ErrContainerNotConnected) || !strings.Contains(err.Error(), `"container-1" is not on "backend"`) {
+		t.Fatalf("DisconnectNetwork() error = %v, want ErrContainerNotConnected", err)
+	}
+}
@@ -0,0 +1,148 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+)
+
+const dockerNetworkType = "network"
+
+type NetworkSubnet struct {
+	Subnet  string `json:"subnet"`
+	Gateway string `json:"gateway,omitempty"`
+	IPRange string `json:"ipRange,omitempty"`
+}
+
+// NetworkContainer is a container endpoint on a network. Addresses are
+// plain IPs; the prefix length is that of the matching subnet.
+type NetworkContainer struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	IPv4       string `json:"ipv4,omitempty"`
+	IPv6       string `json:"ipv6,omitempty"`
+	MacAddress string `json:"macAddress,omitempty"`
+}
+
+type Network struct {
+	ID         string             `json:"id"`
+	Name       string             `json:"name"`
+	Driver     string             `json:"driver"`
+	Scope      string             `json:"scope"`
+	Subnets    []NetworkSubnet    `json:"subnets"`
+	Internal   bool               `json:"internal"`
+	Attachable bool               `json:"attachable"`
+	Ingress    bool               `json:"ingress"`
+	Containers []NetworkContainer `json:"containers"`
+	Created    int64              `json:"created"`
+}
+
+// NetworkEventPayload is the payload of network.* events. ContainerID is set
+// for connect and disconnect.
+type NetworkEventPayload struct {
+	Network
+	ContainerID string `json:"containerId,omitempty"`
+}
+
+func (a *Agent) inspectNetwork(ctx context.Context, id string) (network.Inspect, error) {
+	return a.cache.networks.load(ctx, id, func(ctx context.Context, id string) (network.Inspect, error) {
+		return a.cli.NetworkInspect(ctx, id, network.InspectOptions{})
+	})
+}
+
+func (a *Agent) snapshotNetwork(ctx context.Context, summary network.Summary) Network {
+	ctx, cancel := withCallTimeout(ctx, a.snapshotOpts.CallTimeout)
+	defer cancel()
+
+	// The list leaves Containers empty; only inspect fills it in.
+	info, err := a.inspectNetwork(ctx, summary.ID)
+	if err != nil {
+		return networkFromInspect(summary)
+	}
+
+	return networkFromInspect(info)
+}
+
+func (a *Agent) networkPayload(ctx context.Context, msg events.Message) (*NetworkEventPayload, error) {
+	if msg.Actor.ID == "" {
+		return nil, fmt.Errorf("network event missing id")
+	}
+
+	payload := &NetworkEventPayload{ContainerID: msg.Actor.Attributes["container"]}
+
+	info, err := a.inspectNetwork(ctx, msg.Actor.ID)
+	if err != nil {
+		payload.Network = buildNetworkFallback(msg)
+		return payload, nil
+	}
+
+	payload.Network = networkFromInspect(info)
+	return payload, nil
+}
+
+func networkFromInspect(info network.Inspect) Network {
+	subnets := make([]NetworkSubnet, 0, len(info.IPAM.Config))
+	for _, config := range info.IPAM.Config {
+		subnets = append(subnets, NetworkSubnet{
+			Subnet:  config.Subnet,
+			Gateway: config.Gateway,
+			IPRange: config.IPRange,
+		})
+	}
+
+	containers := make([]NetworkContainer, 0, len(info.Containers))
+	for id, endpoint := range info.Containers {
+		containers = append(containers, NetworkContainer{
+			ID:         shortID(id),
+			Name:       endpoint.Name,
+			IPv4:       stripPrefixLen(endpoint.IPv4Address),
+			IPv6:       stripPrefixLen(endpoint.IPv6Address),
+			MacAddress: endpoint.MacAddress,
+		})
+	}
+	// Endpoints come from a map; keep the order stable so deltas only
+	// report real changes.
+	slices.SortFunc(containers, func(a, b NetworkContainer) int {
+		return strings.Compare(a.Name+a.ID, b.Name+b.ID)
+	})
+
+	var created int64
+	if !info.Created.IsZero() {
+		created = info.Created.Unix()
+	}
+
+	return Network{
+		ID:         info.ID,
+		Name:       info.Name,
+		Driver:     info.Driver,
+		Scope:      info.Scope,
+		Subnets:    subnets,
+		Internal:   info.Internal,
+		Attachable: info.Attachable,
+		Ingress:    info.Ingress,
+		Containers: containers,
+		Created:    created,
+	}
+}
+
+func buildNetworkFallback(msg events.Message) Network {
+	attrs := msg.Actor.Attributes
+
+	return Network{
+		ID:         msg.Actor.ID,
+		Name:       attrs["name"],
+		Driver:     attrs["type"],
+		Subnets:    []NetworkSubnet{},
+		Containers: []NetworkContainer{},
+		Created:    msg.Time,
+	}
+}
+
+func stripPrefixLen(address string) string {
+	ip, _, _ := strings.Cut(address, "/")
+	return ip
+}
@@ -0,0 +1,169 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+)
+
+func networkEvent(id string, action events.Action, attrs map[string]string) events.Message {
+	return events.Message{
+		Type:   events.NetworkEventType,
+		Action: action,
+		Actor:  events.Actor{ID: id, Attributes: attrs},
+	}
+}
+
+func TestNetworkFromInspect(t *testing.T) {
+	info := network.Inspect{
+		ID:         "net-1",
+		Name:       "backend",
+		Driver:     "bridge",
+		Scope:      "local",
+		Internal:   true,
+		Attachable: true,
+		Created:    time.Unix(1767225600, 0),
+		IPAM: network.IPAM{Config: []network.IPAMConfig{
+			{Subnet: "10.1.0.0/24", Gateway: "10.1.0.1", IPRange: "10.1.0.128/25"},
+			{Subnet: "fd00::/64", Gateway: "fd00::1"},
+		}},
+		Containers: map[string]network.EndpointResource{
+			fmt.Sprintf("%064x", 2): {Name: "worker", IPv4Address: "10.1.0.3/24"},
+			fmt.Sprintf("%064x", 1): {Name: "api", IPv4Address: "10.1.0.2/24", IPv6Address: "fd00::2/64", MacAddress: "02:42:0a:01:00:02"},
+		},
+	}
+
+	got := networkFromInspect(info)
+
+	if got.ID != "net-1" || got.Name != "backend" || got.Driver != "bridge" || got.Scope != "local" {
+		t.Fatalf("networkFromInspect() = %+v", got)
+	}
+	if !got.Internal || !got.Attachable || got.Ingress || got.Created != 1767225600 {
+		t.Fatalf("networkFromInspect() flags = %+v", got)
+	}
+	if len(got.Subnets) != 2 || got.Subnets[0] != (NetworkSubnet{Subnet: "10.1.0.0/24", Gateway: "10.1.0.1", IPRange: "10.1.0.128/25"}) {
+		t.Fatalf("subnets = %+v", got.Subnets)
+	}
+
+	want := []NetworkContainer{
+		{ID: "000000000000", Name: "api", IPv4: "10.1.0.2", IPv6: "fd00::2", MacAddress: "02:42:0a:01:00:02"},
+		{ID: "000000000000", Name: "worker", IPv4: "10.1.0.3"},
+	}
+	if len(got.Containers) != len(want) {
+		t.Fatalf("containers = %+v", got.Containers)
+	}
+	for i := range want {
+		if got.Containers[i] != want[i] {
+			t.Fatalf("containers[%d] = %+v, want %+v", i, got.Containers[i], want[i])
+		}
+	}
+}
+
+func TestNetworkSnapshot(t *testing.T) {
+	docker := newFakeDocker(3, 1)
+	a := newAgent(docker, snapshotOptions{Workers: 2, CallTimeout: time.Second, Timeout: time.Second}, eventOptions{})
+
+	payload, err := a.buildSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("buildSnapshot() unexpected error: %v", err)
+	}
+
+	if len(payload.Networks) != 1 {
+		t.Fatalf("networks = %d, want 1", len(payload.Networks))
+	}
+	bridge := payload.Networks[0]
+	if bridge.Name != "bridge" || len(bridge.Subnets) != 1 || len(bridge.Containers) != 3 {
+		t.Fatalf("network = %+v", bridge)
+	}
+	if bridge.Containers[0].Name != "container-0" || bridge.Containers[0].IPv4 != "172.17.0.2" {
+		t.Fatalf("containers[0] = %+v", bridge.Containers[0])
+	}
+
+	t.Run("scoped requests leave networks out", func(t *testing.T) {
+		scoped, err := a.buildScopedSnapshot(context.Background(), snapshotScope{Containers: true})
+		if err != nil {
+			t.Fatalf("buildScopedSnapshot() unexpected error: %v", err)
+		}
+		if scoped.Networks != nil {
+			t.Fatalf("networks = %+v, want nil", scoped.Networks)
+		}
+	})
+
+	t.Run("deltas report endpoint changes", func(t *testing.T) {
+		var tracker snapshotTracker
+		tracker.next(*payload, true, time.Now())
+
+		docker.mu.Lock()
+		delete(docker.networks[0].Containers, docker.containers[2].ID)
+		docker.mu.Unlock()
+		a.cache.observe(networkEvent(bridge.ID, events.ActionDisconnect, nil))
+
+		current, err := a.buildSnapshot(context.Background())
+		if err != nil {
+			t.Fatalf("buildSnapshot() unexpected error: %v", err)
+		}
+
+		event := tracker.next(*current, false, time.Now())
+		if event == nil || event.Type != snapshotDeltaEventType {
+			t.Fatalf("next() = %+v, want delta", event)
+		}
+		delta := event.Data.(SnapshotDeltaPayload)
+		if len(delta.Networks.Changed) != 1 || len(delta.Networks.Changed[0].Containers) != 2 {
+			t.Fatalf("network delta = %+v", delta.Networks)
+		}
+	})
+}
+
+func TestNetworkEvents(t *testing.T) {
+	t.Run("connect carries the network and container", func(t *testing.T) {
+		docker := newFakeDocker(1, 0)
+		a := startEventLoop(t, docker, eventOptions{})
+
+		id := docker.networks[0].ID
+		event := publish(t, a, docker, networkEvent(id, events.ActionConnect, map[string]string{
+			"container": docker.containers[0].ID,
+			"name":      "bridge",
+			"type":      "bridge",
+		}))
+
+		if event.Type != "network.connect" {
+			t.Fatalf("event = %q", event.Type)
+		}
+		payload := event.Data.(*NetworkEventPayload)
+		if payload.ContainerID != docker.containers[0].ID || payload.Name != "bridge" || len(payload.Containers) != 1 {
+			t.Fatalf("payload = %+v", payload)
+		}
+	})
+
+	t.Run("destroy falls back to event attributes", func(t *testing.T) {
+		docker := newFakeDocker(0, 0)
+		a := startEventLoop(t, docker, eventOptions{})
+
+		id := docker.networks[0].ID
+		if _, err := a.inspectNetwork(context.Background(), id); err != nil {
+			t.Fatalf("inspectNetwork() unexpected error: %v", err)
+		}
+
+		docker.mu.Lock()
+		docker.networks = nil
+		docker.mu.Unlock()
+
+		event := publish(t, a, docker, networkEvent(id, events.ActionDestroy, map[string]string{
+			"name": "bridge",
+			"type": "bridge",
+		}))
+
+		payload := event.Data.(*NetworkEventPayload)
+		if event.Type != "network.destroy" || payload.ID != id || payload.Driver != "bridge" || len(payload.Containers) != 0 {
+			t.Fatalf("event = %q payload %+v", event.Type, payload)
+		}
+
+		if stats := a.CacheStats(); stats.NetworkMisses != 2 {
+			t.Fatalf("CacheStats() network misses = %d, want 2", stats.NetworkMisses)
+		}
+	})
+}
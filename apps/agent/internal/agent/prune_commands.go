@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types/build"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// pruneFilters builds the filters prune calls share. Until is a duration or
+// timestamp as Docker accepts it. Labels are key or key=value; a leading !
+// keeps objects with that label instead.
+func pruneFilters(until string, labels []string) filters.Args {
+	args := filters.NewArgs()
+	if until = strings.TrimSpace(until); until != "" {
+		args.Add("until", until)
+	}
+
+	for _, label := range labels {
+		label = strings.TrimSpace(label)
+		if excluded, ok := strings.CutPrefix(label, "!"); ok {
+			args.Add("label!", excluded)
+			continue
+		}
+		if label != "" {
+			args.Add("label", label)
+		}
+	}
+
+	return args
+}
+
+// PruneContainers removes stopped containers and returns their IDs and the
+// space their writable layers took.
+func (a *Agent) PruneContainers(ctx context.Context, until string, labels []string) ([]string, uint64, error) {
+	report, err := a.cli.ContainersPrune(ctx, pruneFilters(until, labels))
+	if err != nil {
+		return nil, 0, fmt.Errorf("docker prune containers: %w", err)
+	}
+
+	deleted := report.ContainersDeleted
+	if deleted == nil {
+		deleted = []string{}
+	}
+
+	return deleted, report.SpaceReclaimed, nil
+}
+
+// PruneImages removes dangling images, or every image no container uses
+// when all is set, and returns the IDs of deleted images. Tags removed from
+// images that stay are not included.
+func (a *Agent) PruneImages(ctx context.Context, all bool, until string, labels []string) ([]string, uint64, error) {
+	args := pruneFilters(until, labels)
+	args.Add("dangling", fmt.Sprint(!all))
+
+	report, err := a.cli.ImagesPrune(ctx, args)
+	if err != nil {
+		return nil, 0, fmt.Errorf("docker prune images: %w", err)
+	}
+
+	deleted := []string{}
+	for _, item := range report.ImagesDeleted {
+		if item.Deleted != "" {
+			deleted = append(deleted, item.Deleted)
+		}
+	}
+
+	return deleted, report.SpaceReclaimed, nil
+}
+
+// PruneNetworks removes networks no container is connected to and returns
+// their names.
+func (a *Agent) PruneNetworks(ctx context.Context, until string, labels []string) ([]string, error) {
+	report, err := a.cli.NetworksPrune(ctx, pruneFilters(until, labels))
+	if err != nil {
+		return nil, fmt.Errorf("docker prune networks: %w", err)
+	}
+
+	deleted := report.NetworksDeleted
+	if deleted == nil {
+		deleted = []string{}
+	}
+
+	return deleted, nil
+}
+
+// PruneBuildCache removes build cache not in use, or all of it when all is
+// set, and returns the IDs of removed records.
+func (a *Agent) PruneBuildCache(ctx context.Context, all bool, until string) ([]string, uint64, error) {
+	report, err := a.cli.BuildCachePrune(ctx, build.CachePruneOptions{
+		All:     all,
+		Filters: pruneFilters(until, nil),
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("docker prune build cache: %w", err)
+	}
+
+	if report == nil {
+		return []string{}, 0, nil
+	}
+
+	deleted := report.CachesDeleted
+	if deleted == nil {
+		deleted = []string{}
+	}
+
+	return deleted, report.SpaceReclaimed, nil
+}
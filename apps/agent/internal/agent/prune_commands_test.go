@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+)
+
+func TestPruneFilters(t *testing.T) {
+	args := pruneFilters(" 24h ", []string{"env=dev", "!keep", " ", "team"})
+
+	if got := args.Get("until"); !slices.Equal(got, []string{"24h"}) {
+		t.Fatalf("until = %v", got)
+	}
+	if got := slices.Sorted(slices.Values(args.Get("label"))); !slices.Equal(got, []string{"env=dev", "team"}) {
+		t.Fatalf("label = %v", got)
+	}
+	if got := args.Get("label!"); !slices.Equal(got, []string{"keep"}) {
+		t.Fatalf("label! = %v", got)
+	}
+
+	t.Run("no filters", func(t *testing.T) {
+		if args := pruneFilters("", nil); args.Len() != 0 {
+			t.Fatalf("filters = %v", args)
+		}
+	})
+}
+
+func newPruneTestAgent(t *testing.T) (*Agent, *fakeDocker) {
+	t.Helper()
+
+	docker := newFakeDocker(3, 3)
+	docker.containers[2].State = container.StateExited
+	docker.containers[2].SizeRw = 5 << 20
+	docker.images = append(docker.images, image.Summary{ID: "sha256:dangling", Size: 7 << 20})
+	docker.networks = append(docker.networks, network.Inspect{ID: "old-id", Name: "old"})
+	docker.diskUsage = testDiskUsage()
+
+	return newAgent(docker, snapshotOptions{Workers: 1}, eventOptions{}), docker
+}
+
+func TestPruneCommands(t *testing.T) {
+	ctx := context.Background()
+	a, docker := newPruneTestAgent(t)
+	stopped := docker.containers[2].ID
+	unused := docker.images[2].ID
+
+	t.Run("dangling images only by default", func(t *testing.T) {
+		deleted, reclaimed, err := a.PruneImages(ctx, false, "", nil)
+		if err != nil {
+			t.Fatalf("PruneImages() unexpected error: %v", err)
+		}
+		if !slices.Equal(deleted, []string{"sha256:dangling"}) || reclaimed != 7<<20 {
+			t.Fatalf("PruneImages() = %v, %d", deleted, reclaimed)
+		}
+		if got := docker.prunes["images"].Get("dangling"); !slices.Equal(got, []string{"true"}) {
+			t.Fatalf("dangling filter = %v", got)
+		}
+	})
+
+	t.Run("stopped containers", func(t *testing.T) {
+		deleted, reclaimed, err := a.PruneContainers(ctx, "1h", []string{"env=dev"})
+		if err != nil {
+			t.Fatalf("PruneContainers() unexpected error: %v", err)
+		}
+		if !slices.Equal(deleted, []string{stopped}) || reclaimed != 5<<20 {
+			t.Fatalf("PruneContainers() = %v, %d", deleted, reclaimed)
+		}
+		if args := docker.prunes["containers"]; !args.ExactMatch("until", "1h") || !args.ExactMatch("label", "env=dev") {
+			t.Fatalf("container filters = %v", args)
+		}
+	})
+
+	t.Run("all unused images, deleted IDs without untagged references", func(t *testing.T) {
+		deleted, reclaimed, err := a.PruneImages(ctx, true, "", nil)
+		if err != nil {
+			t.Fatalf("PruneImages() unexpected error: %v", err)
+		}
+		if !slices.Equal(deleted, []string{unused}) || reclaimed != 3<<20 {
+			t.Fatalf("PruneImages() = %v, %d", deleted, reclaimed)
+		}
+		if got := docker.prunes["images"].Get("dangling"); !slices.Equal(got, []string{"false"}) {
+			t.Fatalf("dangling filter = %v", got)
+		}
+	})
+
+	t.Run("networks without containers", func(t *testing.T) {
+		deleted, err := a.PruneNetworks(ctx, "", nil)
+		if err != nil {
+			t.Fatalf("PruneNetworks() unexpected error: %v", err)
+		}
+		if !slices.Equal(deleted, []string{"old"}) {
+			t.Fatalf("PruneNetworks() = %v", deleted)
+		}
+	})
+
+	t.Run("build cache not in use", func(t *testing.T) {
+		deleted, reclaimed, err := a.PruneBuildCache(ctx, false, "48h")
+		if err != nil {
+			t.Fatalf("PruneBuildCache() unexpected error: %v", err)
+		}
+		if !slices.Equal(deleted, []string{"step-2"}) || reclaimed != 200<<20 {
+			t.Fatalf("PruneBuildCache() = %v, %d", deleted, reclaimed)
+		}
+		if args := docker.prunes["builder"]; !args.ExactMatch("until", "48h") {
+			t.Fatalf("build cache filters = %v", args)
+		}
+	})
+
+	t.Run("nothing left reports empty lists", func(t *testing.T) {
+		deleted, reclaimed, err := a.PruneContainers(ctx, "", nil)
+		if err != nil {
+			t.Fatalf("PruneContainers() unexpected error: %v", err)
+		}
+		if deleted == nil || len(deleted) != 0 || reclaimed != 0 {
+			t.Fatalf("PruneContainers() = %#v, %d", deleted, reclaimed)
+		}
+	})
+}
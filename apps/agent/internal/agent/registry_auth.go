@@ -0,0 +1,191 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/registry"
+	"github.com/sonomandeep/containers/agent/internal/env"
+)
+
+const (
+	agentRegistryAuthFileEnv = "AGENT_REGISTRY_AUTH_FILE"
+
+	// dockerHubAuthKey is the key docker login stores Docker Hub
+	// credentials under.
+	dockerHubAuthKey = "https://index.docker.io/v1/"
+
+	// credentialHelperTimeout bounds a docker-credential-* call, which may
+	// talk to a keychain or a cloud API.
+	credentialHelperTimeout = 10 * time.Second
+)
+
+// dockerConfigFile is the part of a Docker CLI config.json that holds
+// registry credentials.
+type dockerConfigFile struct {
+	Auths       map[string]dockerConfigAuth `json:"auths"`
+	CredsStore  string                      `json:"credsStore"`
+	CredHelpers map[string]string           `json:"credHelpers"`
+}
+
+type dockerConfigAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// defaultRegistryAuthFile is where the Docker CLI keeps its config, so an
+// agent running on the host uses what docker login stored.
+func defaultRegistryAuthFile() string {
+	if dir := env.String("DOCKER_CONFIG", ""); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// registryAuth returns the encoded credentials for host: the given ones
+// when set, otherwise those in the agent's Docker config. Hosts without
+// stored credentials are pulled from anonymously.
+func (a *Agent) registryAuth(ctx context.Context, host string, username string, password string) (string, error) {
+	auth := registry.AuthConfig{Username: username, Password: password, ServerAddress: host}
+	if username == "" && password == "" {
+		stored, err := lookupRegistryAuth(ctx, a.registryAuthFile, host)
+		if err != nil {
+			return "", err
+		}
+		auth = stored
+	}
+
+	if auth == (registry.AuthConfig{}) {
+		return "", nil
+	}
+
+	encoded, err := registry.EncodeAuthConfig(auth)
+	if err != nil {
+		return "", fmt.Errorf("encode registry auth: %w", err)
+	}
+
+	return encoded, nil
+}
+
+// lookupRegistryAuth finds credentials for host in a Docker config file,
+// asking a credential helper when the config names one.
+func lookupRegistryAuth(ctx context.Context, path string, host string) (registry.AuthConfig, error) {
+	if path == "" {
+		return registry.AuthConfig{}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return registry.AuthConfig{}, nil
+	}
+	if err != nil {
+		return registry.AuthConfig{}, fmt.Errorf("read registry auth file: %w", err)
+	}
+
+	var config dockerConfigFile
+	if err := json.Unmarshal(data, &config); err != nil {
+		return registry.AuthConfig{}, fmt.Errorf("parse registry auth file %s: %w", path, err)
+	}
+
+	key := registryAuthKey(host)
+	if helper := config.CredHelpers[host]; helper != "" {
+		return credentialHelperAuth(ctx, helper, key)
+	}
+	if config.CredsStore != "" {
+		return credentialHelperAuth(ctx, config.CredsStore, key)
+	}
+
+	for stored, entry := range config.Auths {
+		if registryAuthKey(stored) != key {
+			continue
+		}
+
+		auth := registry.AuthConfig{
+			Username:      entry.Username,
+			Password:      entry.Password,
+			IdentityToken: entry.IdentityToken,
+			ServerAddress: host,
+		}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return registry.AuthConfig{}, fmt.Errorf("invalid auth for %s in %s: %w", stored, path, err)
+			}
+			auth.Username, auth.Password, _ = strings.Cut(string(decoded), ":")
+		}
+		return auth, nil
+	}
+
+	return registry.AuthConfig{}, nil
+}
+
+// registryAuthKey normalizes a registry as config files key it: Docker Hub
+// under its legacy index URL, others by host with scheme and path dropped.
+func registryAuthKey(host string) string {
+	host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+	host, _, _ = strings.Cut(host, "/")
+
+	switch host {
+	case "docker.io", "index.docker.io", "registry-1.docker.io":
+		return dockerHubAuthKey
+	}
+
+	return host
+}
+
+// credentialHelperAuth runs docker-credential-<helper> get, the protocol
+// the Docker CLI uses for keychains and cloud registries.
+func credentialHelperAuth(ctx context.Context, helper string, key string) (registry.AuthConfig, error) {
+	ctx, cancel := context.WithTimeout(ctx, credentialHelperTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(key)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		output := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(output, "credentials not found") {
+			return registry.AuthConfig{}, nil
+		}
+		return registry.AuthConfig{}, fmt.Errorf("credential helper %s: %w: %s", helper, err, output)
+	}
+
+	var credentials struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &credentials); err != nil {
+		return registry.AuthConfig{}, fmt.Errorf("credential helper %s: %w", helper, err)
+	}
+
+	auth := registry.AuthConfig{ServerAddress: key}
+	// Helpers return identity tokens under this placeholder user name.
+	if credentials.Username == "<token>" {
+		auth.IdentityToken = credentials.Secret
+	} else {
+		auth.Username = credentials.Username
+		auth.Password = credentials.Secret
+	}
+
+	return auth, nil
+}
@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types/registry"
+)
+
+func TestLookupRegistryAuth(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	writeTestFiles(t, dir, map[string]string{
+		// dXNlcjpwYXNz is user:pass.
+		"config.json": `{
+			"auths": {
+				"https://index.docker.io/v1/": {"auth": "dXNlcjpwYXNz"},
+				"https://ghcr.io": {"identitytoken": "ghcr-token"}
+			},
+			"credHelpers": {"123.dkr.ecr.eu-west-1.amazonaws.com": "fake"}
+		}`,
+	})
+
+	tests := []struct {
+		name string
+		host string
+		want registry.AuthConfig
+	}{
+		{"docker hub under its index url", "docker.io", registry.AuthConfig{Username: "user", Password: "pass", ServerAddress: "docker.io"}},
+		{"key with a scheme", "ghcr.io", registry.AuthConfig{IdentityToken: "ghcr-token", ServerAddress: "ghcr.io"}},
+		{"unknown registry pulls anonymously", "quay.io", registry.AuthConfig{}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			auth, err := lookupRegistryAuth(ctx, path, tc.host)
+			if err != nil {
+				t.Fatalf("lookupRegistryAuth() unexpected error: %v", err)
+			}
+			if auth != tc.want {
+				t.Fatalf("lookupRegistryAuth(%q) = %+v, want %+v", tc.host, auth, tc.want)
+			}
+		})
+	}
+
+	t.Run("credential helper", func(t *testing.T) {
+		bin := t.TempDir()
+		helper := "#!/bin/sh\nread server\n" +
+			"echo '{\"ServerURL\":\"'$server'\",\"Username\":\"AWS\",\"Secret\":\"ecr-password\"}'\n"
+		if err := os.WriteFile(filepath.Join(bin, "docker-credential-fake"), []byte(helper), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+		auth, err := lookupRegistryAuth(ctx, path, "123.dkr.ecr.eu-west-1.amazonaws.com")
+		if err != nil {
+			t.Fatalf("lookupRegistryAuth() unexpected error: %v", err)
+		}
+		if auth.Username != "AWS" || auth.Password != "ecr-password" {
+			t.Fatalf("auth = %+v", auth)
+		}
+	})
+
+	t.Run("missing file pulls anonymously", func(t *testing.T) {
+		auth, err := lookupRegistryAuth(ctx, filepath.Join(dir, "missing.json"), "docker.io")
+		if err != nil || auth != (registry.AuthConfig{}) {
+			t.Fatalf("lookupRegistryAuth() = %+v, %v", auth, err)
+		}
+	})
+}
@@ -0,0 +1,228 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	snapshotChunkEventType    = "snapshot.chunk"
+	snapshotCompleteEventType = "snapshot.complete"
+
+	agentSnapshotChunkBytesEnv = "AGENT_SNAPSHOT_CHUNK_BYTES"
+
+	// defaultSnapshotChunkBytes matches the 32KiB default read limit of
+	// coder/websocket, so a server that never raised it still reads chunks.
+	defaultSnapshotChunkBytes = 32 << 10
+)
+
+// SnapshotChunkPayload carries part of a full snapshot that did not fit the
+// byte budget as one event. Chunks of one snapshot share SnapshotID and
+// arrive in Index order; the snapshot is only complete once the
+// snapshot.complete event with the same SnapshotID arrives after all Total
+// chunks. A server that sees a new SnapshotID or a gap first should discard
+// what it collected.
+type SnapshotChunkPayload struct {
+	SnapshotID string      `json:"snapshotId"`
+	Seq        uint64      `json:"seq"`
+	CommandID  string      `json:"commandId,omitempty"`
+	Index      int         `json:"index"`
+	Total      int         `json:"total"`
+	Containers []Container `json:"containers"`
+	Images     []Image     `json:"images"`
+	Networks   []Network   `json:"networks"`
+	Volumes    []Volume    `json:"volumes"`
+}
+
+// SnapshotCompletePayload marks the end of a chunked snapshot. The counts
+// let the server check it reassembled everything.
+type SnapshotCompletePayload struct {
+	SnapshotID string `json:"snapshotId"`
+	Seq        uint64 `json:"seq"`
+	CommandID  string `json:"commandId,omitempty"`
+	Total      int    `json:"total"`
+	Containers int    `json:"containers"`
+	Images     int    `json:"images"`
+	Networks   int    `json:"networks"`
+	Volumes    int    `json:"volumes"`
+}
+
+// emitSnapshotEvent sends event, splitting full snapshots larger than the
+// chunk budget into the event's Parts, so the chunks travel as one unit.
+// Deltas and other events go out as they are.
+func (a *Agent) emitSnapshotEvent(ctx context.Context, event Event) error {
+	payload, ok := event.Data.(SnapshotPayload)
+	if event.Type != snapshotEventType || !ok {
+		a.emitEvent(ctx, event)
+		return nil
+	}
+
+	chunks, err := chunkSnapshot(payload, event.TS, a.snapshotOpts.ChunkBytes)
+	if err != nil {
+		return err
+	}
+
+	if chunks == nil {
+		a.emitEvent(ctx, event)
+		return nil
+	}
+
+	event.Data = nil
+	event.Parts = chunks
+	a.emitEvent(ctx, event)
+	return nil
+}
+
+// stamped fills in the fields the client stamps at write time with their
+// widest values, a replayed event with the largest sequence number, so sizes
+// measured before stamping hold on the wire. Sessions are rand.Text too.
+func stamped(event Event) Event {
+	event.Session = rand.Text()
+	event.Seq = math.MaxUint64
+	event.Replay = true
+
+	return event
+}
+
+// chunkSnapshot splits payload into snapshot.chunk events whose JSON
+// encoding stays within budget, followed by a snapshot.complete event. It
+// returns nil when the snapshot fits in one event or budget is not positive.
+// An object larger than the budget on its own gets a chunk to itself.
+func chunkSnapshot(payload SnapshotPayload, ts time.Time, budget int) ([]Event, error) {
+	if budget <= 0 {
+		return nil, nil
+	}
+
+	whole, err := json.Marshal(stamped(Event{Type: snapshotEventType, TS: ts, Data: payload}))
+	if err != nil {
+		return nil, fmt.Errorf("encode snapshot: %w", err)
+	}
+	if len(whole) <= budget {
+		return nil, nil
+	}
+
+	containerSizes, err := encodedSizes(payload.Containers)
+	if err != nil {
+		return nil, err
+	}
+	imageSizes, err := encodedSizes(payload.Images)
+	if err != nil {
+		return nil, err
+	}
+	networkSizes, err := encodedSizes(payload.Networks)
+	if err != nil {
+		return nil, err
+	}
+	volumeSizes, err := encodedSizes(payload.Volumes)
+	if err != nil {
+		return nil, err
+	}
+
+	id := rand.Text()
+	items := len(payload.Containers) + len(payload.Images) + len(payload.Networks) + len(payload.Volumes)
+
+	// The envelope with empty collections and the widest possible index,
+	// total and stamp; every item then adds its own size plus a separating
+	// comma.
+	envelope, err := json.Marshal(stamped(Event{
+		Type: snapshotChunkEventType,
+		TS:   ts,
+		Data: SnapshotChunkPayload{
+			SnapshotID: id,
+			Seq:        payload.Seq,
+			CommandID:  payload.CommandID,
+			Index:      items,
+			Total:      items,
+			Containers: []Container{},
+			Images:     []Image{},
+			Networks:   []Network{},
+			Volumes:    []Volume{},
+		},
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("encode snapshot chunk: %w", err)
+	}
+
+	var chunks []SnapshotChunkPayload
+	newChunk := func() SnapshotChunkPayload {
+		return SnapshotChunkPayload{
+			Containers: []Container{},
+			Images:     []Image{},
+			Networks:   []Network{},
+			Volumes:    []Volume{},
+		}
+	}
+	current := newChunk()
+	size := len(envelope)
+	add := func(itemSize int) {
+		empty := len(current.Containers)+len(current.Images)+len(current.Networks)+len(current.Volumes) == 0
+		if size+itemSize+1 > budget && !empty {
+			chunks = append(chunks, current)
+			current = newChunk()
+			size = len(envelope)
+		}
+		size += itemSize + 1
+	}
+
+	for i, item := range payload.Containers {
+		add(containerSizes[i])
+		current.Containers = append(current.Containers, item)
+	}
+	for i, item := range payload.Images {
+		add(imageSizes[i])
+		current.Images = append(current.Images, item)
+	}
+	for i, item := range payload.Networks {
+		add(networkSizes[i])
+		current.Networks = append(current.Networks, item)
+	}
+	for i, item := range payload.Volumes {
+		add(volumeSizes[i])
+		current.Volumes = append(current.Volumes, item)
+	}
+	chunks = append(chunks, current)
+
+	events := make([]Event, 0, len(chunks)+1)
+	for i, chunk := range chunks {
+		chunk.SnapshotID = id
+		chunk.Seq = payload.Seq
+		chunk.CommandID = payload.CommandID
+		chunk.Index = i
+		chunk.Total = len(chunks)
+		events = append(events, Event{Type: snapshotChunkEventType, TS: ts, Data: chunk})
+	}
+
+	events = append(events, Event{
+		Type: snapshotCompleteEventType,
+		TS:   ts,
+		Data: SnapshotCompletePayload{
+			SnapshotID: id,
+			Seq:        payload.Seq,
+			CommandID:  payload.CommandID,
+			Total:      len(chunks),
+			Containers: len(payload.Containers),
+			Images:     len(payload.Images),
+			Networks:   len(payload.Networks),
+			Volumes:    len(payload.Volumes),
+		},
+	})
+
+	return events, nil
+}
+
+func encodedSizes[T any](items []T) ([]int, error) {
+	sizes := make([]int, len(items))
+	for i, item := range items {
+		data, err := json.Marshal(item)
+		if err != nil {
+			return nil, fmt.Errorf("encode snapshot item: %w", err)
+		}
+		sizes[i] = len(data)
+	}
+
+	return sizes, nil
+}
@@ -0,0 +1,177 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func chunkTestSnapshot(containers int, images int) SnapshotPayload {
+	payload := SnapshotPayload{Seq: 7, Containers: []Container{}, Images: []Image{}}
+	for i := range containers {
+		payload.Containers = append(payload.Containers, Container{
+			ID:    fmt.Sprintf("%064x", i),
+			Name:  fmt.Sprintf("container-%d", i),
+			Image: "app:latest",
+			State: "running",
+			Ports: []ContainerPort{},
+			Envs: []EnvironmentVariable{
+				{Key: "APP_ENV", Value: "production"},
+				{Key: "PADDING", Value: strings.Repeat("x", i%50)},
+			},
+		})
+	}
+	for i := range images {
+		payload.Images = append(payload.Images, Image{
+			ID:         fmt.Sprintf("%012x", i),
+			Name:       fmt.Sprintf("app-%d", i),
+			Tags:       []string{"latest"},
+			Containers: []ImageContainer{},
+		})
+	}
+
+	return payload
+}
+
+func TestChunkSnapshot(t *testing.T) {
+	ts := time.Unix(1767225600, 0)
+
+	t.Run("small snapshots stay whole", func(t *testing.T) {
+		events, err := chunkSnapshot(chunkTestSnapshot(3, 2), ts, 64<<10)
+		if err != nil {
+			t.Fatalf("chunkSnapshot() unexpected error: %v", err)
+		}
+
+		if events != nil {
+			t.Fatalf("chunkSnapshot() = %d events, want nil", len(events))
+		}
+	})
+
+	t.Run("zero budget disables chunking", func(t *testing.T) {
+		events, err := chunkSnapshot(chunkTestSnapshot(500, 100), ts, 0)
+		if err != nil || events != nil {
+			t.Fatalf("chunkSnapshot() = %d events, %v", len(events), err)
+		}
+	})
+
+	t.Run("chunks fit the budget and reassemble in order", func(t *testing.T) {
+		const budget = 4096
+		payload := chunkTestSnapshot(200, 80)
+		payload.CommandID = "cmd-1"
+
+		events, err := chunkSnapshot(payload, ts, budget)
+		if err != nil {
+			t.Fatalf("chunkSnapshot() unexpected error: %v", err)
+		}
+
+		if len(events) < 3 {
+			t.Fatalf("chunkSnapshot() = %d events", len(events))
+		}
+
+		complete, ok := events[len(events)-1].Data.(SnapshotCompletePayload)
+		if events[len(events)-1].Type != snapshotCompleteEventType || !ok {
+			t.Fatalf("last event = %q", events[len(events)-1].Type)
+		}
+
+		reassembled := SnapshotPayload{Seq: payload.Seq, CommandID: payload.CommandID}
+		for i, event := range events[:len(events)-1] {
+			// As the client writes a replay of it.
+			wire := event
+			wire.Session = rand.Text()
+			wire.Seq = 1 << 40
+			wire.Replay = true
+			data, err := json.Marshal(wire)
+			if err != nil {
+				t.Fatalf("json.Marshal() unexpected error: %v", err)
+			}
+			if len(data) > budget {
+				t.Fatalf("stamped chunk %d is %d bytes, budget %d", i, len(data), budget)
+			}
+
+			chunk := event.Data.(SnapshotChunkPayload)
+			if event.Type != snapshotChunkEventType || chunk.Index != i || chunk.Total != len(events)-1 {
+				t.Fatalf("chunk %d = %q index %d total %d", i, event.Type, chunk.Index, chunk.Total)
+			}
+			if chunk.SnapshotID != complete.SnapshotID || chunk.Seq != 7 || chunk.CommandID != "cmd-1" {
+				t.Fatalf("chunk %d header = %+v", i, chunk)
+			}
+
+			reassembled.Containers = append(reassembled.Containers, chunk.Containers...)
+			reassembled.Images = append(reassembled.Images, chunk.Images...)
+		}
+
+		if complete.Total != len(events)-1 || complete.Containers != 200 || complete.Images != 80 {
+			t.Fatalf("complete = %+v", complete)
+		}
+
+		if !reflect.DeepEqual(reassembled, payload) {
+			t.Fatal("reassembled snapshot differs from the original")
+		}
+	})
+
+	t.Run("oversized objects get their own chunk", func(t *testing.T) {
+		payload := chunkTestSnapshot(3, 0)
+		payload.Containers[1].Envs = append(payload.Containers[1].Envs, EnvironmentVariable{
+			Key:   "BLOB",
+			Value: strings.Repeat("y", 2048),
+		})
+
+		events, err := chunkSnapshot(payload, ts, 1024)
+		if err != nil {
+			t.Fatalf("chunkSnapshot() unexpected error: %v", err)
+		}
+
+		if len(events) != 4 {
+			t.Fatalf("chunkSnapshot() = %d events, want 4", len(events))
+		}
+
+		if chunk := events[1].Data.(SnapshotChunkPayload); len(chunk.Containers) != 1 || chunk.Containers[0].ID != payload.Containers[1].ID {
+			t.Fatalf("chunk 1 = %+v", chunk.Containers)
+		}
+	})
+
+	t.Run("each snapshot gets a new id", func(t *testing.T) {
+		payload := chunkTestSnapshot(50, 0)
+
+		first, err := chunkSnapshot(payload, ts, 2048)
+		if err != nil {
+			t.Fatalf("chunkSnapshot() unexpected error: %v", err)
+		}
+		second, err := chunkSnapshot(payload, ts, 2048)
+		if err != nil {
+			t.Fatalf("chunkSnapshot() unexpected error: %v", err)
+		}
+
+		if first[0].Data.(SnapshotChunkPayload).SnapshotID == second[0].Data.(SnapshotChunkPayload).SnapshotID {
+			t.Fatal("chunked snapshots share an id")
+		}
+	})
+}
+
+func TestEmitSnapshotEvent(t *testing.T) {
+	a := newAgent(newFakeDocker(0, 0), snapshotOptions{Workers: 1, ChunkBytes: 2048}, eventOptions{})
+	payload := chunkTestSnapshot(50, 0)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- a.emitSnapshotEvent(context.Background(), Event{Type: snapshotEventType, Key: snapshotEventType, Data: payload})
+	}()
+
+	event := nextEvent(t, a, time.Second)
+	if err := <-errs; err != nil {
+		t.Fatalf("emitSnapshotEvent() unexpected error: %v", err)
+	}
+
+	// The chunks go out as one event so the client queues them as a unit.
+	if event.Type != snapshotEventType || event.Key != snapshotEventType || event.Data != nil || len(event.Parts) < 3 {
+		t.Fatalf("event = %s key %q with %d parts", event.Type, event.Key, len(event.Parts))
+	}
+	if last := event.Parts[len(event.Parts)-1]; last.Type != snapshotCompleteEventType {
+		t.Fatalf("last part = %s", last.Type)
+	}
+}
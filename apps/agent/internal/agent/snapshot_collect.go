@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sonomandeep/containers/agent/internal/env"
+)
+
+const (
+	agentSnapshotWorkersEnv     = "AGENT_SNAPSHOT_WORKERS"
+	agentSnapshotCallTimeoutEnv = "AGENT_SNAPSHOT_CALL_TIMEOUT"
+	agentSnapshotTimeoutEnv     = "AGENT_SNAPSHOT_TIMEOUT"
+	agentSnapshotIntervalEnv    = "AGENT_SNAPSHOT_INTERVAL"
+
+	defaultSnapshotWorkers     = 8
+	defaultSnapshotCallTimeout = 5 * time.Second
+	defaultSnapshotTimeout     = 20 * time.Second
+	defaultSnapshotInterval    = 30 * time.Second
+)
+
+// snapshotOptions bounds snapshot collection. Workers caps concurrent Docker
+// calls, CallTimeout applies to each inspect or stats call and Timeout to the
+// whole snapshot; whatever is still running then falls back to list data.
+// Interval is the default period between snapshots and ChunkBytes the
+// largest encoded full snapshot sent as one event.
+type snapshotOptions struct {
+	Workers     int
+	CallTimeout time.Duration
+	Timeout     time.Duration
+	Interval    time.Duration
+	ChunkBytes  int
+}
+
+func snapshotOptionsFromEnv() (snapshotOptions, error) {
+	workers, err := env.Int(agentSnapshotWorkersEnv, defaultSnapshotWorkers)
+	if err != nil {
+		return snapshotOptions{}, err
+	}
+
+	callTimeout, err := env.Duration(agentSnapshotCallTimeoutEnv, defaultSnapshotCallTimeout)
+	if err != nil {
+		return snapshotOptions{}, err
+	}
+
+	timeout, err := env.Duration(agentSnapshotTimeoutEnv, defaultSnapshotTimeout)
+	if err != nil {
+		return snapshotOptions{}, err
+	}
+
+	interval, err := env.Duration(agentSnapshotIntervalEnv, defaultSnapshotInterval)
+	if err != nil {
+		return snapshotOptions{}, err
+	}
+
+	chunkBytes, err := env.Int(agentSnapshotChunkBytesEnv, defaultSnapshotChunkBytes)
+	if err != nil {
+		return snapshotOptions{}, err
+	}
+
+	return snapshotOptions{
+		Workers:     workers,
+		CallTimeout: callTimeout,
+		Timeout:     timeout,
+		Interval:    interval,
+		ChunkBytes:  chunkBytes,
+	}, nil
+}
+
+type collected[T any] struct {
+	index int
+	value T
+}
+
+// collect runs fn for indexes [0, n) on at most workers goroutines. It
+// returns once every call finished or ctx expired; done[i] reports whether
+// results[i] was filled. Calls still running after ctx expires see a
+// cancelled context and their results are discarded.
+func collect[T any](
+	ctx context.Context,
+	workers int,
+	n int,
+	fn func(context.Context, int) T,
+) ([]T, []bool) {
+	results := make([]T, n)
+	done := make([]bool, n)
+	if n == 0 {
+		return results, done
+	}
+
+	jobs := make(chan int)
+	out := make(chan collected[T], n)
+	var wg sync.WaitGroup
+	for range min(max(workers, 1), n) {
+		wg.Go(func() {
+			for i := range jobs {
+				out <- collected[T]{index: i, value: fn(ctx, i)}
+			}
+		})
+	}
+
+	go func() {
+		defer close(jobs)
+		for i := range n {
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for received := 0; received < n; received++ {
+		select {
+		case result := <-out:
+			results[result.index] = result.value
+			done[result.index] = true
+		case <-ctx.Done():
+			return results, done
+		}
+	}
+
+	wg.Wait()
+	return results, done
+}
+
+func withCallTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
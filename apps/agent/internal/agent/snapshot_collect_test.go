@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBuildSnapshot(t *testing.T) {
+	t.Run("collects details with bounded concurrency", func(t *testing.T) {
+		docker := newFakeDocker(20, 4)
+		docker.latency = time.Millisecond
+		docker.statsLatency = 5 * time.Millisecond
+		a := newAgent(docker, snapshotOptions{Workers: 4, CallTimeout: time.Second, Timeout: 5 * time.Second}, eventOptions{})
+
+		payload, err := a.buildSnapshot(context.Background())
+		if err != nil {
+			t.Fatalf("buildSnapshot() unexpected error: %v", err)
+		}
+
+		if len(payload.Containers) != 20 || len(payload.Images) != 4 {
+			t.Fatalf("buildSnapshot() containers = %d images = %d", len(payload.Containers), len(payload.Images))
+		}
+
+		for i, item := range payload.Containers {
+			if item.Metrics == nil || len(item.Envs) != 1 {
+				t.Fatalf("container %d missing inspect data: %+v", i, item)
+			}
+
+			if item.Name != fmt.Sprintf("container-%d", i) {
+				t.Fatalf("container %d out of order: %q", i, item.Name)
+			}
+		}
+
+		if peak := docker.maxInflight.Load(); peak > 4 {
+			t.Fatalf("max concurrent calls = %d", peak)
+		}
+	})
+
+	t.Run("drops metrics when stats call times out", func(t *testing.T) {
+		docker := newFakeDocker(3, 1)
+		docker.hang[docker.containers[1].ID] = true
+		a := newAgent(docker, snapshotOptions{Workers: 2, CallTimeout: 20 * time.Millisecond, Timeout: 5 * time.Second}, eventOptions{})
+
+		payload, err := a.buildSnapshot(context.Background())
+		if err != nil {
+			t.Fatalf("buildSnapshot() unexpected error: %v", err)
+		}
+
+		slow := payload.Containers[1]
+		if slow.Metrics != nil || len(slow.Envs) != 1 {
+			t.Fatalf("slow container = %+v", slow)
+		}
+
+		if payload.Containers[0].Metrics == nil {
+			t.Fatal("fast container missing metrics")
+		}
+	})
+
+	t.Run("falls back to summaries after snapshot deadline", func(t *testing.T) {
+		docker := newFakeDocker(4, 1)
+		docker.hang[docker.containers[2].ID] = true
+		a := newAgent(docker, snapshotOptions{Workers: 4, CallTimeout: time.Hour, Timeout: 50 * time.Millisecond}, eventOptions{})
+
+		start := time.Now()
+		payload, err := a.buildSnapshot(context.Background())
+		if err != nil {
+			t.Fatalf("buildSnapshot() unexpected error: %v", err)
+		}
+
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("buildSnapshot() took %s", elapsed)
+		}
+
+		late := payload.Containers[2]
+		if late.Status != "Up 5 minutes" || len(late.Envs) != 0 {
+			t.Fatalf("late container = %+v", late)
+		}
+
+		if payload.Containers[0].Metrics == nil {
+			t.Fatal("fast container missing metrics")
+		}
+	})
+}
+
+// BenchmarkBuildSnapshot measures a 100-container host where each one-shot
+// stats read takes 10ms, the way the daemon blocks for a sampling interval.
+func BenchmarkBuildSnapshot(b *testing.B) {
+	for _, workers := range []int{1, 8, 32} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			docker := newFakeDocker(100, 20)
+			docker.latency = time.Millisecond
+			docker.statsLatency = 10 * time.Millisecond
+			a := newAgent(docker, snapshotOptions{Workers: workers, CallTimeout: time.Second, Timeout: time.Minute}, eventOptions{})
+
+			for b.Loop() {
+				if _, err := a.buildSnapshot(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
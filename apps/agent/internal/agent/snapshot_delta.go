@@ -0,0 +1,166 @@
+package agent
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	snapshotEventType         = "snapshot"
+	snapshotDeltaEventType    = "snapshot.delta"
+	containerMetricsEventType = "container.metrics"
+)
+
+// Delta lists what changed in one collection since the base snapshot.
+// Removed holds IDs only.
+type Delta[T any] struct {
+	Added   []T      `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []T      `json:"changed"`
+}
+
+func (d Delta[T]) empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// SnapshotDeltaPayload applies on top of the state at BaseSeq. A server that
+// does not hold BaseSeq has missed an update and should ask for a resync.
+type SnapshotDeltaPayload struct {
+	Seq        uint64           `json:"seq"`
+	BaseSeq    uint64           `json:"baseSeq"`
+	Containers Delta[Container] `json:"containers"`
+	Images     Delta[Image]     `json:"images"`
+	Networks   Delta[Network]   `json:"networks"`
+	Volumes    Delta[Volume]    `json:"volumes"`
+}
+
+// ContainerMetricsPayload is the payload of container.metrics events. Deltas
+// leave metrics out, so running containers' metrics are sent this way on
+// every tick that does not send a full snapshot.
+type ContainerMetricsPayload struct {
+	ID string `json:"id"`
+	ContainerMetrics
+}
+
+// snapshotTracker remembers the last state sent upstream so periodic
+// snapshots can go out as deltas. Every full snapshot or non-empty delta
+// takes the next sequence number.
+type snapshotTracker struct {
+	mu   sync.Mutex
+	seq  uint64
+	last *SnapshotPayload
+}
+
+// next returns the event to send for payload, or nil when nothing changed.
+func (t *snapshotTracker) next(payload SnapshotPayload, full bool, now time.Time) *Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if full || t.last == nil {
+		t.seq++
+		payload.Seq = t.seq
+		t.last = &payload
+
+		return &Event{Type: snapshotEventType, TS: now, Data: payload}
+	}
+
+	delta := SnapshotDeltaPayload{
+		BaseSeq:    t.last.Seq,
+		Containers: diff(t.last.Containers, payload.Containers, func(c Container) string { return c.ID }, sameContainer),
+		Images:     diff(t.last.Images, payload.Images, func(i Image) string { return i.ID }, deepEqual[Image]),
+		Networks:   diff(t.last.Networks, payload.Networks, func(n Network) string { return n.ID }, deepEqual[Network]),
+		Volumes:    diff(t.last.Volumes, payload.Volumes, func(v Volume) string { return v.Name }, deepEqual[Volume]),
+	}
+	if delta.Containers.empty() && delta.Images.empty() && delta.Networks.empty() && delta.Volumes.empty() {
+		return nil
+	}
+
+	t.seq++
+	delta.Seq = t.seq
+	payload.Seq = t.seq
+	t.last = &payload
+
+	return &Event{Type: snapshotDeltaEventType, TS: now, Data: delta}
+}
+
+// diff matches items by id; same decides whether a kept item changed.
+func diff[T any](previous, current []T, id func(T) string, same func(a, b T) bool) Delta[T] {
+	delta := Delta[T]{Added: []T{}, Removed: []string{}, Changed: []T{}}
+
+	before := make(map[string]T, len(previous))
+	for _, item := range previous {
+		before[id(item)] = item
+	}
+
+	seen := make(map[string]bool, len(current))
+	for _, item := range current {
+		key := id(item)
+		seen[key] = true
+
+		old, ok := before[key]
+		switch {
+		case !ok:
+			delta.Added = append(delta.Added, item)
+		case !same(old, item):
+			delta.Changed = append(delta.Changed, item)
+		}
+	}
+
+	for _, item := range previous {
+		if key := id(item); !seen[key] {
+			delta.Removed = append(delta.Removed, key)
+		}
+	}
+
+	return delta
+}
+
+// emitContainerMetrics sends the metrics of every container that has them,
+// each keyed by container so a newer sample replaces a queued one.
+func (a *Agent) emitContainerMetrics(ctx context.Context, containers []Container) {
+	now := time.Now()
+	for _, item := range containers {
+		if item.Metrics == nil {
+			continue
+		}
+		a.emitEvent(ctx, Event{
+			Type: containerMetricsEventType,
+			TS:   now,
+			Data: ContainerMetricsPayload{ID: item.ID, ContainerMetrics: *item.Metrics},
+			Key:  containerMetricsEventType + ":" + item.ID,
+		})
+	}
+}
+
+func deepEqual[T any](a, b T) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+// statusMarkers picks the parenthesised parts of a container status, such
+// as the exit code in "Exited (1) 2 minutes ago" or the health in "Up 3
+// hours (healthy)".
+var statusMarkers = regexp.MustCompile(`\([^)]*\)`)
+
+// sameContainer ignores what moves on every tick: metrics, which go out as
+// container.metrics events, and the uptime or exit age in the status text.
+// Otherwise every running container would be in every delta. A fallback
+// container is only compared on what inspect and the list summary both
+// fill, so a failed inspect does not flip the container back and forth.
+func sameContainer(x, y Container) bool {
+	if x.fallback || y.fallback {
+		return x.ID == y.ID && x.Name == y.Name && x.State == y.State && x.Created == y.Created
+	}
+
+	if !slices.Equal(statusMarkers.FindAllString(x.Status, -1), statusMarkers.FindAllString(y.Status, -1)) {
+		return false
+	}
+
+	x.Metrics, y.Metrics = nil, nil
+	x.Status, y.Status = "", ""
+
+	return reflect.DeepEqual(x, y)
+}
@@ -0,0 +1,200 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSnapshotTrackerNext(t *testing.T) {
+	now := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	base := SnapshotPayload{
+		Containers: []Container{
+			{ID: "c1", Name: "web", State: "running"},
+			{ID: "c2", Name: "db", State: "running"},
+		},
+		Images: []Image{{ID: "i1", Name: "nginx"}},
+	}
+
+	t.Run("sends full snapshot first", func(t *testing.T) {
+		var tracker snapshotTracker
+
+		event := tracker.next(base, false, now)
+		if event == nil || event.Type != snapshotEventType {
+			t.Fatalf("next() = %+v", event)
+		}
+
+		if payload := event.Data.(SnapshotPayload); payload.Seq != 1 {
+			t.Fatalf("next() seq = %d", payload.Seq)
+		}
+	})
+
+	t.Run("sends delta against previous snapshot", func(t *testing.T) {
+		var tracker snapshotTracker
+		tracker.next(base, false, now)
+
+		current := SnapshotPayload{
+			Containers: []Container{
+				{ID: "c1", Name: "web", State: "exited"},
+				{ID: "c3", Name: "cache", State: "running"},
+			},
+			Images: []Image{{ID: "i1", Name: "nginx"}},
+		}
+
+		event := tracker.next(current, false, now)
+		if event == nil || event.Type != snapshotDeltaEventType {
+			t.Fatalf("next() = %+v", event)
+		}
+
+		delta := event.Data.(SnapshotDeltaPayload)
+		if delta.Seq != 2 || delta.BaseSeq != 1 {
+			t.Fatalf("next() seq = %d baseSeq = %d", delta.Seq, delta.BaseSeq)
+		}
+
+		if len(delta.Containers.Added) != 1 || delta.Containers.Added[0].ID != "c3" {
+			t.Fatalf("added = %+v", delta.Containers.Added)
+		}
+
+		if len(delta.Containers.Changed) != 1 || delta.Containers.Changed[0].State != "exited" {
+			t.Fatalf("changed = %+v", delta.Containers.Changed)
+		}
+
+		if len(delta.Containers.Removed) != 1 || delta.Containers.Removed[0] != "c2" {
+			t.Fatalf("removed = %+v", delta.Containers.Removed)
+		}
+
+		if !delta.Images.empty() {
+			t.Fatalf("images = %+v", delta.Images)
+		}
+	})
+
+	t.Run("skips unchanged state", func(t *testing.T) {
+		var tracker snapshotTracker
+		tracker.next(base, false, now)
+
+		if event := tracker.next(base, false, now); event != nil {
+			t.Fatalf("next() = %+v", event)
+		}
+
+		current := base
+		current.Images = []Image{}
+		event := tracker.next(current, false, now)
+		if delta := event.Data.(SnapshotDeltaPayload); delta.Seq != 2 || delta.BaseSeq != 1 {
+			t.Fatalf("next() seq = %d baseSeq = %d", delta.Seq, delta.BaseSeq)
+		}
+	})
+
+	t.Run("ignores metrics and uptime", func(t *testing.T) {
+		running := func(status string, cpu float64) SnapshotPayload {
+			return SnapshotPayload{Containers: []Container{{
+				ID:      "c1",
+				State:   "running",
+				Status:  status,
+				Metrics: &ContainerMetrics{CPU: cpu},
+			}}}
+		}
+
+		var tracker snapshotTracker
+		tracker.next(running("Up 5 minutes (healthy)", 12.5), false, now)
+
+		if event := tracker.next(running("Up 6 minutes (healthy)", 48), false, now); event != nil {
+			t.Fatalf("next() = %+v", event)
+		}
+
+		event := tracker.next(running("Up 7 minutes (unhealthy)", 48), false, now)
+		if event == nil {
+			t.Fatal("next() = nil, want a delta for the health change")
+		}
+		if changed := event.Data.(SnapshotDeltaPayload).Containers.Changed; len(changed) != 1 || changed[0].Metrics.CPU != 48 {
+			t.Fatalf("changed = %+v", changed)
+		}
+	})
+
+	t.Run("fallback containers compare on shared fields", func(t *testing.T) {
+		inspected := SnapshotPayload{Containers: []Container{{
+			ID:     "c1",
+			Name:   "web",
+			State:  "running",
+			Status: "running (running)",
+			Envs:   []EnvironmentVariable{{Key: "PORT", Value: "80"}},
+		}}}
+		fallback := SnapshotPayload{Containers: []Container{{
+			ID:       "c1",
+			Name:     "web",
+			State:    "running",
+			Status:   "Up 5 minutes",
+			Envs:     []EnvironmentVariable{},
+			fallback: true,
+		}}}
+
+		var tracker snapshotTracker
+		tracker.next(inspected, false, now)
+		for _, payload := range []SnapshotPayload{fallback, inspected} {
+			if event := tracker.next(payload, false, now); event != nil {
+				t.Fatalf("next() = %+v", event)
+			}
+		}
+
+		fallback.Containers[0].State = "exited"
+		if event := tracker.next(fallback, false, now); event == nil {
+			t.Fatal("next() = nil, want a delta for the state change")
+		}
+	})
+
+	t.Run("sends full snapshot when forced", func(t *testing.T) {
+		var tracker snapshotTracker
+		tracker.next(base, false, now)
+
+		event := tracker.next(base, true, now)
+		if event == nil || event.Type != snapshotEventType {
+			t.Fatalf("next() = %+v", event)
+		}
+
+		if payload := event.Data.(SnapshotPayload); payload.Seq != 2 {
+			t.Fatalf("next() seq = %d", payload.Seq)
+		}
+	})
+}
+
+func TestEmitSnapshotContainerMetrics(t *testing.T) {
+	docker := newFakeDocker(2, 0)
+	a := newAgent(docker, snapshotOptions{Workers: 1, CallTimeout: time.Second, Timeout: time.Second}, eventOptions{})
+
+	emit := func(full bool) []Event {
+		t.Helper()
+
+		errs := make(chan error, 1)
+		go func() {
+			errs <- a.emitSnapshot(context.Background(), full)
+		}()
+
+		var sent []Event
+		for {
+			select {
+			case event := <-a.Events():
+				sent = append(sent, event)
+			case err := <-errs:
+				if err != nil {
+					t.Fatalf("emitSnapshot() unexpected error: %v", err)
+				}
+				return sent
+			}
+		}
+	}
+
+	if sent := emit(true); len(sent) != 1 || sent[0].Type != snapshotEventType {
+		t.Fatalf("full snapshot sent %+v", sent)
+	}
+
+	sent := emit(false)
+	if len(sent) != 2 {
+		t.Fatalf("delta tick sent %d events, want metrics for 2 containers", len(sent))
+	}
+	for i, event := range sent {
+		id := docker.containers[i].ID
+		payload, ok := event.Data.(ContainerMetricsPayload)
+		if event.Type != containerMetricsEventType || event.Key != containerMetricsEventType+":"+id || !ok || payload.ID != id {
+			t.Fatalf("event %d = %s key %q %+v", i, event.Type, event.Key, event.Data)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotPartialEventType = "snapshot.partial"
+
+	SnapshotKindContainers = "containers"
+	SnapshotKindImages     = "images"
+	SnapshotKindNetworks   = "networks"
+	SnapshotKindVolumes    = "volumes"
+
+	// minSnapshotInterval keeps a runaway UI from turning snapshots into a
+	// busy loop against the Docker daemon.
+	minSnapshotInterval = time.Second
+	maxSnapshotInterval = time.Hour
+
+	snapshotRequestQueueSize = 4
+)
+
+var ErrSnapshotRequestQueueFull = newKindError("snapshot_queue_full", "snapshot request queue full")
+
+// PartialSnapshotPayload answers a scoped snapshot.request. Collections not
+// requested are null. Requested ones are always a list, empty when none of
+// the requested objects exist any more, and hold only the matching objects;
+// they do not replace the server's full state.
+type PartialSnapshotPayload struct {
+	CommandID  string      `json:"commandId"`
+	Containers []Container `json:"containers"`
+	Images     []Image     `json:"images"`
+	Networks   []Network   `json:"networks"`
+	Volumes    []Volume    `json:"volumes"`
+}
+
+// scoped is items for a requested collection, never nil, and nil for one
+// that was not requested.
+func scoped[T any](requested bool, items []T) []T {
+	if !requested {
+		return nil
+	}
+	if items == nil {
+		return []T{}
+	}
+
+	return items
+}
+
+// snapshotScope selects what a snapshot covers. IDs match full IDs or any
+// prefix of them, with or without the "sha256:" prefix for images; volumes
+// match by name.
+type snapshotScope struct {
+	Containers bool
+	Images     bool
+	Networks   bool
+	Volumes    bool
+	IDs        []string
+}
+
+var fullSnapshotScope = snapshotScope{Containers: true, Images: true, Networks: true, Volumes: true}
+
+func (s snapshotScope) full() bool {
+	return s.Containers && s.Images && s.Networks && s.Volumes && len(s.IDs) == 0
+}
+
+func (s snapshotScope) matches(id string) bool {
+	if len(s.IDs) == 0 {
+		return true
+	}
+
+	trimmed := strings.TrimPrefix(id, "sha256:")
+	for _, want := range s.IDs {
+		want = strings.TrimPrefix(want, "sha256:")
+		if strings.HasPrefix(trimmed, want) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func filterSummaries[T any](items []T, scope snapshotScope, id func(T) string) []T {
+	if len(scope.IDs) == 0 {
+		return items
+	}
+
+	result := make([]T, 0, len(items))
+	for _, item := range items {
+		if scope.matches(id(item)) {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
+
+type snapshotRequest struct {
+	commandID string
+	scope     snapshotScope
+}
+
+type snapshotIntervalChange struct {
+	interval time.Duration
+	ttl      time.Duration
+}
+
+// RequestSnapshot queues an immediate snapshot for the command. With no kinds
+// and no IDs it is a full snapshot that also resets the delta baseline;
+// otherwise a snapshot.partial event carries only the matching objects.
+func (a *Agent) RequestSnapshot(commandID string, kinds []string, ids []string) error {
+	all := len(kinds) == 0
+	scope := snapshotScope{Containers: all, Images: all, Networks: all, Volumes: all}
+	for _, kind := range kinds {
+		switch kind {
+		case SnapshotKindContainers:
+			scope.Containers = true
+		case SnapshotKindImages:
+			scope.Images = true
+		case SnapshotKindNetworks:
+			scope.Networks = true
+		case SnapshotKindVolumes:
+			scope.Volumes = true
+		default:
+			return fmt.Errorf("unknown snapshot kind %q", kind)
+		}
+	}
+
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+		// A bare prefix would match every object.
+		if strings.TrimPrefix(id, "sha256:") == "" {
+			return fmt.Errorf("snapshot id %q has no digest", id)
+		}
+		scope.IDs = append(scope.IDs, id)
+	}
+	if len(ids) > 0 && len(scope.IDs) == 0 {
+		return errors.New("snapshot ids must not be blank")
+	}
+
+	select {
+	case a.requests <- snapshotRequest{commandID: commandID, scope: scope}:
+		return nil
+	default:
+		return ErrSnapshotRequestQueueFull
+	}
+}
+
+// SetSnapshotInterval changes how often periodic snapshots run. Zero restores
+// the configured interval. A positive ttl reverts the change after it
+// elapses, so a dashboard that goes away without saying so does not keep the
+// agent polling fast.
+func (a *Agent) SetSnapshotInterval(interval time.Duration, ttl time.Duration) error {
+	if interval != 0 && (interval < minSnapshotInterval || interval > maxSnapshotInterval) {
+		return fmt.Errorf(
+			"snapshot interval %s out of range [%s, %s]",
+			interval,
+			minSnapshotInterval,
+			maxSnapshotInterval,
+		)
+	}
+
+	if ttl < 0 {
+		return errors.New("snapshot interval ttl must not be negative")
+	}
+
+	// Only the latest change matters; replace one still pending.
+	change := snapshotIntervalChange{interval: interval, ttl: ttl}
+	for {
+		select {
+		case a.intervals <- change:
+			return nil
+		default:
+		}
+
+		select {
+		case <-a.intervals:
+		default:
+		}
+	}
+}
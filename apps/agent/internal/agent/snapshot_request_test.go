@@ -0,0 +1,222 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// startSnapshots runs the snapshot loop with the given default interval and
+// consumes the initial full snapshot.
+func startSnapshots(t *testing.T, docker *fakeDocker, interval time.Duration) *Agent {
+	t.Helper()
+
+	a := newAgent(docker, snapshotOptions{Workers: 4, CallTimeout: time.Second, Timeout: time.Second}, eventOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	go func() {
+		defer close(done)
+		a.runSnapshots(ctx, interval)
+	}()
+
+	if event := nextEvent(t, a, time.Second); event.Type != snapshotEventType {
+		t.Fatalf("first event = %q", event.Type)
+	}
+
+	return a
+}
+
+func nextEvent(t *testing.T, a *Agent, timeout time.Duration) Event {
+	t.Helper()
+
+	select {
+	case event := <-a.Events():
+		return event
+	case <-time.After(timeout):
+		t.Fatal("no event")
+		return Event{}
+	}
+}
+
+func TestRequestSnapshot(t *testing.T) {
+	t.Run("full request resets the baseline", func(t *testing.T) {
+		docker := newFakeDocker(2, 1)
+		a := startSnapshots(t, docker, time.Hour)
+
+		if err := a.RequestSnapshot("cmd-1", nil, nil); err != nil {
+			t.Fatalf("RequestSnapshot() unexpected error: %v", err)
+		}
+
+		event := nextEvent(t, a, time.Second)
+		payload, ok := event.Data.(SnapshotPayload)
+		if event.Type != snapshotEventType || event.Key != snapshotEventType || !ok {
+			t.Fatalf("event = %q (key %q) %T", event.Type, event.Key, event.Data)
+		}
+
+		if payload.CommandID != "cmd-1" || payload.Seq != 2 || len(payload.Containers) != 2 {
+			t.Fatalf("payload = seq %d command %q containers %d", payload.Seq, payload.CommandID, len(payload.Containers))
+		}
+	})
+
+	t.Run("scoped request sends matching objects only", func(t *testing.T) {
+		docker := newFakeDocker(3, 2)
+		a := startSnapshots(t, docker, time.Hour)
+
+		target := docker.containers[1].ID
+		if err := a.RequestSnapshot("cmd-2", []string{SnapshotKindContainers}, []string{target}); err != nil {
+			t.Fatalf("RequestSnapshot() unexpected error: %v", err)
+		}
+
+		event := nextEvent(t, a, time.Second)
+		payload, ok := event.Data.(PartialSnapshotPayload)
+		if event.Type != snapshotPartialEventType || !ok {
+			t.Fatalf("event = %q %T", event.Type, event.Data)
+		}
+
+		if payload.CommandID != "cmd-2" || payload.Images != nil {
+			t.Fatalf("payload = %+v", payload)
+		}
+
+		if len(payload.Containers) != 1 || payload.Containers[0].ID != target {
+			t.Fatalf("containers = %+v", payload.Containers)
+		}
+	})
+
+	t.Run("requested ids that are gone come back empty", func(t *testing.T) {
+		a := startSnapshots(t, newFakeDocker(2, 1), time.Hour)
+
+		if err := a.RequestSnapshot("cmd-4", []string{SnapshotKindContainers}, []string{"deadbeef"}); err != nil {
+			t.Fatalf("RequestSnapshot() unexpected error: %v", err)
+		}
+
+		data, err := json.Marshal(nextEvent(t, a, time.Second).Data)
+		if err != nil {
+			t.Fatalf("Marshal() unexpected error: %v", err)
+		}
+		want := `{"commandId":"cmd-4","containers":[],"images":null,"networks":null,"volumes":null}`
+		if string(data) != want {
+			t.Fatalf("payload = %s, want %s", data, want)
+		}
+	})
+
+	t.Run("images by id list their containers", func(t *testing.T) {
+		docker := newFakeDocker(4, 2)
+		a := startSnapshots(t, docker, time.Hour)
+
+		if err := a.RequestSnapshot("cmd-3", []string{SnapshotKindImages}, []string{docker.images[0].ID}); err != nil {
+			t.Fatalf("RequestSnapshot() unexpected error: %v", err)
+		}
+
+		payload := nextEvent(t, a, time.Second).Data.(PartialSnapshotPayload)
+		if payload.Containers != nil || len(payload.Images) != 1 {
+			t.Fatalf("payload = %+v", payload)
+		}
+
+		if got := len(payload.Images[0].Containers); got != 2 {
+			t.Fatalf("image containers = %d, want 2", got)
+		}
+	})
+
+	t.Run("rejects unknown kinds and blank ids", func(t *testing.T) {
+		a := newAgent(newFakeDocker(0, 0), snapshotOptions{}, eventOptions{})
+
+		if err := a.RequestSnapshot("cmd-4", []string{"secrets"}, nil); err == nil {
+			t.Fatal("RequestSnapshot() expected error for unknown kind")
+		}
+
+		if err := a.RequestSnapshot("cmd-4", nil, []string{" "}); err == nil {
+			t.Fatal("RequestSnapshot() expected error for blank id")
+		}
+
+		if err := a.RequestSnapshot("cmd-4", []string{SnapshotKindImages}, []string{"sha256:"}); err == nil {
+			t.Fatal("RequestSnapshot() expected error for an id without a digest")
+		}
+		if len(a.requests) != 0 {
+			t.Fatalf("queued %d requests for rejected ids", len(a.requests))
+		}
+	})
+
+	t.Run("reports a full queue", func(t *testing.T) {
+		a := newAgent(newFakeDocker(0, 0), snapshotOptions{}, eventOptions{})
+
+		for range snapshotRequestQueueSize {
+			if err := a.RequestSnapshot("cmd-5", nil, nil); err != nil {
+				t.Fatalf("RequestSnapshot() unexpected error: %v", err)
+			}
+		}
+
+		if err := a.RequestSnapshot("cmd-5", nil, nil); !errors.Is(err, ErrSnapshotRequestQueueFull) {
+			t.Fatalf("RequestSnapshot() expected ErrSnapshotRequestQueueFull, got %v", err)
+		}
+	})
+}
+
+func TestSetSnapshotInterval(t *testing.T) {
+	t.Run("rejects out of range intervals", func(t *testing.T) {
+		a := newAgent(newFakeDocker(0, 0), snapshotOptions{}, eventOptions{})
+
+		for _, interval := range []time.Duration{time.Millisecond, 2 * time.Hour} {
+			if err := a.SetSnapshotInterval(interval, 0); err == nil {
+				t.Fatalf("SetSnapshotInterval(%s) expected error", interval)
+			}
+		}
+	})
+
+	t.Run("keeps only the latest pending change", func(t *testing.T) {
+		a := newAgent(newFakeDocker(0, 0), snapshotOptions{}, eventOptions{})
+
+		for _, interval := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+			if err := a.SetSnapshotInterval(interval, 0); err != nil {
+				t.Fatalf("SetSnapshotInterval() unexpected error: %v", err)
+			}
+		}
+
+		if change := <-a.intervals; change.interval != 3*time.Second {
+			t.Fatalf("pending interval = %s", change.interval)
+		}
+	})
+
+	t.Run("faster interval sends deltas sooner", func(t *testing.T) {
+		docker := newFakeDocker(1, 0)
+		a := startSnapshots(t, docker, time.Hour)
+
+		docker.mu.Lock()
+		docker.containers[0].State = "exited"
+		docker.mu.Unlock()
+
+		if err := a.SetSnapshotInterval(minSnapshotInterval, 0); err != nil {
+			t.Fatalf("SetSnapshotInterval() unexpected error: %v", err)
+		}
+
+		if event := nextEvent(t, a, 3*minSnapshotInterval); event.Type != snapshotDeltaEventType {
+			t.Fatalf("event = %q", event.Type)
+		}
+	})
+
+	t.Run("temporary interval reverts after ttl", func(t *testing.T) {
+		docker := newFakeDocker(1, 0)
+		a := startSnapshots(t, docker, time.Hour)
+
+		if err := a.SetSnapshotInterval(minSnapshotInterval, 10*time.Millisecond); err != nil {
+			t.Fatalf("SetSnapshotInterval() unexpected error: %v", err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		docker.mu.Lock()
+		docker.containers[0].State = "exited"
+		docker.mu.Unlock()
+
+		select {
+		case event := <-a.Events():
+			t.Fatalf("unexpected %q after the ttl expired", event.Type)
+		case <-time.After(minSnapshotInterval + 500*time.Millisecond):
+		}
+	})
+}
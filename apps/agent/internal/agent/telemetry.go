@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	telemetryEventType = "agent.telemetry"
+
+	agentTelemetryIntervalEnv = "AGENT_TELEMETRY_INTERVAL"
+
+	defaultTelemetryInterval = time.Minute
+)
+
+// OutboundStats counts what happened to events on their way to the server.
+// Replaced events were superseded by a newer one before they were written;
+// Pending is the current queue length.
+type OutboundStats struct {
+	Queued   uint64 `json:"queued"`
+	Dropped  uint64 `json:"dropped"`
+	Replaced uint64 `json:"replaced"`
+	Pending  int    `json:"pending"`
+}
+
+// OutboundReporter reports the state of the outbound queue, typically the
+// client the agent events are written to.
+type OutboundReporter interface {
+	OutboundStats() OutboundStats
+}
+
+type TelemetryPayload struct {
+	Cache    CacheStats     `json:"cache"`
+	Events   EventStats     `json:"events"`
+	Outbound *OutboundStats `json:"outbound,omitempty"`
+}
+
+// ReportOutbound includes the outbound queue counters of reporter in the
+// telemetry events. It must be called before Run.
+func (a *Agent) ReportOutbound(reporter OutboundReporter) {
+	a.outbound = reporter
+}
+
+func (a *Agent) telemetry() TelemetryPayload {
+	payload := TelemetryPayload{
+		Cache:  a.CacheStats(),
+		Events: a.EventStats(),
+	}
+
+	if a.outbound != nil {
+		stats := a.outbound.OutboundStats()
+		payload.Outbound = &stats
+	}
+
+	return payload
+}
+
+// runTelemetry sends the agent counters every interval. Each sample replaces
+// one still waiting to be written.
+func (a *Agent) runTelemetry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			a.emitEvent(ctx, Event{
+				Type: telemetryEventType,
+				TS:   time.Now(),
+				Data: a.telemetry(),
+				Key:  telemetryEventType,
+			})
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type fakeOutboundReporter struct {
+	stats OutboundStats
+}
+
+func (f fakeOutboundReporter) OutboundStats() OutboundStats {
+	return f.stats
+}
+
+func TestRunTelemetry(t *testing.T) {
+	docker := newFakeDocker(1, 0)
+	a := newAgent(docker, snapshotOptions{Workers: 1, CallTimeout: time.Second, Timeout: time.Second}, eventOptions{})
+	a.ReportOutbound(fakeOutboundReporter{stats: OutboundStats{Queued: 5, Dropped: 1, Replaced: 2}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		a.runTelemetry(ctx, 10*time.Millisecond)
+	}()
+
+	event := nextEvent(t, a, time.Second)
+	if event.Type != telemetryEventType || event.Key != telemetryEventType {
+		t.Fatalf("event = %q key %q", event.Type, event.Key)
+	}
+
+	payload := event.Data.(TelemetryPayload)
+	if payload.Outbound == nil || payload.Outbound.Queued != 5 || payload.Outbound.Replaced != 2 {
+		t.Fatalf("outbound = %+v", payload.Outbound)
+	}
+}
@@ -0,0 +1,733 @@
+package agent
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/errdefs"
+)
+
+const (
+	volumeBackupEventPrefix  = "volume.backup"
+	volumeRestoreEventPrefix = "volume.restore"
+
+	volumeTransferAuto   = "auto"
+	volumeTransferDirect = "direct"
+	volumeTransferHelper = "helper"
+
+	volumeArchiveTar   = "tar"
+	volumeArchiveTarGz = "tar.gz"
+
+	agentVolumeHelperImageEnv = "AGENT_VOLUME_HELPER_IMAGE"
+	defaultVolumeHelperImage  = "busybox:latest"
+
+	// volumeHelperPath is where helper containers mount the volume. Helpers
+	// are created but never started; the archive API works on them as is.
+	volumeHelperPath  = "/volume"
+	volumeHelperLabel = "containers.agent.volume-helper"
+	// volumeHelperOwnerLabel names the agent process that created a helper,
+	// so a restarted agent can tell helpers orphaned by a crash from its own.
+	volumeHelperOwnerLabel = "containers.agent.volume-helper.owner"
+)
+
+var ErrVolumeChecksumMismatch = newKindError("volume_checksum_mismatch", "volume archive checksum mismatch")
+
+// volumeProgressInterval spaces progress events of one transfer.
+var volumeProgressInterval = time.Second
+
+// VolumeTransferProgress reports the archive bytes a backup or restore has
+// moved so far. Total is the archive size when known up front.
+type VolumeTransferProgress struct {
+	CommandID string `json:"commandId"`
+	Volume    string `json:"volume"`
+	Bytes     int64  `json:"bytes"`
+	Total     *int64 `json:"total,omitempty"`
+}
+
+// VolumeTransferResult ends a backup or restore. SHA256 is the hex digest of
+// the archive as written or read, compressed if it was. Partial marks a
+// failed restore that had already written into the volume: restores are not
+// staged, so the volume then holds a mix of old and restored files and
+// should be restored again before use.
+type VolumeTransferResult struct {
+	CommandID  string `json:"commandId"`
+	Volume     string `json:"volume"`
+	Method     string `json:"method"`
+	Format     string `json:"format,omitempty"`
+	Bytes      int64  `json:"bytes"`
+	SHA256     string `json:"sha256,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+	Partial    bool   `json:"partial,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// BackupVolume archives a volume into target as tar, or tar.gz with compress.
+// It returns once the volume and method check out; the copy runs in the
+// background and reports volume.backup.progress, then volume.backup.complete
+// with the checksum or volume.backup.failed. target is closed either way, and
+// aborted with CloseWithError on failure when it supports that, including
+// when BackupVolume itself returns an error.
+func (a *Agent) BackupVolume(
+	ctx context.Context,
+	commandID string,
+	name string,
+	method string,
+	compress bool,
+	target io.WriteCloser,
+) (err error) {
+	defer func() {
+		if err != nil {
+			closeTransfer(target, err)
+		}
+	}()
+
+	info, err := a.lookupVolume(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	method, err = volumeTransferMethod(method, info)
+	if err != nil {
+		return err
+	}
+
+	transfer := a.newVolumeTransfer(ctx, volumeBackupEventPrefix, commandID, info.Name, method)
+	transfer.format = volumeArchiveTar
+	if compress {
+		transfer.format = volumeArchiveTarGz
+	}
+
+	a.transfers.Go(func() {
+		err := a.backupVolume(ctx, transfer, info, compress, io.MultiWriter(target, transfer))
+		transfer.finish(err)
+		closeTransfer(target, err)
+	})
+
+	return nil
+}
+
+func (a *Agent) backupVolume(
+	ctx context.Context,
+	transfer *volumeTransfer,
+	info volume.Volume,
+	compress bool,
+	out io.Writer,
+) error {
+	archive := out
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(out)
+		archive = gz
+	}
+
+	switch transfer.method {
+	case volumeTransferDirect:
+		root, err := os.OpenRoot(info.Mountpoint)
+		if err != nil {
+			return fmt.Errorf("open volume %q: %w", info.Name, err)
+		}
+		defer root.Close()
+
+		if err := writeVolumeArchive(root, archive); err != nil {
+			return fmt.Errorf("archive volume %q: %w", info.Name, err)
+		}
+
+	case volumeTransferHelper:
+		helperID, err := a.createVolumeHelper(ctx, info.Name, true)
+		if err != nil {
+			return err
+		}
+		defer a.removeVolumeHelper(ctx, helperID)
+
+		reader, _, err := a.cli.CopyFromContainer(ctx, helperID, volumeHelperPath+"/.")
+		if err != nil {
+			return fmt.Errorf("docker copy from volume helper: %w", err)
+		}
+		defer reader.Close()
+
+		if _, err := io.Copy(archive, reader); err != nil {
+			return fmt.Errorf("archive volume %q: %w", info.Name, err)
+		}
+	}
+
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf("compress volume %q: %w", info.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// RestoreVolume unpacks a tar or tar.gz archive from source into a volume,
+// creating it with the local driver when missing. Existing files are
+// overwritten, others are kept. With a checksum the whole archive is verified
+// before anything is written; a source that cannot seek is spooled to a
+// temporary file for that. Like BackupVolume it runs in the background,
+// reports volume.restore.* events and closes source either way.
+func (a *Agent) RestoreVolume(
+	ctx context.Context,
+	commandID string,
+	name string,
+	method string,
+	checksum string,
+	source io.ReadCloser,
+) (err error) {
+	defer func() {
+		if err != nil {
+			closeTransfer(source, err)
+		}
+	}()
+
+	info, err := a.lookupVolume(ctx, name)
+	if errors.Is(err, ErrVolumeNotFound) {
+		if _, err = a.CreateVolume(ctx, name, "", nil, nil); err == nil {
+			info, err = a.lookupVolume(ctx, name)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	method, err = volumeTransferMethod(method, info)
+	if err != nil {
+		return err
+	}
+
+	checksum = strings.ToLower(strings.TrimSpace(checksum))
+	if checksum != "" {
+		if decoded, err := hex.DecodeString(checksum); err != nil || len(decoded) != sha256.Size {
+			return fmt.Errorf("invalid checksum %q: want a hex sha256 digest", checksum)
+		}
+	}
+
+	transfer := a.newVolumeTransfer(ctx, volumeRestoreEventPrefix, commandID, info.Name, method)
+	if stat, ok := source.(interface{ Stat() (os.FileInfo, error) }); ok {
+		if fi, err := stat.Stat(); err == nil && fi.Mode().IsRegular() {
+			size := fi.Size()
+			transfer.total = &size
+		}
+	}
+
+	a.transfers.Go(func() {
+		err := a.restoreVolume(ctx, transfer, info, checksum, source)
+		transfer.finish(err)
+		closeTransfer(source, err)
+	})
+
+	return nil
+}
+
+func (a *Agent) restoreVolume(
+	ctx context.Context,
+	transfer *volumeTransfer,
+	info volume.Volume,
+	checksum string,
+	source io.Reader,
+) error {
+	if checksum != "" {
+		verified, cleanup, err := verifyVolumeArchive(source, checksum)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		source = verified
+	}
+
+	buffered := bufio.NewReader(io.TeeReader(source, transfer))
+	archive := io.Reader(buffered)
+	transfer.format = volumeArchiveTar
+	if magic, err := buffered.Peek(2); err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return fmt.Errorf("decompress archive: %w", err)
+		}
+		defer gz.Close()
+
+		archive = gz
+		transfer.format = volumeArchiveTarGz
+	}
+
+	switch transfer.method {
+	case volumeTransferDirect:
+		root, err := os.OpenRoot(info.Mountpoint)
+		if err != nil {
+			return fmt.Errorf("open volume %q: %w", info.Name, err)
+		}
+		defer root.Close()
+
+		transfer.partial = true
+		if err := extractVolumeArchive(root, archive); err != nil {
+			return fmt.Errorf("restore volume %q: %w", info.Name, err)
+		}
+
+	case volumeTransferHelper:
+		helperID, err := a.createVolumeHelper(ctx, info.Name, false)
+		if err != nil {
+			return err
+		}
+		defer a.removeVolumeHelper(ctx, helperID)
+
+		transfer.partial = true
+		err = a.cli.CopyToContainer(ctx, helperID, volumeHelperPath, archive, container.CopyToContainerOptions{})
+		if err != nil {
+			return fmt.Errorf("docker copy to volume helper: %w", err)
+		}
+	}
+
+	// Padding after the tar trailer still counts towards bytes and checksum.
+	if _, err := io.Copy(io.Discard, buffered); err != nil {
+		return fmt.Errorf("read archive: %w", err)
+	}
+
+	return nil
+}
+
+// verifyVolumeArchive reads source fully and compares its sha256 with
+// checksum. It returns a reader positioned at the start of the archive.
+func verifyVolumeArchive(source io.Reader, checksum string) (io.Reader, func(), error) {
+	digest := sha256.New()
+
+	if seeker, ok := source.(io.ReadSeeker); ok {
+		if _, err := io.Copy(digest, seeker); err != nil {
+			return nil, nil, fmt.Errorf("read archive: %w", err)
+		}
+		if err := compareChecksum(digest, checksum); err != nil {
+			return nil, nil, err
+		}
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return nil, nil, fmt.Errorf("rewind archive: %w", err)
+		}
+
+		return seeker, func() {}, nil
+	}
+
+	spool, err := os.CreateTemp("", "volume-restore-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("spool archive: %w", err)
+	}
+	cleanup := func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}
+
+	if _, err := io.Copy(io.MultiWriter(spool, digest), source); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("spool archive: %w", err)
+	}
+	if err := compareChecksum(digest, checksum); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("rewind archive: %w", err)
+	}
+
+	return spool, cleanup, nil
+}
+
+func compareChecksum(digest hash.Hash, want string) error {
+	if got := hex.EncodeToString(digest.Sum(nil)); got != want {
+		return fmt.Errorf("%w: got %s, want %s", ErrVolumeChecksumMismatch, got, want)
+	}
+
+	return nil
+}
+
+// volumeTransferMethod resolves auto to direct when the agent can open the
+// volume's mountpoint, as when it runs on the host, and to helper otherwise.
+func volumeTransferMethod(method string, info volume.Volume) (string, error) {
+	method = strings.TrimSpace(method)
+	if method == "" {
+		method = volumeTransferAuto
+	}
+
+	switch method {
+	case volumeTransferAuto:
+		if mountpointReadable(info.Mountpoint) {
+			return volumeTransferDirect, nil
+		}
+		return volumeTransferHelper, nil
+
+	case volumeTransferDirect:
+		if !mountpointReadable(info.Mountpoint) {
+			return "", fmt.Errorf(
+				"volume %q mountpoint %q is not accessible to the agent, use the helper method",
+				info.Name,
+				info.Mountpoint,
+			)
+		}
+		return method, nil
+
+	case volumeTransferHelper:
+		return method, nil
+
+	default:
+		return "", fmt.Errorf(
+			"unknown transfer method %q, want %s, %s or %s",
+			method,
+			volumeTransferAuto,
+			volumeTransferDirect,
+			volumeTransferHelper,
+		)
+	}
+}
+
+func mountpointReadable(mountpoint string) bool {
+	if mountpoint == "" {
+		return false
+	}
+
+	root, err := os.OpenRoot(mountpoint)
+	if err != nil {
+		return false
+	}
+	defer root.Close()
+
+	_, err = fs.ReadDir(root.FS(), ".")
+	return err == nil
+}
+
+// createVolumeHelper creates a stopped container with the volume mounted at
+// volumeHelperPath, pulling the helper image on first use.
+func (a *Agent) createVolumeHelper(ctx context.Context, name string, readOnly bool) (string, error) {
+	config := &container.Config{
+		Image:  a.volumeHelperImage,
+		Cmd:    []string{"true"},
+		Labels: map[string]string{volumeHelperLabel: name, volumeHelperOwnerLabel: a.volumeHelperOwner},
+	}
+	hostConfig := &container.HostConfig{
+		Mounts: []mount.Mount{{
+			Type:     mount.TypeVolume,
+			Source:   name,
+			Target:   volumeHelperPath,
+			ReadOnly: readOnly,
+		}},
+	}
+
+	created, err := a.cli.ContainerCreate(ctx, config, hostConfig, nil, nil, "")
+	if errdefs.IsNotFound(err) {
+		if err := a.pullVolumeHelper(ctx); err != nil {
+			return "", err
+		}
+		created, err = a.cli.ContainerCreate(ctx, config, hostConfig, nil, nil, "")
+	}
+	if err != nil {
+		return "", fmt.Errorf("docker create volume helper: %w", err)
+	}
+
+	return created.ID, nil
+}
+
+func (a *Agent) pullVolumeHelper(ctx context.Context) error {
+	progress, err := a.cli.ImagePull(ctx, a.volumeHelperImage, image.PullOptions{})
+	if err != nil {
+		return fmt.Errorf("docker pull volume helper %q: %w", a.volumeHelperImage, err)
+	}
+	defer progress.Close()
+
+	if _, err := io.Copy(io.Discard, progress); err != nil {
+		return fmt.Errorf("docker pull volume helper %q: %w", a.volumeHelperImage, err)
+	}
+
+	return nil
+}
+
+func (a *Agent) removeVolumeHelper(ctx context.Context, id string) {
+	// Clean up even when the transfer failed because ctx ended.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	defer cancel()
+
+	if err := a.cli.ContainerRemove(ctx, id, container.RemoveOptions{Force: true}); err != nil {
+		a.emitError(ctx, fmt.Errorf("docker remove volume helper %s: %w", shortID(id), err))
+	}
+}
+
+// removeStaleVolumeHelpers removes helper containers left behind by an agent
+// that stopped mid-transfer. Helpers of this process are kept.
+func (a *Agent) removeStaleVolumeHelpers(ctx context.Context) {
+	helpers, err := a.cli.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", volumeHelperLabel)),
+	})
+	if err != nil {
+		a.emitError(ctx, fmt.Errorf("docker list volume helpers: %w", err))
+		return
+	}
+
+	for _, helper := range helpers {
+		if helper.Labels[volumeHelperOwnerLabel] != a.volumeHelperOwner {
+			a.removeVolumeHelper(ctx, helper.ID)
+		}
+	}
+}
+
+// writeVolumeArchive writes the tree under root as a tar stream with names
+// relative to root. Symlinks are stored, not followed; sockets and devices
+// are skipped.
+func writeVolumeArchive(root *os.Root, w io.Writer) error {
+	tw := tar.NewWriter(w)
+
+	err := fs.WalkDir(root.FS(), ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		mode := info.Mode()
+		if !mode.IsRegular() && !mode.IsDir() && mode&fs.ModeSymlink == 0 {
+			return nil
+		}
+
+		var link string
+		if mode&fs.ModeSymlink != 0 {
+			if link, err = root.Readlink(name); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if mode.IsDir() {
+			header.Name += "/"
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !mode.IsRegular() {
+			return nil
+		}
+
+		file, err := root.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// extractVolumeArchive unpacks a tar stream under root. os.Root rejects
+// entries, including symlink targets, that would resolve outside of it.
+func extractVolumeArchive(root *os.Root, r io.Reader) error {
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read archive: %w", err)
+		}
+
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if name == "." {
+			continue
+		}
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("archive entry %q is outside the volume", header.Name)
+		}
+
+		mode := header.FileInfo().Mode().Perm()
+		if dir := filepath.Dir(name); dir != "." {
+			if err := root.MkdirAll(dir, 0o755); err != nil {
+				return err
+			}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := root.MkdirAll(name, mode); err != nil {
+				return err
+			}
+
+		case tar.TypeReg:
+			file, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(file, tr)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+
+		case tar.TypeSymlink:
+			if err := root.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			if err := root.Symlink(header.Linkname, name); err != nil {
+				return err
+			}
+
+		case tar.TypeLink:
+			target := filepath.Clean(filepath.FromSlash(header.Linkname))
+			if !filepath.IsLocal(target) {
+				return fmt.Errorf("archive link %q is outside the volume", header.Linkname)
+			}
+			if err := root.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			if err := root.Link(target, name); err != nil {
+				return err
+			}
+
+		default:
+			continue
+		}
+
+		// Ownership only sticks when the agent runs as root, which is the
+		// case whenever it can read other containers' volumes directly.
+		if err := root.Lchown(name, header.Uid, header.Gid); err != nil && !errors.Is(err, fs.ErrPermission) {
+			return err
+		}
+		if header.Typeflag == tar.TypeDir || header.Typeflag == tar.TypeReg {
+			if err := root.Chmod(name, mode); err != nil {
+				return err
+			}
+			if err := root.Chtimes(name, header.ModTime, header.ModTime); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// volumeTransfer counts and hashes archive bytes as they pass and reports
+// progress at most once per volumeProgressInterval.
+type volumeTransfer struct {
+	agent     *Agent
+	ctx       context.Context
+	prefix    string
+	commandID string
+	volume    string
+	method    string
+	format    string
+	total     *int64
+	// partial is set once a restore starts writing into the volume.
+	partial bool
+
+	digest   hash.Hash
+	bytes    int64
+	started  time.Time
+	reported time.Time
+}
+
+func (a *Agent) newVolumeTransfer(
+	ctx context.Context,
+	prefix string,
+	commandID string,
+	name string,
+	method string,
+) *volumeTransfer {
+	now := time.Now()
+
+	return &volumeTransfer{
+		agent:     a,
+		ctx:       ctx,
+		prefix:    prefix,
+		commandID: commandID,
+		volume:    name,
+		method:    method,
+		digest:    sha256.New(),
+		started:   now,
+		reported:  now,
+	}
+}
+
+func (t *volumeTransfer) Write(p []byte) (int, error) {
+	t.digest.Write(p)
+	t.bytes += int64(len(p))
+
+	if now := time.Now(); now.Sub(t.reported) >= volumeProgressInterval {
+		t.reported = now
+		t.agent.emitEvent(t.ctx, Event{
+			Type: t.prefix + ".progress",
+			TS:   now,
+			Data: VolumeTransferProgress{
+				CommandID: t.commandID,
+				Volume:    t.volume,
+				Bytes:     t.bytes,
+				Total:     t.total,
+			},
+			// Only the latest progress of a transfer is worth sending.
+			Key: t.prefix + ".progress:" + t.commandID,
+		})
+	}
+
+	return len(p), nil
+}
+
+func (t *volumeTransfer) finish(err error) {
+	result := VolumeTransferResult{
+		CommandID:  t.commandID,
+		Volume:     t.volume,
+		Method:     t.method,
+		Format:     t.format,
+		Bytes:      t.bytes,
+		DurationMs: time.Since(t.started).Milliseconds(),
+	}
+
+	eventType := t.prefix + ".complete"
+	if err != nil {
+		eventType = t.prefix + ".failed"
+		result.Partial = t.partial
+		result.Error = err.Error()
+	} else {
+		result.SHA256 = hex.EncodeToString(t.digest.Sum(nil))
+	}
+
+	t.agent.emitEvent(t.ctx, Event{Type: eventType, TS: time.Now(), Data: result})
+}
+
+// closeTransfer closes a backup target or restore source, aborting it when
+// the transfer failed so the other end does not take a partial archive for
+// a complete one.
+func closeTransfer(c io.Closer, err error) {
+	if aborter, ok := c.(interface{ CloseWithError(error) error }); ok && err != nil {
+		aborter.CloseWithError(err)
+		return
+	}
+
+	c.Close()
+}
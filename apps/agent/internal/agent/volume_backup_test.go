@@ -0,0 +1,394 @@
+package agent
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/volume"
+)
+
+// archiveBuffer is a backup target that records how it was closed.
+type archiveBuffer struct {
+	bytes.Buffer
+	closed  bool
+	aborted error
+}
+
+func (b *archiveBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func (b *archiveBuffer) CloseWithError(err error) error {
+	b.aborted = err
+	return nil
+}
+
+// archiveSource is a restore source that cannot seek, like a stream.
+type archiveSource struct {
+	io.Reader
+	closed  bool
+	aborted error
+}
+
+func (s *archiveSource) Close() error {
+	s.closed = true
+	return nil
+}
+
+func (s *archiveSource) CloseWithError(err error) error {
+	s.aborted = err
+	return nil
+}
+
+// waitTransfer collects events until a transfer ends and returns the
+// progress events and the result.
+func waitTransfer(t *testing.T, a *Agent) ([]Event, Event) {
+	t.Helper()
+
+	var progress []Event
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-a.events:
+			if strings.HasSuffix(event.Type, ".progress") {
+				progress = append(progress, event)
+				continue
+			}
+			a.transfers.Wait()
+			return progress, event
+		case err := <-a.errors:
+			t.Fatalf("unexpected agent error: %v", err)
+		case <-timeout:
+			t.Fatal("transfer did not finish")
+		}
+	}
+}
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func newDirectVolumeAgent(t *testing.T) (*Agent, *fakeDocker, string, string) {
+	t.Helper()
+
+	a, docker := newVolumeTestAgent(t)
+	source, target := t.TempDir(), t.TempDir()
+
+	writeTestFiles(t, source, map[string]string{
+		"config.json":  `{"debug":true}`,
+		"logs/app.log": "started\n",
+	})
+	if err := os.Mkdir(filepath.Join(source, "empty"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("logs/app.log", filepath.Join(source, "current")); err != nil {
+		t.Fatal(err)
+	}
+
+	docker.mu.Lock()
+	docker.volumes[0].Mountpoint = source
+	docker.volumes = append(docker.volumes, volume.Volume{Name: "restored", Driver: "local", Mountpoint: target})
+	docker.mu.Unlock()
+
+	return a, docker, source, target
+}
+
+func TestBackupVolumeDirect(t *testing.T) {
+	ctx := context.Background()
+	a, _, _, target := newDirectVolumeAgent(t)
+
+	archive := &archiveBuffer{}
+	if err := a.BackupVolume(ctx, "cmd-1", "data", "", true, archive); err != nil {
+		t.Fatalf("BackupVolume() unexpected error: %v", err)
+	}
+
+	_, event := waitTransfer(t, a)
+	if event.Type != "volume.backup.complete" {
+		t.Fatalf("event = %s %+v", event.Type, event.Data)
+	}
+
+	result := event.Data.(VolumeTransferResult)
+	sum := sha256.Sum256(archive.Bytes())
+	if result.CommandID != "cmd-1" || result.Method != "direct" || result.Format != "tar.gz" {
+		t.Fatalf("result = %+v", result)
+	}
+	if result.SHA256 != hex.EncodeToString(sum[:]) || result.Bytes != int64(archive.Len()) {
+		t.Fatalf("result checksum = %s (%d bytes), archive = %x (%d bytes)", result.SHA256, result.Bytes, sum, archive.Len())
+	}
+	if !archive.closed || archive.aborted != nil {
+		t.Fatalf("target closed = %v, aborted = %v", archive.closed, archive.aborted)
+	}
+
+	t.Run("restores with a verified checksum", func(t *testing.T) {
+		source := &archiveSource{Reader: bytes.NewReader(archive.Bytes())}
+		if err := a.RestoreVolume(ctx, "cmd-2", "restored", "direct", result.SHA256, source); err != nil {
+			t.Fatalf("RestoreVolume() unexpected error: %v", err)
+		}
+
+		_, event := waitTransfer(t, a)
+		if event.Type != "volume.restore.complete" {
+			t.Fatalf("event = %s %+v", event.Type, event.Data)
+		}
+		restored := event.Data.(VolumeTransferResult)
+		if restored.SHA256 != result.SHA256 || restored.Format != "tar.gz" || !source.closed {
+			t.Fatalf("restore result = %+v, source closed = %v", restored, source.closed)
+		}
+
+		content, err := os.ReadFile(filepath.Join(target, "current"))
+		if err != nil || string(content) != "started\n" {
+			t.Fatalf("restored symlink content = %q, %v", content, err)
+		}
+		info, err := os.Stat(filepath.Join(target, "config.json"))
+		if err != nil || info.Mode().Perm() != 0o640 {
+			t.Fatalf("restored config.json = %v, %v", info, err)
+		}
+		if info, err := os.Stat(filepath.Join(target, "empty")); err != nil || !info.IsDir() {
+			t.Fatalf("restored empty dir = %v, %v", info, err)
+		}
+	})
+
+	t.Run("rejects a checksum mismatch before writing", func(t *testing.T) {
+		empty := t.TempDir()
+		a.cli.(*fakeDocker).volumes[2].Mountpoint = empty
+
+		source := &archiveSource{Reader: bytes.NewReader(archive.Bytes())}
+		err := a.RestoreVolume(ctx, "cmd-3", "restored", "", strings.Repeat("0", 64), source)
+		if err != nil {
+			t.Fatalf("RestoreVolume() unexpected error: %v", err)
+		}
+
+		_, event := waitTransfer(t, a)
+		failed := event.Data.(VolumeTransferResult)
+		if event.Type != "volume.restore.failed" || !strings.Contains(failed.Error, "checksum mismatch") {
+			t.Fatalf("event = %s %+v", event.Type, failed)
+		}
+		if !errors.Is(source.aborted, ErrVolumeChecksumMismatch) {
+			t.Fatalf("source aborted with %v", source.aborted)
+		}
+		if entries, _ := os.ReadDir(empty); len(entries) != 0 {
+			t.Fatalf("restore wrote %d entries despite the mismatch", len(entries))
+		}
+		if failed.Partial {
+			t.Fatal("result marked partial although nothing was written")
+		}
+	})
+
+	t.Run("marks a restore that failed mid-write as partial", func(t *testing.T) {
+		a.cli.(*fakeDocker).volumes[2].Mountpoint = t.TempDir()
+
+		truncated := archive.Bytes()[:archive.Len()/2]
+		source := &archiveSource{Reader: bytes.NewReader(truncated)}
+		if err := a.RestoreVolume(ctx, "cmd-4", "restored", "direct", "", source); err != nil {
+			t.Fatalf("RestoreVolume() unexpected error: %v", err)
+		}
+
+		_, event := waitTransfer(t, a)
+		failed := event.Data.(VolumeTransferResult)
+		if event.Type != "volume.restore.failed" || !failed.Partial {
+			t.Fatalf("event = %s %+v", event.Type, failed)
+		}
+	})
+}
+
+func TestBackupVolumeProgress(t *testing.T) {
+	interval := volumeProgressInterval
+	volumeProgressInterval = 0
+	t.Cleanup(func() { volumeProgressInterval = interval })
+
+	a, _, _, _ := newDirectVolumeAgent(t)
+
+	archive := &archiveBuffer{}
+	if err := a.BackupVolume(context.Background(), "cmd-1", "data", "direct", false, archive); err != nil {
+		t.Fatalf("BackupVolume() unexpected error: %v", err)
+	}
+
+	progress, event := waitTransfer(t, a)
+	if event.Type != "volume.backup.complete" || len(progress) == 0 {
+		t.Fatalf("event = %s after %d progress events", event.Type, len(progress))
+	}
+
+	last := progress[len(progress)-1]
+	if last.Key != "volume.backup.progress:cmd-1" {
+		t.Fatalf("progress key = %q", last.Key)
+	}
+	if data := last.Data.(VolumeTransferProgress); data.Bytes <= 0 || data.Bytes > int64(archive.Len()) {
+		t.Fatalf("progress = %+v for a %d byte archive", data, archive.Len())
+	}
+}
+
+func TestBackupVolumeHelper(t *testing.T) {
+	ctx := context.Background()
+	a, docker := newVolumeTestAgent(t)
+	docker.missingImages[defaultVolumeHelperImage] = true
+
+	archive := &archiveBuffer{}
+	if err := a.BackupVolume(ctx, "cmd-1", "data", "", false, archive); err != nil {
+		t.Fatalf("BackupVolume() unexpected error: %v", err)
+	}
+
+	_, event := waitTransfer(t, a)
+	result := event.Data.(VolumeTransferResult)
+	if event.Type != "volume.backup.complete" || result.Method != "helper" || result.Format != "tar" {
+		t.Fatalf("event = %s %+v", event.Type, result)
+	}
+	if docker.callCount("ImagePull") != 1 {
+		t.Fatalf("ImagePull() calls = %d, want 1", docker.callCount("ImagePull"))
+	}
+	if len(docker.helpers) != 0 || docker.callCount("ContainerRemove") != 1 {
+		t.Fatalf("helpers left = %d, ContainerRemove() calls = %d", len(docker.helpers), docker.callCount("ContainerRemove"))
+	}
+
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(archive.Bytes()))
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, header.Name)
+	}
+	if strings.Join(names, ",") != "./config.json,./logs/app.log" {
+		t.Fatalf("archive entries = %v", names)
+	}
+
+	t.Run("restores into a new volume", func(t *testing.T) {
+		source := &archiveSource{Reader: bytes.NewReader(archive.Bytes())}
+		if err := a.RestoreVolume(ctx, "cmd-2", "fresh", "helper", "", source); err != nil {
+			t.Fatalf("RestoreVolume() unexpected error: %v", err)
+		}
+
+		_, event := waitTransfer(t, a)
+		if event.Type != "volume.restore.complete" {
+			t.Fatalf("event = %s %+v", event.Type, event.Data)
+		}
+		if docker.callCount("VolumeCreate") != 1 {
+			t.Fatalf("VolumeCreate() calls = %d, want 1", docker.callCount("VolumeCreate"))
+		}
+		if !maps.Equal(docker.volumeFiles["fresh"], docker.volumeFiles["data"]) {
+			t.Fatalf("restored files = %v, want %v", docker.volumeFiles["fresh"], docker.volumeFiles["data"])
+		}
+	})
+}
+
+func TestRemoveStaleVolumeHelpers(t *testing.T) {
+	a, docker := newVolumeTestAgent(t)
+	docker.containers = append(docker.containers,
+		container.Summary{ID: "stale", Labels: map[string]string{
+			volumeHelperLabel:      "data",
+			volumeHelperOwnerLabel: "crashed",
+		}},
+		container.Summary{ID: "running", Labels: map[string]string{
+			volumeHelperLabel:      "data",
+			volumeHelperOwnerLabel: a.volumeHelperOwner,
+		}},
+	)
+	before := len(docker.containers)
+
+	a.removeStaleVolumeHelpers(context.Background())
+
+	if docker.callCount("ContainerRemove") != 1 {
+		t.Fatalf("ContainerRemove() calls = %d, want 1", docker.callCount("ContainerRemove"))
+	}
+	ids := make([]string, 0, len(docker.containers))
+	for _, item := range docker.containers {
+		ids = append(ids, item.ID)
+	}
+	if len(ids) != before-1 || slices.Contains(ids, "stale") || !slices.Contains(ids, "running") {
+		t.Fatalf("containers left = %v", ids)
+	}
+}
+
+func TestVolumeTransferMethod(t *testing.T) {
+	ctx := context.Background()
+	a, _ := newVolumeTestAgent(t)
+
+	tests := []struct {
+		name    string
+		method  string
+		message string
+	}{
+		{"direct without access to the mountpoint", "direct", "not accessible to the agent"},
+		{"unknown method", "rsync", `unknown transfer method "rsync"`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			archive := &archiveBuffer{}
+			err := a.BackupVolume(ctx, "cmd-1", "data", tc.method, false, archive)
+			if err == nil || !strings.Contains(err.Error(), tc.message) {
+				t.Fatalf("BackupVolume() error = %v, want %q", err, tc.message)
+			}
+			if archive.aborted != err {
+				t.Fatalf("target aborted with %v, want %v", archive.aborted, err)
+			}
+		})
+	}
+
+	t.Run("missing volume", func(t *testing.T) {
+		err := a.BackupVolume(ctx, "cmd-1", "missing", "", false, &archiveBuffer{})
+		if !errors.Is(err, ErrVolumeNotFound) {
+			t.Fatalf("BackupVolume() error = %v, want ErrVolumeNotFound", err)
+		}
+	})
+}
+
+func TestExtractVolumeArchiveRejectsEscapes(t *testing.T) {
+	tests := []struct {
+		name   string
+		header tar.Header
+	}{
+		{"parent path", tar.Header{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0o644}},
+		{"link outside", tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd"}},
+		{"write through symlink", tar.Header{Name: "out/escape", Typeflag: tar.TypeReg, Mode: 0o644}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.Symlink(t.TempDir(), filepath.Join(dir, "out")); err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			if err := tw.WriteHeader(&tc.header); err != nil {
+				t.Fatal(err)
+			}
+			tw.Close()
+
+			root, err := os.OpenRoot(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer root.Close()
+
+			if err := extractVolumeArchive(root, &buf); err == nil {
+				t.Fatal("extractVolumeArchive() expected error")
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/errdefs"
+)
+
+const defaultVolumeDriver = "local"
+
+var (
+	ErrVolumeNotFound = newKindError("volume_not_found", "volume not found")
+	ErrVolumeExists   = newKindError("volume_exists", "volume already exists")
+	ErrVolumeInUse    = newKindError("volume_in_use", "volume in use")
+)
+
+// CreateVolume creates a volume and returns its name. The driver defaults to
+// local; options are passed to the driver as is.
+func (a *Agent) CreateVolume(
+	ctx context.Context,
+	name string,
+	driver string,
+	options map[string]string,
+	labels map[string]string,
+) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("volume name is required")
+	}
+
+	driver = strings.TrimSpace(driver)
+	if driver == "" {
+		driver = defaultVolumeDriver
+	}
+
+	// Docker returns an existing volume of the same name instead of failing,
+	// which would silently ignore a different driver or labels.
+	if _, err := a.cli.VolumeInspect(ctx, name); err == nil {
+		return "", fmt.Errorf("%w: %q", ErrVolumeExists, name)
+	} else if !errdefs.IsNotFound(err) {
+		return "", fmt.Errorf("docker inspect volume: %w", err)
+	}
+
+	created, err := a.cli.VolumeCreate(ctx, volume.CreateOptions{
+		Name:       name,
+		Driver:     driver,
+		DriverOpts: options,
+		Labels:     labels,
+	})
+	if err != nil {
+		return "", fmt.Errorf("docker create volume: %w", err)
+	}
+
+	return created.Name, nil
+}
+
+// RemoveVolume removes a volume. It refuses while containers, running or
+// not, mount it and names them; force only skips that check.
+func (a *Agent) RemoveVolume(ctx context.Context, name string, force bool) error {
+	info, err := a.lookupVolume(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if !force {
+		// Bypass the cache so a container created moments ago counts.
+		containers, err := a.fetchContainerList(ctx, "")
+		if err != nil {
+			return fmt.Errorf("docker list containers: %w", err)
+		}
+
+		if users := containersForVolume(info.Name, containers); len(users) > 0 {
+			names := make([]string, 0, len(users))
+			for _, user := range users {
+				names = append(names, user.Name)
+			}
+
+			return fmt.Errorf(
+				"%w: %q is mounted by %d containers: %s",
+				ErrVolumeInUse,
+				info.Name,
+				len(names),
+				strings.Join(names, ", "),
+			)
+		}
+	}
+
+	if err := a.cli.VolumeRemove(ctx, info.Name, force); err != nil {
+		if errdefs.IsNotFound(err) {
+			return fmt.Errorf("%w: %q", ErrVolumeNotFound, name)
+		}
+		if errdefs.IsConflict(err) {
+			return fmt.Errorf("%w: %q: %w", ErrVolumeInUse, name, err)
+		}
+
+		return fmt.Errorf("docker remove volume: %w", err)
+	}
+
+	return nil
+}
+
+// PruneVolumes removes unused volumes and returns their names and the bytes
+// reclaimed. Docker only prunes anonymous volumes unless all is set.
+func (a *Agent) PruneVolumes(ctx context.Context, all bool) ([]string, uint64, error) {
+	args := filters.NewArgs()
+	if all {
+		args.Add("all", "true")
+	}
+
+	report, err := a.cli.VolumesPrune(ctx, args)
+	if err != nil {
+		return nil, 0, fmt.Errorf("docker prune volumes: %w", err)
+	}
+
+	deleted := report.VolumesDeleted
+	if deleted == nil {
+		deleted = []string{}
+	}
+
+	return deleted, report.SpaceReclaimed, nil
+}
+
+func (a *Agent) lookupVolume(ctx context.Context, name string) (volume.Volume, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return volume.Volume{}, errors.New("volume name is required")
+	}
+
+	info, err := a.cli.VolumeInspect(ctx, name)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return volume.Volume{}, fmt.Errorf("%w: %q", ErrVolumeNotFound, name)
+		}
+
+		return volume.Volume{}, fmt.Errorf("docker inspect volume: %w", err)
+	}
+
+	return info, nil
+}
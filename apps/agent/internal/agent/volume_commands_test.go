@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newVolumeTestAgent(t *testing.T) (*Agent, *fakeDocker) {
+	t.Helper()
+
+	docker := newFakeDocker(2, 0)
+	a := newAgent(docker, snapshotOptions{Workers: 1, CallTimeout: time.Second, Timeout: time.Second}, eventOptions{})
+	return a, docker
+}
+
+func TestCreateVolume(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("creates with the local driver by default", func(t *testing.T) {
+		a, docker := newVolumeTestAgent(t)
+
+		name, err := a.CreateVolume(ctx, " uploads ", "", map[string]string{"size": "1G"}, map[string]string{"app": "web"})
+		if err != nil {
+			t.Fatalf("CreateVolume() unexpected error: %v", err)
+		}
+		if name != "uploads" {
+			t.Fatalf("CreateVolume() = %q, want uploads", name)
+		}
+
+		info, err := docker.VolumeInspect(ctx, "uploads")
+		if err != nil {
+			t.Fatalf("VolumeInspect() unexpected error: %v", err)
+		}
+		if info.Driver != "local" || info.Labels["app"] != "web" || info.Options["size"] != "1G" {
+			t.Fatalf("created volume = %+v", info)
+		}
+	})
+
+	t.Run("refuses an existing name", func(t *testing.T) {
+		a, docker := newVolumeTestAgent(t)
+
+		_, err := a.CreateVolume(ctx, "data", "local", nil, nil)
+		if !errors.Is(err, ErrVolumeExists) {
+			t.Fatalf("CreateVolume() error = %v, want ErrVolumeExists", err)
+		}
+		if docker.callCount("VolumeCreate") != 0 {
+			t.Fatal("VolumeCreate() called for an existing volume")
+		}
+	})
+
+	t.Run("requires a name", func(t *testing.T) {
+		a, _ := newVolumeTestAgent(t)
+
+		if _, err := a.CreateVolume(ctx, " ", "", nil, nil); err == nil {
+			t.Fatal("CreateVolume() expected error for an empty name")
+		}
+	})
+}
+
+func TestRemoveVolume(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("removes an orphaned volume", func(t *testing.T) {
+		a, docker := newVolumeTestAgent(t)
+
+		if err := a.RemoveVolume(ctx, "cache", false); err != nil {
+			t.Fatalf("RemoveVolume() unexpected error: %v", err)
+		}
+		if docker.callCount("VolumeRemove") != 1 {
+			t.Fatalf("VolumeRemove() calls = %d", docker.callCount("VolumeRemove"))
+		}
+	})
+
+	t.Run("refuses a mounted volume and names its containers", func(t *testing.T) {
+		a, docker := newVolumeTestAgent(t)
+
+		err := a.RemoveVolume(ctx, "data", false)
+		if !errors.Is(err, ErrVolumeInUse) {
+			t.Fatalf("RemoveVolume() error = %v, want ErrVolumeInUse", err)
+		}
+		if !strings.Contains(err.Error(), "container-0") {
+			t.Fatalf("RemoveVolume() error = %v, want the container name", err)
+		}
+		if docker.callCount("VolumeRemove") != 0 {
+			t.Fatal("VolumeRemove() called for a volume in use")
+		}
+	})
+
+	t.Run("force skips the in-use check", func(t *testing.T) {
+		a, docker := newVolumeTestAgent(t)
+
+		if err := a.RemoveVolume(ctx, "data", true); err != nil {
+			t.Fatalf("RemoveVolume() unexpected error: %v", err)
+		}
+		if docker.callCount("VolumeRemove") != 1 {
+			t.Fatalf("VolumeRemove() calls = %d", docker.callCount("VolumeRemove"))
+		}
+	})
+
+	t.Run("reports a missing volume", func(t *testing.T) {
+		a, _ := newVolumeTestAgent(t)
+
+		err := a.RemoveVolume(ctx, "missing", false)
+		if !errors.Is(err, ErrVolumeNotFound) {
+			t.Fatalf("RemoveVolume() error = %v, want ErrVolumeNotFound", err)
+		}
+	})
+}
+
+func TestPruneVolumes(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("anonymous only by default", func(t *testing.T) {
+		a, _ := newVolumeTestAgent(t)
+
+		deleted, reclaimed, err := a.PruneVolumes(ctx, false)
+		if err != nil {
+			t.Fatalf("PruneVolumes() unexpected error: %v", err)
+		}
+		if deleted == nil || len(deleted) != 0 || reclaimed != 0 {
+			t.Fatalf("PruneVolumes() = %v, %d", deleted, reclaimed)
+		}
+	})
+
+	t.Run("all removes unused named volumes", func(t *testing.T) {
+		a, docker := newVolumeTestAgent(t)
+		docker.mu.Lock()
+		docker.volumeSizes["cache"] = 2048
+		docker.mu.Unlock()
+
+		deleted, reclaimed, err := a.PruneVolumes(ctx, true)
+		if err != nil {
+			t.Fatalf("PruneVolumes() unexpected error: %v", err)
+		}
+		if !slices.Equal(deleted, []string{"cache"}) || reclaimed != 2048 {
+			t.Fatalf("PruneVolumes() = %v, %d", deleted, reclaimed)
+		}
+	})
+}
@@ -0,0 +1,184 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/volume"
+)
+
+const (
+	dockerVolumeType = "volume"
+)
+
+// VolumeContainer is a container mounting a volume.
+type VolumeContainer struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	State       string `json:"state"`
+	Destination string `json:"destination"`
+	ReadOnly    bool   `json:"readOnly"`
+}
+
+// Volume is a named volume. A volume no container references, running or
+// not, is orphaned. Size is the disk usage in bytes from the last system df
+// run; it is omitted until measured or when the driver cannot report it.
+type Volume struct {
+	Name       string            `json:"name"`
+	Driver     string            `json:"driver"`
+	Scope      string            `json:"scope"`
+	Mountpoint string            `json:"mountpoint"`
+	Labels     map[string]string `json:"labels"`
+	Created    int64             `json:"created"`
+	Containers []VolumeContainer `json:"containers"`
+	Orphaned   bool              `json:"orphaned"`
+	Size       *int64            `json:"size,omitempty"`
+}
+
+// VolumeEventPayload is the payload of volume.* events. ContainerID is set
+// for mount and unmount.
+type VolumeEventPayload struct {
+	Volume
+	ContainerID string `json:"containerId,omitempty"`
+}
+
+// volumeUsage holds the latest system df results by volume name.
+type volumeUsage struct {
+	mu    sync.Mutex
+	sizes map[string]int64
+}
+
+func (s *volumeUsage) get(name string) *int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	size, ok := s.sizes[name]
+	if !ok {
+		return nil
+	}
+
+	return &size
+}
+
+func (s *volumeUsage) set(sizes map[string]int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sizes = sizes
+}
+
+// volumeSizes picks the volume sizes out of a system df. Docker reports -1
+// for volumes it cannot measure, e.g. with remote drivers. Snapshots pick
+// the sizes up, so changed sizes reach the server with the next delta.
+func volumeSizes(du types.DiskUsage) map[string]int64 {
+	sizes := make(map[string]int64, len(du.Volumes))
+	for _, item := range du.Volumes {
+		if item == nil || item.UsageData == nil || item.UsageData.Size < 0 {
+			continue
+		}
+		sizes[item.Name] = item.UsageData.Size
+	}
+
+	return sizes
+}
+
+func (a *Agent) listVolumes(ctx context.Context) ([]volume.Volume, error) {
+	response, err := a.cli.VolumeList(ctx, volume.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("docker list volumes: %w", err)
+	}
+
+	volumes := make([]volume.Volume, 0, len(response.Volumes))
+	for _, item := range response.Volumes {
+		if item != nil {
+			volumes = append(volumes, *item)
+		}
+	}
+
+	return volumes, nil
+}
+
+func (a *Agent) volumePayload(ctx context.Context, msg events.Message) (*VolumeEventPayload, error) {
+	if msg.Actor.ID == "" {
+		return nil, fmt.Errorf("volume event missing name")
+	}
+
+	payload := &VolumeEventPayload{ContainerID: msg.Actor.Attributes["container"]}
+
+	info, err := a.cli.VolumeInspect(ctx, msg.Actor.ID)
+	if err != nil {
+		payload.Volume = buildVolumeFallback(msg)
+		return payload, nil
+	}
+
+	containers, err := a.listContainers(ctx)
+	if err != nil {
+		containers = nil
+	}
+
+	payload.Volume = a.volumeFromInspect(info, containers)
+	return payload, nil
+}
+
+func (a *Agent) volumeFromInspect(info volume.Volume, containers []container.Summary) Volume {
+	labels := info.Labels
+	if labels == nil {
+		labels = map[string]string{}
+	}
+
+	users := containersForVolume(info.Name, containers)
+
+	return Volume{
+		Name:       info.Name,
+		Driver:     info.Driver,
+		Scope:      info.Scope,
+		Mountpoint: info.Mountpoint,
+		Labels:     labels,
+		Created:    parseCreated(info.CreatedAt),
+		Containers: users,
+		Orphaned:   len(users) == 0,
+		Size:       a.volumeUsage.get(info.Name),
+	}
+}
+
+func containersForVolume(name string, containers []container.Summary) []VolumeContainer {
+	result := []VolumeContainer{}
+
+	for _, item := range containers {
+		for _, point := range item.Mounts {
+			if point.Type != mount.TypeVolume || point.Name != name {
+				continue
+			}
+			result = append(result, VolumeContainer{
+				ID:          shortID(item.ID),
+				Name:        strings.TrimPrefix(firstName(item.Names), "/"),
+				State:       item.State,
+				Destination: point.Destination,
+				ReadOnly:    !point.RW,
+			})
+		}
+	}
+
+	slices.SortFunc(result, func(a, b VolumeContainer) int {
+		return strings.Compare(a.Name+a.Destination, b.Name+b.Destination)
+	})
+
+	return result
+}
+
+func buildVolumeFallback(msg events.Message) Volume {
+	return Volume{
+		Name:       msg.Actor.ID,
+		Driver:     msg.Actor.Attributes["driver"],
+		Labels:     map[string]string{},
+		Containers: []VolumeContainer{},
+		Created:    msg.Time,
+	}
+}
@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+)
+
+func volumeEvent(name string, action events.Action, attrs map[string]string) events.Message {
+	return events.Message{
+		Type:   events.VolumeEventType,
+		Action: action,
+		Actor:  events.Actor{ID: name, Attributes: attrs},
+	}
+}
+
+func TestVolumeSnapshot(t *testing.T) {
+	docker := newFakeDocker(2, 0)
+	a := newAgent(docker, snapshotOptions{Workers: 2, CallTimeout: time.Second, Timeout: time.Second}, eventOptions{})
+	ctx := context.Background()
+
+	payload, err := a.buildSnapshot(ctx)
+	if err != nil {
+		t.Fatalf("buildSnapshot() unexpected error: %v", err)
+	}
+
+	if len(payload.Volumes) != 2 {
+		t.Fatalf("volumes = %d, want 2", len(payload.Volumes))
+	}
+
+	data, cache := payload.Volumes[0], payload.Volumes[1]
+	if data.Name != "data" || data.Orphaned || len(data.Containers) != 1 || data.Created != 1767225600 {
+		t.Fatalf("data volume = %+v", data)
+	}
+	if user := data.Containers[0]; user.Name != "container-0" || user.Destination != "/data" || user.ReadOnly {
+		t.Fatalf("data volume container = %+v", user)
+	}
+	if !cache.Orphaned || len(cache.Containers) != 0 || cache.Labels["tier"] != "tmp" {
+		t.Fatalf("cache volume = %+v", cache)
+	}
+	if data.Size != nil {
+		t.Fatalf("size = %d before measuring", *data.Size)
+	}
+
+	t.Run("sizes come from the last measurement", func(t *testing.T) {
+		if _, err := a.dockerDiskUsage(ctx); err != nil {
+			t.Fatalf("dockerDiskUsage() unexpected error: %v", err)
+		}
+
+		payload, err := a.buildSnapshot(ctx)
+		if err != nil {
+			t.Fatalf("buildSnapshot() unexpected error: %v", err)
+		}
+
+		if size := payload.Volumes[0].Size; size == nil || *size != 4<<20 {
+			t.Fatalf("data size = %v", size)
+		}
+		// Docker reports -1 when it cannot measure a volume.
+		if size := payload.Volumes[1].Size; size != nil {
+			t.Fatalf("cache size = %d, want none", *size)
+		}
+
+		if calls := docker.callCount("DiskUsage"); calls != 1 {
+			t.Fatalf("DiskUsage() calls = %d, want 1", calls)
+		}
+	})
+
+	t.Run("scoped by name", func(t *testing.T) {
+		scoped, err := a.buildScopedSnapshot(ctx, snapshotScope{Volumes: true, IDs: []string{"cache"}})
+		if err != nil {
+			t.Fatalf("buildScopedSnapshot() unexpected error: %v", err)
+		}
+
+		if len(scoped.Volumes) != 1 || scoped.Volumes[0].Name != "cache" || scoped.Networks != nil {
+			t.Fatalf("scoped = %+v", scoped)
+		}
+	})
+}
+
+func TestVolumeEvents(t *testing.T) {
+	t.Run("mount carries the volume and container", func(t *testing.T) {
+		docker := newFakeDocker(1, 0)
+		a := startEventLoop(t, docker, eventOptions{})
+
+		event := publish(t, a, docker, volumeEvent("data", events.ActionMount, map[string]string{
+			"container":   docker.containers[0].ID,
+			"destination": "/data",
+			"driver":      "local",
+		}))
+
+		payload := event.Data.(*VolumeEventPayload)
+		if event.Type != "volume.mount" || payload.Name != "data" || payload.ContainerID != docker.containers[0].ID {
+			t.Fatalf("event = %q payload %+v", event.Type, payload)
+		}
+		if len(payload.Containers) != 1 || payload.Orphaned {
+			t.Fatalf("containers = %+v", payload.Containers)
+		}
+	})
+
+	t.Run("destroy falls back to event attributes", func(t *testing.T) {
+		docker := newFakeDocker(0, 0)
+		a := startEventLoop(t, docker, eventOptions{})
+
+		event := publish(t, a, docker, volumeEvent("gone", events.ActionDestroy, map[string]string{"driver": "local"}))
+
+		payload := event.Data.(*VolumeEventPayload)
+		if event.Type != "volume.destroy" || payload.Name != "gone" || payload.Driver != "local" {
+			t.Fatalf("event = %q payload %+v", event.Type, payload)
+		}
+	})
+}
@@ -7,25 +7,51 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"net/url"
-	"os"
+	"net/http"
+	"sync"
 	"time"
 
 	"github.com/coder/websocket"
-	"github.com/coder/websocket/wsjson"
 	"github.com/sonomandeep/containers/agent/internal/agent"
+	"github.com/sonomandeep/containers/agent/internal/env"
 )
 
 const (
 	agentAPIURLEnv = "AGENT_API_URL"
 	agentIDEnv     = "AGENT_ID"
+
+	dialTimeout         = 10 * time.Second
+	minReconnectBackoff = 500 * time.Millisecond
+	maxReconnectBackoff = 15 * time.Second
+
+	endpointEventType = "agent.endpoint"
 )
 
+var errFailback = errors.New("failing back to preferred endpoint")
+
 type Client struct {
-	Conn     *websocket.Conn
-	incoming <-chan InMsg
-	outgoing chan agent.Event
+	cfg config
+
+	incoming chan InMsg
+	outbox   *outbox
+	attached chan Endpoint
+	seq      *sequencer
+	errs     chan error
 	Errs     <-chan error
+
+	mu       sync.RWMutex
+	conn     *websocket.Conn
+	mux      *mux
+	endpoint Endpoint
+	closed   bool
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	// closeStatus and closeReason are sent in the close frame; closeErr
+	// is what closing the connection returned.
+	closeStatus websocket.StatusCode
+	closeReason string
+	closeErr    error
 }
 
 type InMsg struct {
@@ -33,121 +59,531 @@ type InMsg struct {
 	Data []byte
 }
 
-func Connect(ctx context.Context) (*Client, error) {
-	dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
-	defer cancel()
+type config struct {
+	endpoints        []Endpoint
+	dial             dialOptions
+	failbackInterval time.Duration
+	reconnectTimeout time.Duration
+	replayBuffer     int
+	outboundQueue    int
+	streamStall      time.Duration
+}
 
-	wsURL, err := buildURL()
+func configFromEnv() (config, error) {
+	endpoints, err := endpointsFromEnv()
 	if err != nil {
-		return nil, err
+		return config{}, err
+	}
+
+	opts, err := dialOptionsFromEnv()
+	if err != nil {
+		return config{}, err
+	}
+
+	failbackInterval, err := env.Duration(agentFailbackIntervalEnv, defaultFailbackInterval)
+	if err != nil {
+		return config{}, err
+	}
+
+	reconnectTimeout, err := env.Duration(agentReconnectTimeoutEnv, defaultReconnectTimeout)
+	if err != nil {
+		return config{}, err
+	}
+
+	replayBuffer, err := env.Int(agentReplayBufferEnv, defaultReplayBuffer)
+	if err != nil {
+		return config{}, err
+	}
+
+	outboundQueue, err := env.Int(agentOutboundQueueEnv, defaultOutboundQueue)
+	if err != nil {
+		return config{}, err
+	}
+
+	streamStall, err := env.Duration(agentStreamStallTimeoutEnv, defaultStreamStallTimeout)
+	if err != nil {
+		return config{}, err
 	}
-	log.Printf("ws: connecting to %s", wsURL)
 
-	c, _, err := websocket.Dial(dialCtx, wsURL, nil)
+	return config{
+		endpoints:        endpoints,
+		dial:             opts,
+		failbackInterval: failbackInterval,
+		reconnectTimeout: reconnectTimeout,
+		replayBuffer:     replayBuffer,
+		outboundQueue:    outboundQueue,
+		streamStall:      streamStall,
+	}, nil
+}
+
+// Connect attaches to the first reachable endpoint in AGENT_API_URL and keeps
+// the connection alive in the background: it reconnects in preference order
+// when the connection drops and fails back to a more preferred endpoint once
+// it is healthy again. Errs only fires when no endpoint could be reached for
+// AGENT_RECONNECT_TIMEOUT.
+func Connect(ctx context.Context) (*Client, error) {
+	cfg, err := configFromEnv()
 	if err != nil {
 		return nil, err
 	}
 
-	log.Printf("ws: connection established")
+	return connect(ctx, cfg)
+}
 
-	incoming := make(chan InMsg, 64)
-	outgoing := make(chan agent.Event, 64)
+func connect(ctx context.Context, cfg config) (*Client, error) {
+	conn, endpoint, err := dialFirst(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
 	errCh := make(chan error, 1)
+	c := &Client{
+		cfg:      cfg,
+		incoming: make(chan InMsg, 64),
+		outbox:   newOutbox(cfg.outboundQueue),
+		attached: make(chan Endpoint, 1),
+		seq:      newSequencer(cfg.replayBuffer),
+		errs:     errCh,
+		Errs:     errCh,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	c.attach(runCtx, conn, endpoint)
 
-	go read(ctx, c, incoming, errCh)
-	go writer(ctx, c, outgoing, errCh)
+	go c.run(runCtx, conn, endpoint)
 
-	return &Client{
-		Conn:     c,
-		incoming: incoming,
-		outgoing: outgoing,
-		Errs:     errCh,
+	return c, nil
+}
+
+type dialOptions struct {
+	TLS      TLSOptions
+	Proxy    ProxyOptions
+	Encoding encodingOptions
+}
+
+func dialOptionsFromEnv() (dialOptions, error) {
+	tlsOpts, err := tlsOptionsFromEnv()
+	if err != nil {
+		return dialOptions{}, err
+	}
+
+	encodingOpts, err := encodingOptionsFromEnv()
+	if err != nil {
+		return dialOptions{}, err
+	}
+
+	return dialOptions{
+		TLS:      tlsOpts,
+		Proxy:    proxyOptionsFromEnv(),
+		Encoding: encodingOpts,
 	}, nil
 }
 
+func (o dialOptions) httpClient() (*http.Client, *proxyTracker, error) {
+	tlsConfig, err := o.TLS.config()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	proxyFunc, err := o.Proxy.proxyFunc()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tracker := &proxyTracker{}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.Proxy = tracker.wrap(proxyFunc)
+	transport.OnProxyConnectResponse = checkProxyConnectResponse
+
+	return &http.Client{Transport: transport}, tracker, nil
+}
+
+func dial(ctx context.Context, wsURL string, opts dialOptions) (*websocket.Conn, error) {
+	httpClient, tracker, err := opts.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	defer httpClient.CloseIdleConnections()
+
+	if opts.TLS.InsecureSkipVerify {
+		log.Printf("ws: %s is set, server certificate is not verified", agentTLSInsecureEnv)
+	}
+	log.Printf("ws: connecting to %s", wsURL)
+
+	c, res, err := websocket.Dial(ctx, wsURL, &websocket.DialOptions{
+		HTTPClient:      httpClient,
+		Subprotocols:    opts.Encoding.subprotocols(),
+		CompressionMode: opts.Encoding.Compression,
+	})
+	if err != nil {
+		return nil, tracker.classify(wsURL, res, err)
+	}
+
+	log.Printf(
+		"ws: negotiated %s encoding (extensions: %q)",
+		negotiatedEncoding(c.Subprotocol()),
+		res.Header.Get("Sec-WebSocket-Extensions"),
+	)
+
+	if proxy := tracker.used(); proxy != nil {
+		log.Printf("ws: connected through proxy %s", proxy.Redacted())
+	}
+
+	return c, nil
+}
+
+// dialFirst tries the endpoints in preference order and returns the first
+// one that accepts the connection.
+func dialFirst(ctx context.Context, cfg config) (*websocket.Conn, Endpoint, error) {
+	var errs []error
+
+	for _, endpoint := range cfg.endpoints {
+		dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+		conn, err := dial(dialCtx, endpoint.wsURL, cfg.dial)
+		cancel()
+		if err == nil {
+			return conn, endpoint, nil
+		}
+
+		log.Printf("ws: endpoint %d (%s) unavailable: %v", endpoint.Index, endpoint.URL, err)
+		errs = append(errs, fmt.Errorf("endpoint %s: %w", endpoint.URL, err))
+
+		if ctx.Err() != nil {
+			return nil, Endpoint{}, ctx.Err()
+		}
+	}
+
+	return nil, Endpoint{}, errors.Join(errs...)
+}
+
 func (c *Client) Incoming() <-chan InMsg {
 	return c.incoming
 }
 
+// Attached delivers the endpoint every time the client (re)attaches after
+// the initial connection, so callers can resend state the new server
+// instance has not seen.
+func (c *Client) Attached() <-chan Endpoint {
+	return c.attached
+}
+
+// Endpoint reports the control-plane endpoint the client is attached to.
+func (c *Client) Endpoint() Endpoint {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.endpoint
+}
+
+// OpenStream opens a multiplexed stream on the current connection. Streams do
+// not survive a reconnect; they fail with the connection error instead, and
+// with ErrStreamStalled once a Read or Write made no progress for
+// AGENT_STREAM_STALL_TIMEOUT.
+func (c *Client) OpenStream(ctx context.Context, kind string, meta any) (*Stream, error) {
+	c.mu.RLock()
+	m := c.mux
+	c.mu.RUnlock()
+
+	if m == nil {
+		return nil, ErrMuxClosed
+	}
+
+	return m.open(ctx, kind, meta)
+}
+
+// Session identifies this agent process in the Session field of every
+// event; sequence numbers restart with it.
+func (c *Client) Session() string {
+	return c.seq.session
+}
+
+// ReplayEvents resends buffered events from fromSeq on, marked as replays.
+// It fails with ErrReplaySession for another session and with
+// ErrReplayUnavailable once those events were evicted; the server then needs
+// a full snapshot instead.
+func (c *Client) ReplayEvents(session string, fromSeq uint64) error {
+	return c.seq.request(session, fromSeq)
+}
+
+// Write queues event for the server without blocking. Snapshots and
+// metrics give way to command results and lifecycle events when the queue
+// is full, and a queued event is replaced by a newer one it supersedes.
 func (c *Client) Write(event agent.Event) {
-	select {
-	case c.outgoing <- event:
-	default:
-		log.Println("ws: outbound queue full, dropping event")
+	if !c.outbox.push(event) {
+		log.Printf("ws: outbound queue full, dropping %s event", event.Type)
 	}
 }
 
+// OutboundStats reports how many events were queued, dropped and replaced
+// since the client connected.
+func (c *Client) OutboundStats() agent.OutboundStats {
+	return c.outbox.stats()
+}
+
 func (c *Client) Close(status websocket.StatusCode, reason string) error {
-	if c == nil || c.Conn == nil {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
 		return nil
 	}
-	close(c.outgoing)
-	return c.Conn.Close(status, reason)
+	c.closed = true
+	c.closeStatus, c.closeReason = status, reason
+	c.mu.Unlock()
+
+	// Cancel first so run does not mistake the close for a lost connection
+	// and reconnect; the session closes the connection on its way out.
+	c.cancel()
+	<-c.done
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.closeErr
+}
+
+// closeConn runs the close handshake when the client shuts down. Without
+// an explicit Close the parent context ended, so the agent is going away.
+func (c *Client) closeConn(conn *websocket.Conn) {
+	c.mu.RLock()
+	status, reason := c.closeStatus, c.closeReason
+	c.mu.RUnlock()
+
+	if status == 0 {
+		status, reason = websocket.StatusGoingAway, "shutdown"
+	}
+	err := conn.Close(status, reason)
+
+	c.mu.Lock()
+	c.closeErr = err
+	c.mu.Unlock()
+}
+
+func (c *Client) attach(ctx context.Context, conn *websocket.Conn, endpoint Endpoint) {
+	c.mu.Lock()
+	c.conn = conn
+	c.endpoint = endpoint
+	c.mu.Unlock()
+
+	log.Printf("ws: attached to endpoint %d (%s)", endpoint.Index, endpoint.URL)
+
+	event := c.seq.stamp(agent.Event{Type: endpointEventType, TS: time.Now(), Data: endpoint})
+	if err := negotiatedEncoding(conn.Subprotocol()).write(ctx, conn, event); err != nil {
+		log.Printf("ws: report endpoint: %v", err)
+	}
+}
+
+func (c *Client) run(ctx context.Context, conn *websocket.Conn, endpoint Endpoint) {
+	defer close(c.done)
+	defer close(c.incoming)
+
+	for {
+		next, err := c.session(ctx, conn, endpoint)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if errors.Is(err, errFailback) {
+			conn, endpoint = next.conn, next.endpoint
+		} else {
+			log.Printf("ws: connection to endpoint %d lost: %v", endpoint.Index, err)
+
+			conn, endpoint, err = c.reconnect(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					c.reportError(err)
+				}
+				return
+			}
+		}
+
+		c.attach(ctx, conn, endpoint)
+
+		select {
+		case c.attached <- endpoint:
+		default:
+		}
+	}
 }
 
-func buildURL() (string, error) {
-	apiURL := os.Getenv(agentAPIURLEnv)
-	if apiURL == "" {
-		return "", fmt.Errorf("missing %s", agentAPIURLEnv)
+type failbackTarget struct {
+	conn     *websocket.Conn
+	endpoint Endpoint
+}
+
+// session pumps messages over conn until it fails or a more preferred
+// endpoint becomes healthy. On failback the new connection is returned and
+// the old one is closed with StatusGoingAway.
+func (c *Client) session(
+	ctx context.Context,
+	conn *websocket.Conn,
+	endpoint Endpoint,
+) (failbackTarget, error) {
+	// The session outlives ctx until the close handshake is done, which
+	// needs the reader.
+	sessionCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	// Nothing on the agent serves server-opened streams yet, so the mux
+	// refuses them.
+	m := newMux(sessionCtx, func(ctx context.Context, f []byte) error {
+		return conn.Write(ctx, websocket.MessageBinary, f)
+	}, nil, agentFirstStreamID, c.cfg.streamStall)
+
+	c.mu.Lock()
+	c.mux = m
+	c.mu.Unlock()
+
+	errCh := make(chan error, 2)
+	var wg sync.WaitGroup
+	wg.Go(func() { read(sessionCtx, conn, m, c.incoming, errCh) })
+	wg.Go(func() {
+		writer(sessionCtx, conn, negotiatedEncoding(conn.Subprotocol()), c.seq, c.outbox, errCh)
+	})
+	defer func() {
+		c.mu.Lock()
+		if c.mux == m {
+			c.mux = nil
+		}
+		c.mu.Unlock()
+
+		cancel()
+		wg.Wait()
+	}()
+
+	var probes <-chan time.Time
+	if endpoint.Index > 0 {
+		ticker := time.NewTicker(c.cfg.failbackInterval)
+		defer ticker.Stop()
+		probes = ticker.C
 	}
 
-	agentID := os.Getenv(agentIDEnv)
-	if agentID == "" {
-		return "", fmt.Errorf("missing %s", agentIDEnv)
+	healthy := make(map[int]int)
+	for {
+		select {
+		case <-ctx.Done():
+			c.closeConn(conn)
+			return failbackTarget{}, ctx.Err()
+
+		case err := <-errCh:
+			conn.CloseNow()
+			return failbackTarget{}, err
+
+		case <-probes:
+			target, ok := c.tryFailback(ctx, endpoint, healthy)
+			if !ok {
+				continue
+			}
+
+			log.Printf("ws: failing back from endpoint %d to %d", endpoint.Index, target.endpoint.Index)
+			conn.Close(websocket.StatusGoingAway, "failback")
+			return target, errFailback
+		}
 	}
+}
 
-	parsed, err := url.Parse(apiURL)
+func (c *Client) tryFailback(
+	ctx context.Context,
+	current Endpoint,
+	healthy map[int]int,
+) (failbackTarget, bool) {
+	httpClient, _, err := c.cfg.dial.httpClient()
 	if err != nil {
-		return "", fmt.Errorf("invalid %s: %w", agentAPIURLEnv, err)
+		return failbackTarget{}, false
 	}
+	defer httpClient.CloseIdleConnections()
 
-	switch parsed.Scheme {
-	case "http":
-		parsed.Scheme = "ws"
-	case "https":
-		parsed.Scheme = "wss"
-	case "ws", "wss":
-	default:
-		return "", fmt.Errorf("unsupported %s scheme: %s", agentAPIURLEnv, parsed.Scheme)
+	for _, endpoint := range c.cfg.endpoints[:current.Index] {
+		if err := probe(ctx, httpClient, endpoint); err != nil {
+			healthy[endpoint.Index] = 0
+			continue
+		}
+
+		healthy[endpoint.Index]++
+		if healthy[endpoint.Index] < failbackHealthyProbes {
+			continue
+		}
+
+		dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+		conn, err := dial(dialCtx, endpoint.wsURL, c.cfg.dial)
+		cancel()
+		if err != nil {
+			log.Printf("ws: failback to endpoint %d failed: %v", endpoint.Index, err)
+			healthy[endpoint.Index] = 0
+			continue
+		}
+
+		return failbackTarget{conn: conn, endpoint: endpoint}, true
 	}
 
-	parsed.Path = "/api/agents/socket"
-	q := parsed.Query()
-	q.Set("id", agentID)
-	parsed.RawQuery = q.Encode()
+	return failbackTarget{}, false
+}
+
+// reconnect walks the endpoints in preference order with exponential backoff
+// between rounds until one accepts or the reconnect timeout expires.
+func (c *Client) reconnect(ctx context.Context) (*websocket.Conn, Endpoint, error) {
+	deadline := time.Now().Add(c.cfg.reconnectTimeout)
+	backoff := minReconnectBackoff
 
-	return parsed.String(), nil
+	for {
+		conn, endpoint, err := dialFirst(ctx, c.cfg)
+		if err == nil {
+			return conn, endpoint, nil
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, Endpoint{}, fmt.Errorf("no control-plane endpoint reachable for %s: %w", c.cfg.reconnectTimeout, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, Endpoint{}, ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, maxReconnectBackoff)
+	}
 }
 
-func read(ctx context.Context, c *websocket.Conn, out chan<- InMsg, errs chan<- error) {
-	defer close(out)
+func (c *Client) reportError(err error) {
+	select {
+	case c.errs <- err:
+	default:
+	}
+}
 
+func read(
+	ctx context.Context,
+	c *websocket.Conn,
+	m *mux,
+	out chan<- InMsg,
+	errs chan<- error,
+) {
 	for {
 		typ, payload, err := c.Read(ctx)
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
 
 			switch websocket.CloseStatus(err) {
 			case websocket.StatusNormalClosure:
 				log.Println("ws: normal closure")
-				return
 
 			case websocket.StatusGoingAway:
 				log.Println("ws: server going away")
-				return
-			}
 
-			if ctx.Err() != nil {
-				log.Println("ws: context cancelled")
-				return
-			}
-
-			if errors.Is(err, net.ErrClosed) {
-				log.Println("ws: connection closed")
-				return
+			default:
+				if errors.Is(err, net.ErrClosed) {
+					log.Println("ws: connection closed")
+				} else {
+					log.Printf("ws: read error: %v", err)
+				}
 			}
 
-			log.Printf("ws: read error: %v", err)
-
 			select {
 			case errs <- err:
 			default:
@@ -155,6 +591,13 @@ func read(ctx context.Context, c *websocket.Conn, out chan<- InMsg, errs chan<-
 			return
 		}
 
+		if typ == websocket.MessageBinary {
+			if err := m.handleFrame(payload); err != nil {
+				log.Printf("ws: invalid stream frame: %v", err)
+			}
+			continue
+		}
+
 		b := make([]byte, len(payload))
 		copy(b, payload)
 
@@ -166,22 +609,44 @@ func read(ctx context.Context, c *websocket.Conn, out chan<- InMsg, errs chan<-
 	}
 }
 
-func writer(ctx context.Context, c *websocket.Conn, out <-chan agent.Event, errs chan<- error) {
+func writer(
+	ctx context.Context,
+	c *websocket.Conn,
+	enc wireEncoding,
+	seq *sequencer,
+	out *outbox,
+	errs chan<- error,
+) {
+	write := func(event agent.Event) bool {
+		if err := enc.write(ctx, c, event); err != nil {
+			select {
+			case errs <- err:
+			default:
+			}
+			return false
+		}
+		return true
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
 
-		case msg, ok := <-out:
-			if !ok {
-				return
+		case <-seq.replay:
+			for _, event := range seq.pending() {
+				if !write(event) {
+					return
+				}
 			}
-			if err := wsjson.Write(ctx, c, msg); err != nil {
 
-				select {
-				case errs <- err:
-				default:
-				}
+		case <-out.ready:
+			msg, ok := out.pop()
+			if !ok {
+				continue
+			}
+			seq.skip(out.takeLost())
+			if !write(seq.stamp(msg)) {
 				return
 			}
 		}
@@ -0,0 +1,122 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/coder/websocket"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/sonomandeep/containers/agent/internal/agent"
+	"github.com/sonomandeep/containers/agent/internal/env"
+)
+
+const (
+	agentWireEncodingEnv  = "AGENT_WIRE_ENCODING"
+	agentWSCompressionEnv = "AGENT_WS_COMPRESSION"
+
+	jsonSubprotocol = "containers.agent.json.v1"
+	cborSubprotocol = "containers.agent.cbor.v1"
+
+	// frameEvent carries one CBOR-encoded agent.Event in a binary message,
+	// next to the stream frames. The stream id is always 0.
+	frameEvent byte = 5
+)
+
+// wireEncoding is how events are written once the server has picked a
+// subprotocol. JSON text messages stay the fallback for servers that do not
+// negotiate one.
+type wireEncoding string
+
+const (
+	encodingJSON wireEncoding = "json"
+	encodingCBOR wireEncoding = "cbor"
+)
+
+var cborEncMode = func() cbor.EncMode {
+	mode, err := cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	return mode
+}()
+
+type encodingOptions struct {
+	Preferred   wireEncoding
+	Compression websocket.CompressionMode
+}
+
+func encodingOptionsFromEnv() (encodingOptions, error) {
+	opts := encodingOptions{
+		Preferred:   encodingCBOR,
+		Compression: websocket.CompressionNoContextTakeover,
+	}
+
+	switch value := strings.ToLower(env.String(agentWireEncodingEnv, "")); value {
+	case "":
+	case string(encodingJSON), string(encodingCBOR):
+		opts.Preferred = wireEncoding(value)
+	default:
+		return encodingOptions{}, fmt.Errorf("unsupported %s: %s", agentWireEncodingEnv, value)
+	}
+
+	switch value := strings.ToLower(env.String(agentWSCompressionEnv, "")); value {
+	case "":
+	case "disabled":
+		opts.Compression = websocket.CompressionDisabled
+	case "no-context-takeover":
+		opts.Compression = websocket.CompressionNoContextTakeover
+	case "context-takeover":
+		opts.Compression = websocket.CompressionContextTakeover
+	default:
+		return encodingOptions{}, fmt.Errorf("unsupported %s: %s", agentWSCompressionEnv, value)
+	}
+
+	return opts, nil
+}
+
+// subprotocols lists the encodings offered to the server, most preferred
+// first.
+func (o encodingOptions) subprotocols() []string {
+	if o.Preferred == encodingCBOR {
+		return []string{cborSubprotocol, jsonSubprotocol}
+	}
+
+	return []string{jsonSubprotocol}
+}
+
+func negotiatedEncoding(subprotocol string) wireEncoding {
+	if subprotocol == cborSubprotocol {
+		return encodingCBOR
+	}
+
+	return encodingJSON
+}
+
+func (e wireEncoding) encode(event agent.Event) (websocket.MessageType, []byte, error) {
+	if e == encodingCBOR {
+		payload, err := cborEncMode.Marshal(event)
+		if err != nil {
+			return 0, nil, fmt.Errorf("encode %s event as cbor: %w", event.Type, err)
+		}
+
+		return websocket.MessageBinary, frame(frameEvent, 0, payload), nil
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return 0, nil, fmt.Errorf("encode %s event as json: %w", event.Type, err)
+	}
+
+	return websocket.MessageText, payload, nil
+}
+
+func (e wireEncoding) write(ctx context.Context, c *websocket.Conn, event agent.Event) error {
+	typ, payload, err := e.encode(event)
+	if err != nil {
+		return err
+	}
+
+	return c.Write(ctx, typ, payload)
+}
@@ -0,0 +1,255 @@
+package client
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/sonomandeep/containers/agent/internal/agent"
+)
+
+func TestWireEncoding(t *testing.T) {
+	event := agent.Event{
+		Type: "container.start",
+		TS:   time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC),
+		Data: agent.Container{ID: "c1", Name: "web", State: "running", Ports: []agent.ContainerPort{}},
+	}
+
+	t.Run("encodes json as text message", func(t *testing.T) {
+		typ, payload, err := encodingJSON.encode(event)
+		if err != nil {
+			t.Fatalf("encode() unexpected error: %v", err)
+		}
+
+		if typ != websocket.MessageText || !strings.Contains(string(payload), `"type":"container.start"`) {
+			t.Fatalf("encode() = %v %s", typ, payload)
+		}
+	})
+
+	t.Run("encodes cbor as event frame with json field names", func(t *testing.T) {
+		typ, payload, err := encodingCBOR.encode(event)
+		if err != nil {
+			t.Fatalf("encode() unexpected error: %v", err)
+		}
+
+		if typ != websocket.MessageBinary || payload[0] != frameEvent {
+			t.Fatalf("encode() type = %v frame = %d", typ, payload[0])
+		}
+
+		var decoded map[string]any
+		if err := cbor.Unmarshal(payload[frameHeaderSize:], &decoded); err != nil {
+			t.Fatalf("cbor.Unmarshal() unexpected error: %v", err)
+		}
+
+		data, ok := decoded["data"].(map[any]any)
+		if decoded["type"] != "container.start" || !ok || data["name"] != "web" {
+			t.Fatalf("decoded event = %v", decoded)
+		}
+
+		if _, ok := data["metrics"]; ok {
+			t.Fatalf("decoded event kept omitempty field: %v", data)
+		}
+	})
+
+	t.Run("falls back to json without negotiated subprotocol", func(t *testing.T) {
+		if negotiatedEncoding("") != encodingJSON {
+			t.Fatal("negotiatedEncoding() expected json fallback")
+		}
+
+		if negotiatedEncoding(cborSubprotocol) != encodingCBOR {
+			t.Fatal("negotiatedEncoding() expected cbor")
+		}
+	})
+
+	t.Run("rejects unsupported encoding setting", func(t *testing.T) {
+		t.Setenv(agentWireEncodingEnv, "msgpack")
+
+		if _, err := encodingOptionsFromEnv(); err == nil {
+			t.Fatal("encodingOptionsFromEnv() expected error")
+		}
+	})
+}
+
+func TestDialNegotiatesEncoding(t *testing.T) {
+	serve := func(subprotocols []string) (*httptest.Server, chan websocket.MessageType) {
+		received := make(chan websocket.MessageType, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: subprotocols})
+			if err != nil {
+				return
+			}
+			defer conn.CloseNow()
+
+			typ, _, err := conn.Read(context.Background())
+			if err == nil {
+				received <- typ
+			}
+		}))
+		t.Cleanup(server.Close)
+
+		return server, received
+	}
+
+	for _, tc := range []struct {
+		name         string
+		subprotocols []string
+		want         websocket.MessageType
+	}{
+		{name: "server selects cbor", subprotocols: []string{cborSubprotocol}, want: websocket.MessageBinary},
+		{name: "server selects json", subprotocols: []string{jsonSubprotocol}, want: websocket.MessageText},
+		{name: "server ignores subprotocols", subprotocols: nil, want: websocket.MessageText},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server, received := serve(tc.subprotocols)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			opts := dialOptions{Encoding: encodingOptions{Preferred: encodingCBOR}}
+			conn, err := dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), opts)
+			if err != nil {
+				t.Fatalf("dial() unexpected error: %v", err)
+			}
+			defer conn.CloseNow()
+
+			enc := negotiatedEncoding(conn.Subprotocol())
+			if err := enc.write(ctx, conn, agent.Event{Type: "snapshot", TS: time.Now()}); err != nil {
+				t.Fatalf("write() unexpected error: %v", err)
+			}
+
+			select {
+			case typ := <-received:
+				if typ != tc.want {
+					t.Fatalf("server received %v, want %v", typ, tc.want)
+				}
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for event")
+			}
+		})
+	}
+}
+
+// largeSnapshot mimics a busy host: 500 containers with typical env, port
+// and metric payloads plus the images they run.
+func largeSnapshot() agent.Event {
+	host := "node-01.prod.internal"
+	containers := make([]agent.Container, 0, 500)
+	for i := range 500 {
+		envs := make([]agent.EnvironmentVariable, 0, 15)
+		for j := range 15 {
+			envs = append(envs, agent.EnvironmentVariable{
+				Key:   fmt.Sprintf("APP_SETTING_%02d", j),
+				Value: fmt.Sprintf("value-%d-%d-with-some-realistic-length", i, j),
+			})
+		}
+
+		public := 30000 + i
+		containers = append(containers, agent.Container{
+			ID:     fmt.Sprintf("%064x", i),
+			Name:   fmt.Sprintf("service-%03d", i),
+			Image:  fmt.Sprintf("registry.example.com/team/service-%02d:1.%d.0", i%40, i%7),
+			State:  "running",
+			Status: "running (running)",
+			Ports: []agent.ContainerPort{
+				{IPVersion: "IPv4", Private: 8080, Public: &public, Type: "tcp"},
+				{IPVersion: "IPv6", Private: 8080, Public: &public, Type: "tcp"},
+				{Private: 9090, Type: "tcp"},
+			},
+			Metrics: &agent.ContainerMetrics{
+				CPU:    float64(i%100) / 3,
+				Memory: agent.ContainerMemory{Used: uint64(i) << 20, Total: 8 << 30},
+			},
+			Envs:    envs,
+			Host:    &host,
+			Created: 1767225600 + int64(i),
+		})
+	}
+
+	images := make([]agent.Image, 0, 40)
+	for i := range 40 {
+		layers := 12
+		images = append(images, agent.Image{
+			ID:           fmt.Sprintf("%012x", i),
+			Name:         fmt.Sprintf("service-%02d", i),
+			Tags:         []string{fmt.Sprintf("service-%02d:1.%d.0", i, i%7)},
+			Size:         int64(200+i) << 20,
+			Layers:       &layers,
+			OS:           "linux",
+			Architecture: "amd64",
+			Registry:     "registry.example.com",
+			Containers:   []agent.ImageContainer{},
+		})
+	}
+
+	return agent.Event{
+		Type: "snapshot",
+		TS:   time.Now(),
+		Data: agent.SnapshotPayload{Containers: containers, Images: images},
+	}
+}
+
+// BenchmarkEncodeSnapshot reports wire-bytes/op for each encoding, with and
+// without permessage-deflate as coder/websocket applies it (BestSpeed).
+func BenchmarkEncodeSnapshot(b *testing.B) {
+	event := largeSnapshot()
+
+	for _, enc := range []wireEncoding{encodingJSON, encodingCBOR} {
+		for _, deflate := range []bool{false, true} {
+			name := string(enc)
+			if deflate {
+				name += "+deflate"
+			}
+
+			b.Run(name, func(b *testing.B) {
+				var buf bytes.Buffer
+				fw, _ := flate.NewWriter(&buf, flate.BestSpeed)
+				wire := 0
+
+				b.ReportAllocs()
+				for b.Loop() {
+					_, payload, err := enc.encode(event)
+					if err != nil {
+						b.Fatal(err)
+					}
+
+					wire = len(payload)
+					if deflate {
+						buf.Reset()
+						fw.Reset(&buf)
+						fw.Write(payload)
+						fw.Flush()
+						wire = buf.Len()
+					}
+				}
+
+				b.ReportMetric(float64(wire), "wire-bytes/op")
+			})
+		}
+	}
+}
+
+func TestLargeSnapshotEncodesSmallerAsCBOR(t *testing.T) {
+	event := largeSnapshot()
+
+	_, jsonPayload, err := encodingJSON.encode(event)
+	if err != nil {
+		t.Fatalf("encode() unexpected error: %v", err)
+	}
+
+	_, cborPayload, err := encodingCBOR.encode(event)
+	if err != nil {
+		t.Fatalf("encode() unexpected error: %v", err)
+	}
+
+	if len(cborPayload) >= len(jsonPayload) {
+		t.Fatalf("cbor %d bytes, json %d bytes", len(cborPayload), len(jsonPayload))
+	}
+}
@@ -0,0 +1,147 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sonomandeep/containers/agent/internal/env"
+)
+
+const (
+	agentFailbackIntervalEnv = "AGENT_FAILBACK_INTERVAL"
+	agentReconnectTimeoutEnv = "AGENT_RECONNECT_TIMEOUT"
+
+	defaultFailbackInterval = 30 * time.Second
+	defaultReconnectTimeout = 5 * time.Minute
+
+	// failbackHealthyProbes is how many consecutive healthy probes a more
+	// preferred endpoint needs before the agent moves back to it.
+	failbackHealthyProbes = 2
+	probeTimeout          = 5 * time.Second
+
+	// healthPath answers 2xx once the control plane can take agent
+	// sessions.
+	healthPath = "/api/health"
+)
+
+// Endpoint is one control-plane URL from AGENT_API_URL. Index 0 is the
+// primary; the agent always prefers the lowest healthy index. URL has any
+// password redacted, since endpoints are logged and sent upstream.
+type Endpoint struct {
+	URL     string `json:"url"`
+	Index   int    `json:"index"`
+	Primary bool   `json:"primary"`
+
+	wsURL    string
+	probeURL string
+}
+
+func endpointsFromEnv() ([]Endpoint, error) {
+	raw := env.String(agentAPIURLEnv, "")
+	if raw == "" {
+		return nil, fmt.Errorf("missing %s", agentAPIURLEnv)
+	}
+
+	agentID := env.String(agentIDEnv, "")
+	if agentID == "" {
+		return nil, fmt.Errorf("missing %s", agentIDEnv)
+	}
+
+	return parseEndpoints(raw, agentID)
+}
+
+func parseEndpoints(raw, agentID string) ([]Endpoint, error) {
+	endpoints := []Endpoint{}
+	seen := map[string]bool{}
+
+	for item := range strings.SplitSeq(raw, ",") {
+		apiURL := strings.TrimSpace(item)
+		if apiURL == "" {
+			continue
+		}
+
+		endpoint, err := newEndpoint(apiURL, agentID)
+		if err != nil {
+			return nil, err
+		}
+
+		if seen[apiURL] {
+			return nil, fmt.Errorf("duplicate %s entry: %s", agentAPIURLEnv, endpoint.URL)
+		}
+		seen[apiURL] = true
+		endpoint.Index = len(endpoints)
+		endpoint.Primary = endpoint.Index == 0
+		endpoints = append(endpoints, endpoint)
+	}
+
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("missing %s", agentAPIURLEnv)
+	}
+
+	return endpoints, nil
+}
+
+func newEndpoint(apiURL, agentID string) (Endpoint, error) {
+	parsed, err := url.Parse(apiURL)
+	if err != nil {
+		return Endpoint{}, fmt.Errorf("invalid %s: %w", agentAPIURLEnv, err)
+	}
+
+	redacted := parsed.Redacted()
+	probe := *parsed
+	switch parsed.Scheme {
+	case "http", "ws":
+		parsed.Scheme = "ws"
+		probe.Scheme = "http"
+	case "https", "wss":
+		parsed.Scheme = "wss"
+		probe.Scheme = "https"
+	default:
+		return Endpoint{}, fmt.Errorf("unsupported %s scheme: %s", agentAPIURLEnv, parsed.Scheme)
+	}
+
+	parsed.Path = "/api/agents/socket"
+	q := parsed.Query()
+	q.Set("id", agentID)
+	parsed.RawQuery = q.Encode()
+
+	probe.Path = healthPath
+	probe.RawQuery = ""
+	probe.User = nil
+
+	return Endpoint{
+		URL:      redacted,
+		wsURL:    parsed.String(),
+		probeURL: probe.String(),
+	}, nil
+}
+
+// probe checks that the endpoint answers HTTP without opening an agent
+// session, so the server does not see a second connection for this agent.
+// Only a 2xx from the health path counts as healthy: a 404 or 401 from a
+// load balancer in front of a missing backend does not.
+func probe(ctx context.Context, httpClient *http.Client, endpoint Endpoint) error {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.probeURL, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < http.StatusOK || res.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("unhealthy: %s", res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,606 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Stream frames travel as binary websocket messages:
+//
+//	[type:1][stream id:4][payload]
+//
+// open carries the JSON stream header, data carries bytes, close half-closes
+// the sender's side (a non-empty payload aborts the stream with that reason)
+// and window-update carries a uint32 credit. Agent-initiated streams use odd
+// ids, server-initiated streams even ids.
+const (
+	frameOpen         byte = 1
+	frameData         byte = 2
+	frameClose        byte = 3
+	frameWindowUpdate byte = 4
+
+	frameHeaderSize = 5
+
+	// maxFramePayload bounds a data frame so one busy stream cannot hold the
+	// connection while others wait.
+	maxFramePayload = 16 << 10
+	// initialWindow is the credit each side starts with per stream.
+	initialWindow = 256 << 10
+
+	agentFirstStreamID  uint32 = 1
+	serverFirstStreamID uint32 = 2
+
+	agentStreamStallTimeoutEnv = "AGENT_STREAM_STALL_TIMEOUT"
+
+	// defaultStreamStallTimeout is how long a blocked Read or Write waits
+	// for data or window credit before the stream is aborted. The
+	// connection can stay healthy while a peer stops granting credit, so
+	// losing it is not enough to unblock a transfer.
+	defaultStreamStallTimeout = 2 * time.Minute
+)
+
+var (
+	ErrMuxClosed     = errors.New("stream mux closed")
+	ErrStreamClosed  = errors.New("stream closed")
+	ErrStreamStalled = errors.New("stream stalled")
+)
+
+type streamHeader struct {
+	Kind string          `json:"kind"`
+	Meta json.RawMessage `json:"meta,omitempty"`
+}
+
+// mux carries many streams over one connection. All stream state is guarded
+// by mu; a single scheduler goroutine owns sending, emitting control frames
+// first and then one data chunk per ready stream in round-robin order.
+type mux struct {
+	send func(context.Context, []byte) error
+	// accepted receives peer-opened streams; with nil they are refused.
+	accepted     chan<- *Stream
+	stallTimeout time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	streams map[uint32]*Stream
+	order   []uint32
+	next    int
+	nextID  uint32
+	control [][]byte
+	err     error
+}
+
+func newMux(
+	ctx context.Context,
+	send func(context.Context, []byte) error,
+	accepted chan<- *Stream,
+	firstID uint32,
+	stallTimeout time.Duration,
+) *mux {
+	if stallTimeout <= 0 {
+		stallTimeout = defaultStreamStallTimeout
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	m := &mux{
+		send:         send,
+		accepted:     accepted,
+		stallTimeout: stallTimeout,
+		ctx:          ctx,
+		cancel:       cancel,
+		done:         make(chan struct{}),
+		streams:      make(map[uint32]*Stream),
+		nextID:       firstID,
+	}
+	m.cond = sync.NewCond(&m.mu)
+
+	go m.schedule()
+	go m.watchStalls()
+	go func() {
+		<-ctx.Done()
+		m.close(ErrMuxClosed)
+	}()
+
+	return m
+}
+
+// Stream is one bidirectional byte stream. Read returns io.EOF once the peer
+// has closed its side; Close only closes the local side.
+type Stream struct {
+	m      *mux
+	id     uint32
+	header streamHeader
+
+	recv         []byte
+	recvWindow   int
+	consumed     int
+	remoteClosed bool
+	pending      []byte
+	sendWindow   int
+	localClosed  bool
+	err          error
+	// waiting counts Reads and Writes blocked on the stream; active is when
+	// it last moved data or credit, or when the first of them started.
+	waiting int
+	active  time.Time
+}
+
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+func (s *Stream) Kind() string {
+	return s.header.Kind
+}
+
+func (s *Stream) Meta() json.RawMessage {
+	return s.header.Meta
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	m := s.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s.wait(func() bool {
+		return len(s.recv) == 0 && !s.remoteClosed && s.err == nil
+	})
+
+	if len(s.recv) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		return 0, io.EOF
+	}
+
+	n := copy(p, s.recv)
+	s.recv = s.recv[n:]
+	s.consumed += n
+
+	// Return credit in batches so small reads do not each cost a frame.
+	if s.consumed >= initialWindow/2 && s.err == nil {
+		s.recvWindow += s.consumed
+		m.queueControl(windowUpdateFrame(s.id, uint32(s.consumed)))
+		s.consumed = 0
+	}
+
+	return n, nil
+}
+
+func (s *Stream) Write(p []byte) (int, error) {
+	m := s.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s.wait(func() bool {
+		return len(s.pending) > 0 && s.err == nil && !s.localClosed
+	})
+
+	if err := s.writeErr(); err != nil {
+		return 0, err
+	}
+
+	s.pending = p
+	m.cond.Broadcast()
+
+	s.wait(func() bool {
+		return len(s.pending) > 0 && s.err == nil
+	})
+
+	written := len(p) - len(s.pending)
+	s.pending = nil
+	if s.err != nil {
+		return written, s.err
+	}
+
+	return written, nil
+}
+
+// wait blocks while blocked reports true. Callers hold m.mu.
+func (s *Stream) wait(blocked func() bool) {
+	if !blocked() {
+		return
+	}
+
+	if s.waiting == 0 {
+		s.active = time.Now()
+	}
+	s.waiting++
+	defer func() { s.waiting-- }()
+
+	for blocked() {
+		s.m.cond.Wait()
+	}
+}
+
+func (s *Stream) writeErr() error {
+	if s.err != nil {
+		return s.err
+	}
+
+	if s.localClosed {
+		return ErrStreamClosed
+	}
+
+	return nil
+}
+
+// Close half-closes the stream: the peer reads io.EOF after the data already
+// written, and can keep sending until it closes its own side.
+func (s *Stream) Close() error {
+	m := s.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s.wait(func() bool {
+		return len(s.pending) > 0 && s.err == nil
+	})
+
+	if s.localClosed || s.err != nil {
+		return nil
+	}
+
+	s.localClosed = true
+	m.queueControl(closeFrame(s.id, ""))
+	m.release(s)
+
+	return nil
+}
+
+// CloseWithError aborts both directions and tells the peer why.
+func (s *Stream) CloseWithError(reason error) error {
+	m := s.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s.err != nil {
+		return nil
+	}
+
+	message := "aborted"
+	if reason != nil {
+		message = reason.Error()
+	}
+
+	m.queueControl(closeFrame(s.id, message))
+	s.abort(fmt.Errorf("%w: %s", ErrStreamClosed, message))
+
+	return nil
+}
+
+// abort fails the stream locally. Callers hold m.mu.
+func (s *Stream) abort(err error) {
+	if s.err != nil {
+		return
+	}
+
+	s.err = err
+	s.localClosed = true
+	s.remoteClosed = true
+	s.pending = nil
+	s.m.release(s)
+}
+
+func (m *mux) open(ctx context.Context, kind string, meta any) (*Stream, error) {
+	header := streamHeader{Kind: kind}
+	if meta != nil {
+		raw, err := json.Marshal(meta)
+		if err != nil {
+			return nil, fmt.Errorf("encode stream meta: %w", err)
+		}
+		header.Meta = raw
+	}
+
+	payload, err := json.Marshal(header)
+	if err != nil {
+		return nil, fmt.Errorf("encode stream header: %w", err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	id := m.nextID
+	m.nextID += 2
+
+	s := m.newStream(id, header)
+	m.queueControl(frame(frameOpen, id, payload))
+
+	return s, nil
+}
+
+// newStream registers a stream. Callers hold m.mu.
+func (m *mux) newStream(id uint32, header streamHeader) *Stream {
+	s := &Stream{
+		m:          m,
+		id:         id,
+		header:     header,
+		recvWindow: initialWindow,
+		sendWindow: initialWindow,
+	}
+	m.streams[id] = s
+	m.order = append(m.order, id)
+
+	return s
+}
+
+// release forgets a stream once both sides are done. Callers hold m.mu.
+func (m *mux) release(s *Stream) {
+	m.cond.Broadcast()
+
+	if !s.localClosed || !s.remoteClosed {
+		return
+	}
+
+	if _, ok := m.streams[s.id]; !ok {
+		return
+	}
+
+	delete(m.streams, s.id)
+	for i, id := range m.order {
+		if id == s.id {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			if m.next > i {
+				m.next--
+			}
+			break
+		}
+	}
+}
+
+// queueControl schedules a frame ahead of pending data. Callers hold m.mu.
+func (m *mux) queueControl(f []byte) {
+	if m.err != nil {
+		return
+	}
+
+	m.control = append(m.control, f)
+	m.cond.Broadcast()
+}
+
+func (m *mux) handleFrame(data []byte) error {
+	if len(data) < frameHeaderSize {
+		return fmt.Errorf("stream frame too short: %d bytes", len(data))
+	}
+
+	typ := data[0]
+	id := binary.BigEndian.Uint32(data[1:frameHeaderSize])
+	payload := data[frameHeaderSize:]
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+
+	if typ == frameOpen {
+		return m.handleOpen(id, payload)
+	}
+
+	s, ok := m.streams[id]
+	if !ok {
+		// Frames can race with a local abort; the peer learns from our close.
+		return nil
+	}
+
+	switch typ {
+	case frameData:
+		if s.remoteClosed {
+			return nil
+		}
+
+		if len(payload) > s.recvWindow {
+			m.queueControl(closeFrame(id, "flow control window exceeded"))
+			s.abort(fmt.Errorf("%w: peer exceeded flow control window", ErrStreamClosed))
+			return nil
+		}
+
+		s.recvWindow -= len(payload)
+		s.recv = append(s.recv, payload...)
+		s.active = time.Now()
+		m.cond.Broadcast()
+
+	case frameClose:
+		if len(payload) > 0 {
+			s.abort(fmt.Errorf("%w: %s", ErrStreamClosed, payload))
+			return nil
+		}
+
+		s.remoteClosed = true
+		m.release(s)
+
+	case frameWindowUpdate:
+		if len(payload) != 4 {
+			return fmt.Errorf("stream %d: invalid window update", id)
+		}
+
+		s.sendWindow += int(binary.BigEndian.Uint32(payload))
+		s.active = time.Now()
+		m.cond.Broadcast()
+
+	default:
+		return fmt.Errorf("stream %d: unknown frame type %d", id, typ)
+	}
+
+	return nil
+}
+
+// handleOpen accepts a peer-initiated stream. Callers hold m.mu.
+func (m *mux) handleOpen(id uint32, payload []byte) error {
+	if id%2 == m.nextID%2 {
+		return fmt.Errorf("stream %d: peer used local stream id", id)
+	}
+
+	if _, exists := m.streams[id]; exists {
+		return fmt.Errorf("stream %d: already open", id)
+	}
+
+	var header streamHeader
+	if err := json.Unmarshal(payload, &header); err != nil {
+		m.queueControl(closeFrame(id, "invalid stream header"))
+		return nil
+	}
+
+	s := m.newStream(id, header)
+
+	select {
+	case m.accepted <- s:
+	default:
+		m.queueControl(closeFrame(id, "stream not accepted"))
+		s.abort(fmt.Errorf("%w: stream not accepted", ErrStreamClosed))
+	}
+
+	return nil
+}
+
+func (m *mux) schedule() {
+	defer close(m.done)
+
+	for {
+		f, ok := m.nextFrame()
+		if !ok {
+			return
+		}
+
+		if err := m.send(m.ctx, f); err != nil {
+			m.close(err)
+			return
+		}
+	}
+}
+
+func (m *mux) nextFrame() ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for {
+		if m.err != nil {
+			return nil, false
+		}
+
+		if len(m.control) > 0 {
+			f := m.control[0]
+			m.control = m.control[1:]
+			return f, true
+		}
+
+		if f := m.nextDataFrame(); f != nil {
+			return f, true
+		}
+
+		m.cond.Wait()
+	}
+}
+
+// nextDataFrame takes one chunk from the next stream with pending data and
+// send credit, starting after the stream served last. Callers hold m.mu.
+func (m *mux) nextDataFrame() []byte {
+	for range len(m.order) {
+		if m.next >= len(m.order) {
+			m.next = 0
+		}
+
+		s := m.streams[m.order[m.next]]
+		m.next++
+
+		if len(s.pending) == 0 || s.sendWindow <= 0 || s.err != nil {
+			continue
+		}
+
+		n := min(len(s.pending), s.sendWindow, maxFramePayload)
+		f := frame(frameData, s.id, s.pending[:n])
+		s.pending = s.pending[n:]
+		s.sendWindow -= n
+		s.active = time.Now()
+		if len(s.pending) == 0 {
+			m.cond.Broadcast()
+		}
+
+		return f
+	}
+
+	return nil
+}
+
+// watchStalls aborts streams whose Reads or Writes have been blocked for
+// stallTimeout without data or credit moving, telling the peer why.
+func (m *mux) watchStalls() {
+	ticker := time.NewTicker(m.stallTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case <-m.ctx.Done():
+			return
+		case now = <-ticker.C:
+		}
+
+		m.mu.Lock()
+		for id, s := range m.streams {
+			if s.waiting == 0 || s.err != nil || now.Sub(s.active) < m.stallTimeout {
+				continue
+			}
+
+			reason := fmt.Sprintf("no progress for %s", m.stallTimeout)
+			m.queueControl(closeFrame(id, reason))
+			s.abort(fmt.Errorf("%w: %s", ErrStreamStalled, reason))
+		}
+		m.mu.Unlock()
+	}
+}
+
+func (m *mux) close(err error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return
+	}
+
+	m.err = err
+	for _, s := range m.streams {
+		s.abort(err)
+	}
+	m.control = nil
+	m.cond.Broadcast()
+	m.mu.Unlock()
+
+	m.cancel()
+}
+
+func frame(typ byte, id uint32, payload []byte) []byte {
+	f := make([]byte, frameHeaderSize+len(payload))
+	f[0] = typ
+	binary.BigEndian.PutUint32(f[1:frameHeaderSize], id)
+	copy(f[frameHeaderSize:], payload)
+
+	return f
+}
+
+func closeFrame(id uint32, reason string) []byte {
+	return frame(frameClose, id, []byte(reason))
+}
+
+func windowUpdateFrame(id uint32, increment uint32) []byte {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, increment)
+
+	return frame(frameWindowUpdate, id, payload)
+}
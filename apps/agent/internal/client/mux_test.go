@@ -0,0 +1,315 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+type frameLog struct {
+	mu     sync.Mutex
+	frames [][]byte
+}
+
+func (l *frameLog) add(f []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.frames = append(l.frames, append([]byte(nil), f...))
+}
+
+func (l *frameLog) dataStreamOrder() []uint32 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	order := []uint32{}
+	for _, f := range l.frames {
+		if f[0] == frameData {
+			order = append(order, binary.BigEndian.Uint32(f[1:frameHeaderSize]))
+		}
+	}
+
+	return order
+}
+
+// newMuxPair wires an agent-side and a server-side mux back to back.
+func newMuxPair(t *testing.T) (*mux, *mux, chan *Stream) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	var agentSide, serverSide *mux
+	agentAccepted := make(chan *Stream, 4)
+	serverAccepted := make(chan *Stream, 4)
+	agentSide = newMux(ctx, func(_ context.Context, f []byte) error {
+		return serverSide.handleFrame(f)
+	}, agentAccepted, agentFirstStreamID, defaultStreamStallTimeout)
+	serverSide = newMux(ctx, func(_ context.Context, f []byte) error {
+		return agentSide.handleFrame(f)
+	}, serverAccepted, serverFirstStreamID, defaultStreamStallTimeout)
+
+	return agentSide, serverSide, serverAccepted
+}
+
+func acceptStream(t *testing.T, accepted <-chan *Stream) *Stream {
+	t.Helper()
+
+	select {
+	case s := <-accepted:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for stream")
+		return nil
+	}
+}
+
+func TestMuxStreams(t *testing.T) {
+	t.Run("opens stream and transfers data both ways", func(t *testing.T) {
+		agentSide, _, serverAccepted := newMuxPair(t)
+
+		local, err := agentSide.open(context.Background(), "logs", map[string]string{"containerId": "c1"})
+		if err != nil {
+			t.Fatalf("open() unexpected error: %v", err)
+		}
+
+		remote := acceptStream(t, serverAccepted)
+		if remote.Kind() != "logs" || string(remote.Meta()) != `{"containerId":"c1"}` {
+			t.Fatalf("accepted stream kind = %q meta = %s", remote.Kind(), remote.Meta())
+		}
+
+		if _, err := local.Write([]byte("hello")); err != nil {
+			t.Fatalf("Write() unexpected error: %v", err)
+		}
+		if err := local.Close(); err != nil {
+			t.Fatalf("Close() unexpected error: %v", err)
+		}
+
+		got, err := io.ReadAll(remote)
+		if err != nil || string(got) != "hello" {
+			t.Fatalf("ReadAll() = %q, %v", got, err)
+		}
+
+		if _, err := remote.Write([]byte("world")); err != nil {
+			t.Fatalf("Write() unexpected error: %v", err)
+		}
+		remote.Close()
+
+		got, err = io.ReadAll(local)
+		if err != nil || string(got) != "world" {
+			t.Fatalf("ReadAll() = %q, %v", got, err)
+		}
+	})
+
+	t.Run("blocks writer until receiver grants window", func(t *testing.T) {
+		agentSide, _, serverAccepted := newMuxPair(t)
+
+		local, err := agentSide.open(context.Background(), "exec", nil)
+		if err != nil {
+			t.Fatalf("open() unexpected error: %v", err)
+		}
+		remote := acceptStream(t, serverAccepted)
+
+		payload := bytes.Repeat([]byte("x"), initialWindow+maxFramePayload)
+		written := make(chan error, 1)
+		go func() {
+			_, err := local.Write(payload)
+			written <- err
+		}()
+
+		select {
+		case err := <-written:
+			t.Fatalf("Write() returned before window update: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		got := make([]byte, 0, len(payload))
+		buf := make([]byte, 32<<10)
+		for len(got) < len(payload) {
+			n, err := remote.Read(buf)
+			if err != nil {
+				t.Fatalf("Read() unexpected error: %v", err)
+			}
+			got = append(got, buf[:n]...)
+		}
+
+		if err := <-written; err != nil {
+			t.Fatalf("Write() unexpected error: %v", err)
+		}
+
+		if !bytes.Equal(got, payload) {
+			t.Fatal("received payload differs from sent payload")
+		}
+	})
+
+	t.Run("interleaves concurrent streams", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// The scheduler blocks on its first frame until both writers have
+		// queued their data, so the order only reflects scheduling.
+		release := make(chan struct{})
+		var once sync.Once
+		log := &frameLog{}
+		agentSide := newMux(ctx, func(_ context.Context, f []byte) error {
+			once.Do(func() { <-release })
+			log.add(f)
+			return nil
+		}, make(chan *Stream), agentFirstStreamID, defaultStreamStallTimeout)
+
+		const size = 8 * maxFramePayload
+		var wg sync.WaitGroup
+		for range 2 {
+			s, err := agentSide.open(context.Background(), "files", nil)
+			if err != nil {
+				t.Fatalf("open() unexpected error: %v", err)
+			}
+			wg.Go(func() {
+				s.Write(bytes.Repeat([]byte("y"), size))
+				s.Close()
+			})
+		}
+
+		waitFor(t, "queued writes", func() bool {
+			agentSide.mu.Lock()
+			defer agentSide.mu.Unlock()
+
+			for _, s := range agentSide.streams {
+				if len(s.pending) == 0 {
+					return false
+				}
+			}
+			return true
+		})
+		close(release)
+		wg.Wait()
+
+		order := log.dataStreamOrder()
+		if len(order) != 16 {
+			t.Fatalf("data frames = %d", len(order))
+		}
+
+		for i := 1; i < len(order); i++ {
+			if order[i] == order[i-1] {
+				t.Fatalf("stream %d sent consecutive frames: %v", order[i], order)
+			}
+		}
+	})
+
+	t.Run("aborts stream with reason", func(t *testing.T) {
+		agentSide, _, serverAccepted := newMuxPair(t)
+
+		local, err := agentSide.open(context.Background(), "port-forward", nil)
+		if err != nil {
+			t.Fatalf("open() unexpected error: %v", err)
+		}
+		remote := acceptStream(t, serverAccepted)
+
+		remote.CloseWithError(errors.New("target refused"))
+
+		_, err = local.Read(make([]byte, 1))
+		if !errors.Is(err, ErrStreamClosed) {
+			t.Fatalf("Read() expected ErrStreamClosed, got %v", err)
+		}
+
+		if _, err := local.Write([]byte("x")); !errors.Is(err, ErrStreamClosed) {
+			t.Fatalf("Write() expected ErrStreamClosed, got %v", err)
+		}
+	})
+
+	t.Run("fails open streams when mux closes", func(t *testing.T) {
+		agentSide, _, serverAccepted := newMuxPair(t)
+
+		local, err := agentSide.open(context.Background(), "logs", nil)
+		if err != nil {
+			t.Fatalf("open() unexpected error: %v", err)
+		}
+		acceptStream(t, serverAccepted)
+
+		agentSide.close(ErrMuxClosed)
+
+		if _, err := local.Read(make([]byte, 1)); !errors.Is(err, ErrMuxClosed) {
+			t.Fatalf("Read() expected ErrMuxClosed, got %v", err)
+		}
+
+		if _, err := agentSide.open(context.Background(), "logs", nil); !errors.Is(err, ErrMuxClosed) {
+			t.Fatalf("open() expected ErrMuxClosed, got %v", err)
+		}
+	})
+
+	t.Run("refuses stream using local id parity", func(t *testing.T) {
+		agentSide, _, _ := newMuxPair(t)
+
+		if err := agentSide.handleFrame(frame(frameOpen, 3, []byte(`{"kind":"logs"}`))); err == nil {
+			t.Fatal("handleFrame() expected error")
+		}
+	})
+}
+
+func TestMuxRefusesStreamsWithoutAcceptor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var agentSide, serverSide *mux
+	agentSide = newMux(ctx, func(_ context.Context, f []byte) error {
+		return serverSide.handleFrame(f)
+	}, nil, agentFirstStreamID, defaultStreamStallTimeout)
+	serverSide = newMux(ctx, func(_ context.Context, f []byte) error {
+		return agentSide.handleFrame(f)
+	}, make(chan *Stream, 1), serverFirstStreamID, defaultStreamStallTimeout)
+
+	remote, err := serverSide.open(ctx, "exec", nil)
+	if err != nil {
+		t.Fatalf("open() unexpected error: %v", err)
+	}
+
+	if _, err := io.ReadAll(remote); !errors.Is(err, ErrStreamClosed) {
+		t.Fatalf("ReadAll() error = %v, want ErrStreamClosed", err)
+	}
+}
+
+func TestMuxAbortsStalledStreams(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const stall = 100 * time.Millisecond
+	var agentSide, serverSide *mux
+	serverAccepted := make(chan *Stream, 1)
+	agentSide = newMux(ctx, func(_ context.Context, f []byte) error {
+		return serverSide.handleFrame(f)
+	}, nil, agentFirstStreamID, stall)
+	serverSide = newMux(ctx, func(_ context.Context, f []byte) error {
+		return agentSide.handleFrame(f)
+	}, serverAccepted, serverFirstStreamID, defaultStreamStallTimeout)
+
+	local, err := agentSide.open(ctx, "volume.backup", nil)
+	if err != nil {
+		t.Fatalf("open() unexpected error: %v", err)
+	}
+	remote := acceptStream(t, serverAccepted)
+
+	// The server never reads, so it never grants more credit.
+	written := make(chan error, 1)
+	go func() {
+		_, err := local.Write(bytes.Repeat([]byte("x"), initialWindow+1))
+		written <- err
+	}()
+
+	select {
+	case err := <-written:
+		if !errors.Is(err, ErrStreamStalled) {
+			t.Fatalf("Write() error = %v, want ErrStreamStalled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write() still blocked after the stall timeout")
+	}
+
+	if _, err := io.ReadAll(remote); !errors.Is(err, ErrStreamClosed) {
+		t.Fatalf("ReadAll() error = %v, want the peer to see the abort", err)
+	}
+}
@@ -0,0 +1,242 @@
+package client
+
+import (
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/sonomandeep/containers/agent/internal/agent"
+)
+
+const (
+	agentOutboundQueueEnv = "AGENT_OUTBOUND_QUEUE"
+
+	defaultOutboundQueue = 64
+)
+
+// priority orders outbound events; higher values are written first and
+// survive a full queue longer.
+type priority int
+
+const (
+	priorityLow priority = iota
+	priorityNormal
+	priorityHigh
+
+	priorityLevels
+)
+
+// eventPriority puts command results, agent state and alerts ahead of
+// Docker lifecycle events, and both ahead of snapshots and metrics, which
+// the next sample makes obsolete anyway. A partial snapshot answers a
+// command, so it goes with the command results.
+func eventPriority(event agent.Event) priority {
+	switch {
+	case event.Type == "snapshot.partial":
+		return priorityHigh
+
+	case event.Type == "agent.telemetry",
+		event.Type == "snapshot",
+		strings.HasPrefix(event.Type, "snapshot."),
+		strings.HasSuffix(event.Type, ".metrics"):
+		return priorityLow
+
+	case strings.HasPrefix(event.Type, "command."),
+		strings.HasPrefix(event.Type, "agent."),
+		strings.HasPrefix(event.Type, "alert."):
+		return priorityHigh
+
+	default:
+		return priorityNormal
+	}
+}
+
+// supersedes reports whether event makes the queued one obsolete: it
+// carries the same Key, as the next container.metrics sample of a container
+// does with container.metrics:<id>, or it is a full snapshot and queued is a
+// delta that the snapshot already covers.
+func supersedes(event agent.Event, queued agent.Event) bool {
+	if event.Key != "" && event.Key == queued.Key {
+		return true
+	}
+
+	return event.Type == "snapshot" && queued.Type == "snapshot.delta"
+}
+
+// outbox buffers events until the writer of the current connection takes
+// them. It holds at most capacity events across all priorities; when full, a
+// new event evicts the oldest event of a lower priority or is dropped.
+//
+// An event with Parts, a chunked snapshot, is one unit: it is always
+// admitted and never evicted, since dropping any chunk would leave the
+// server with a snapshot it has to throw away. Once the writer takes the
+// first part, the rest follow before anything else. Its Key makes a newer
+// snapshot replace it, so at most one waits at a time; that holds even
+// mid-write, when the rest of the parts are dropped and the server is left
+// with a partial group it must discard.
+type outbox struct {
+	capacity int
+
+	mu       sync.Mutex
+	queues   [priorityLevels][]agent.Event
+	size     int
+	queued   uint64
+	dropped  uint64
+	replaced uint64
+	// lost counts drops since the writer last asked, for sequence gaps.
+	lost uint64
+	// unit is the event whose parts are being written; parts holds what
+	// is left of them.
+	unit  agent.Event
+	parts []agent.Event
+
+	ready chan struct{}
+}
+
+func newOutbox(capacity int) *outbox {
+	if capacity <= 0 {
+		capacity = defaultOutboundQueue
+	}
+
+	return &outbox{
+		capacity: capacity,
+		ready:    make(chan struct{}, 1),
+	}
+}
+
+// push queues event and reports whether it was kept.
+func (o *outbox) push(event agent.Event) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for p := range o.queues {
+		kept := o.queues[p][:0]
+		for _, queued := range o.queues[p] {
+			if supersedes(event, queued) {
+				o.replaced++
+				o.size--
+				continue
+			}
+			kept = append(kept, queued)
+		}
+		clear(o.queues[p][len(kept):])
+		o.queues[p] = kept
+	}
+
+	// The server discards a chunked snapshot it did not get whole, so the
+	// rest of one being written is not worth sending either.
+	if len(o.parts) > 0 && supersedes(event, o.unit) {
+		o.replaced++
+		o.unit, o.parts = agent.Event{}, nil
+	}
+
+	p := eventPriority(event)
+	if o.size >= o.capacity && len(event.Parts) == 0 && !o.evictBelow(p) {
+		o.dropped++
+		o.lost++
+		return false
+	}
+
+	o.queues[p] = append(o.queues[p], event)
+	o.size++
+	o.queued++
+	o.signal()
+
+	return true
+}
+
+// evictBelow drops the oldest event with a lower priority than p, passing
+// over units with Parts. o.mu must be held.
+func (o *outbox) evictBelow(p priority) bool {
+	for lower := range p {
+		i := slices.IndexFunc(o.queues[lower], func(queued agent.Event) bool {
+			return len(queued.Parts) == 0
+		})
+		if i < 0 {
+			continue
+		}
+
+		o.queues[lower] = slices.Delete(o.queues[lower], i, i+1)
+		o.size--
+		o.dropped++
+		o.lost++
+		return true
+	}
+
+	return false
+}
+
+// pop returns the next part of the unit being written or else the oldest
+// event of the highest priority. It signals ready again while events
+// remain, so the writer can interleave replays.
+func (o *outbox) pop() (agent.Event, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(o.parts) > 0 {
+		event := o.parts[0]
+		o.parts = o.parts[1:]
+		o.signalPending()
+		return event, true
+	}
+
+	for p := priorityLevels - 1; p >= 0; p-- {
+		if len(o.queues[p]) == 0 {
+			continue
+		}
+
+		event := o.queues[p][0]
+		o.queues[p][0] = agent.Event{}
+		o.queues[p] = o.queues[p][1:]
+		o.size--
+
+		if len(event.Parts) > 0 {
+			o.unit, o.parts = event, event.Parts[1:]
+			event = event.Parts[0]
+		}
+
+		o.signalPending()
+		return event, true
+	}
+
+	return agent.Event{}, false
+}
+
+// signalPending wakes the writer again while anything is left. o.mu must
+// be held.
+func (o *outbox) signalPending() {
+	if o.size > 0 || len(o.parts) > 0 {
+		o.signal()
+	}
+}
+
+// takeLost returns how many events were dropped since the last call.
+func (o *outbox) takeLost() uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	lost := o.lost
+	o.lost = 0
+
+	return lost
+}
+
+// signal wakes the writer. o.mu must be held.
+func (o *outbox) signal() {
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (o *outbox) stats() agent.OutboundStats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return agent.OutboundStats{
+		Queued:   o.queued,
+		Dropped:  o.dropped,
+		Replaced: o.replaced,
+		Pending:  o.size + len(o.parts),
+	}
+}
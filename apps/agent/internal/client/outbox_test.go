@@ -0,0 +1,176 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/sonomandeep/containers/agent/internal/agent"
+)
+
+func drain(box *outbox) []string {
+	var types []string
+	for {
+		event, ok := box.pop()
+		if !ok {
+			return types
+		}
+		types = append(types, event.Type)
+	}
+}
+
+func popType(box *outbox) string {
+	event, _ := box.pop()
+	return event.Type
+}
+
+func TestOutbox(t *testing.T) {
+	t.Run("writes higher priorities first", func(t *testing.T) {
+		box := newOutbox(8)
+		for _, typ := range []string{"snapshot", "container.start", "command.result", "snapshot.delta", "container.die", "alert.disk", "snapshot.partial"} {
+			box.push(agent.Event{Type: typ})
+		}
+
+		got := drain(box)
+		want := []string{"command.result", "alert.disk", "snapshot.partial", "container.start", "container.die", "snapshot", "snapshot.delta"}
+		if len(got) != len(want) {
+			t.Fatalf("pop() order = %v, want %v", got, want)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("pop() order = %v, want %v", got, want)
+			}
+		}
+	})
+
+	t.Run("replaces superseded events", func(t *testing.T) {
+		box := newOutbox(8)
+		box.push(agent.Event{Type: "snapshot", Key: "snapshot", Data: 1})
+		box.push(agent.Event{Type: "snapshot.delta", Data: 2})
+		box.push(agent.Event{Type: "host.metrics", Key: "host.metrics", Data: 1})
+		box.push(agent.Event{Type: "container.start"})
+		box.push(agent.Event{Type: "snapshot", Key: "snapshot", Data: 3})
+		box.push(agent.Event{Type: "host.metrics", Key: "host.metrics", Data: 2})
+
+		if stats := box.stats(); stats.Replaced != 3 || stats.Pending != 3 || stats.Queued != 6 {
+			t.Fatalf("stats() = %+v", stats)
+		}
+
+		box.pop()
+		if event, _ := box.pop(); event.Type != "snapshot" || event.Data != 3 {
+			t.Fatalf("pop() = %+v, want latest snapshot", event)
+		}
+		if event, _ := box.pop(); event.Type != "host.metrics" || event.Data != 2 {
+			t.Fatalf("pop() = %+v, want latest metrics", event)
+		}
+	})
+
+	t.Run("full queue evicts lower priorities", func(t *testing.T) {
+		box := newOutbox(2)
+		box.push(agent.Event{Type: "snapshot.chunk"})
+		box.push(agent.Event{Type: "container.start"})
+
+		if !box.push(agent.Event{Type: "command.result"}) {
+			t.Fatal("push() dropped a command result")
+		}
+		if box.push(agent.Event{Type: "snapshot.chunk"}) {
+			t.Fatal("push() kept a snapshot in a full queue")
+		}
+		if !box.push(agent.Event{Type: "agent.docker.unavailable"}) {
+			t.Fatal("push() dropped an agent event")
+		}
+		if box.push(agent.Event{Type: "container.die"}) {
+			t.Fatal("push() kept a lifecycle event behind two high priority events")
+		}
+
+		if lost := box.takeLost(); lost != 4 {
+			t.Fatalf("takeLost() = %d, want 4", lost)
+		}
+		if lost := box.takeLost(); lost != 0 {
+			t.Fatalf("takeLost() again = %d, want 0", lost)
+		}
+
+		if stats := box.stats(); stats.Dropped != 4 || stats.Pending != 2 {
+			t.Fatalf("stats() = %+v", stats)
+		}
+
+		if got := drain(box); len(got) != 2 || got[0] != "command.result" || got[1] != "agent.docker.unavailable" {
+			t.Fatalf("pop() order = %v", got)
+		}
+	})
+
+	t.Run("signals while events remain", func(t *testing.T) {
+		box := newOutbox(4)
+		box.push(agent.Event{Type: "container.start"})
+		box.push(agent.Event{Type: "container.die"})
+
+		for range 2 {
+			select {
+			case <-box.ready:
+			default:
+				t.Fatal("outbox did not signal a pending event")
+			}
+			box.pop()
+		}
+
+		select {
+		case <-box.ready:
+			t.Fatal("outbox signaled an empty queue")
+		default:
+		}
+	})
+	t.Run("chunked snapshots travel as one unit", func(t *testing.T) {
+		chunked := func(n int) agent.Event {
+			event := agent.Event{Type: "snapshot", Key: "snapshot"}
+			for i := range n {
+				event.Parts = append(event.Parts, agent.Event{Type: "snapshot.chunk", Data: i})
+			}
+			return event
+		}
+
+		box := newOutbox(2)
+		box.push(agent.Event{Type: "container.start"})
+		box.push(agent.Event{Type: "container.die"})
+
+		// More chunks than the queue holds are still admitted whole.
+		if !box.push(chunked(5)) {
+			t.Fatal("push() dropped a chunked snapshot")
+		}
+		// A lifecycle event does not evict the snapshot.
+		if box.push(agent.Event{Type: "container.stop"}) {
+			t.Fatal("push() evicted a chunked snapshot")
+		}
+
+		// A command result evicts the oldest lifecycle event instead.
+		box.push(agent.Event{Type: "command.result"})
+		if got := []string{popType(box), popType(box)}; got[0] != "command.result" || got[1] != "container.die" {
+			t.Fatalf("pop() order = %v", got)
+		}
+
+		if event, _ := box.pop(); event.Type != "snapshot.chunk" || event.Data != 0 {
+			t.Fatalf("pop() = %+v, want first chunk", event)
+		}
+		// Once started, the chunks go out back to back.
+		box.push(agent.Event{Type: "command.result"})
+		for want := 1; want < 5; want++ {
+			if event, _ := box.pop(); event.Type != "snapshot.chunk" || event.Data != want {
+				t.Fatalf("pop() = %+v, want chunk %d", event, want)
+			}
+		}
+		if event, _ := box.pop(); event.Type != "command.result" {
+			t.Fatalf("pop() = %q after the chunks", event.Type)
+		}
+	})
+
+	t.Run("a newer snapshot replaces one being written", func(t *testing.T) {
+		box := newOutbox(4)
+		box.push(agent.Event{Type: "snapshot", Key: "snapshot", Parts: []agent.Event{
+			{Type: "snapshot.chunk", Data: "old"},
+			{Type: "snapshot.chunk", Data: "old"},
+		}})
+		box.pop()
+
+		box.push(agent.Event{Type: "snapshot", Key: "snapshot", Data: "new"})
+		if got := drain(box); len(got) != 1 || got[0] != "snapshot" {
+			t.Fatalf("pop() order = %v", got)
+		}
+	})
+}
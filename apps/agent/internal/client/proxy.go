@@ -0,0 +1,132 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/sonomandeep/containers/agent/internal/env"
+	"golang.org/x/net/http/httpproxy"
+)
+
+const agentProxyURLEnv = "AGENT_PROXY_URL"
+
+// ProxyError reports that the connection failed at the proxy itself: it was
+// unreachable, refused the credentials or could not open the tunnel.
+type ProxyError struct {
+	Proxy string
+	Err   error
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("proxy %s: %v", e.Proxy, e.Err)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// ProxyOptions configures outbound proxying. URL overrides HTTP_PROXY and
+// HTTPS_PROXY; NO_PROXY is honored either way. Credentials are taken from
+// the URL userinfo.
+type ProxyOptions struct {
+	URL string
+}
+
+func proxyOptionsFromEnv() ProxyOptions {
+	return ProxyOptions{URL: env.String(agentProxyURLEnv, "")}
+}
+
+func (o ProxyOptions) proxyFunc() (func(*url.URL) (*url.URL, error), error) {
+	cfg := httpproxy.FromEnvironment()
+
+	if o.URL != "" {
+		parsed, err := url.Parse(o.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", agentProxyURLEnv, err)
+		}
+
+		switch parsed.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupported %s scheme: %s", agentProxyURLEnv, parsed.Scheme)
+		}
+
+		cfg.HTTPProxy = o.URL
+		cfg.HTTPSProxy = o.URL
+	}
+
+	return cfg.ProxyFunc(), nil
+}
+
+// proxyTracker remembers which proxy the transport picked for the dial so
+// failures can be attributed to either the proxy or the upstream.
+type proxyTracker struct {
+	mu    sync.Mutex
+	proxy *url.URL
+}
+
+func (t *proxyTracker) wrap(fn func(*url.URL) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(r *http.Request) (*url.URL, error) {
+		proxy, err := fn(r.URL)
+		if err != nil {
+			return nil, err
+		}
+
+		t.mu.Lock()
+		t.proxy = proxy
+		t.mu.Unlock()
+
+		return proxy, nil
+	}
+}
+
+func (t *proxyTracker) used() *url.URL {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.proxy
+}
+
+func checkProxyConnectResponse(
+	_ context.Context,
+	proxy *url.URL,
+	_ *http.Request,
+	res *http.Response,
+) error {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+
+	return &ProxyError{
+		Proxy: proxy.Redacted(),
+		Err:   fmt.Errorf("CONNECT rejected: %s", res.Status),
+	}
+}
+
+func (t *proxyTracker) classify(target string, res *http.Response, err error) error {
+	proxy := t.used()
+	if proxy == nil || err == nil {
+		return err
+	}
+
+	var proxyErr *ProxyError
+	if errors.As(err, &proxyErr) {
+		return proxyErr
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "proxyconnect" {
+		return &ProxyError{Proxy: proxy.Redacted(), Err: opErr.Err}
+	}
+
+	if res != nil && res.StatusCode == http.StatusProxyAuthRequired {
+		return &ProxyError{Proxy: proxy.Redacted(), Err: errors.New(res.Status)}
+	}
+
+	return fmt.Errorf("upstream %s (via proxy %s): %w", target, proxy.Redacted(), err)
+}
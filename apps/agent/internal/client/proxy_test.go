@@ -0,0 +1,259 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// connectProxy is a minimal CONNECT proxy. It resolves every tunnel target
+// to upstream so tests can use a hostname covered by the httptest
+// certificate, which the real proxy selection would otherwise skip as local.
+type connectProxy struct {
+	upstream string
+	auth     string
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if p.auth != "" {
+		expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(p.auth))
+		if r.Header.Get("Proxy-Authorization") != expected {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+	}
+
+	p.mu.Lock()
+	p.targets = append(p.targets, r.Host)
+	p.mu.Unlock()
+
+	upstream, err := net.Dial("tcp", p.upstream)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+
+	go func() {
+		defer conn.Close()
+		defer upstream.Close()
+		io.Copy(upstream, conn)
+	}()
+	go io.Copy(conn, upstream)
+}
+
+func (p *connectProxy) tunnels() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]string(nil), p.targets...)
+}
+
+func newProxyFixture(t *testing.T, upstream http.Handler, auth string) (*connectProxy, *httptest.Server, TLSOptions) {
+	t.Helper()
+
+	server := httptest.NewTLSServer(upstream)
+	t.Cleanup(server.Close)
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caPath, caPEM, 0o600); err != nil {
+		t.Fatalf("WriteFile() unexpected error: %v", err)
+	}
+
+	proxy := &connectProxy{upstream: server.Listener.Addr().String(), auth: auth}
+	proxyServer := httptest.NewServer(proxy)
+	t.Cleanup(proxyServer.Close)
+
+	return proxy, proxyServer, TLSOptions{CAFile: caPath}
+}
+
+func dialThroughProxy(t *testing.T, opts dialOptions) error {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := dial(ctx, "wss://example.com/api/agents/socket", opts)
+	if err != nil {
+		return err
+	}
+	conn.CloseNow()
+
+	return nil
+}
+
+func withCredentials(rawURL, userinfo string) string {
+	return strings.Replace(rawURL, "http://", "http://"+userinfo+"@", 1)
+}
+
+func TestDialProxy(t *testing.T) {
+	t.Setenv("HTTPS_PROXY", "")
+	t.Setenv("HTTP_PROXY", "")
+	t.Setenv("NO_PROXY", "")
+
+	t.Run("tunnels wss through explicit proxy with basic auth", func(t *testing.T) {
+		proxy, proxyServer, tlsOpts := newProxyFixture(t, websocketHandler(t), "agent:secret")
+
+		opts := dialOptions{TLS: tlsOpts, Proxy: ProxyOptions{URL: withCredentials(proxyServer.URL, "agent:secret")}}
+		if err := dialThroughProxy(t, opts); err != nil {
+			t.Fatalf("dial() unexpected error: %v", err)
+		}
+
+		tunnels := proxy.tunnels()
+		if len(tunnels) != 1 || tunnels[0] != "example.com:443" {
+			t.Fatalf("proxy tunnels = %v", tunnels)
+		}
+	})
+
+	t.Run("honors HTTPS_PROXY", func(t *testing.T) {
+		proxy, proxyServer, tlsOpts := newProxyFixture(t, websocketHandler(t), "")
+		t.Setenv("HTTPS_PROXY", proxyServer.URL)
+
+		if err := dialThroughProxy(t, dialOptions{TLS: tlsOpts}); err != nil {
+			t.Fatalf("dial() unexpected error: %v", err)
+		}
+
+		if len(proxy.tunnels()) != 1 {
+			t.Fatalf("proxy tunnels = %v", proxy.tunnels())
+		}
+	})
+
+	t.Run("reports rejected proxy credentials as proxy error", func(t *testing.T) {
+		_, proxyServer, tlsOpts := newProxyFixture(t, websocketHandler(t), "agent:secret")
+
+		opts := dialOptions{TLS: tlsOpts, Proxy: ProxyOptions{URL: withCredentials(proxyServer.URL, "agent:wrong")}}
+		err := dialThroughProxy(t, opts)
+
+		var proxyErr *ProxyError
+		if !errors.As(err, &proxyErr) {
+			t.Fatalf("dial() expected ProxyError, got %v", err)
+		}
+
+		if !strings.Contains(err.Error(), "407") {
+			t.Fatalf("dial() error = %q", err)
+		}
+
+		if strings.Contains(err.Error(), "wrong") {
+			t.Fatalf("dial() error leaks proxy password: %q", err)
+		}
+	})
+
+	t.Run("reports unreachable proxy as proxy error", func(t *testing.T) {
+		_, proxyServer, tlsOpts := newProxyFixture(t, websocketHandler(t), "")
+		proxyURL := proxyServer.URL
+		proxyServer.Close()
+
+		err := dialThroughProxy(t, dialOptions{TLS: tlsOpts, Proxy: ProxyOptions{URL: proxyURL}})
+
+		var proxyErr *ProxyError
+		if !errors.As(err, &proxyErr) {
+			t.Fatalf("dial() expected ProxyError, got %v", err)
+		}
+	})
+
+	t.Run("reports upstream handshake failure as upstream error", func(t *testing.T) {
+		_, proxyServer, tlsOpts := newProxyFixture(t, http.NotFoundHandler(), "")
+
+		err := dialThroughProxy(t, dialOptions{TLS: tlsOpts, Proxy: ProxyOptions{URL: proxyServer.URL}})
+		if err == nil {
+			t.Fatal("dial() expected error")
+		}
+
+		var proxyErr *ProxyError
+		if errors.As(err, &proxyErr) {
+			t.Fatalf("dial() unexpected ProxyError: %v", err)
+		}
+
+		if !strings.HasPrefix(err.Error(), "upstream ") {
+			t.Fatalf("dial() error = %q", err)
+		}
+	})
+
+	t.Run("rejects unsupported proxy scheme", func(t *testing.T) {
+		err := dialThroughProxy(t, dialOptions{Proxy: ProxyOptions{URL: "ftp://proxy.internal"}})
+		if err == nil {
+			t.Fatal("dial() expected error")
+		}
+	})
+}
+
+func TestProxyOptionsProxyFunc(t *testing.T) {
+	t.Setenv("HTTPS_PROXY", "http://env-proxy.internal:3128")
+	t.Setenv("HTTP_PROXY", "")
+	t.Setenv("NO_PROXY", "api.internal")
+
+	target := func(host string) *url.URL {
+		return &url.URL{Scheme: "https", Host: host}
+	}
+
+	t.Run("uses HTTPS_PROXY from env", func(t *testing.T) {
+		fn, err := ProxyOptions{}.proxyFunc()
+		if err != nil {
+			t.Fatalf("proxyFunc() unexpected error: %v", err)
+		}
+
+		proxy, err := fn(target("api.example.com"))
+		if err != nil || proxy == nil || proxy.Host != "env-proxy.internal:3128" {
+			t.Fatalf("proxyFunc() = %v, %v", proxy, err)
+		}
+	})
+
+	t.Run("explicit URL overrides env", func(t *testing.T) {
+		fn, err := ProxyOptions{URL: "http://explicit.internal:8080"}.proxyFunc()
+		if err != nil {
+			t.Fatalf("proxyFunc() unexpected error: %v", err)
+		}
+
+		proxy, err := fn(target("api.example.com"))
+		if err != nil || proxy == nil || proxy.Host != "explicit.internal:8080" {
+			t.Fatalf("proxyFunc() = %v, %v", proxy, err)
+		}
+	})
+
+	t.Run("bypasses NO_PROXY hosts", func(t *testing.T) {
+		fn, err := ProxyOptions{URL: "http://explicit.internal:8080"}.proxyFunc()
+		if err != nil {
+			t.Fatalf("proxyFunc() unexpected error: %v", err)
+		}
+
+		proxy, err := fn(target("api.internal"))
+		if err != nil || proxy != nil {
+			t.Fatalf("proxyFunc() = %v, %v", proxy, err)
+		}
+	})
+}
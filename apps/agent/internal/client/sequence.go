@@ -0,0 +1,155 @@
+package client
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/sonomandeep/containers/agent/internal/agent"
+)
+
+const (
+	agentReplayBufferEnv = "AGENT_REPLAY_BUFFER"
+
+	defaultReplayBuffer = 512
+)
+
+var (
+	ErrReplaySession     = errors.New("replay requested for another session")
+	ErrReplayUnavailable = errors.New("events no longer in replay buffer")
+)
+
+// sequencer stamps every outbound event with the agent session ID and the
+// next sequence number, at the moment it is written so that numbers on the
+// wire strictly increase. Events the outbox dropped are skipped over, so
+// their numbers show up as a gap. The last events stay in a ring so the
+// server can ask for the ones it missed, e.g. written just before a
+// connection died.
+type sequencer struct {
+	session string
+
+	mu         sync.Mutex
+	last       uint64
+	ring       []agent.Event
+	replayFrom uint64
+	replay     chan struct{}
+}
+
+func newSequencer(capacity int) *sequencer {
+	if capacity <= 0 {
+		capacity = defaultReplayBuffer
+	}
+
+	return &sequencer{
+		session: rand.Text(),
+		ring:    make([]agent.Event, capacity),
+		replay:  make(chan struct{}, 1),
+	}
+}
+
+func (s *sequencer) stamp(event agent.Event) agent.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.last++
+	event.Session = s.session
+	event.Seq = s.last
+	event.Replay = false
+	s.ring[s.last%uint64(len(s.ring))] = event
+
+	return event
+}
+
+// skip uses up n sequence numbers for events dropped before they were
+// written. Their ring slots are cleared, so a replay across the gap fails
+// with ErrReplayUnavailable and the server falls back to a full snapshot.
+func (s *sequencer) skip(n uint64) {
+	if n == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	size := uint64(len(s.ring))
+	for i := range min(n, size) {
+		s.ring[(s.last+1+i)%size] = agent.Event{}
+	}
+	s.last += n
+}
+
+// oldest returns the lowest sequence number still buffered. s.mu must be
+// held.
+func (s *sequencer) oldest() uint64 {
+	if s.last < uint64(len(s.ring)) {
+		return 1
+	}
+
+	return s.last - uint64(len(s.ring)) + 1
+}
+
+// request schedules a resend of every buffered event from seq fromSeq on.
+// The active writer picks it up before its next queued event.
+func (s *sequencer) request(session string, fromSeq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if session != s.session {
+		return fmt.Errorf("%w: %s", ErrReplaySession, session)
+	}
+
+	if fromSeq > s.last {
+		// Nothing newer was sent; the server is up to date.
+		return nil
+	}
+
+	if fromSeq == 0 || fromSeq < s.oldest() {
+		return fmt.Errorf("%w: from %d, oldest %d", ErrReplayUnavailable, fromSeq, s.oldest())
+	}
+
+	for seq := fromSeq; seq <= s.last; seq++ {
+		if s.ring[seq%uint64(len(s.ring))].Type == "" {
+			return fmt.Errorf("%w: event %d was dropped before it was sent", ErrReplayUnavailable, seq)
+		}
+	}
+
+	if s.replayFrom == 0 || fromSeq < s.replayFrom {
+		s.replayFrom = fromSeq
+	}
+
+	select {
+	case s.replay <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// pending returns the events to resend for the outstanding request, marked
+// as replays, and clears it.
+func (s *sequencer) pending() []agent.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.replayFrom == 0 {
+		return nil
+	}
+
+	// Events may have been evicted since the request was accepted.
+	from := max(s.replayFrom, s.oldest())
+	s.replayFrom = 0
+
+	events := make([]agent.Event, 0, s.last-from+1)
+	for seq := from; seq <= s.last; seq++ {
+		event := s.ring[seq%uint64(len(s.ring))]
+		if event.Type == "" {
+			// Dropped after the request was accepted.
+			continue
+		}
+		event.Replay = true
+		events = append(events, event)
+	}
+
+	return events
+}
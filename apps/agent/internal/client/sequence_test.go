@@ -0,0 +1,151 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/sonomandeep/containers/agent/internal/agent"
+)
+
+func TestSequencer(t *testing.T) {
+	t.Run("stamps strictly increasing numbers", func(t *testing.T) {
+		seq := newSequencer(4)
+
+		for want := uint64(1); want <= 10; want++ {
+			event := seq.stamp(agent.Event{Type: "container.start"})
+			if event.Seq != want || event.Session != seq.session {
+				t.Fatalf("stamp() = seq %d session %q, want %d", event.Seq, event.Session, want)
+			}
+		}
+	})
+
+	t.Run("replays buffered events in order", func(t *testing.T) {
+		seq := newSequencer(4)
+		for range 6 {
+			seq.stamp(agent.Event{Type: "container.start"})
+		}
+
+		if err := seq.request(seq.session, 4); err != nil {
+			t.Fatalf("request() unexpected error: %v", err)
+		}
+
+		events := seq.pending()
+		if len(events) != 3 {
+			t.Fatalf("pending() = %d events, want 3", len(events))
+		}
+		for i, event := range events {
+			if event.Seq != uint64(4+i) || !event.Replay {
+				t.Fatalf("pending()[%d] = seq %d replay %t", i, event.Seq, event.Replay)
+			}
+		}
+
+		if events := seq.pending(); events != nil {
+			t.Fatalf("pending() after drain = %d events", len(events))
+		}
+	})
+
+	t.Run("merges overlapping requests", func(t *testing.T) {
+		seq := newSequencer(8)
+		for range 5 {
+			seq.stamp(agent.Event{Type: "container.start"})
+		}
+
+		for _, from := range []uint64{4, 2, 3} {
+			if err := seq.request(seq.session, from); err != nil {
+				t.Fatalf("request(%d) unexpected error: %v", from, err)
+			}
+		}
+
+		if events := seq.pending(); len(events) != 4 || events[0].Seq != 2 {
+			t.Fatalf("pending() = %d events", len(events))
+		}
+	})
+
+	t.Run("rejects evicted ranges and other sessions", func(t *testing.T) {
+		seq := newSequencer(4)
+		for range 6 {
+			seq.stamp(agent.Event{Type: "container.start"})
+		}
+
+		if err := seq.request(seq.session, 2); !errors.Is(err, ErrReplayUnavailable) {
+			t.Fatalf("request() expected ErrReplayUnavailable, got %v", err)
+		}
+
+		if err := seq.request("previous-session", 5); !errors.Is(err, ErrReplaySession) {
+			t.Fatalf("request() expected ErrReplaySession, got %v", err)
+		}
+	})
+
+	t.Run("dropped events leave a gap that cannot be replayed", func(t *testing.T) {
+		seq := newSequencer(8)
+		seq.stamp(agent.Event{Type: "container.start"})
+		seq.skip(2)
+
+		if event := seq.stamp(agent.Event{Type: "container.die"}); event.Seq != 4 {
+			t.Fatalf("stamp() after skip = seq %d, want 4", event.Seq)
+		}
+
+		if err := seq.request(seq.session, 2); !errors.Is(err, ErrReplayUnavailable) {
+			t.Fatalf("request() across the gap error = %v, want ErrReplayUnavailable", err)
+		}
+		if err := seq.request(seq.session, 4); err != nil {
+			t.Fatalf("request() after the gap unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ignores requests past the last event", func(t *testing.T) {
+		seq := newSequencer(4)
+		seq.stamp(agent.Event{Type: "container.start"})
+
+		if err := seq.request(seq.session, 2); err != nil {
+			t.Fatalf("request() unexpected error: %v", err)
+		}
+
+		select {
+		case <-seq.replay:
+			t.Fatal("request() scheduled an empty replay")
+		default:
+		}
+	})
+}
+
+func TestClientSequencing(t *testing.T) {
+	server := newFakeControlPlane(t, true)
+
+	c, err := connect(context.Background(), testConfig(t, server))
+	if err != nil {
+		t.Fatalf("connect() unexpected error: %v", err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+
+	for range 3 {
+		c.Write(agent.Event{Type: "container.start", TS: time.Now()})
+	}
+	waitFor(t, "events", func() bool { return len(server.receivedEvents()) == 4 })
+
+	for i, event := range server.receivedEvents() {
+		if event.Seq != uint64(i+1) || event.Session != c.Session() || event.Replay {
+			t.Fatalf("event %d = %+v", i, event)
+		}
+	}
+
+	if err := c.ReplayEvents(c.Session(), 3); err != nil {
+		t.Fatalf("ReplayEvents() unexpected error: %v", err)
+	}
+	waitFor(t, "replayed events", func() bool { return len(server.receivedEvents()) == 6 })
+
+	replayed := server.receivedEvents()[4:]
+	if replayed[0].Seq != 3 || replayed[1].Seq != 4 || !replayed[0].Replay || !replayed[1].Replay {
+		t.Fatalf("replayed = %+v", replayed)
+	}
+
+	// New events continue the sequence after a replay.
+	c.Write(agent.Event{Type: "container.die", TS: time.Now()})
+	waitFor(t, "next event", func() bool { return len(server.receivedEvents()) == 7 })
+	if next := server.receivedEvents()[6]; next.Seq != 5 || next.Replay {
+		t.Fatalf("next = %+v", next)
+	}
+}
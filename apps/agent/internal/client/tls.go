@@ -0,0 +1,135 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sonomandeep/containers/agent/internal/env"
+)
+
+const (
+	agentTLSCAFileEnv       = "AGENT_TLS_CA_FILE"
+	agentTLSCertFileEnv     = "AGENT_TLS_CERT_FILE"
+	agentTLSKeyFileEnv      = "AGENT_TLS_KEY_FILE"
+	agentTLSPinnedSHA256Env = "AGENT_TLS_PINNED_SHA256"
+	agentTLSInsecureEnv     = "AGENT_TLS_INSECURE_SKIP_VERIFY"
+)
+
+var ErrCertificatePinMismatch = errors.New("server certificate does not match pinned fingerprint")
+
+// TLSOptions configures how the agent authenticates the control plane and
+// itself. CAFile is appended to the system roots, CertFile/KeyFile enable
+// mutual TLS and PinnedSHA256 is the hex SHA-256 of the server leaf
+// certificate. InsecureSkipVerify is meant for development only.
+type TLSOptions struct {
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	PinnedSHA256       string
+	InsecureSkipVerify bool
+}
+
+func tlsOptionsFromEnv() (TLSOptions, error) {
+	opts := TLSOptions{
+		CAFile:       env.String(agentTLSCAFileEnv, ""),
+		CertFile:     env.String(agentTLSCertFileEnv, ""),
+		KeyFile:      env.String(agentTLSKeyFileEnv, ""),
+		PinnedSHA256: env.String(agentTLSPinnedSHA256Env, ""),
+	}
+
+	insecure, err := env.Bool(agentTLSInsecureEnv, false)
+	if err != nil {
+		return TLSOptions{}, err
+	}
+	opts.InsecureSkipVerify = insecure
+
+	return opts, nil
+}
+
+func (o TLSOptions) config() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", agentTLSCAFileEnv, err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s contains no valid certificates", agentTLSCAFileEnv)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return nil, fmt.Errorf("%s and %s must be set together", agentTLSCertFileEnv, agentTLSKeyFileEnv)
+	}
+
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if o.PinnedSHA256 != "" {
+		pin, err := parseFingerprint(o.PinnedSHA256)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", agentTLSPinnedSHA256Env, err)
+		}
+		cfg.VerifyConnection = verifyPinnedCertificate(pin)
+	}
+
+	if o.InsecureSkipVerify {
+		cfg.InsecureSkipVerify = true
+	}
+
+	return cfg, nil
+}
+
+// verifyPinnedCertificate runs after the regular chain verification (or in
+// place of it when InsecureSkipVerify is set), so a pin can also be used to
+// trust a self-signed server certificate.
+func verifyPinnedCertificate(pin []byte) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return ErrCertificatePinMismatch
+		}
+
+		sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+		if !bytes.Equal(sum[:], pin) {
+			return fmt.Errorf("%w: got %s", ErrCertificatePinMismatch, hex.EncodeToString(sum[:]))
+		}
+
+		return nil
+	}
+}
+
+func parseFingerprint(value string) ([]byte, error) {
+	normalized := strings.ToLower(strings.TrimSpace(value))
+	normalized = strings.TrimPrefix(normalized, "sha256:")
+	normalized = strings.ReplaceAll(normalized, ":", "")
+
+	decoded, err := hex.DecodeString(normalized)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(decoded) != sha256.Size {
+		return nil, fmt.Errorf("expected %d bytes, got %d", sha256.Size, len(decoded))
+	}
+
+	return decoded, nil
+}
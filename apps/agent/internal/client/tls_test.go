@@ -0,0 +1,280 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	tlsCert tls.Certificate
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert, isCA bool, usage x509.ExtKeyUsage) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() unexpected error: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if !isCA {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate() unexpected error: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate() unexpected error: %v", err)
+	}
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		tlsCert: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert},
+	}
+}
+
+func (c *testCert) writeFiles(t *testing.T) (string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+	if err := os.WriteFile(certPath, certPEM, 0o600); err != nil {
+		t.Fatalf("WriteFile() unexpected error: %v", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey() unexpected error: %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(keyPath, keyPEM, 0o600); err != nil {
+		t.Fatalf("WriteFile() unexpected error: %v", err)
+	}
+
+	return certPath, keyPath
+}
+
+func websocketHandler(t *testing.T) http.Handler {
+	t.Helper()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close(websocket.StatusNormalClosure, "")
+	})
+}
+
+func newTLSServer(t *testing.T, serverCert *testCert, clientCA *testCert) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewUnstartedServer(websocketHandler(t))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert.tlsCert}}
+	if clientCA != nil {
+		pool := x509.NewCertPool()
+		pool.AddCert(clientCA.cert)
+		server.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+		server.TLS.ClientCAs = pool
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func wsURL(server *httptest.Server) string {
+	return "wss" + strings.TrimPrefix(server.URL, "https")
+}
+
+func dialTest(t *testing.T, url string, opts TLSOptions) error {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := dial(ctx, url, dialOptions{TLS: opts})
+	if err != nil {
+		return err
+	}
+	conn.CloseNow()
+
+	return nil
+}
+
+func TestDialTLS(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil, true, 0)
+	serverCert := newTestCert(t, "server", ca, false, x509.ExtKeyUsageServerAuth)
+	caPath, _ := ca.writeFiles(t)
+
+	t.Run("trusts server signed by custom CA", func(t *testing.T) {
+		server := newTLSServer(t, serverCert, nil)
+
+		if err := dialTest(t, wsURL(server), TLSOptions{CAFile: caPath}); err != nil {
+			t.Fatalf("dial() unexpected error: %v", err)
+		}
+	})
+
+	t.Run("rejects server signed by unknown CA", func(t *testing.T) {
+		server := newTLSServer(t, serverCert, nil)
+
+		err := dialTest(t, wsURL(server), TLSOptions{})
+		var unknownAuthority x509.UnknownAuthorityError
+		if !errors.As(err, &unknownAuthority) {
+			t.Fatalf("dial() expected UnknownAuthorityError, got %v", err)
+		}
+	})
+
+	t.Run("presents client certificate for mutual TLS", func(t *testing.T) {
+		clientCert := newTestCert(t, "agent", ca, false, x509.ExtKeyUsageClientAuth)
+		certPath, keyPath := clientCert.writeFiles(t)
+		server := newTLSServer(t, serverCert, ca)
+
+		err := dialTest(t, wsURL(server), TLSOptions{CAFile: caPath, CertFile: certPath, KeyFile: keyPath})
+		if err != nil {
+			t.Fatalf("dial() unexpected error: %v", err)
+		}
+	})
+
+	t.Run("fails mutual TLS without client certificate", func(t *testing.T) {
+		server := newTLSServer(t, serverCert, ca)
+
+		if err := dialTest(t, wsURL(server), TLSOptions{CAFile: caPath}); err == nil {
+			t.Fatal("dial() expected error")
+		}
+	})
+
+	t.Run("accepts self-signed server matching pin", func(t *testing.T) {
+		server := httptest.NewTLSServer(websocketHandler(t))
+		t.Cleanup(server.Close)
+
+		sum := sha256.Sum256(server.Certificate().Raw)
+		opts := TLSOptions{PinnedSHA256: hex.EncodeToString(sum[:]), InsecureSkipVerify: true}
+
+		if err := dialTest(t, wsURL(server), opts); err != nil {
+			t.Fatalf("dial() unexpected error: %v", err)
+		}
+	})
+
+	t.Run("rejects server not matching pin", func(t *testing.T) {
+		server := newTLSServer(t, serverCert, nil)
+
+		opts := TLSOptions{CAFile: caPath, PinnedSHA256: strings.Repeat("ab", sha256.Size)}
+
+		err := dialTest(t, wsURL(server), opts)
+		if !errors.Is(err, ErrCertificatePinMismatch) {
+			t.Fatalf("dial() expected ErrCertificatePinMismatch, got %v", err)
+		}
+	})
+
+	t.Run("skips verification when insecure", func(t *testing.T) {
+		server := httptest.NewTLSServer(websocketHandler(t))
+		t.Cleanup(server.Close)
+
+		if err := dialTest(t, wsURL(server), TLSOptions{InsecureSkipVerify: true}); err != nil {
+			t.Fatalf("dial() unexpected error: %v", err)
+		}
+	})
+}
+
+func TestTLSOptionsConfig(t *testing.T) {
+	t.Run("requires certificate and key together", func(t *testing.T) {
+		_, err := TLSOptions{CertFile: "cert.pem"}.config()
+		if err == nil {
+			t.Fatal("config() expected error")
+		}
+	})
+
+	t.Run("rejects CA file without certificates", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "ca.pem")
+		if err := os.WriteFile(path, []byte("not a certificate"), 0o600); err != nil {
+			t.Fatalf("WriteFile() unexpected error: %v", err)
+		}
+
+		if _, err := (TLSOptions{CAFile: path}).config(); err == nil {
+			t.Fatal("config() expected error")
+		}
+	})
+
+	t.Run("parses fingerprint formats", func(t *testing.T) {
+		plain := strings.Repeat("ab", sha256.Size)
+		colons := strings.ToUpper(strings.TrimSuffix(strings.Repeat("ab:", sha256.Size), ":"))
+
+		for _, value := range []string{plain, "sha256:" + plain, colons} {
+			if _, err := parseFingerprint(value); err != nil {
+				t.Fatalf("parseFingerprint(%q) unexpected error: %v", value, err)
+			}
+		}
+
+		if _, err := parseFingerprint("abcd"); err == nil {
+			t.Fatal("parseFingerprint() expected error for short fingerprint")
+		}
+	})
+
+	t.Run("reads options from env", func(t *testing.T) {
+		t.Setenv(agentTLSCAFileEnv, " /etc/agent/ca.pem ")
+		t.Setenv(agentTLSInsecureEnv, "true")
+
+		opts, err := tlsOptionsFromEnv()
+		if err != nil {
+			t.Fatalf("tlsOptionsFromEnv() unexpected error: %v", err)
+		}
+
+		if opts.CAFile != "/etc/agent/ca.pem" || !opts.InsecureSkipVerify {
+			t.Fatalf("tlsOptionsFromEnv() = %+v", opts)
+		}
+	})
+
+	t.Run("rejects invalid insecure flag", func(t *testing.T) {
+		t.Setenv(agentTLSInsecureEnv, "maybe")
+
+		if _, err := tlsOptionsFromEnv(); err == nil {
+			t.Fatal("tlsOptionsFromEnv() expected error")
+		}
+	})
+}
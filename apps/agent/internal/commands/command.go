@@ -8,7 +8,28 @@ import (
 	"time"
 )
 
-const ContainerStopName = "container.stop"
+const (
+	ContainerStopName     = "container.stop"
+	SnapshotResyncName    = "snapshot.resync"
+	SnapshotRequestName   = "snapshot.request"
+	SnapshotIntervalName  = "snapshot.interval"
+	EventsResyncName      = "events.resync"
+	NetworkCreateName     = "network.create"
+	NetworkRemoveName     = "network.remove"
+	NetworkConnectName    = "network.connect"
+	NetworkDisconnectName = "network.disconnect"
+	VolumeCreateName      = "volume.create"
+	VolumeRemoveName      = "volume.remove"
+	VolumePruneName       = "volume.prune"
+	VolumeBackupName      = "volume.backup"
+	VolumeRestoreName     = "volume.restore"
+	ContainerPruneName    = "container.prune"
+	ImagePruneName        = "image.prune"
+	BuilderPruneName      = "builder.prune"
+	SystemPruneName       = "system.prune"
+	ImagePullName         = "image.pull"
+	ImageRemoveName       = "image.remove"
+)
 
 var ErrNotCommand = errors.New("message is not a command")
 
@@ -17,6 +38,12 @@ type Command struct {
 	TS      time.Time
 	Name    string
 	Payload json.RawMessage
+
+	// reported is set once a result went out, so a handler that reports
+	// partial results before failing is not reported twice. deferred is
+	// set when the command runs in the background and reports itself.
+	reported bool
+	deferred bool
 }
 
 type commandEnvelope struct {
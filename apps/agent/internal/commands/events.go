@@ -0,0 +1,73 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// eventsResyncPayload asks for every event of Session from FromSeq on.
+type eventsResyncPayload struct {
+	Session string  `json:"session"`
+	FromSeq *uint64 `json:"fromSeq"`
+}
+
+func (d *Dispatcher) registerEventHandlers() {
+	d.register(EventsResyncName, d.handleEventsResync)
+}
+
+// handleEventsResync replays buffered events. When they are gone, or belong
+// to an earlier session, it falls back to a full snapshot if a resyncer is
+// configured.
+func (d *Dispatcher) handleEventsResync(_ context.Context, command *Command) error {
+	if command == nil {
+		return errors.New("command is nil")
+	}
+
+	if d.eventReplayer == nil {
+		return errors.New("event replayer not configured")
+	}
+
+	var payload eventsResyncPayload
+	if err := json.Unmarshal(command.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid %s payload: %w", EventsResyncName, err)
+	}
+
+	payload.Session = strings.TrimSpace(payload.Session)
+	if payload.Session == "" {
+		return errors.New("events.resync payload missing session")
+	}
+
+	if payload.FromSeq == nil {
+		return errors.New("events.resync payload missing fromSeq")
+	}
+
+	err := d.eventReplayer.ReplayEvents(payload.Session, *payload.FromSeq)
+	if err == nil {
+		log.Printf(
+			"command %q (%s) replaying events from seq %d",
+			command.Name,
+			command.ID,
+			*payload.FromSeq,
+		)
+		return nil
+	}
+
+	if d.snapshotResyncer == nil {
+		return fmt.Errorf("replay events: %w", err)
+	}
+
+	d.snapshotResyncer.Resync()
+	log.Printf(
+		"command %q (%s) cannot replay from seq %d (%v), sending full snapshot",
+		command.Name,
+		command.ID,
+		*payload.FromSeq,
+		err,
+	)
+
+	return nil
+}
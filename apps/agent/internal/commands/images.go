@@ -0,0 +1,181 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// The limits of pullImageSchema in the shared package, so the agent rejects
+// what the API would.
+const (
+	maxRegistryLength  = 255
+	maxImageNameLength = 128
+	maxImageTagLength  = 128
+)
+
+var (
+	imageNamePattern = regexp.MustCompile(`^[a-z0-9]+(?:[._-][a-z0-9]+)*(?:/[a-z0-9]+(?:[._-][a-z0-9]+)*)*$`)
+	imageTagPattern  = regexp.MustCompile(`^[\w.-]+$`)
+)
+
+// registryAuthPayload carries credentials for one pull. They are passed to
+// Docker and not stored.
+type registryAuthPayload struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// imagePullPayload pulls registry/name:tag. Without auth the agent's own
+// registry credentials are used, if it has any.
+type imagePullPayload struct {
+	Registry string               `json:"registry"`
+	Name     string               `json:"name"`
+	Tag      string               `json:"tag"`
+	Auth     *registryAuthPayload `json:"auth"`
+}
+
+// imageRemovePayload removes images by ID or reference. Force also removes
+// containers using them; noPrune keeps untagged parent layers.
+type imageRemovePayload struct {
+	Images  []string `json:"images"`
+	Force   bool     `json:"force"`
+	NoPrune bool     `json:"noPrune"`
+}
+
+// imageRemoval is the outcome for one requested image. Untagged lists the
+// references dropped, Deleted the image and layer IDs removed from disk.
+type imageRemoval struct {
+	Image    string   `json:"image"`
+	Untagged []string `json:"untagged"`
+	Deleted  []string `json:"deleted"`
+	Error    string   `json:"error,omitempty"`
+}
+
+type imageRemoveResult struct {
+	Images []imageRemoval `json:"images"`
+}
+
+func (d *Dispatcher) registerImageHandlers() {
+	d.register(ImagePullName, d.handleImagePull)
+	d.register(ImageRemoveName, d.handleImageRemove)
+}
+
+func (d *Dispatcher) handleImagePull(ctx context.Context, command *Command) error {
+	if command == nil {
+		return errors.New("command is nil")
+	}
+
+	if d.imagePuller == nil {
+		return errors.New("image puller not configured")
+	}
+
+	var payload imagePullPayload
+	if err := json.Unmarshal(command.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid %s payload: %w", ImagePullName, err)
+	}
+
+	reference, err := payload.reference()
+	if err != nil {
+		return err
+	}
+
+	var username, password string
+	if payload.Auth != nil {
+		username, password = strings.TrimSpace(payload.Auth.Username), payload.Auth.Password
+		if username == "" || password == "" {
+			return errors.New("image.pull auth needs username and password")
+		}
+	}
+
+	if err := d.imagePuller.PullImage(ctx, command.ID, reference, username, password); err != nil {
+		return fmt.Errorf("pull image %q: %w", reference, err)
+	}
+
+	log.Printf("command %q (%s) pulling image %q", command.Name, command.ID, reference)
+
+	return nil
+}
+
+// handleImageRemove removes every image it can and reports each outcome.
+// It fails when any image could not be removed.
+func (d *Dispatcher) handleImageRemove(ctx context.Context, command *Command) error {
+	if command == nil {
+		return errors.New("command is nil")
+	}
+
+	if d.imageRemover == nil {
+		return errors.New("image remover not configured")
+	}
+
+	var payload imageRemovePayload
+	if err := json.Unmarshal(command.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid %s payload: %w", ImageRemoveName, err)
+	}
+
+	images := make([]string, 0, len(payload.Images))
+	for _, ref := range payload.Images {
+		if ref = strings.TrimSpace(ref); ref != "" && !slices.Contains(images, ref) {
+			images = append(images, ref)
+		}
+	}
+	if len(images) == 0 {
+		return errors.New("image.remove payload missing images")
+	}
+
+	result := imageRemoveResult{Images: make([]imageRemoval, 0, len(images))}
+	var errs []error
+	for _, ref := range images {
+		removal := imageRemoval{Image: ref, Untagged: []string{}, Deleted: []string{}}
+
+		untagged, deleted, err := d.imageRemover.RemoveImage(ctx, ref, payload.Force, payload.NoPrune)
+		if err != nil {
+			removal.Error = err.Error()
+			errs = append(errs, fmt.Errorf("remove image %q: %w", ref, err))
+		} else {
+			removal.Untagged, removal.Deleted = untagged, deleted
+		}
+		result.Images = append(result.Images, removal)
+	}
+
+	d.report(command, result)
+	log.Printf(
+		"command %q (%s) removed %d of %d images",
+		command.Name,
+		command.ID,
+		len(images)-len(errs),
+		len(images),
+	)
+
+	return errors.Join(errs...)
+}
+
+// reference validates the payload like pullImageSchema and joins it into
+// an image reference.
+func (p *imagePullPayload) reference() (string, error) {
+	registry := strings.TrimSuffix(strings.TrimSpace(p.Registry), "/")
+	name := strings.TrimSpace(p.Name)
+	tag := strings.TrimSpace(p.Tag)
+
+	switch {
+	case registry == "":
+		return "", errors.New("image.pull payload missing registry")
+	case name == "":
+		return "", errors.New("image.pull payload missing name")
+	case tag == "":
+		return "", errors.New("image.pull payload missing tag")
+	case len(registry) > maxRegistryLength:
+		return "", fmt.Errorf("image.pull registry longer than %d characters", maxRegistryLength)
+	case len(name) > maxImageNameLength || !imageNamePattern.MatchString(name):
+		return "", fmt.Errorf("image.pull payload has invalid name %q", name)
+	case len(tag) > maxImageTagLength || !imageTagPattern.MatchString(tag):
+		return "", fmt.Errorf("image.pull payload has invalid tag %q", tag)
+	}
+
+	return registry + "/" + name + ":" + tag, nil
+}
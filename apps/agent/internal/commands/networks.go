@@ -0,0 +1,215 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// networkCreatePayload creates a network. Driver defaults to bridge; subnet
+// and gateway are optional and gateway requires subnet.
+type networkCreatePayload struct {
+	Name     string            `json:"name"`
+	Driver   string            `json:"driver"`
+	Subnet   string            `json:"subnet"`
+	Gateway  string            `json:"gateway"`
+	Labels   map[string]string `json:"labels"`
+	Internal bool              `json:"internal"`
+}
+
+type networkCreateResult struct {
+	NetworkID string `json:"networkId"`
+	Name      string `json:"name"`
+}
+
+type networkRemovePayload struct {
+	NetworkID string `json:"networkId"`
+}
+
+// networkConnectPayload attaches a container. IP is an optional static IPv4
+// or IPv6 address inside one of the network's subnets.
+type networkConnectPayload struct {
+	NetworkID   string   `json:"networkId"`
+	ContainerID string   `json:"containerId"`
+	Aliases     []string `json:"aliases"`
+	IP          string   `json:"ip"`
+}
+
+type networkDisconnectPayload struct {
+	NetworkID   string `json:"networkId"`
+	ContainerID string `json:"containerId"`
+	Force       bool   `json:"force"`
+}
+
+func (d *Dispatcher) registerNetworkHandlers() {
+	d.register(NetworkCreateName, d.handleNetworkCreate)
+	d.register(NetworkRemoveName, d.handleNetworkRemove)
+	d.register(NetworkConnectName, d.handleNetworkConnect)
+	d.register(NetworkDisconnectName, d.handleNetworkDisconnect)
+}
+
+func (d *Dispatcher) handleNetworkCreate(ctx context.Context, command *Command) error {
+	if command == nil {
+		return errors.New("command is nil")
+	}
+
+	if d.networkManager == nil {
+		return errors.New("network manager not configured")
+	}
+
+	var payload networkCreatePayload
+	if err := json.Unmarshal(command.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid %s payload: %w", NetworkCreateName, err)
+	}
+
+	payload.Name = strings.TrimSpace(payload.Name)
+	if payload.Name == "" {
+		return errors.New("network.create payload missing name")
+	}
+
+	id, err := d.networkManager.CreateNetwork(
+		ctx,
+		payload.Name,
+		payload.Driver,
+		payload.Subnet,
+		payload.Gateway,
+		payload.Internal,
+		payload.Labels,
+	)
+	if err != nil {
+		return fmt.Errorf("create network %q: %w", payload.Name, err)
+	}
+
+	d.report(command, networkCreateResult{NetworkID: id, Name: payload.Name})
+	log.Printf(
+		"command %q (%s) created network %q (%s)",
+		command.Name,
+		command.ID,
+		payload.Name,
+		id,
+	)
+
+	return nil
+}
+
+func (d *Dispatcher) handleNetworkRemove(ctx context.Context, command *Command) error {
+	if command == nil {
+		return errors.New("command is nil")
+	}
+
+	if d.networkManager == nil {
+		return errors.New("network manager not configured")
+	}
+
+	var payload networkRemovePayload
+	if err := json.Unmarshal(command.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid %s payload: %w", NetworkRemoveName, err)
+	}
+
+	payload.NetworkID = strings.TrimSpace(payload.NetworkID)
+	if payload.NetworkID == "" {
+		return errors.New("network.remove payload missing networkId")
+	}
+
+	if err := d.networkManager.RemoveNetwork(ctx, payload.NetworkID); err != nil {
+		return fmt.Errorf("remove network %q: %w", payload.NetworkID, err)
+	}
+
+	log.Printf(
+		"command %q (%s) removed network %q",
+		command.Name,
+		command.ID,
+		payload.NetworkID,
+	)
+
+	return nil
+}
+
+func (d *Dispatcher) handleNetworkConnect(ctx context.Context, command *Command) error {
+	if command == nil {
+		return errors.New("command is nil")
+	}
+
+	if d.networkManager == nil {
+		return errors.New("network manager not configured")
+	}
+
+	var payload networkConnectPayload
+	if err := json.Unmarshal(command.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid %s payload: %w", NetworkConnectName, err)
+	}
+
+	payload.NetworkID = strings.TrimSpace(payload.NetworkID)
+	if payload.NetworkID == "" {
+		return errors.New("network.connect payload missing networkId")
+	}
+
+	payload.ContainerID = strings.TrimSpace(payload.ContainerID)
+	if payload.ContainerID == "" {
+		return errors.New("network.connect payload missing containerId")
+	}
+
+	err := d.networkManager.ConnectNetwork(
+		ctx,
+		payload.NetworkID,
+		payload.ContainerID,
+		payload.Aliases,
+		payload.IP,
+	)
+	if err != nil {
+		return fmt.Errorf("connect %q to network %q: %w", payload.ContainerID, payload.NetworkID, err)
+	}
+
+	log.Printf(
+		"command %q (%s) connected container %q to network %q",
+		command.Name,
+		command.ID,
+		payload.ContainerID,
+		payload.NetworkID,
+	)
+
+	return nil
+}
+
+func (d *Dispatcher) handleNetworkDisconnect(ctx context.Context, command *Command) error {
+	if command == nil {
+		return errors.New("command is nil")
+	}
+
+	if d.networkManager == nil {
+		return errors.New("network manager not configured")
+	}
+
+	var payload networkDisconnectPayload
+	if err := json.Unmarshal(command.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid %s payload: %w", NetworkDisconnectName, err)
+	}
+
+	payload.NetworkID = strings.TrimSpace(payload.NetworkID)
+	if payload.NetworkID == "" {
+		return errors.New("network.disconnect payload missing networkId")
+	}
+
+	payload.ContainerID = strings.TrimSpace(payload.ContainerID)
+	if payload.ContainerID == "" {
+		return errors.New("network.disconnect payload missing containerId")
+	}
+
+	err := d.networkManager.DisconnectNetwork(ctx, payload.NetworkID, payload.ContainerID, payload.Force)
+	if err != nil {
+		return fmt.Errorf("disconnect %q from network %q: %w", payload.ContainerID, payload.NetworkID, err)
+	}
+
+	log.Printf(
+		"command %q (%s) disconnected container %q from network %q",
+		command.Name,
+		command.ID,
+		payload.ContainerID,
+		payload.NetworkID,
+	)
+
+	return nil
+}
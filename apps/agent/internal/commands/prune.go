@@ -0,0 +1,261 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// Prune payloads are optional. Until is a duration or timestamp as Docker
+// accepts it; labels are key or key=value, with a leading ! to keep matching
+// objects instead.
+
+type containerPrunePayload struct {
+	Until  string   `json:"until"`
+	Labels []string `json:"labels"`
+}
+
+// imagePrunePayload prunes dangling images, or every image no container
+// uses with all set.
+type imagePrunePayload struct {
+	All    bool     `json:"all"`
+	Until  string   `json:"until"`
+	Labels []string `json:"labels"`
+}
+
+// builderPrunePayload prunes build cache not in use, or all of it with all
+// set. Build cache has no labels to filter on.
+type builderPrunePayload struct {
+	All   bool   `json:"all"`
+	Until string `json:"until"`
+}
+
+// systemPrunePayload prunes stopped containers, unused networks, images as
+// image.prune does and build cache, and unused anonymous volumes with
+// volumes set. Until and labels do not apply to volumes.
+type systemPrunePayload struct {
+	All     bool     `json:"all"`
+	Volumes bool     `json:"volumes"`
+	Until   string   `json:"until"`
+	Labels  []string `json:"labels"`
+}
+
+type containerPruneResult struct {
+	ContainersDeleted []string `json:"containersDeleted"`
+	SpaceReclaimed    uint64   `json:"spaceReclaimed"`
+}
+
+type imagePruneResult struct {
+	ImagesDeleted  []string `json:"imagesDeleted"`
+	SpaceReclaimed uint64   `json:"spaceReclaimed"`
+}
+
+type builderPruneResult struct {
+	CachesDeleted  []string `json:"cachesDeleted"`
+	SpaceReclaimed uint64   `json:"spaceReclaimed"`
+}
+
+type systemPruneResult struct {
+	ContainersDeleted []string `json:"containersDeleted"`
+	VolumesDeleted    []string `json:"volumesDeleted"`
+	NetworksDeleted   []string `json:"networksDeleted"`
+	ImagesDeleted     []string `json:"imagesDeleted"`
+	CachesDeleted     []string `json:"cachesDeleted"`
+	SpaceReclaimed    uint64   `json:"spaceReclaimed"`
+}
+
+func (d *Dispatcher) registerPruneHandlers() {
+	d.register(ContainerPruneName, d.handleContainerPrune)
+	d.register(ImagePruneName, d.handleImagePrune)
+	d.register(BuilderPruneName, d.handleBuilderPrune)
+	d.register(SystemPruneName, d.handleSystemPrune)
+}
+
+// decodePrunePayload accepts an empty payload as all defaults.
+func decodePrunePayload(command *Command, payload any) error {
+	if len(command.Payload) == 0 {
+		return nil
+	}
+
+	if err := json.Unmarshal(command.Payload, payload); err != nil {
+		return fmt.Errorf("invalid %s payload: %w", command.Name, err)
+	}
+
+	return nil
+}
+
+func (d *Dispatcher) handleContainerPrune(ctx context.Context, command *Command) error {
+	if command == nil {
+		return errors.New("command is nil")
+	}
+
+	if d.pruner == nil {
+		return errors.New("pruner not configured")
+	}
+
+	var payload containerPrunePayload
+	if err := decodePrunePayload(command, &payload); err != nil {
+		return err
+	}
+
+	return d.runInBackground(ctx, command, func(ctx context.Context) error {
+		deleted, reclaimed, err := d.pruner.PruneContainers(ctx, payload.Until, payload.Labels)
+		if err != nil {
+			return fmt.Errorf("prune containers: %w", err)
+		}
+
+		d.report(command, containerPruneResult{ContainersDeleted: deleted, SpaceReclaimed: reclaimed})
+		log.Printf(
+			"command %q (%s) pruned %d containers, reclaimed %d bytes",
+			command.Name,
+			command.ID,
+			len(deleted),
+			reclaimed,
+		)
+
+		return nil
+	})
+}
+
+func (d *Dispatcher) handleImagePrune(ctx context.Context, command *Command) error {
+	if command == nil {
+		return errors.New("command is nil")
+	}
+
+	if d.pruner == nil {
+		return errors.New("pruner not configured")
+	}
+
+	var payload imagePrunePayload
+	if err := decodePrunePayload(command, &payload); err != nil {
+		return err
+	}
+
+	return d.runInBackground(ctx, command, func(ctx context.Context) error {
+		deleted, reclaimed, err := d.pruner.PruneImages(ctx, payload.All, payload.Until, payload.Labels)
+		if err != nil {
+			return fmt.Errorf("prune images: %w", err)
+		}
+
+		d.report(command, imagePruneResult{ImagesDeleted: deleted, SpaceReclaimed: reclaimed})
+		log.Printf(
+			"command %q (%s) pruned %d images, reclaimed %d bytes",
+			command.Name,
+			command.ID,
+			len(deleted),
+			reclaimed,
+		)
+
+		return nil
+	})
+}
+
+func (d *Dispatcher) handleBuilderPrune(ctx context.Context, command *Command) error {
+	if command == nil {
+		return errors.New("command is nil")
+	}
+
+	if d.pruner == nil {
+		return errors.New("pruner not configured")
+	}
+
+	var payload builderPrunePayload
+	if err := decodePrunePayload(command, &payload); err != nil {
+		return err
+	}
+
+	return d.runInBackground(ctx, command, func(ctx context.Context) error {
+		deleted, reclaimed, err := d.pruner.PruneBuildCache(ctx, payload.All, payload.Until)
+		if err != nil {
+			return fmt.Errorf("prune build cache: %w", err)
+		}
+
+		d.report(command, builderPruneResult{CachesDeleted: deleted, SpaceReclaimed: reclaimed})
+		log.Printf(
+			"command %q (%s) pruned %d build cache records, reclaimed %d bytes",
+			command.Name,
+			command.ID,
+			len(deleted),
+			reclaimed,
+		)
+
+		return nil
+	})
+}
+
+// handleSystemPrune prunes in the order docker system prune does, so
+// objects freed by one step can go in the next. It stops at the first
+// failure.
+func (d *Dispatcher) handleSystemPrune(ctx context.Context, command *Command) error {
+	if command == nil {
+		return errors.New("command is nil")
+	}
+
+	if d.pruner == nil {
+		return errors.New("pruner not configured")
+	}
+
+	var payload systemPrunePayload
+	if err := decodePrunePayload(command, &payload); err != nil {
+		return err
+	}
+
+	if payload.Volumes && d.volumeManager == nil {
+		return errors.New("volume manager not configured")
+	}
+
+	return d.runInBackground(ctx, command, func(ctx context.Context) error {
+		result := systemPruneResult{VolumesDeleted: []string{}}
+
+		deleted, reclaimed, err := d.pruner.PruneContainers(ctx, payload.Until, payload.Labels)
+		if err != nil {
+			return fmt.Errorf("prune containers: %w", err)
+		}
+		result.ContainersDeleted = deleted
+		result.SpaceReclaimed += reclaimed
+
+		if payload.Volumes {
+			deleted, reclaimed, err := d.volumeManager.PruneVolumes(ctx, false)
+			if err != nil {
+				return fmt.Errorf("prune volumes: %w", err)
+			}
+			result.VolumesDeleted = deleted
+			result.SpaceReclaimed += reclaimed
+		}
+
+		if result.NetworksDeleted, err = d.pruner.PruneNetworks(ctx, payload.Until, payload.Labels); err != nil {
+			return fmt.Errorf("prune networks: %w", err)
+		}
+
+		deleted, reclaimed, err = d.pruner.PruneImages(ctx, payload.All, payload.Until, payload.Labels)
+		if err != nil {
+			return fmt.Errorf("prune images: %w", err)
+		}
+		result.ImagesDeleted = deleted
+		result.SpaceReclaimed += reclaimed
+
+		deleted, reclaimed, err = d.pruner.PruneBuildCache(ctx, payload.All, payload.Until)
+		if err != nil {
+			return fmt.Errorf("prune build cache: %w", err)
+		}
+		result.CachesDeleted = deleted
+		result.SpaceReclaimed += reclaimed
+
+		d.report(command, result)
+		log.Printf(
+			"command %q (%s) pruned %d containers, %d volumes, %d networks, %d images and %d build cache records, reclaimed %d bytes",
+			command.Name,
+			command.ID,
+			len(result.ContainersDeleted),
+			len(result.VolumesDeleted),
+			len(result.NetworksDeleted),
+			len(result.ImagesDeleted),
+			len(result.CachesDeleted),
+			result.SpaceReclaimed,
+		)
+
+		return nil
+	})
+}
@@ -4,7 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"log"
+	"os"
 	"strings"
+	"time"
 )
 
 var ErrUnhandledCommand = errors.New("command not handled")
@@ -13,20 +17,222 @@ type ContainerStopper interface {
 	StopContainer(context.Context, string) error
 }
 
+type SnapshotResyncer interface {
+	Resync()
+}
+
+type SnapshotRequester interface {
+	RequestSnapshot(commandID string, kinds []string, ids []string) error
+}
+
+type SnapshotScheduler interface {
+	SetSnapshotInterval(interval time.Duration, ttl time.Duration) error
+}
+
+type EventReplayer interface {
+	ReplayEvents(session string, fromSeq uint64) error
+}
+
+type NetworkManager interface {
+	CreateNetwork(
+		ctx context.Context,
+		name string,
+		driver string,
+		subnet string,
+		gateway string,
+		internal bool,
+		labels map[string]string,
+	) (string, error)
+	RemoveNetwork(ctx context.Context, networkID string) error
+	ConnectNetwork(ctx context.Context, networkID string, containerID string, aliases []string, ip string) error
+	DisconnectNetwork(ctx context.Context, networkID string, containerID string, force bool) error
+}
+
+// VolumeManager manages volumes. BackupVolume and RestoreVolume return once
+// the transfer has started and own target and source from the call on: they
+// close them, aborting with CloseWithError on failure, even when they return
+// an error.
+type VolumeManager interface {
+	CreateVolume(
+		ctx context.Context,
+		name string,
+		driver string,
+		options map[string]string,
+		labels map[string]string,
+	) (string, error)
+	RemoveVolume(ctx context.Context, name string, force bool) error
+	PruneVolumes(ctx context.Context, all bool) ([]string, uint64, error)
+	BackupVolume(
+		ctx context.Context,
+		commandID string,
+		name string,
+		method string,
+		compress bool,
+		target io.WriteCloser,
+	) error
+	RestoreVolume(
+		ctx context.Context,
+		commandID string,
+		name string,
+		method string,
+		checksum string,
+		source io.ReadCloser,
+	) error
+}
+
+// Pruner removes unused Docker objects in bulk. Each call returns what it
+// removed and, where Docker reports it, the bytes reclaimed. Labels are key
+// or key=value filters; a leading ! keeps matching objects instead.
+type Pruner interface {
+	PruneContainers(ctx context.Context, until string, labels []string) ([]string, uint64, error)
+	PruneImages(ctx context.Context, all bool, until string, labels []string) ([]string, uint64, error)
+	PruneNetworks(ctx context.Context, until string, labels []string) ([]string, error)
+	PruneBuildCache(ctx context.Context, all bool, until string) ([]string, uint64, error)
+}
+
+// ImagePuller pulls images. PullImage returns once the pull has started and
+// reports progress and the outcome itself. Without username and password
+// the agent's own registry credentials are used.
+type ImagePuller interface {
+	PullImage(ctx context.Context, commandID string, reference string, username string, password string) error
+}
+
+// ImageRemover removes one image by ID or reference and returns the
+// references untagged and the IDs deleted.
+type ImageRemover interface {
+	RemoveImage(ctx context.Context, ref string, force bool, noPrune bool) ([]string, []string, error)
+}
+
+// StreamOpener opens a byte stream to the server, e.g. to carry a volume
+// archive next to the event traffic.
+type StreamOpener interface {
+	OpenStream(ctx context.Context, kind string, meta any) (io.ReadWriteCloser, error)
+}
+
+// BackgroundRunner runs long commands, e.g. prunes, off the loop commands
+// are dispatched from. The agent keeps running until they are done.
+type BackgroundRunner interface {
+	RunInBackground(func())
+}
+
 type Handler func(context.Context, *Command) error
 
 type Dispatcher struct {
-	handlers         map[string]Handler
-	containerStopper ContainerStopper
+	handlers          map[string]Handler
+	containerStopper  ContainerStopper
+	snapshotResyncer  SnapshotResyncer
+	snapshotRequester SnapshotRequester
+	snapshotScheduler SnapshotScheduler
+	eventReplayer     EventReplayer
+	networkManager    NetworkManager
+	volumeManager     VolumeManager
+	pruner            Pruner
+	imagePuller       ImagePuller
+	imageRemover      ImageRemover
+	streamOpener      StreamOpener
+	backupDir         *os.Root
+	backgroundRunner  BackgroundRunner
+	resultReporter    ResultReporter
+}
+
+type DispatcherOption func(*Dispatcher)
+
+func WithSnapshotResyncer(resyncer SnapshotResyncer) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.snapshotResyncer = resyncer
+	}
+}
+
+func WithSnapshotRequester(requester SnapshotRequester) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.snapshotRequester = requester
+	}
+}
+
+func WithSnapshotScheduler(scheduler SnapshotScheduler) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.snapshotScheduler = scheduler
+	}
 }
 
-func NewDispatcher(containerStopper ContainerStopper) *Dispatcher {
+func WithEventReplayer(replayer EventReplayer) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.eventReplayer = replayer
+	}
+}
+
+func WithNetworkManager(manager NetworkManager) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.networkManager = manager
+	}
+}
+
+func WithVolumeManager(manager VolumeManager) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.volumeManager = manager
+	}
+}
+
+func WithPruner(pruner Pruner) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.pruner = pruner
+	}
+}
+
+func WithImagePuller(puller ImagePuller) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.imagePuller = puller
+	}
+}
+
+func WithImageRemover(remover ImageRemover) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.imageRemover = remover
+	}
+}
+
+func WithStreamOpener(opener StreamOpener) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.streamOpener = opener
+	}
+}
+
+// WithBackupDir confines volume backup and restore paths to dir.
+func WithBackupDir(dir *os.Root) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.backupDir = dir
+	}
+}
+
+func WithBackgroundRunner(runner BackgroundRunner) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.backgroundRunner = runner
+	}
+}
+
+func WithResultReporter(reporter ResultReporter) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.resultReporter = reporter
+	}
+}
+
+func NewDispatcher(containerStopper ContainerStopper, opts ...DispatcherOption) *Dispatcher {
 	dispatcher := &Dispatcher{
 		handlers:         make(map[string]Handler),
 		containerStopper: containerStopper,
 	}
 
+	for _, opt := range opts {
+		opt(dispatcher)
+	}
+
 	dispatcher.registerContainerHandlers()
+	dispatcher.registerSnapshotHandlers()
+	dispatcher.registerEventHandlers()
+	dispatcher.registerNetworkHandlers()
+	dispatcher.registerVolumeHandlers()
+	dispatcher.registerPruneHandlers()
+	dispatcher.registerImageHandlers()
 
 	return dispatcher
 }
@@ -41,7 +247,38 @@ func (d *Dispatcher) Dispatch(ctx context.Context, command *Command) error {
 		return fmt.Errorf("%w: %s", ErrUnhandledCommand, command.Name)
 	}
 
-	return handler(ctx, command)
+	err := handler(ctx, command)
+	switch {
+	case command.deferred:
+	case err != nil && !command.reported:
+		d.reportFailure(command, err)
+	case err == nil && !command.reported:
+		// Tells the server the command succeeded when it has no data.
+		d.report(command, nil)
+	}
+
+	return err
+}
+
+// runInBackground runs a validated command with the background runner and
+// reports its failure, since Dispatch has returned by then. Without a
+// runner the command runs before Dispatch returns.
+func (d *Dispatcher) runInBackground(ctx context.Context, command *Command, run func(context.Context) error) error {
+	if d.backgroundRunner == nil {
+		return run(ctx)
+	}
+
+	command.deferred = true
+	d.backgroundRunner.RunInBackground(func() {
+		if err := run(ctx); err != nil {
+			if !command.reported {
+				d.reportFailure(command, err)
+			}
+			log.Printf("command %q (%s) failed: %v", command.Name, command.ID, err)
+		}
+	})
+
+	return nil
 }
 
 func (d *Dispatcher) register(name string, handler Handler) {
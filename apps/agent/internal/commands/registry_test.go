@@ -4,6 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -94,3 +99,1215 @@ func TestDispatcherDispatch(t *testing.T) {
 		}
 	})
 }
+
+type fakeSnapshotResyncer struct {
+	calls int
+}
+
+func (f *fakeSnapshotResyncer) Resync() {
+	f.calls++
+}
+
+func TestDispatcherSnapshotResync(t *testing.T) {
+	t.Run("requests full snapshot", func(t *testing.T) {
+		resyncer := &fakeSnapshotResyncer{}
+		dispatcher := NewDispatcher(&fakeContainerStopper{}, WithSnapshotResyncer(resyncer))
+
+		err := dispatcher.Dispatch(context.Background(), &Command{
+			ID:      "cmd-1",
+			TS:      time.Now(),
+			Name:    SnapshotResyncName,
+			Payload: json.RawMessage(`{"lastSeq":41}`),
+		})
+		if err != nil {
+			t.Fatalf("Dispatch() unexpected error: %v", err)
+		}
+
+		if resyncer.calls != 1 {
+			t.Fatalf("Resync() calls = %d", resyncer.calls)
+		}
+	})
+
+	t.Run("returns error without resyncer", func(t *testing.T) {
+		dispatcher := NewDispatcher(&fakeContainerStopper{})
+
+		err := dispatcher.Dispatch(context.Background(), &Command{
+			ID:      "cmd-1",
+			TS:      time.Now(),
+			Name:    SnapshotResyncName,
+			Payload: json.RawMessage(`{}`),
+		})
+		if err == nil {
+			t.Fatal("Dispatch() expected error")
+		}
+	})
+}
+
+type fakeSnapshotRequester struct {
+	commandIDs []string
+	kinds      [][]string
+	ids        [][]string
+	err        error
+}
+
+func (f *fakeSnapshotRequester) RequestSnapshot(commandID string, kinds []string, ids []string) error {
+	f.commandIDs = append(f.commandIDs, commandID)
+	f.kinds = append(f.kinds, kinds)
+	f.ids = append(f.ids, ids)
+	return f.err
+}
+
+func TestDispatcherSnapshotRequest(t *testing.T) {
+	t.Run("forwards scope and command id", func(t *testing.T) {
+		requester := &fakeSnapshotRequester{}
+		dispatcher := NewDispatcher(&fakeContainerStopper{}, WithSnapshotRequester(requester))
+
+		err := dispatcher.Dispatch(context.Background(), &Command{
+			ID:      "cmd-7",
+			TS:      time.Now(),
+			Name:    SnapshotRequestName,
+			Payload: json.RawMessage(`{"kinds":["containers"],"ids":["abc123"]}`),
+		})
+		if err != nil {
+			t.Fatalf("Dispatch() unexpected error: %v", err)
+		}
+
+		if len(requester.commandIDs) != 1 || requester.commandIDs[0] != "cmd-7" {
+			t.Fatalf("RequestSnapshot() commandIDs = %v", requester.commandIDs)
+		}
+
+		if len(requester.kinds[0]) != 1 || requester.kinds[0][0] != "containers" {
+			t.Fatalf("RequestSnapshot() kinds = %v", requester.kinds[0])
+		}
+
+		if len(requester.ids[0]) != 1 || requester.ids[0][0] != "abc123" {
+			t.Fatalf("RequestSnapshot() ids = %v", requester.ids[0])
+		}
+	})
+
+	t.Run("returns requester error", func(t *testing.T) {
+		requester := &fakeSnapshotRequester{err: errors.New("queue full")}
+		dispatcher := NewDispatcher(&fakeContainerStopper{}, WithSnapshotRequester(requester))
+
+		err := dispatcher.Dispatch(context.Background(), &Command{
+			ID:      "cmd-7",
+			TS:      time.Now(),
+			Name:    SnapshotRequestName,
+			Payload: json.RawMessage(`{}`),
+		})
+		if err == nil {
+			t.Fatal("Dispatch() expected error")
+		}
+	})
+}
+
+type fakeSnapshotScheduler struct {
+	intervals []time.Duration
+	ttls      []time.Duration
+}
+
+func (f *fakeSnapshotScheduler) SetSnapshotInterval(interval time.Duration, ttl time.Duration) error {
+	f.intervals = append(f.intervals, interval)
+	f.ttls = append(f.ttls, ttl)
+	return nil
+}
+
+func TestDispatcherSnapshotInterval(t *testing.T) {
+	t.Run("converts milliseconds", func(t *testing.T) {
+		scheduler := &fakeSnapshotScheduler{}
+		dispatcher := NewDispatcher(&fakeContainerStopper{}, WithSnapshotScheduler(scheduler))
+
+		err := dispatcher.Dispatch(context.Background(), &Command{
+			ID:      "cmd-8",
+			TS:      time.Now(),
+			Name:    SnapshotIntervalName,
+			Payload: json.RawMessage(`{"intervalMs":5000,"ttlMs":300000}`),
+		})
+		if err != nil {
+			t.Fatalf("Dispatch() unexpected error: %v", err)
+		}
+
+		if len(scheduler.intervals) != 1 || scheduler.intervals[0] != 5*time.Second {
+			t.Fatalf("SetSnapshotInterval() intervals = %v", scheduler.intervals)
+		}
+
+		if scheduler.ttls[0] != 5*time.Minute {
+			t.Fatalf("SetSnapshotInterval() ttl = %s", scheduler.ttls[0])
+		}
+	})
+
+	t.Run("rejects missing or negative interval", func(t *testing.T) {
+		for _, payload := range []string{`{}`, `{"intervalMs":-1}`, `{"intervalMs":1000,"ttlMs":-1}`} {
+			scheduler := &fakeSnapshotScheduler{}
+			dispatcher := NewDispatcher(&fakeContainerStopper{}, WithSnapshotScheduler(scheduler))
+
+			err := dispatcher.Dispatch(context.Background(), &Command{
+				ID:      "cmd-8",
+				TS:      time.Now(),
+				Name:    SnapshotIntervalName,
+				Payload: json.RawMessage(payload),
+			})
+			if err == nil {
+				t.Fatalf("Dispatch(%s) expected error", payload)
+			}
+
+			if len(scheduler.intervals) != 0 {
+				t.Fatalf("SetSnapshotInterval() calls = %d", len(scheduler.intervals))
+			}
+		}
+	})
+}
+
+type fakeEventReplayer struct {
+	sessions []string
+	fromSeqs []uint64
+	err      error
+}
+
+func (f *fakeEventReplayer) ReplayEvents(session string, fromSeq uint64) error {
+	f.sessions = append(f.sessions, session)
+	f.fromSeqs = append(f.fromSeqs, fromSeq)
+	return f.err
+}
+
+func TestDispatcherEventsResync(t *testing.T) {
+	t.Run("replays from sequence", func(t *testing.T) {
+		replayer := &fakeEventReplayer{}
+		resyncer := &fakeSnapshotResyncer{}
+		dispatcher := NewDispatcher(
+			&fakeContainerStopper{},
+			WithEventReplayer(replayer),
+			WithSnapshotResyncer(resyncer),
+		)
+
+		err := dispatcher.Dispatch(context.Background(), &Command{
+			ID:      "cmd-9",
+			TS:      time.Now(),
+			Name:    EventsResyncName,
+			Payload: json.RawMessage(`{"session":"s-1","fromSeq":42}`),
+		})
+		if err != nil {
+			t.Fatalf("Dispatch() unexpected error: %v", err)
+		}
+
+		if len(replayer.fromSeqs) != 1 || replayer.fromSeqs[0] != 42 || replayer.sessions[0] != "s-1" {
+			t.Fatalf("ReplayEvents() calls = %v %v", replayer.sessions, replayer.fromSeqs)
+		}
+
+		if resyncer.calls != 0 {
+			t.Fatalf("Resync() calls = %d", resyncer.calls)
+		}
+	})
+
+	t.Run("falls back to full snapshot", func(t *testing.T) {
+		replayer := &fakeEventReplayer{err: errors.New("events no longer in replay buffer")}
+		resyncer := &fakeSnapshotResyncer{}
+		dispatcher := NewDispatcher(
+			&fakeContainerStopper{},
+			WithEventReplayer(replayer),
+			WithSnapshotResyncer(resyncer),
+		)
+
+		err := dispatcher.Dispatch(context.Background(), &Command{
+			ID:      "cmd-9",
+			TS:      time.Now(),
+			Name:    EventsResyncName,
+			Payload: json.RawMessage(`{"session":"s-1","fromSeq":1}`),
+		})
+		if err != nil {
+			t.Fatalf("Dispatch() unexpected error: %v", err)
+		}
+
+		if resyncer.calls != 1 {
+			t.Fatalf("Resync() calls = %d", resyncer.calls)
+		}
+	})
+
+	t.Run("returns replay error without resyncer", func(t *testing.T) {
+		replayer := &fakeEventReplayer{err: errors.New("replay requested for another session")}
+		dispatcher := NewDispatcher(&fakeContainerStopper{}, WithEventReplayer(replayer))
+
+		err := dispatcher.Dispatch(context.Background(), &Command{
+			ID:      "cmd-9",
+			TS:      time.Now(),
+			Name:    EventsResyncName,
+			Payload: json.RawMessage(`{"session":"s-0","fromSeq":1}`),
+		})
+		if err == nil {
+			t.Fatal("Dispatch() expected error")
+		}
+	})
+
+	t.Run("requires session and fromSeq", func(t *testing.T) {
+		for _, payload := range []string{`{"fromSeq":1}`, `{"session":"s-1"}`} {
+			replayer := &fakeEventReplayer{}
+			dispatcher := NewDispatcher(&fakeContainerStopper{}, WithEventReplayer(replayer))
+
+			err := dispatcher.Dispatch(context.Background(), &Command{
+				ID:      "cmd-9",
+				TS:      time.Now(),
+				Name:    EventsResyncName,
+				Payload: json.RawMessage(payload),
+			})
+			if err == nil {
+				t.Fatalf("Dispatch(%s) expected error", payload)
+			}
+
+			if len(replayer.fromSeqs) != 0 {
+				t.Fatalf("ReplayEvents() calls = %d", len(replayer.fromSeqs))
+			}
+		}
+	})
+}
+
+type networkCall struct {
+	name      string
+	network   string
+	container string
+	driver    string
+	subnet    string
+	aliases   []string
+	ip        string
+	force     bool
+}
+
+type fakeNetworkManager struct {
+	calls []networkCall
+	err   error
+}
+
+func (f *fakeNetworkManager) CreateNetwork(
+	_ context.Context,
+	name string,
+	driver string,
+	subnet string,
+	_ string,
+	_ bool,
+	_ map[string]string,
+) (string, error) {
+	f.calls = append(f.calls, networkCall{name: "create", network: name, driver: driver, subnet: subnet})
+	return "net-1", f.err
+}
+
+func (f *fakeNetworkManager) RemoveNetwork(_ context.Context, networkID string) error {
+	f.calls = append(f.calls, networkCall{name: "remove", network: networkID})
+	return f.err
+}
+
+func (f *fakeNetworkManager) ConnectNetwork(
+	_ context.Context,
+	networkID string,
+	containerID string,
+	aliases []string,
+	ip string,
+) error {
+	f.calls = append(f.calls, networkCall{
+		name:      "connect",
+		network:   networkID,
+		container: containerID,
+		aliases:   aliases,
+		ip:        ip,
+	})
+	return f.err
+}
+
+func (f *fakeNetworkManager) DisconnectNetwork(
+	_ context.Context,
+	networkID string,
+	containerID string,
+	force bool,
+) error {
+	f.calls = append(f.calls, networkCall{name: "disconnect", network: networkID, container: containerID, force: force})
+	return f.err
+}
+
+func TestDispatcherNetworkCommands(t *testing.T) {
+	dispatch := func(d *Dispatcher, name string, payload string) error {
+		return d.Dispatch(context.Background(), &Command{
+			ID:      "cmd-10",
+			TS:      time.Now(),
+			Name:    name,
+			Payload: json.RawMessage(payload),
+		})
+	}
+
+	t.Run("dispatches network commands", func(t *testing.T) {
+		manager := &fakeNetworkManager{}
+		dispatcher := NewDispatcher(&fakeContainerStopper{}, WithNetworkManager(manager))
+
+		commands := []struct {
+			name    string
+			payload string
+		}{
+			{NetworkCreateName, `{"name":" backend ","driver":"bridge","subnet":"10.10.0.0/24"}`},
+			{NetworkConnectName, `{"networkId":"backend","containerId":"api","aliases":["db"],"ip":"10.10.0.5"}`},
+			{NetworkDisconnectName, `{"networkId":"backend","containerId":"api","force":true}`},
+			{NetworkRemoveName, `{"networkId":"backend"}`},
+		}
+		for _, command := range commands {
+			if err := dispatch(dispatcher, command.name, command.payload); err != nil {
+				t.Fatalf("Dispatch(%s) unexpected error: %v", command.name, err)
+			}
+		}
+
+		want := []networkCall{
+			{name: "create", network: "backend", driver: "bridge", subnet: "10.10.0.0/24"},
+			{name: "connect", network: "backend", container: "api", aliases: []string{"db"}, ip: "10.10.0.5"},
+			{name: "disconnect", network: "backend", container: "api", force: true},
+			{name: "remove", network: "backend"},
+		}
+		if len(manager.calls) != len(want) {
+			t.Fatalf("network calls = %+v", manager.calls)
+		}
+		for i := range want {
+			got := manager.calls[i]
+			if got.name != want[i].name || got.network != want[i].network || got.container != want[i].container ||
+				got.driver != want[i].driver || got.subnet != want[i].subnet || got.ip != want[i].ip ||
+				got.force != want[i].force || len(got.aliases) != len(want[i].aliases) {
+				t.Fatalf("network call %d = %+v, want %+v", i, got, want[i])
+			}
+		}
+	})
+
+	t.Run("rejects incomplete payloads", func(t *testing.T) {
+		manager := &fakeNetworkManager{}
+		dispatcher := NewDispatcher(&fakeContainerStopper{}, WithNetworkManager(manager))
+
+		payloads := []struct {
+			name    string
+			payload string
+		}{
+			{NetworkCreateName, `{"driver":"bridge"}`},
+			{NetworkRemoveName, `{"networkId":" "}`},
+			{NetworkConnectName, `{"networkId":"backend"}`},
+			{NetworkDisconnectName, `{"containerId":"api"}`},
+		}
+		for _, command := range payloads {
+			if err := dispatch(dispatcher, command.name, command.payload); err == nil {
+				t.Fatalf("Dispatch(%s, %s) expected error", command.name, command.payload)
+			}
+		}
+
+		if len(manager.calls) != 0 {
+			t.Fatalf("network calls = %+v", manager.calls)
+		}
+	})
+
+	t.Run("wraps manager errors", func(t *testing.T) {
+		conflict := errors.New("network in use")
+		dispatcher := NewDispatcher(&fakeContainerStopper{}, WithNetworkManager(&fakeNetworkManager{err: conflict}))
+
+		err := dispatch(dispatcher, NetworkRemoveName, `{"networkId":"backend"}`)
+		if !errors.Is(err, conflict) {
+			t.Fatalf("Dispatch() error = %v, want %v", err, conflict)
+		}
+	})
+
+	t.Run("reports the created network", func(t *testing.T) {
+		results := &fakeResultReporter{}
+		dispatcher := NewDispatcher(
+			&fakeContainerStopper{},
+			WithNetworkManager(&fakeNetworkManager{}),
+			WithResultReporter(results),
+		)
+
+		if err := dispatch(dispatcher, NetworkCreateName, `{"name":"backend"}`); err != nil {
+			t.Fatalf("Dispatch() unexpected error: %v", err)
+		}
+
+		data, err := json.Marshal(results.results)
+		if err != nil {
+			t.Fatalf("Marshal() unexpected error: %v", err)
+		}
+		want := `[{"commandId":"cmd-10","name":"network.create","data":{"networkId":"net-1","name":"backend"}}]`
+		if string(data) != want {
+			t.Fatalf("results = %s, want %s", data, want)
+		}
+	})
+
+	t.Run("reports failures with their kind", func(t *testing.T) {
+		tests := []struct {
+			err  error
+			want string
+		}{
+			{
+				fakeKindError{kind: "subnet_overlap", message: "subnet overlaps an existing network"},
+				`[{"commandId":"cmd-10","name":"network.create","data":null,"error":{"kind":"subnet_overlap",` +
+					`"message":"create network \"backend\": subnet overlaps an existing network"}}]`,
+			},
+			{
+				errors.New("daemon unavailable"),
+				`[{"commandId":"cmd-10","name":"network.create","data":null,"error":{"kind":"failed",` +
+					`"message":"create network \"backend\": daemon unavailable"}}]`,
+			},
+		}
+		for _, tc := range tests {
+			results := &fakeResultReporter{}
+			dispatcher := NewDispatcher(
+				&fakeContainerStopper{},
+				WithNetworkManager(&fakeNetworkManager{err: tc.err}),
+				WithResultReporter(results),
+			)
+
+			if err := dispatch(dispatcher, NetworkCreateName, `{"name":"backend"}`); !errors.Is(err, tc.err) {
+				t.Fatalf("Dispatch() error = %v, want %v", err, tc.err)
+			}
+
+			data, err := json.Marshal(results.results)
+			if err != nil {
+				t.Fatalf("Marshal() unexpected error: %v", err)
+			}
+			if string(data) != tc.want {
+				t.Fatalf("results = %s, want %s", data, tc.want)
+			}
+		}
+	})
+
+	t.Run("requires a network manager", func(t *testing.T) {
+		dispatcher := NewDispatcher(&fakeContainerStopper{})
+
+		if err := dispatch(dispatcher, NetworkRemoveName, `{"networkId":"backend"}`); err == nil {
+			t.Fatal("Dispatch() expected error")
+		}
+	})
+}
+
+type fakeKindError struct {
+	kind    string
+	message string
+}
+
+func (e fakeKindError) Error() string {
+	return e.message
+}
+
+func (e fakeKindError) ErrorKind() string {
+	return e.kind
+}
+
+type volumeCall struct {
+	name     string
+	volume   string
+	method   string
+	checksum string
+	compress bool
+	force    bool
+	all      bool
+}
+
+type fakeVolumeManager struct {
+	calls  []volumeCall
+	err    error
+	target io.WriteCloser
+	source io.ReadCloser
+}
+
+func (f *fakeVolumeManager) CreateVolume(
+	_ context.Context,
+	name string,
+	_ string,
+	_ map[string]string,
+	_ map[string]string,
+) (string, error) {
+	f.calls = append(f.calls, volumeCall{name: "create", volume: name})
+	return name, f.err
+}
+
+func (f *fakeVolumeManager) RemoveVolume(_ context.Context, name string, force bool) error {
+	f.calls = append(f.calls, volumeCall{name: "remove", volume: name, force: force})
+	return f.err
+}
+
+func (f *fakeVolumeManager) PruneVolumes(_ context.Context, all bool) ([]string, uint64, error) {
+	f.calls = append(f.calls, volumeCall{name: "prune", all: all})
+	return []string{"cache"}, 2048, f.err
+}
+
+func (f *fakeVolumeManager) BackupVolume(
+	_ context.Context,
+	_ string,
+	name string,
+	method string,
+	compress bool,
+	target io.WriteCloser,
+) error {
+	f.calls = append(f.calls, volumeCall{name: "backup", volume: name, method: method, compress: compress})
+	f.target = target
+	// Like the agent, abort what the transfer would have owned.
+	if aborter, ok := target.(interface{ CloseWithError(error) error }); ok && f.err != nil {
+		aborter.CloseWithError(f.err)
+	}
+	return f.err
+}
+
+func (f *fakeVolumeManager) RestoreVolume(
+	_ context.Context,
+	_ string,
+	name string,
+	method string,
+	checksum string,
+	source io.ReadCloser,
+) error {
+	f.calls = append(f.calls, volumeCall{name: "restore", volume: name, method: method, checksum: checksum})
+	f.source = source
+	if aborter, ok := source.(interface{ CloseWithError(error) error }); ok && f.err != nil {
+		aborter.CloseWithError(f.err)
+	}
+	return f.err
+}
+
+type fakeStream struct {
+	io.Reader
+	io.Writer
+	closed  bool
+	aborted error
+}
+
+func (s *fakeStream) Close() error {
+	s.closed = true
+	return nil
+}
+
+func (s *fakeStream) CloseWithError(err error) error {
+	s.aborted = err
+	return nil
+}
+
+type fakeStreamOpener struct {
+	kinds   []string
+	metas   []any
+	streams []*fakeStream
+}
+
+func (f *fakeStreamOpener) OpenStream(_ context.Context, kind string, meta any) (io.ReadWriteCloser, error) {
+	stream := &fakeStream{}
+	f.kinds = append(f.kinds, kind)
+	f.metas = append(f.metas, meta)
+	f.streams = append(f.streams, stream)
+	return stream, nil
+}
+
+func openBackupDir(t *testing.T) *os.Root {
+	t.Helper()
+
+	dir, err := os.OpenRoot(t.TempDir())
+	if err != nil {
+		t.Fatalf("OpenRoot() unexpected error: %v", err)
+	}
+	t.Cleanup(func() { dir.Close() })
+
+	return dir
+}
+
+type fakeBackgroundRunner struct {
+	runs []func()
+}
+
+func (f *fakeBackgroundRunner) RunInBackground(run func()) {
+	f.runs = append(f.runs, run)
+}
+
+type fakeResultReporter struct {
+	results []Result
+}
+
+func (f *fakeResultReporter) ReportResult(result Result) {
+	f.results = append(f.results, result)
+}
+
+func TestDispatcherVolumeCommands(t *testing.T) {
+	dispatch := func(d *Dispatcher, name string, payload string) error {
+		return d.Dispatch(context.Background(), &Command{
+			ID:      "cmd-20",
+			TS:      time.Now(),
+			Name:    name,
+			Payload: json.RawMessage(payload),
+		})
+	}
+
+	t.Run("dispatches volume commands and reports results", func(t *testing.T) {
+		manager := &fakeVolumeManager{}
+		results := &fakeResultReporter{}
+		dispatcher := NewDispatcher(
+			&fakeContainerStopper{},
+			WithVolumeManager(manager),
+			WithResultReporter(results),
+		)
+
+		commands := []struct {
+			name    string
+			payload string
+		}{
+			{VolumeCreateName, `{"name":" uploads ","labels":{"app":"web"}}`},
+			{VolumeRemoveName, `{"name":"uploads","force":true}`},
+			{VolumePruneName, `{"all":true}`},
+		}
+		for _, command := range commands {
+			if err := dispatch(dispatcher, command.name, command.payload); err != nil {
+				t.Fatalf("Dispatch(%s) unexpected error: %v", command.name, err)
+			}
+		}
+
+		want := []volumeCall{
+			{name: "create", volume: "uploads"},
+			{name: "remove", volume: "uploads", force: true},
+			{name: "prune", all: true},
+		}
+		if len(manager.calls) != len(want) {
+			t.Fatalf("volume calls = %+v", manager.calls)
+		}
+		for i := range want {
+			if manager.calls[i] != want[i] {
+				t.Fatalf("volume call %d = %+v, want %+v", i, manager.calls[i], want[i])
+			}
+		}
+
+		if len(results.results) != 3 {
+			t.Fatalf("results = %+v", results.results)
+		}
+		data, err := json.Marshal(results.results[1:])
+		if err != nil {
+			t.Fatalf("Marshal() unexpected error: %v", err)
+		}
+		wantResult := `[{"commandId":"cmd-20","name":"volume.remove","data":null},` +
+			`{"commandId":"cmd-20","name":"volume.prune","data":{"volumesDeleted":["cache"],"spaceReclaimed":2048}}]`
+		if string(data) != wantResult {
+			t.Fatalf("remove and prune results = %s, want %s", data, wantResult)
+		}
+	})
+
+	t.Run("backs up to a stream", func(t *testing.T) {
+		manager := &fakeVolumeManager{}
+		streams := &fakeStreamOpener{}
+		dispatcher := NewDispatcher(
+			&fakeContainerStopper{},
+			WithVolumeManager(manager),
+			WithStreamOpener(streams),
+		)
+
+		payload := `{"name":"data","method":"helper","compress":true,"target":{"stream":true}}`
+		if err := dispatch(dispatcher, VolumeBackupName, payload); err != nil {
+			t.Fatalf("Dispatch() unexpected error: %v", err)
+		}
+
+		if len(streams.kinds) != 1 || streams.kinds[0] != VolumeBackupName {
+			t.Fatalf("opened streams = %v", streams.kinds)
+		}
+		if meta := streams.metas[0].(volumeStreamMeta); meta.CommandID != "cmd-20" || meta.Volume != "data" {
+			t.Fatalf("stream meta = %+v", meta)
+		}
+		if manager.target != streams.streams[0] {
+			t.Fatal("backup target is not the opened stream")
+		}
+		if got := manager.calls[0]; got.method != "helper" || !got.compress {
+			t.Fatalf("backup call = %+v", got)
+		}
+	})
+
+	t.Run("backs up to a new host file", func(t *testing.T) {
+		manager := &fakeVolumeManager{}
+		dir := openBackupDir(t)
+		dispatcher := NewDispatcher(&fakeContainerStopper{}, WithVolumeManager(manager), WithBackupDir(dir))
+
+		payload := `{"name":"data","target":{"path":"data.tar"}}`
+		if err := dispatch(dispatcher, VolumeBackupName, payload); err != nil {
+			t.Fatalf("Dispatch() unexpected error: %v", err)
+		}
+		manager.target.Close()
+
+		if _, err := os.Stat(filepath.Join(dir.Name(), "data.tar")); err != nil {
+			t.Fatalf("backup file: %v", err)
+		}
+		if err := dispatch(dispatcher, VolumeBackupName, payload); err == nil {
+			t.Fatal("Dispatch() expected error for an existing backup file")
+		}
+	})
+
+	t.Run("removes the backup file when the backup cannot start", func(t *testing.T) {
+		manager := &fakeVolumeManager{err: errors.New("volume not found")}
+		dir := openBackupDir(t)
+		dispatcher := NewDispatcher(&fakeContainerStopper{}, WithVolumeManager(manager), WithBackupDir(dir))
+
+		err := dispatch(dispatcher, VolumeBackupName, `{"name":"data","target":{"path":"data.tar"}}`)
+		if !errors.Is(err, manager.err) {
+			t.Fatalf("Dispatch() error = %v, want %v", err, manager.err)
+		}
+		if _, err := os.Stat(filepath.Join(dir.Name(), "data.tar")); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("backup file left behind: %v", err)
+		}
+	})
+
+	t.Run("restores from a stream and aborts it on failure", func(t *testing.T) {
+		manager := &fakeVolumeManager{err: errors.New("unknown transfer method")}
+		streams := &fakeStreamOpener{}
+		dispatcher := NewDispatcher(
+			&fakeContainerStopper{},
+			WithVolumeManager(manager),
+			WithStreamOpener(streams),
+		)
+
+		payload := `{"name":"data","method":"rsync","checksum":"abc","source":{"stream":true}}`
+		if err := dispatch(dispatcher, VolumeRestoreName, payload); !errors.Is(err, manager.err) {
+			t.Fatalf("Dispatch() error = %v, want %v", err, manager.err)
+		}
+
+		if got := manager.calls[0]; got.name != "restore" || got.method != "rsync" || got.checksum != "abc" {
+			t.Fatalf("restore call = %+v", got)
+		}
+		if stream := streams.streams[0]; !errors.Is(stream.aborted, manager.err) {
+			t.Fatalf("stream aborted with %v", stream.aborted)
+		}
+	})
+
+	t.Run("keeps host files inside the backup directory", func(t *testing.T) {
+		manager := &fakeVolumeManager{}
+		dir := openBackupDir(t)
+		outside := t.TempDir()
+		if err := os.WriteFile(filepath.Join(outside, "data.tar"), []byte("archive"), 0o600); err != nil {
+			t.Fatalf("WriteFile() unexpected error: %v", err)
+		}
+		if err := os.Symlink(outside, filepath.Join(dir.Name(), "escape")); err != nil {
+			t.Fatalf("Symlink() unexpected error: %v", err)
+		}
+		dispatcher := NewDispatcher(&fakeContainerStopper{}, WithVolumeManager(manager), WithBackupDir(dir))
+
+		payloads := []struct {
+			name    string
+			payload string
+		}{
+			{VolumeBackupName, `{"name":"data","target":{"path":"` + filepath.Join(outside, "new.tar") + `"}}`},
+			{VolumeBackupName, `{"name":"data","target":{"path":"../new.tar"}}`},
+			{VolumeBackupName, `{"name":"data","target":{"path":"escape/new.tar"}}`},
+			{VolumeRestoreName, `{"name":"data","source":{"path":"escape/data.tar"}}`},
+		}
+		for _, command := range payloads {
+			if err := dispatch(dispatcher, command.name, command.payload); err == nil {
+				t.Fatalf("Dispatch(%s, %s) expected error", command.name, command.payload)
+			}
+		}
+
+		if _, err := os.Stat(filepath.Join(outside, "new.tar")); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("backup written outside the backup directory: %v", err)
+		}
+		if len(manager.calls) != 0 {
+			t.Fatalf("volume calls = %+v", manager.calls)
+		}
+	})
+
+	t.Run("host files need a backup directory", func(t *testing.T) {
+		dispatcher := NewDispatcher(&fakeContainerStopper{}, WithVolumeManager(&fakeVolumeManager{}))
+
+		err := dispatch(dispatcher, VolumeBackupName, `{"name":"data","target":{"path":"data.tar"}}`)
+		if err == nil || err.Error() != "backup directory not configured" {
+			t.Fatalf("Dispatch() error = %v", err)
+		}
+	})
+
+	t.Run("rejects incomplete payloads", func(t *testing.T) {
+		manager := &fakeVolumeManager{}
+		dispatcher := NewDispatcher(
+			&fakeContainerStopper{},
+			WithVolumeManager(manager),
+			WithStreamOpener(&fakeStreamOpener{}),
+			WithBackupDir(openBackupDir(t)),
+		)
+
+		payloads := []struct {
+			name    string
+			payload string
+		}{
+			{VolumeCreateName, `{"driver":"local"}`},
+			{VolumeRemoveName, `{"name":" "}`},
+			{VolumeBackupName, `{"name":"data"}`},
+			{VolumeBackupName, `{"name":"data","target":{"path":"data.tar","stream":true}}`},
+			{VolumeBackupName, `{"name":"data","target":{"path":"/tmp/data.tar"}}`},
+			{VolumeRestoreName, `{"source":{"stream":true}}`},
+		}
+		for _, command := range payloads {
+			if err := dispatch(dispatcher, command.name, command.payload); err == nil {
+				t.Fatalf("Dispatch(%s, %s) expected error", command.name, command.payload)
+			}
+		}
+
+		if len(manager.calls) != 0 {
+			t.Fatalf("volume calls = %+v", manager.calls)
+		}
+	})
+
+	t.Run("stream targets need a stream opener", func(t *testing.T) {
+		dispatcher := NewDispatcher(&fakeContainerStopper{}, WithVolumeManager(&fakeVolumeManager{}))
+
+		err := dispatch(dispatcher, VolumeBackupName, `{"name":"data","target":{"stream":true}}`)
+		if err == nil {
+			t.Fatal("Dispatch() expected error")
+		}
+	})
+
+	t.Run("requires a volume manager", func(t *testing.T) {
+		dispatcher := NewDispatcher(&fakeContainerStopper{})
+
+		if err := dispatch(dispatcher, VolumePruneName, `{}`); err == nil {
+			t.Fatal("Dispatch() expected error")
+		}
+	})
+}
+
+type pruneCall struct {
+	name   string
+	all    bool
+	until  string
+	labels string
+}
+
+type fakePruner struct {
+	calls []pruneCall
+	fail  string
+}
+
+func (f *fakePruner) record(name string, all bool, until string, labels []string) error {
+	f.calls = append(f.calls, pruneCall{name: name, all: all, until: until, labels: strings.Join(labels, ",")})
+	if name == f.fail {
+		return errors.New("daemon busy")
+	}
+	return nil
+}
+
+func (f *fakePruner) PruneContainers(_ context.Context, until string, labels []string) ([]string, uint64, error) {
+	return []string{"c1"}, 100, f.record("containers", false, until, labels)
+}
+
+func (f *fakePruner) PruneImages(_ context.Context, all bool, until string, labels []string) ([]string, uint64, error) {
+	return []string{"sha256:i1", "sha256:i2"}, 1000, f.record("images", all, until, labels)
+}
+
+func (f *fakePruner) PruneNetworks(_ context.Context, until string, labels []string) ([]string, error) {
+	return []string{"n1"}, f.record("networks", false, until, labels)
+}
+
+func (f *fakePruner) PruneBuildCache(_ context.Context, all bool, until string) ([]string, uint64, error) {
+	return []string{"b1"}, 10, f.record("builder", all, until, nil)
+}
+
+func TestDispatcherPruneCommands(t *testing.T) {
+	dispatch := func(d *Dispatcher, name string, payload string) error {
+		return d.Dispatch(context.Background(), &Command{
+			ID:      "cmd-30",
+			TS:      time.Now(),
+			Name:    name,
+			Payload: json.RawMessage(payload),
+		})
+	}
+
+	t.Run("passes filters and reports what was removed", func(t *testing.T) {
+		pruner := &fakePruner{}
+		results := &fakeResultReporter{}
+		dispatcher := NewDispatcher(&fakeContainerStopper{}, WithPruner(pruner), WithResultReporter(results))
+
+		commands := []struct {
+			name    string
+			payload string
+			want    pruneCall
+			result  string
+		}{
+			{
+				ContainerPruneName,
+				`{"until":"24h","labels":["env=dev"]}`,
+				pruneCall{name: "containers", until: "24h", labels: "env=dev"},
+				`{"containersDeleted":["c1"],"spaceReclaimed":100}`,
+			},
+			{
+				ImagePruneName,
+				`{"all":true,"labels":["!keep"]}`,
+				pruneCall{name: "images", all: true, labels: "!keep"},
+				`{"imagesDeleted":["sha256:i1","sha256:i2"],"spaceReclaimed":1000}`,
+			},
+			{
+				BuilderPruneName,
+				`{}`,
+				pruneCall{name: "builder"},
+				`{"cachesDeleted":["b1"],"spaceReclaimed":10}`,
+			},
+		}
+		for i, command := range commands {
+			if err := dispatch(dispatcher, command.name, command.payload); err != nil {
+				t.Fatalf("Dispatch(%s) unexpected error: %v", command.name, err)
+			}
+			if pruner.calls[i] != command.want {
+				t.Fatalf("prune call = %+v, want %+v", pruner.calls[i], command.want)
+			}
+
+			data, err := json.Marshal(results.results[i].Data)
+			if err != nil {
+				t.Fatalf("Marshal() unexpected error: %v", err)
+			}
+			if string(data) != command.result {
+				t.Fatalf("%s result = %s, want %s", command.name, data, command.result)
+			}
+		}
+	})
+
+	t.Run("system prune runs every step and sums reclaimed space", func(t *testing.T) {
+		pruner := &fakePruner{}
+		volumes := &fakeVolumeManager{}
+		results := &fakeResultReporter{}
+		dispatcher := NewDispatcher(
+			&fakeContainerStopper{},
+			WithPruner(pruner),
+			WithVolumeManager(volumes),
+			WithResultReporter(results),
+		)
+
+		if err := dispatch(dispatcher, SystemPruneName, `{"all":true,"volumes":true,"until":"1h"}`); err != nil {
+			t.Fatalf("Dispatch() unexpected error: %v", err)
+		}
+
+		var steps []string
+		for _, call := range pruner.calls {
+			steps = append(steps, call.name)
+		}
+		if strings.Join(steps, ",") != "containers,networks,images,builder" || !pruner.calls[2].all {
+			t.Fatalf("prune calls = %+v", pruner.calls)
+		}
+		if len(volumes.calls) != 1 || volumes.calls[0] != (volumeCall{name: "prune"}) {
+			t.Fatalf("volume calls = %+v", volumes.calls)
+		}
+
+		data, err := json.Marshal(results.results[0].Data)
+		if err != nil {
+			t.Fatalf("Marshal() unexpected error: %v", err)
+		}
+		want := `{"containersDeleted":["c1"],"volumesDeleted":["cache"],"networksDeleted":["n1"],` +
+			`"imagesDeleted":["sha256:i1","sha256:i2"],"cachesDeleted":["b1"],"spaceReclaimed":3158}`
+		if string(data) != want {
+			t.Fatalf("system prune result = %s, want %s", data, want)
+		}
+	})
+
+	t.Run("system prune stops at the first failure", func(t *testing.T) {
+		pruner := &fakePruner{fail: "networks"}
+		results := &fakeResultReporter{}
+		dispatcher := NewDispatcher(&fakeContainerStopper{}, WithPruner(pruner), WithResultReporter(results))
+
+		err := dispatch(dispatcher, SystemPruneName, `{}`)
+		if err == nil || !strings.Contains(err.Error(), "prune networks") {
+			t.Fatalf("Dispatch() error = %v", err)
+		}
+		if len(pruner.calls) != 2 || len(results.results) != 1 || results.results[0].Data != nil ||
+			results.results[0].Error == nil || results.results[0].Error.Kind != "failed" {
+			t.Fatalf("prune calls = %+v, results = %+v", pruner.calls, results.results)
+		}
+	})
+
+	t.Run("prunes in the background", func(t *testing.T) {
+		pruner := &fakePruner{fail: "images"}
+		runner := &fakeBackgroundRunner{}
+		results := &fakeResultReporter{}
+		dispatcher := NewDispatcher(
+			&fakeContainerStopper{},
+			WithPruner(pruner),
+			WithBackgroundRunner(runner),
+			WithResultReporter(results),
+		)
+
+		for _, name := range []string{ContainerPruneName, ImagePruneName} {
+			if err := dispatch(dispatcher, name, `{}`); err != nil {
+				t.Fatalf("Dispatch(%s) unexpected error: %v", name, err)
+			}
+		}
+		if len(pruner.calls) != 0 || len(runner.runs) != 2 {
+			t.Fatalf("prune calls = %+v, background runs = %d", pruner.calls, len(runner.runs))
+		}
+
+		for _, run := range runner.runs {
+			run()
+		}
+
+		data, err := json.Marshal(results.results)
+		if err != nil {
+			t.Fatalf("Marshal() unexpected error: %v", err)
+		}
+		want := `[{"commandId":"cmd-30","name":"container.prune","data":{"containersDeleted":["c1"],"spaceReclaimed":100}},` +
+			`{"commandId":"cmd-30","name":"image.prune","data":null,"error":{"kind":"failed","message":"prune images: daemon busy"}}]`
+		if string(data) != want {
+			t.Fatalf("results = %s, want %s", data, want)
+		}
+	})
+
+	t.Run("rejects missing dependencies", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			opts    []DispatcherOption
+			payload string
+			message string
+		}{
+			{"no pruner", nil, `{}`, "pruner not configured"},
+			{"volumes without a volume manager", []DispatcherOption{WithPruner(&fakePruner{})}, `{"volumes":true}`, "volume manager not configured"},
+		}
+
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				dispatcher := NewDispatcher(&fakeContainerStopper{}, tc.opts...)
+				err := dispatch(dispatcher, SystemPruneName, tc.payload)
+				if err == nil || !strings.Contains(err.Error(), tc.message) {
+					t.Fatalf("Dispatch() error = %v, want %q", err, tc.message)
+				}
+			})
+		}
+	})
+}
+
+type imagePullCall struct {
+	commandID string
+	reference string
+	username  string
+	password  string
+}
+
+type fakeImagePuller struct {
+	calls []imagePullCall
+}
+
+func (f *fakeImagePuller) PullImage(_ context.Context, commandID string, reference string, username string, password string) error {
+	f.calls = append(f.calls, imagePullCall{commandID, reference, username, password})
+	return nil
+}
+
+func TestDispatcherImagePull(t *testing.T) {
+	dispatch := func(d *Dispatcher, payload string) error {
+		return d.Dispatch(context.Background(), &Command{
+			ID:      "cmd-40",
+			TS:      time.Now(),
+			Name:    ImagePullName,
+			Payload: json.RawMessage(payload),
+		})
+	}
+
+	t.Run("pulls registry, name and tag", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			payload string
+			want    imagePullCall
+		}{
+			{
+				"anonymous",
+				`{"registry":"docker.io","name":"library/nginx","tag":"1.27-alpine"}`,
+				imagePullCall{"cmd-40", "docker.io/library/nginx:1.27-alpine", "", ""},
+			},
+			{
+				"with credentials",
+				`{"registry":"ghcr.io/","name":"acme/api","tag":"v2.1.0","auth":{"username":"ci","password":"token"}}`,
+				imagePullCall{"cmd-40", "ghcr.io/acme/api:v2.1.0", "ci", "token"},
+			},
+		}
+
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				puller := &fakeImagePuller{}
+				dispatcher := NewDispatcher(&fakeContainerStopper{}, WithImagePuller(puller))
+
+				if err := dispatch(dispatcher, tc.payload); err != nil {
+					t.Fatalf("Dispatch() unexpected error: %v", err)
+				}
+				if len(puller.calls) != 1 || puller.calls[0] != tc.want {
+					t.Fatalf("pull calls = %+v, want %+v", puller.calls, tc.want)
+				}
+			})
+		}
+	})
+
+	t.Run("rejects what pullImageSchema rejects", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			payload string
+			message string
+		}{
+			{"missing registry", `{"name":"nginx","tag":"latest"}`, "missing registry"},
+			{"missing tag", `{"registry":"docker.io","name":"nginx"}`, "missing tag"},
+			{"uppercase name", `{"registry":"docker.io","name":"Nginx","tag":"latest"}`, "invalid name"},
+			{"digest as tag", `{"registry":"docker.io","name":"nginx","tag":"sha256:abc"}`, "invalid tag"},
+			{"half credentials", `{"registry":"docker.io","name":"nginx","tag":"latest","auth":{"username":"ci"}}`, "needs username and password"},
+		}
+
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				puller := &fakeImagePuller{}
+				dispatcher := NewDispatcher(&fakeContainerStopper{}, WithImagePuller(puller))
+
+				err := dispatch(dispatcher, tc.payload)
+				if err == nil || !strings.Contains(err.Error(), tc.message) {
+					t.Fatalf("Dispatch() error = %v, want %q", err, tc.message)
+				}
+				if len(puller.calls) != 0 {
+					t.Fatalf("pull calls = %+v", puller.calls)
+				}
+			})
+		}
+	})
+
+	t.Run("not configured", func(t *testing.T) {
+		dispatcher := NewDispatcher(&fakeContainerStopper{})
+		err := dispatch(dispatcher, `{"registry":"docker.io","name":"nginx","tag":"latest"}`)
+		if err == nil || err.Error() != "image puller not configured" {
+			t.Fatalf("Dispatch() error = %v", err)
+		}
+	})
+}
+
+type fakeImageRemover struct {
+	calls []string
+}
+
+func (f *fakeImageRemover) RemoveImage(_ context.Context, ref string, force bool, noPrune bool) ([]string, []string, error) {
+	f.calls = append(f.calls, fmt.Sprintf("%s force=%t noPrune=%t", ref, force, noPrune))
+	if ref == "busy" {
+		return nil, nil, errors.New("image in use")
+	}
+	return []string{ref + ":latest"}, []string{"sha256:" + ref}, nil
+}
+
+func TestDispatcherImageRemove(t *testing.T) {
+	dispatch := func(d *Dispatcher, payload string) error {
+		return d.Dispatch(context.Background(), &Command{
+			ID:      "cmd-50",
+			TS:      time.Now(),
+			Name:    ImageRemoveName,
+			Payload: json.RawMessage(payload),
+		})
+	}
+
+	t.Run("reports each image and fails when any failed", func(t *testing.T) {
+		remover := &fakeImageRemover{}
+		results := &fakeResultReporter{}
+		dispatcher := NewDispatcher(&fakeContainerStopper{}, WithImageRemover(remover), WithResultReporter(results))
+
+		err := dispatch(dispatcher, `{"images":["web"," busy ","web",""],"force":true,"noPrune":true}`)
+		if err == nil || !strings.Contains(err.Error(), `remove image "busy"`) {
+			t.Fatalf("Dispatch() error = %v", err)
+		}
+
+		if strings.Join(remover.calls, ";") != "web force=true noPrune=true;busy force=true noPrune=true" {
+			t.Fatalf("remove calls = %v", remover.calls)
+		}
+
+		if len(results.results) != 1 || results.results[0].Error != nil {
+			t.Fatalf("results = %+v, want only the removal result", results.results)
+		}
+		data, err := json.Marshal(results.results[0].Data)
+		if err != nil {
+			t.Fatalf("Marshal() unexpected error: %v", err)
+		}
+		want := `{"images":[{"image":"web","untagged":["web:latest"],"deleted":["sha256:web"]},` +
+			`{"image":"busy","untagged":[],"deleted":[],"error":"image in use"}]}`
+		if string(data) != want {
+			t.Fatalf("result = %s, want %s", data, want)
+		}
+	})
+
+	t.Run("rejects an empty list", func(t *testing.T) {
+		dispatcher := NewDispatcher(&fakeContainerStopper{}, WithImageRemover(&fakeImageRemover{}))
+		err := dispatch(dispatcher, `{"images":[" "]}`)
+		if err == nil || err.Error() != "image.remove payload missing images" {
+			t.Fatalf("Dispatch() error = %v", err)
+		}
+	})
+}
@@ -0,0 +1,64 @@
+package commands
+
+import "errors"
+
+// ResultEventType is the event type results are sent as.
+const ResultEventType = "command.result"
+
+// failedErrorKind is the kind of errors that do not name one.
+const failedErrorKind = "failed"
+
+// Result is sent for every dispatched command. It carries the data the
+// command produced, e.g. the name of a created volume, null for commands
+// without data, or Error instead of data when the command failed.
+type Result struct {
+	CommandID string       `json:"commandId"`
+	Name      string       `json:"name"`
+	Data      any          `json:"data"`
+	Error     *ResultError `json:"error,omitempty"`
+}
+
+// ResultError says why a command failed. Kind is stable for the server to
+// match on, e.g. subnet_overlap; Message is for people.
+type ResultError struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+type ResultReporter interface {
+	ReportResult(Result)
+}
+
+func (d *Dispatcher) report(command *Command, data any) {
+	command.reported = true
+	if d.resultReporter == nil {
+		return
+	}
+
+	d.resultReporter.ReportResult(Result{
+		CommandID: command.ID,
+		Name:      command.Name,
+		Data:      data,
+	})
+}
+
+// reportFailure reports err with the kind of the first error in its chain
+// that has an ErrorKind method.
+func (d *Dispatcher) reportFailure(command *Command, err error) {
+	command.reported = true
+	if d.resultReporter == nil {
+		return
+	}
+
+	kind := failedErrorKind
+	var kinded interface{ ErrorKind() string }
+	if errors.As(err, &kinded) {
+		kind = kinded.ErrorKind()
+	}
+
+	d.resultReporter.ReportResult(Result{
+		CommandID: command.ID,
+		Name:      command.Name,
+		Error:     &ResultError{Kind: kind, Message: err.Error()},
+	})
+}
@@ -0,0 +1,134 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+type snapshotResyncPayload struct {
+	LastSeq *uint64 `json:"lastSeq"`
+}
+
+// snapshotRequestPayload scopes a snapshot.request. Kinds holds any of
+// "containers", "images", "networks" and "volumes"; empty kinds and ids ask
+// for a full snapshot.
+type snapshotRequestPayload struct {
+	Kinds []string `json:"kinds"`
+	IDs   []string `json:"ids"`
+}
+
+// snapshotIntervalPayload sets the periodic snapshot interval. An intervalMs
+// of 0 restores the agent default; ttlMs, when set, reverts the change after
+// that long.
+type snapshotIntervalPayload struct {
+	IntervalMs *int64 `json:"intervalMs"`
+	TTLMs      int64  `json:"ttlMs"`
+}
+
+func (d *Dispatcher) registerSnapshotHandlers() {
+	d.register(SnapshotResyncName, d.handleSnapshotResync)
+	d.register(SnapshotRequestName, d.handleSnapshotRequest)
+	d.register(SnapshotIntervalName, d.handleSnapshotInterval)
+}
+
+func (d *Dispatcher) handleSnapshotResync(_ context.Context, command *Command) error {
+	if command == nil {
+		return errors.New("command is nil")
+	}
+
+	if d.snapshotResyncer == nil {
+		return errors.New("snapshot resyncer not configured")
+	}
+
+	var payload snapshotResyncPayload
+	if err := json.Unmarshal(command.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid %s payload: %w", SnapshotResyncName, err)
+	}
+
+	d.snapshotResyncer.Resync()
+
+	if payload.LastSeq != nil {
+		log.Printf(
+			"command %q (%s) requested full snapshot after seq %d",
+			command.Name,
+			command.ID,
+			*payload.LastSeq,
+		)
+		return nil
+	}
+
+	log.Printf("command %q (%s) requested full snapshot", command.Name, command.ID)
+	return nil
+}
+
+func (d *Dispatcher) handleSnapshotRequest(_ context.Context, command *Command) error {
+	if command == nil {
+		return errors.New("command is nil")
+	}
+
+	if d.snapshotRequester == nil {
+		return errors.New("snapshot requester not configured")
+	}
+
+	var payload snapshotRequestPayload
+	if err := json.Unmarshal(command.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid %s payload: %w", SnapshotRequestName, err)
+	}
+
+	if err := d.snapshotRequester.RequestSnapshot(command.ID, payload.Kinds, payload.IDs); err != nil {
+		return fmt.Errorf("request snapshot: %w", err)
+	}
+
+	log.Printf(
+		"command %q (%s) requested snapshot (kinds=%v ids=%d)",
+		command.Name,
+		command.ID,
+		payload.Kinds,
+		len(payload.IDs),
+	)
+
+	return nil
+}
+
+func (d *Dispatcher) handleSnapshotInterval(_ context.Context, command *Command) error {
+	if command == nil {
+		return errors.New("command is nil")
+	}
+
+	if d.snapshotScheduler == nil {
+		return errors.New("snapshot scheduler not configured")
+	}
+
+	var payload snapshotIntervalPayload
+	if err := json.Unmarshal(command.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid %s payload: %w", SnapshotIntervalName, err)
+	}
+
+	if payload.IntervalMs == nil {
+		return errors.New("snapshot.interval payload missing intervalMs")
+	}
+
+	if *payload.IntervalMs < 0 || payload.TTLMs < 0 {
+		return errors.New("snapshot.interval payload must not be negative")
+	}
+
+	interval := time.Duration(*payload.IntervalMs) * time.Millisecond
+	ttl := time.Duration(payload.TTLMs) * time.Millisecond
+	if err := d.snapshotScheduler.SetSnapshotInterval(interval, ttl); err != nil {
+		return fmt.Errorf("set snapshot interval: %w", err)
+	}
+
+	log.Printf(
+		"command %q (%s) set snapshot interval to %s (ttl %s)",
+		command.Name,
+		command.ID,
+		interval,
+		ttl,
+	)
+
+	return nil
+}
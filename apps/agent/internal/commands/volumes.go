@@ -0,0 +1,379 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sonomandeep/containers/agent/internal/env"
+)
+
+// volumeCreatePayload creates a volume. Driver defaults to local; options
+// are driver specific.
+type volumeCreatePayload struct {
+	Name    string            `json:"name"`
+	Driver  string            `json:"driver"`
+	Options map[string]string `json:"options"`
+	Labels  map[string]string `json:"labels"`
+}
+
+type volumeRemovePayload struct {
+	Name  string `json:"name"`
+	Force bool   `json:"force"`
+}
+
+// volumePrunePayload prunes unused volumes; named ones only with all set.
+type volumePrunePayload struct {
+	All bool `json:"all"`
+}
+
+const (
+	volumeBackupDirEnv     = "AGENT_VOLUME_BACKUP_DIR"
+	defaultVolumeBackupDir = "/var/lib/containers-agent/backups"
+)
+
+// volumeArchiveLocation is where a backup goes or a restore comes from: a
+// path inside the agent's backup directory, or a stream the agent opens to
+// the server when stream is set.
+type volumeArchiveLocation struct {
+	Path   string `json:"path"`
+	Stream bool   `json:"stream"`
+}
+
+// volumeBackupPayload archives a volume. Method is auto, direct (read the
+// mountpoint) or helper (copy through a temporary container).
+type volumeBackupPayload struct {
+	Name     string                `json:"name"`
+	Method   string                `json:"method"`
+	Compress bool                  `json:"compress"`
+	Target   volumeArchiveLocation `json:"target"`
+}
+
+// volumeRestorePayload unpacks an archive into a volume. Checksum, a hex
+// sha256 of the archive, is verified before anything is written.
+type volumeRestorePayload struct {
+	Name     string                `json:"name"`
+	Method   string                `json:"method"`
+	Checksum string                `json:"checksum"`
+	Source   volumeArchiveLocation `json:"source"`
+}
+
+// volumeStreamMeta identifies the archive on a volume.backup or
+// volume.restore stream.
+type volumeStreamMeta struct {
+	CommandID string `json:"commandId"`
+	Volume    string `json:"volume"`
+}
+
+type volumeCreateResult struct {
+	Name string `json:"name"`
+}
+
+type volumePruneResult struct {
+	VolumesDeleted []string `json:"volumesDeleted"`
+	SpaceReclaimed uint64   `json:"spaceReclaimed"`
+}
+
+func (d *Dispatcher) registerVolumeHandlers() {
+	d.register(VolumeCreateName, d.handleVolumeCreate)
+	d.register(VolumeRemoveName, d.handleVolumeRemove)
+	d.register(VolumePruneName, d.handleVolumePrune)
+	d.register(VolumeBackupName, d.handleVolumeBackup)
+	d.register(VolumeRestoreName, d.handleVolumeRestore)
+}
+
+func (d *Dispatcher) handleVolumeCreate(ctx context.Context, command *Command) error {
+	if command == nil {
+		return errors.New("command is nil")
+	}
+
+	if d.volumeManager == nil {
+		return errors.New("volume manager not configured")
+	}
+
+	var payload volumeCreatePayload
+	if err := json.Unmarshal(command.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid %s payload: %w", VolumeCreateName, err)
+	}
+
+	payload.Name = strings.TrimSpace(payload.Name)
+	if payload.Name == "" {
+		return errors.New("volume.create payload missing name")
+	}
+
+	name, err := d.volumeManager.CreateVolume(ctx, payload.Name, payload.Driver, payload.Options, payload.Labels)
+	if err != nil {
+		return fmt.Errorf("create volume %q: %w", payload.Name, err)
+	}
+
+	d.report(command, volumeCreateResult{Name: name})
+	log.Printf("command %q (%s) created volume %q", command.Name, command.ID, name)
+
+	return nil
+}
+
+func (d *Dispatcher) handleVolumeRemove(ctx context.Context, command *Command) error {
+	if command == nil {
+		return errors.New("command is nil")
+	}
+
+	if d.volumeManager == nil {
+		return errors.New("volume manager not configured")
+	}
+
+	var payload volumeRemovePayload
+	if err := json.Unmarshal(command.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid %s payload: %w", VolumeRemoveName, err)
+	}
+
+	payload.Name = strings.TrimSpace(payload.Name)
+	if payload.Name == "" {
+		return errors.New("volume.remove payload missing name")
+	}
+
+	if err := d.volumeManager.RemoveVolume(ctx, payload.Name, payload.Force); err != nil {
+		return fmt.Errorf("remove volume %q: %w", payload.Name, err)
+	}
+
+	log.Printf("command %q (%s) removed volume %q", command.Name, command.ID, payload.Name)
+
+	return nil
+}
+
+func (d *Dispatcher) handleVolumePrune(ctx context.Context, command *Command) error {
+	if command == nil {
+		return errors.New("command is nil")
+	}
+
+	if d.volumeManager == nil {
+		return errors.New("volume manager not configured")
+	}
+
+	var payload volumePrunePayload
+	if len(command.Payload) > 0 {
+		if err := json.Unmarshal(command.Payload, &payload); err != nil {
+			return fmt.Errorf("invalid %s payload: %w", VolumePruneName, err)
+		}
+	}
+
+	return d.runInBackground(ctx, command, func(ctx context.Context) error {
+		deleted, reclaimed, err := d.volumeManager.PruneVolumes(ctx, payload.All)
+		if err != nil {
+			return fmt.Errorf("prune volumes: %w", err)
+		}
+
+		d.report(command, volumePruneResult{VolumesDeleted: deleted, SpaceReclaimed: reclaimed})
+		log.Printf(
+			"command %q (%s) pruned %d volumes, reclaimed %d bytes",
+			command.Name,
+			command.ID,
+			len(deleted),
+			reclaimed,
+		)
+
+		return nil
+	})
+}
+
+func (d *Dispatcher) handleVolumeBackup(ctx context.Context, command *Command) error {
+	if command == nil {
+		return errors.New("command is nil")
+	}
+
+	if d.volumeManager == nil {
+		return errors.New("volume manager not configured")
+	}
+
+	var payload volumeBackupPayload
+	if err := json.Unmarshal(command.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid %s payload: %w", VolumeBackupName, err)
+	}
+
+	payload.Name = strings.TrimSpace(payload.Name)
+	if payload.Name == "" {
+		return errors.New("volume.backup payload missing name")
+	}
+
+	if err := d.checkArchiveLocation(VolumeBackupName, "target", &payload.Target); err != nil {
+		return err
+	}
+
+	var target io.WriteCloser
+	if payload.Target.Stream {
+		stream, err := d.openVolumeStream(ctx, command, payload.Name)
+		if err != nil {
+			return err
+		}
+		target = stream
+	} else {
+		// Never overwrite an earlier backup.
+		file, err := d.backupDir.OpenFile(payload.Target.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			return fmt.Errorf("create backup file: %w", err)
+		}
+		target = &backupFile{File: file, dir: d.backupDir, path: payload.Target.Path}
+	}
+
+	err := d.volumeManager.BackupVolume(
+		ctx,
+		command.ID,
+		payload.Name,
+		payload.Method,
+		payload.Compress,
+		target,
+	)
+	if err != nil {
+		return fmt.Errorf("backup volume %q: %w", payload.Name, err)
+	}
+
+	log.Printf(
+		"command %q (%s) backing up volume %q to %s",
+		command.Name,
+		command.ID,
+		payload.Name,
+		payload.Target,
+	)
+
+	return nil
+}
+
+func (d *Dispatcher) handleVolumeRestore(ctx context.Context, command *Command) error {
+	if command == nil {
+		return errors.New("command is nil")
+	}
+
+	if d.volumeManager == nil {
+		return errors.New("volume manager not configured")
+	}
+
+	var payload volumeRestorePayload
+	if err := json.Unmarshal(command.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid %s payload: %w", VolumeRestoreName, err)
+	}
+
+	payload.Name = strings.TrimSpace(payload.Name)
+	if payload.Name == "" {
+		return errors.New("volume.restore payload missing name")
+	}
+
+	if err := d.checkArchiveLocation(VolumeRestoreName, "source", &payload.Source); err != nil {
+		return err
+	}
+
+	var source io.ReadCloser
+	if payload.Source.Stream {
+		stream, err := d.openVolumeStream(ctx, command, payload.Name)
+		if err != nil {
+			return err
+		}
+		source = stream
+	} else {
+		file, err := d.backupDir.Open(payload.Source.Path)
+		if err != nil {
+			return fmt.Errorf("open backup file: %w", err)
+		}
+		source = file
+	}
+
+	err := d.volumeManager.RestoreVolume(
+		ctx,
+		command.ID,
+		payload.Name,
+		payload.Method,
+		payload.Checksum,
+		source,
+	)
+	if err != nil {
+		return fmt.Errorf("restore volume %q: %w", payload.Name, err)
+	}
+
+	log.Printf(
+		"command %q (%s) restoring volume %q from %s",
+		command.Name,
+		command.ID,
+		payload.Name,
+		payload.Source,
+	)
+
+	return nil
+}
+
+// checkArchiveLocation requires exactly one of path and stream, and a path
+// that stays inside the backup directory. The directory's os.Root also
+// refuses symlinks that lead out of it.
+func (d *Dispatcher) checkArchiveLocation(name string, field string, location *volumeArchiveLocation) error {
+	location.Path = strings.TrimSpace(location.Path)
+
+	switch {
+	case location.Path == "" && !location.Stream:
+		return fmt.Errorf("%s payload missing %s", name, field)
+	case location.Path != "" && location.Stream:
+		return fmt.Errorf("%s payload %s takes a path or a stream, not both", name, field)
+	case location.Stream && d.streamOpener == nil:
+		return errors.New("stream opener not configured")
+	case location.Path != "" && d.backupDir == nil:
+		return errors.New("backup directory not configured")
+	case location.Path != "" && !filepath.IsLocal(location.Path):
+		return fmt.Errorf("%s payload %s path %q is not inside the backup directory", name, field, location.Path)
+	}
+
+	return nil
+}
+
+func (d *Dispatcher) openVolumeStream(ctx context.Context, command *Command, volume string) (io.ReadWriteCloser, error) {
+	stream, err := d.streamOpener.OpenStream(ctx, command.Name, volumeStreamMeta{
+		CommandID: command.ID,
+		Volume:    volume,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("open %s stream: %w", command.Name, err)
+	}
+
+	return stream, nil
+}
+
+func (l volumeArchiveLocation) String() string {
+	if l.Stream {
+		return "stream"
+	}
+
+	return l.Path
+}
+
+// OpenBackupDir opens the directory volume backups are written to and
+// restored from, creating it if needed.
+func OpenBackupDir() (*os.Root, error) {
+	path := env.String(volumeBackupDirEnv, defaultVolumeBackupDir)
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		return nil, fmt.Errorf("create backup directory: %w", err)
+	}
+
+	dir, err := os.OpenRoot(path)
+	if err != nil {
+		return nil, fmt.Errorf("open backup directory: %w", err)
+	}
+
+	return dir, nil
+}
+
+// backupFile removes a partly written backup when the transfer fails.
+type backupFile struct {
+	*os.File
+	dir  *os.Root
+	path string
+}
+
+func (f *backupFile) CloseWithError(error) error {
+	err := f.Close()
+	if removeErr := f.dir.Remove(f.path); err == nil {
+		err = removeErr
+	}
+
+	return err
+}
@@ -0,0 +1,92 @@
+// Package env reads agent settings from environment variables. Values are
+// trimmed, an unset or blank variable yields the fallback, and numeric
+// settings must be positive. Settings with a syntax of their own are read
+// with String and a blank fallback.
+package env
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+func String(key string, fallback string) string {
+	if value := strings.TrimSpace(os.Getenv(key)); value != "" {
+		return value
+	}
+
+	return fallback
+}
+
+func Bool(key string, fallback bool) (bool, error) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %w", key, err)
+	}
+
+	return parsed, nil
+}
+
+func Duration(key string, fallback time.Duration) (time.Duration, error) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+
+	if parsed <= 0 {
+		return 0, fmt.Errorf("invalid %s: must be positive", key)
+	}
+
+	return parsed, nil
+}
+
+func Int(key string, fallback int) (int, error) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+
+	if parsed <= 0 {
+		return 0, fmt.Errorf("invalid %s: must be positive", key)
+	}
+
+	return parsed, nil
+}
+
+// Size parses sizes such as 512MiB or 10g, in binary units.
+func Size(key string, fallback int64) (int64, error) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := units.RAMInBytes(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+
+	if parsed <= 0 {
+		return 0, fmt.Errorf("invalid %s: must be positive", key)
+	}
+
+	return parsed, nil
+}
@@ -0,0 +1,69 @@
+package env
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDuration(t *testing.T) {
+	t.Run("fallback when unset", func(t *testing.T) {
+		t.Setenv("AGENT_TEST_DURATION", " ")
+		got, err := Duration("AGENT_TEST_DURATION", time.Minute)
+		if err != nil || got != time.Minute {
+			t.Fatalf("Duration() = %v, %v", got, err)
+		}
+	})
+
+	t.Run("parses the value", func(t *testing.T) {
+		t.Setenv("AGENT_TEST_DURATION", "90s")
+		got, err := Duration("AGENT_TEST_DURATION", time.Minute)
+		if err != nil || got != 90*time.Second {
+			t.Fatalf("Duration() = %v, %v", got, err)
+		}
+	})
+
+	for _, value := range []string{"soon", "0s", "-1m"} {
+		t.Run("rejects "+value, func(t *testing.T) {
+			t.Setenv("AGENT_TEST_DURATION", value)
+			if _, err := Duration("AGENT_TEST_DURATION", time.Minute); err == nil {
+				t.Fatal("Duration() expected error")
+			}
+		})
+	}
+}
+
+func TestBool(t *testing.T) {
+	t.Setenv("AGENT_TEST_BOOL", "true")
+	if got, err := Bool("AGENT_TEST_BOOL", false); err != nil || !got {
+		t.Fatalf("Bool() = %t, %v", got, err)
+	}
+
+	t.Setenv("AGENT_TEST_BOOL", "maybe")
+	if _, err := Bool("AGENT_TEST_BOOL", false); err == nil {
+		t.Fatal("Bool() expected error")
+	}
+}
+
+func TestInt(t *testing.T) {
+	t.Setenv("AGENT_TEST_INT", "8")
+	if got, err := Int("AGENT_TEST_INT", 1); err != nil || got != 8 {
+		t.Fatalf("Int() = %d, %v", got, err)
+	}
+
+	t.Setenv("AGENT_TEST_INT", "0")
+	if _, err := Int("AGENT_TEST_INT", 1); err == nil {
+		t.Fatal("Int() expected error")
+	}
+}
+
+func TestSize(t *testing.T) {
+	t.Setenv("AGENT_TEST_SIZE", "10GiB")
+	if got, err := Size("AGENT_TEST_SIZE", 1); err != nil || got != 10<<30 {
+		t.Fatalf("Size() = %d, %v", got, err)
+	}
+
+	t.Setenv("AGENT_TEST_SIZE", "lots")
+	if _, err := Size("AGENT_TEST_SIZE", 1); err == nil {
+		t.Fatal("Size() expected error")
+	}
+}
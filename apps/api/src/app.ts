@@ -30,6 +30,9 @@ for (const route of routes) {
 
 app.on(["POST", "GET"], "/api/auth/*", (c) => auth.handler(c.req.raw));
 
+// Agents probe this before failing back to a preferred endpoint.
+app.get("/api/health", (c) => c.body(null, 204));
+
 process.on("SIGTERM", () => {
   console.log("SIGTERM received, closing Redis...");
   closeRedis();